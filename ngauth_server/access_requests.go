@@ -0,0 +1,304 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Access requests: a user who is denied access may request it, and data owners approve the
+// request, creating a grant in the grants database, or reject it.
+
+const (
+	accessRequestPending  = "pending"
+	accessRequestApproved = "approved"
+	accessRequestRejected = "rejected"
+)
+
+type AccessRequest struct {
+	Id     string `json:"id"`
+	UserId string `json:"userId"`
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+
+	// Dataset id, if access was requested by dataset, in which case bucket and prefix are its
+	// location.
+	Dataset string `json:"dataset,omitempty"`
+
+	// Justification provided by the user.
+	Reason string `json:"reason,omitempty"`
+
+	// Either "pending", "approved" or "rejected".
+	Status  string `json:"status"`
+	Created int64  `json:"created"`
+
+	// Data owner who approved or rejected the request, and when.
+	DecidedBy string `json:"decidedBy,omitempty"`
+	Decided   int64  `json:"decided,omitempty"`
+
+	// Grant created by approval of the request.
+	GrantId string `json:"grantId,omitempty"`
+}
+
+const accessRequestsSchema = `CREATE TABLE IF NOT EXISTS access_requests (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	bucket TEXT NOT NULL,
+	prefix TEXT NOT NULL,
+	dataset TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	status TEXT NOT NULL,
+	created BIGINT NOT NULL,
+	decided_by TEXT NOT NULL,
+	decided BIGINT NOT NULL,
+	grant_id TEXT NOT NULL
+)`
+
+const accessRequestsIndex = `CREATE INDEX IF NOT EXISTS access_requests_bucket_status ON access_requests (bucket, status)`
+
+const accessRequestColumns = `id, user_id, bucket, prefix, dataset, reason, status, created, decided_by, decided, grant_id`
+
+// Maximum length of the reason for a request.
+const maxAccessRequestReasonLength = 2000
+
+func scanAccessRequest(scanner interface{ Scan(...interface{}) error }) (request AccessRequest, err error) {
+	err = scanner.Scan(&request.Id, &request.UserId, &request.Bucket, &request.Prefix, &request.Dataset, &request.Reason, &request.Status, &request.Created, &request.DecidedBy, &request.Decided, &request.GrantId)
+	return
+}
+
+func (g *GrantsDatabase) queryAccessRequests(ctx context.Context, query string, args ...interface{}) ([]AccessRequest, error) {
+	rows, err := g.db.QueryContext(ctx, `SELECT `+accessRequestColumns+` FROM access_requests WHERE `+query+` ORDER BY created`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	requests := []AccessRequest{}
+	for rows.Next() {
+		request, err := scanAccessRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+// ListAccessRequests returns the requests for bucket with the specified status, or all statuses
+// if status is "".
+func (g *GrantsDatabase) ListAccessRequests(ctx context.Context, bucket string, status string) ([]AccessRequest, error) {
+	if status == "" {
+		return g.queryAccessRequests(ctx, `bucket = $1`, bucket)
+	}
+	return g.queryAccessRequests(ctx, `bucket = $1 AND status = $2`, bucket, status)
+}
+
+func (g *GrantsDatabase) ListUserAccessRequests(ctx context.Context, userId string) ([]AccessRequest, error) {
+	return g.queryAccessRequests(ctx, `user_id = $1`, userId)
+}
+
+func (g *GrantsDatabase) GetAccessRequest(ctx context.Context, id string) (AccessRequest, error) {
+	return scanAccessRequest(g.db.QueryRowContext(ctx, `SELECT `+accessRequestColumns+` FROM access_requests WHERE id = $1`, id))
+}
+
+func (g *GrantsDatabase) CreateAccessRequest(ctx context.Context, request AccessRequest) error {
+	_, err := g.db.ExecContext(ctx, `INSERT INTO access_requests (`+accessRequestColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`, request.Id, request.UserId, request.Bucket, request.Prefix, request.Dataset, request.Reason, request.Status, request.Created, request.DecidedBy, request.Decided, request.GrantId)
+	return err
+}
+
+// DecideAccessRequest records the decision on a pending request and, if it is approved, creates
+// grant.  Returns false if the request is no longer pending.
+func (g *GrantsDatabase) DecideAccessRequest(ctx context.Context, request AccessRequest, grant *Grant) (bool, error) {
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, `UPDATE access_requests SET status = $1, decided_by = $2, decided = $3, grant_id = $4 WHERE id = $5 AND status = $6`, request.Status, request.DecidedBy, request.Decided, request.GrantId, request.Id, accessRequestPending)
+	if err != nil {
+		return false, err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return false, err
+	}
+	if grant != nil {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO grants (id, user_id, bucket, prefix, granted_by, created, expires) VALUES ($1, $2, $3, $4, $5, $6, $7)`, grant.Id, grant.UserId, grant.Bucket, grant.Prefix, grant.GrantedBy, grant.Created, grant.Expires); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+func (auth *Authenticator) addAccessRequestRoutes(mux *gorilla_mux.Router) {
+	writeJson := func(w http.ResponseWriter, status int, value interface{}) {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(value)
+	}
+
+	// Lists the requests for a bucket, for data owners, or else the user's own requests.
+	mux.Methods("GET").Path("/access_requests").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getApiUser(w, r)
+		if userToken == nil {
+			return
+		}
+		var requests []AccessRequest
+		var err error
+		if bucket := r.URL.Query().Get("bucket"); bucket != "" {
+			if !auth.isDataOwner(userToken, bucket) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			requests, err = auth.GrantsDatabase.ListAccessRequests(r.Context(), bucket, r.URL.Query().Get("status"))
+		} else {
+			requests, err = auth.GrantsDatabase.ListUserAccessRequests(r.Context(), userToken.UserId)
+		}
+		if err != nil {
+			log.Printf("Error listing access requests: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, http.StatusOK, requests)
+	})
+
+	mux.Methods("POST").Path("/access_requests").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getApiUser(w, r)
+		if userToken == nil {
+			return
+		}
+		if userToken.ImpersonatedBy != "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var request AccessRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.Dataset != "" {
+			dataset := auth.Datasets.Get(request.Dataset)
+			if dataset == nil {
+				http.Error(w, "Unknown dataset", http.StatusNotFound)
+				return
+			}
+			request.Bucket = dataset.Bucket
+			request.Prefix = dataset.Prefix
+		}
+		if request.Bucket == "" || !isValidObjectPrefix(request.Prefix) || len(request.Reason) > maxAccessRequestReasonLength {
+			http.Error(w, "Invalid access request", http.StatusBadRequest)
+			return
+		}
+		if !auth.BucketFilter.IsBrokered(request.Bucket) {
+			http.Error(w, "Bucket not served by this server", http.StatusForbidden)
+			return
+		}
+		// Repeated requests return the existing pending request.
+		existing, err := auth.GrantsDatabase.ListUserAccessRequests(r.Context(), userToken.UserId)
+		if err != nil {
+			log.Printf("Error listing access requests: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		for _, e := range existing {
+			if e.Status == accessRequestPending && e.Bucket == request.Bucket && e.Prefix == request.Prefix {
+				writeJson(w, http.StatusOK, e)
+				return
+			}
+		}
+		request.Id = generateGrantId()
+		request.UserId = userToken.UserId
+		request.Status = accessRequestPending
+		request.Created = time.Now().Unix()
+		request.DecidedBy = ""
+		request.Decided = 0
+		request.GrantId = ""
+		if err := auth.GrantsDatabase.CreateAccessRequest(r.Context(), request); err != nil {
+			log.Printf("Error creating access request: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s requested access to %s/%s", request.UserId, request.Bucket, request.Prefix)
+		writeJson(w, http.StatusCreated, request)
+	})
+
+	// Approves or rejects a pending request.  Approval accepts an optional body {"expires": TIME}
+	// specifying the expiration time of the grant.
+	mux.Methods("POST").Path("/access_requests/{id}/{decision:approve|reject}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getApiUser(w, r)
+		if userToken == nil {
+			return
+		}
+		vars := gorilla_mux.Vars(r)
+		request, err := auth.GrantsDatabase.GetAccessRequest(r.Context(), vars["id"])
+		if err == sql.ErrNoRows || (err == nil && !auth.isDataOwner(userToken, request.Bucket)) {
+			http.Error(w, "Unknown access request", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading access request: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		var decision struct {
+			Expires int64 `json:"expires,omitempty"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		now := time.Now().Unix()
+		if decision.Expires != 0 && decision.Expires <= now {
+			http.Error(w, "Invalid expiration time", http.StatusBadRequest)
+			return
+		}
+		request.DecidedBy = userToken.UserId
+		request.Decided = now
+		var grant *Grant
+		if vars["decision"] == "approve" {
+			grant = &Grant{
+				Id:        generateGrantId(),
+				UserId:    request.UserId,
+				Bucket:    request.Bucket,
+				Prefix:    request.Prefix,
+				GrantedBy: userToken.UserId,
+				Created:   now,
+				Expires:   decision.Expires,
+			}
+			request.Status = accessRequestApproved
+			request.GrantId = grant.Id
+		} else {
+			request.Status = accessRequestRejected
+		}
+		decided, err := auth.GrantsDatabase.DecideAccessRequest(r.Context(), request, grant)
+		if err != nil {
+			log.Printf("Error deciding access request: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if !decided {
+			http.Error(w, "Access request already decided", http.StatusConflict)
+			return
+		}
+		log.Printf("%s %s access request %s of %s for %s/%s", userToken.UserId, request.Status, request.Id, request.UserId, request.Bucket, request.Prefix)
+		writeJson(w, http.StatusOK, request)
+	})
+}
@@ -0,0 +1,272 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Account linking allows one person's identities from several identity providers to resolve to a
+// single canonical user id.  A user logged in under the canonical user id links another identity
+// by logging in with its provider.  Subsequent logins with either identity produce a login
+// session for the canonical user id, with all linked user ids considered for IAM permissions.
+
+const accountLinkMaxAge = 10 * time.Minute
+
+type accountLink struct {
+	CanonicalUserId string `json:"canonicalUserId"`
+}
+
+// pendingAccountLink is stored while the user logs in with the identity to be linked.
+type pendingAccountLink struct {
+	UserId  string `json:"userId"`
+	Expires int64  `json:"expires"`
+}
+
+func accountLinkKey(userId string) string {
+	return "account_links/by_linked/" + url.PathEscape(userId)
+}
+
+func accountLinkCanonicalPrefix(canonicalUserId string) string {
+	return "account_links/by_canonical/" + url.PathEscape(canonicalUserId) + "/"
+}
+
+func pendingAccountLinkKey(nonce string) string {
+	return "account_links/pending/" + nonce
+}
+
+// getLinkedUserIds returns the user ids linked to a canonical user id.
+func (auth *Authenticator) getLinkedUserIds(ctx context.Context, canonicalUserId string) (userIds []string, err error) {
+	prefix := accountLinkCanonicalPrefix(canonicalUserId)
+	keys, err := auth.Store.List(ctx, prefix)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		userId, err := url.PathUnescape(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			continue
+		}
+		userIds = append(userIds, userId)
+	}
+	return
+}
+
+// resolveAccountLinks replaces the user id of a qualified identity with its canonical user id, if
+// it has been linked, and adds all user ids linked to the canonical user id to LinkedUserIds.
+func (auth *Authenticator) resolveAccountLinks(ctx context.Context, identity *Identity) error {
+	var link accountLink
+	err := auth.Store.Get(ctx, accountLinkKey(identity.UserId), &link)
+	if err == nil {
+		identity.LinkedUserIds = append(identity.LinkedUserIds, identity.UserId)
+		identity.UserId = link.CanonicalUserId
+	} else if err != errStoreNotFound {
+		return err
+	}
+	linkedUserIds, err := auth.getLinkedUserIds(ctx, identity.UserId)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{identity.UserId: true}
+	for _, userId := range identity.LinkedUserIds {
+		seen[userId] = true
+	}
+	for _, userId := range linkedUserIds {
+		if !seen[userId] {
+			identity.LinkedUserIds = append(identity.LinkedUserIds, userId)
+			seen[userId] = true
+		}
+	}
+	return nil
+}
+
+func (auth *Authenticator) deleteAccountLink(ctx context.Context, canonicalUserId string, userId string) error {
+	if err := auth.Store.Delete(ctx, accountLinkKey(userId)); err != nil {
+		return err
+	}
+	return auth.Store.Delete(ctx, accountLinkCanonicalPrefix(canonicalUserId)+url.PathEscape(userId))
+}
+
+// completeAccountLink links a newly-authenticated, qualified identity to the user that started
+// the pending link.
+func (auth *Authenticator) completeAccountLink(w http.ResponseWriter, r *http.Request, identity *Identity, nonce string) {
+	ctx := r.Context()
+	var pending pendingAccountLink
+	if err := auth.Store.Get(ctx, pendingAccountLinkKey(nonce), &pending); err != nil || pending.Expires < time.Now().Unix() {
+		http.Error(w, "Account link request expired", http.StatusBadRequest)
+		return
+	}
+	auth.Store.Delete(ctx, pendingAccountLinkKey(nonce))
+	// The login session must still belong to the user that started the link.
+	userToken := auth.getUserTokenFromCookie(r)
+	if userToken == nil || userToken.UserId != pending.UserId {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	canonicalUserId := pending.UserId
+	userId := identity.UserId
+	if userId == canonicalUserId {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	linkedUserIds, err := auth.getLinkedUserIds(ctx, userId)
+	if err == nil && len(linkedUserIds) > 0 {
+		http.Error(w, "The account has other accounts linked to it; unlink them first", http.StatusConflict)
+		return
+	}
+	var existing accountLink
+	if err == nil {
+		err = auth.Store.Get(ctx, accountLinkKey(userId), &existing)
+		if err == nil {
+			// Move the link from its previous canonical user id.
+			err = auth.deleteAccountLink(ctx, existing.CanonicalUserId, userId)
+		} else if err == errStoreNotFound {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = auth.Store.Put(ctx, accountLinkKey(userId), accountLink{CanonicalUserId: canonicalUserId})
+	}
+	if err == nil {
+		err = auth.Store.Put(ctx, accountLinkCanonicalPrefix(canonicalUserId)+url.PathEscape(userId), struct{}{})
+	}
+	if err != nil {
+		log.Printf("Error linking %s to %s: %v", userId, canonicalUserId, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Linked %s to %s", userId, canonicalUserId)
+	// Refresh the login session to include the newly-linked user id.
+	if !containsString(userToken.LinkedUserIds, userId) {
+		userToken.LinkedUserIds = append(userToken.LinkedUserIds, userId)
+	}
+	if err := auth.setUserTokenCookie(w, r, *userToken); err != nil {
+		log.Printf("Error setting login session of %s: %v", userToken.UserId, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func containsString(list []string, s string) bool {
+	for _, element := range list {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (auth *Authenticator) writeAccountLinks(w http.ResponseWriter, r *http.Request, userToken *UserToken) {
+	linkedUserIds, err := auth.getLinkedUserIds(r.Context(), userToken.UserId)
+	if err != nil {
+		log.Printf("Error listing linked accounts for %s: %v", userToken.UserId, err)
+		return
+	}
+	formToken := html.EscapeString(EncodeUserToken(auth.UserTokenKey, formUserTokenType, auth.makeTemporaryUserToken(*userToken, "")))
+	fmt.Fprint(w, "<p>Linked accounts:</p>\n<ul>\n")
+	for _, userId := range linkedUserIds {
+		fmt.Fprintf(w, `<li>%s
+<form action="/unlink" method="post" style="display:inline">
+<input type="hidden" name="token" value="%s">
+<input type="hidden" name="user_id" value="%s">
+<input type="submit" value="Unlink">
+</form></li>
+`, html.EscapeString(userId), formToken, html.EscapeString(userId))
+	}
+	fmt.Fprintf(w, `</ul>
+<form action="/link" method="post">
+<input type="hidden" name="token" value="%s">
+<select name="provider">
+`, formToken)
+	for _, provider := range auth.IdentityProviders {
+		displayName := identityProviderDisplayNames[provider.Name()]
+		if displayName == "" {
+			displayName = provider.Name()
+		}
+		fmt.Fprintf(w, "<option value=\"%s\">%s</option>\n", html.EscapeString(provider.Name()), html.EscapeString(displayName))
+	}
+	fmt.Fprint(w, `</select>
+<input type="submit" value="Link account">
+</form>
+`)
+}
+
+func (auth *Authenticator) addAccountLinkRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("POST").Path("/link").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getFormUser(w, r)
+		if userToken == nil {
+			return
+		}
+		providerName := r.PostForm.Get("provider")
+		if auth.GetIdentityProvider(providerName) == nil {
+			http.Error(w, "Unknown identity provider", http.StatusBadRequest)
+			return
+		}
+		nonceBytes := make([]byte, 16)
+		if _, err := rand.Read(nonceBytes); err != nil {
+			panic(err)
+		}
+		nonce := base64url.EncodeToString(nonceBytes)
+		pending := pendingAccountLink{UserId: userToken.UserId, Expires: time.Now().Add(accountLinkMaxAge).Unix()}
+		if err := auth.Store.Put(r.Context(), pendingAccountLinkKey(nonce), pending); err != nil {
+			log.Printf("Error storing pending account link: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		auth.startLogin(w, r, loginState{Provider: providerName, Link: nonce})
+	})
+
+	mux.Methods("POST").Path("/unlink").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getFormUser(w, r)
+		if userToken == nil {
+			return
+		}
+		userId := r.PostForm.Get("user_id")
+		var link accountLink
+		if err := auth.Store.Get(r.Context(), accountLinkKey(userId), &link); err != nil || link.CanonicalUserId != userToken.UserId {
+			http.Error(w, "Account not linked", http.StatusNotFound)
+			return
+		}
+		if err := auth.deleteAccountLink(r.Context(), userToken.UserId, userId); err != nil {
+			log.Printf("Error unlinking %s from %s: %v", userId, userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Unlinked %s from %s", userId, userToken.UserId)
+		var linkedUserIds []string
+		for _, id := range userToken.LinkedUserIds {
+			if id != userId {
+				linkedUserIds = append(linkedUserIds, id)
+			}
+		}
+		userToken.LinkedUserIds = linkedUserIds
+		if err := auth.setUserTokenCookie(w, r, *userToken); err != nil {
+			log.Printf("Error setting login session of %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessControlList grants users and groups read access to buckets, or to object prefixes within
+// buckets, for deployments where GCS IAM is not the source of truth.
+//
+// The file specified by ACL_PATH contains a JSON object of the form:
+//
+//	{
+//	  "users": {"google:*@example.org": ["lab-bucket", "shared-bucket/public/"]},
+//	  "groups": {"keycloak:/lab/members": ["lab-bucket"]},
+//	  "claims": {"hd=example.org": ["lab-bucket"]}
+//	}
+//
+// User patterns are matched against qualified user ids as for the login allowlist.  Groups are
+// qualified identity provider groups, as for GROUP_BUCKETS_PATH.  Claims are "NAME=PATTERN", as
+// for "claim:" members of role bindings.  Each resource is either a bucket name or
+// "BUCKET/PREFIX".  The file is reloaded whenever it is modified.
+type AccessControlList struct {
+	path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	entries accessControlEntries
+}
+
+type accessControlEntries struct {
+	Users  map[string][]string `json:"users"`
+	Groups map[string][]string `json:"groups"`
+	Claims map[string][]string `json:"claims"`
+}
+
+// prefixAuthorizer is implemented by storage authorizers that consider the groups of the user
+// token and may grant access limited to object prefixes.
+type prefixAuthorizer interface {
+	// CheckObjectPrefixes returns whether the user may read objects in bucket whose names start
+	// with prefix, which may be empty, and, if access is limited to narrower object prefixes, the
+	// prefixes.
+	CheckObjectPrefixes(userToken *UserToken, bucket string, prefix string) (granted bool, prefixes []string)
+}
+
+func parseAccessControlEntries(data []byte) (entries accessControlEntries, err error) {
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return
+	}
+	users := make(map[string][]string)
+	for pattern, resources := range entries.Users {
+		pattern = strings.ToLower(pattern)
+		if _, err = path.Match(pattern, ""); err != nil {
+			err = fmt.Errorf("Invalid pattern %q: %w", pattern, err)
+			return
+		}
+		users[pattern] = append(users[pattern], resources...)
+	}
+	entries.Users = users
+	claims := make(map[string][]string)
+	for spec, resources := range entries.Claims {
+		spec = strings.ToLower(spec)
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			err = fmt.Errorf("Invalid claim %q", spec)
+			return
+		}
+		if _, err = path.Match(parts[1], ""); err != nil {
+			err = fmt.Errorf("Invalid pattern %q: %w", spec, err)
+			return
+		}
+		claims[spec] = append(claims[spec], resources...)
+	}
+	entries.Claims = claims
+	for _, grants := range []map[string][]string{entries.Users, entries.Groups, entries.Claims} {
+		for _, resources := range grants {
+			for _, resource := range resources {
+				if resource == "" || !isValidObjectPrefix(resource) {
+					err = fmt.Errorf("Invalid resource %q", resource)
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// reload reads the ACL file if it has been modified since it was last read.
+func (acl *AccessControlList) reload() error {
+	info, err := os.Stat(acl.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(acl.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(acl.path)
+	if err != nil {
+		return err
+	}
+	entries, err := parseAccessControlEntries(data)
+	if err != nil {
+		return err
+	}
+	acl.entries = entries
+	acl.modTime = info.ModTime()
+	return nil
+}
+
+func (acl *AccessControlList) CheckObjectPrefixes(userToken *UserToken, bucket string, prefix string) (granted bool, prefixes []string) {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	if err := acl.reload(); err != nil {
+		// Continue to use the previously-loaded ACL.
+		log.Printf("Error reloading ACL from %s: %v", acl.path, err)
+	}
+	var resources []string
+	for _, userId := range userToken.Principals() {
+		userId = strings.ToLower(userId)
+		for pattern, patternResources := range acl.entries.Users {
+			if matched, _ := path.Match(pattern, userId); matched {
+				resources = append(resources, patternResources...)
+			}
+		}
+	}
+	for _, group := range userToken.Groups {
+		resources = append(resources, acl.entries.Groups[group]...)
+	}
+	for spec, claimResources := range acl.entries.Claims {
+		if matchesClaim(spec, userToken.Claims) {
+			resources = append(resources, claimResources...)
+		}
+	}
+	for _, resource := range resources {
+		if resourceCoversPrefix(resource, bucket, prefix) {
+			return true, nil
+		}
+		// Without a requested prefix, access is limited to the granted prefixes.
+		if parts := strings.SplitN(resource, "/", 2); prefix == "" && parts[0] == bucket {
+			granted = true
+			prefixes = append(prefixes, parts[1])
+		}
+	}
+	return
+}
+
+func (acl *AccessControlList) CheckStoragePermission(ctx context.Context, userId string, bucket string, prefix string, permission string) (bool, error) {
+	if permission == storageWritePermission {
+		return false, nil
+	}
+	granted, prefixes := acl.CheckObjectPrefixes(&UserToken{UserId: userId}, bucket, prefix)
+	return granted && prefixes == nil, nil
+}
+
+func loadAccessControlList() (*AccessControlList, error) {
+	path, ok := os.LookupEnv("ACL_PATH")
+	if !ok {
+		return nil, fmt.Errorf("ACL_PATH must be specified when AUTHORIZATION_MODE=acl")
+	}
+	acl := &AccessControlList{path: path}
+	if err := acl.reload(); err != nil {
+		return nil, fmt.Errorf("Error reading ACL from %s: %w", path, err)
+	}
+	return acl, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Data use agreements: a dataset may specify the text of an agreement that users must accept
+// before /gcs_token issues access tokens for it.  Acceptances are recorded in the state store, and
+// must be repeated if the text changes.
+
+type agreementAcceptance struct {
+	Version  string `json:"version"`
+	Accepted int64  `json:"accepted"`
+}
+
+type agreementResponse struct {
+	Dataset   string `json:"dataset"`
+	Agreement string `json:"agreement"`
+
+	// Identifies the text of the agreement, and must be specified when accepting it.
+	Version string `json:"version"`
+}
+
+type acceptAgreementRequest struct {
+	Token   string `json:"token"`
+	Version string `json:"version"`
+}
+
+func getAgreementVersion(agreement string) string {
+	hash := sha256.Sum256([]byte(agreement))
+	return base64url.EncodeToString(hash[:16])
+}
+
+func agreementAcceptanceKey(userId string, datasetId string) string {
+	return "agreements/" + userId + "/" + datasetId
+}
+
+// hasAcceptedAgreement returns true if the dataset has no agreement, or the user has accepted the
+// current version of it.
+func (auth *Authenticator) hasAcceptedAgreement(ctx context.Context, userId string, datasetId string, dataset *Dataset) (bool, error) {
+	if dataset.Agreement == "" {
+		return true, nil
+	}
+	var acceptance agreementAcceptance
+	err := auth.Store.Get(ctx, agreementAcceptanceKey(userId, datasetId), &acceptance)
+	if errors.Is(err, errStoreNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return acceptance.Version == getAgreementVersion(dataset.Agreement), nil
+}
+
+func (auth *Authenticator) addAgreementRoutes(mux *gorilla_mux.Router) {
+	// Sets the CORS headers, and returns false if the origin is not allowed.
+	checkOrigin := func(w http.ResponseWriter, r *http.Request) bool {
+		origin := r.Header.Get("origin")
+		if origin == "" {
+			return true
+		}
+		w.Header().Set("vary", "origin")
+		if !OriginPattern.MatchString(origin) || !auth.IsOriginAllowed(origin) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return false
+		}
+		w.Header().Set("access-control-allow-origin", origin)
+		return true
+	}
+
+	// Returns the agreement, for display by the client.
+	mux.Methods("GET").Path("/datasets/{dataset}/agreement").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkOrigin(w, r) {
+			return
+		}
+		datasetId := gorilla_mux.Vars(r)["dataset"]
+		dataset := auth.Datasets.Get(datasetId)
+		if dataset == nil || dataset.Agreement == "" {
+			http.Error(w, "No agreement", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(agreementResponse{
+			Dataset:   datasetId,
+			Agreement: dataset.Agreement,
+			Version:   getAgreementVersion(dataset.Agreement),
+		})
+	})
+
+	// Records acceptance of the agreement by the user identified, as for /gcs_token, by the token
+	// in the request body or by the Authorization header.
+	mux.Methods("POST").Path("/datasets/{dataset}/agreement").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkOrigin(w, r) {
+			return
+		}
+		var request acceptAgreementRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		userToken, err := auth.resolveRequestUserToken(r, request.Token)
+		if err != nil {
+			log.Printf("Invalid authentication token: %+v", err)
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		if userToken.UserId == anonymousUserId {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		if userToken.ImpersonatedBy != "" {
+			// Administrators may not accept agreements on behalf of users.
+			http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+			return
+		}
+		datasetId := gorilla_mux.Vars(r)["dataset"]
+		dataset := auth.Datasets.Get(datasetId)
+		if dataset == nil || dataset.Agreement == "" {
+			http.Error(w, "No agreement", http.StatusNotFound)
+			return
+		}
+		if request.Version != getAgreementVersion(dataset.Agreement) {
+			http.Error(w, "Agreement has changed", http.StatusConflict)
+			return
+		}
+		acceptance := agreementAcceptance{Version: request.Version, Accepted: time.Now().Unix()}
+		if err := auth.Store.Put(r.Context(), agreementAcceptanceKey(userToken.UserId, datasetId), &acceptance); err != nil {
+			http.Error(w, "Failed to record acceptance", http.StatusInternalServerError)
+			log.Printf("Error recording acceptance of agreement, user=%s, dataset=%s, err=%+v", userToken.UserId, datasetId, err)
+			return
+		}
+		log.Printf("AUDIT: %s accepted agreement %s for dataset %s", userToken.UserId, request.Version, datasetId)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
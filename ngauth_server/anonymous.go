@@ -0,0 +1,57 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Anonymous access allows users who are not logged in to read a configured set of public buckets
+// through the same ngauth server as private buckets.  Anonymous buckets are read with access tokens
+// issued using the ngauth service account, while world-readable public buckets are read without
+// credentials.
+
+// User id of anonymous user tokens.  Since the user ids of logged-in users are either qualified by
+// the provider name or are email addresses, this cannot collide with a real user.
+const anonymousUserId = "anonymous"
+
+// loadAnonymousBuckets returns the buckets specified by ANONYMOUS_BUCKETS, or nil if anonymous
+// access is disabled.
+func loadAnonymousBuckets() []string {
+	return splitList(os.Getenv("ANONYMOUS_BUCKETS"))
+}
+
+func (auth *Authenticator) makeAnonymousUserToken() UserToken {
+	return UserToken{
+		UserId:  anonymousUserId,
+		Expires: time.Now().Unix() + auth.TokenLifetimes.CrossOriginLifetimeSeconds(""),
+		Buckets: auth.AnonymousBuckets,
+	}
+}
+
+// IsPublicBucket returns true if bucket is world-readable, as specified by PUBLIC_BUCKETS.
+func (auth *Authenticator) IsPublicBucket(bucket string) bool {
+	return containsString(auth.PublicBuckets, bucket)
+}
+
+// IsAnonymousBucket returns true if bucket may be read without logging in.
+func (auth *Authenticator) IsAnonymousBucket(bucket string) bool {
+	for _, b := range auth.AnonymousBuckets {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
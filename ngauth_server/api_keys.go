@@ -0,0 +1,234 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// API keys allow programmatic callers to authenticate with an `Authorization: ApiKey KEY` header.
+// Only a hash of each key is stored.
+
+const apiKeyPrefix = "ngauth_"
+
+const apiKeyAuthorizationScheme = "ApiKey"
+
+type apiKey struct {
+	// Identity of the user who created the key.
+	UserId        string   `json:"userId"`
+	LinkedUserIds []string `json:"linkedUserIds,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+
+	Description string `json:"description,omitempty"`
+	Created     int64  `json:"created"`
+}
+
+func apiKeyStoreKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return "api_keys/" + base64url.EncodeToString(hash[:])
+}
+
+func generateApiKey() string {
+	keyBytes := make([]byte, 32)
+	if _, err := rand.Read(keyBytes); err != nil {
+		panic(err)
+	}
+	return apiKeyPrefix + base64url.EncodeToString(keyBytes)
+}
+
+// getAuthorizationCredentials returns the credentials specified in the Authorization header
+// with the specified scheme, or "".
+func getAuthorizationCredentials(r *http.Request, scheme string) string {
+	authorization := r.Header.Get("authorization")
+	if i := strings.IndexByte(authorization, ' '); i != -1 && strings.EqualFold(authorization[:i], scheme) {
+		return strings.TrimSpace(authorization[i+1:])
+	}
+	return ""
+}
+
+// getApiKeyFromRequest returns the API key specified in the Authorization header, or "".
+func getApiKeyFromRequest(r *http.Request) string {
+	return getAuthorizationCredentials(r, apiKeyAuthorizationScheme)
+}
+
+type contextKey int
+
+const userTokenContextKey contextKey = 0
+
+// getUserTokenFromContext returns the user token established by authorizationMiddleware, or nil.
+func getUserTokenFromContext(ctx context.Context) *UserToken {
+	token, _ := ctx.Value(userTokenContextKey).(*UserToken)
+	return token
+}
+
+// getUserTokenFromAuthorization returns the user token established by authorizationMiddleware, or
+// specified as an ngauth token in an "Authorization: Bearer" header, or nil.  Returns nil if the
+// user is denied by the deny rules.
+func (auth *Authenticator) getUserTokenFromAuthorization(r *http.Request) *UserToken {
+	userToken := getUserTokenFromContext(r.Context())
+	if userToken == nil {
+		bearer := getAuthorizationCredentials(r, "Bearer")
+		if bearer == "" {
+			bearer = getAuthorizationCredentials(r, "DPoP")
+		}
+		if bearer != "" {
+			if token, err := auth.DecodeClientToken(r.Context(), bearer); err == nil && checkTokenAudience(&token) == nil && checkTokenOrigin(r, &token) == nil && checkTokenBinding(r, bearer, &token) == nil && auth.consumeSingleUseToken(r, &token) == nil {
+				userToken = &token
+			}
+		}
+	}
+	if userToken != nil && auth.DenyRules.IsDenied(userToken, "", r.Header.Get("origin"), userToken.Origin) {
+		return nil
+	}
+	return userToken
+}
+
+// resolveRequestUserToken returns the user token established by authorizationMiddleware or, if
+// none, specified by token in the request body, either a personal access token or an ngauth token.
+func (auth *Authenticator) resolveRequestUserToken(r *http.Request, token string) (UserToken, error) {
+	if userToken := getUserTokenFromContext(r.Context()); userToken != nil {
+		return *userToken, nil
+	}
+	if strings.HasPrefix(token, personalAccessTokenPrefix) {
+		userToken, err := auth.resolvePersonalAccessToken(r.Context(), token)
+		if err != nil {
+			return UserToken{}, err
+		}
+		return *userToken, nil
+	}
+	userToken, err := auth.DecodeClientToken(r.Context(), token)
+	if err != nil {
+		return userToken, err
+	}
+	if err := checkTokenAudience(&userToken); err != nil {
+		return userToken, err
+	}
+	if err := checkTokenOrigin(r, &userToken); err != nil {
+		return userToken, err
+	}
+	if err := checkTokenBinding(r, token, &userToken); err != nil {
+		return userToken, err
+	}
+	return userToken, auth.consumeSingleUseToken(r, &userToken)
+}
+
+// authorizationMiddleware validates the API key or personal access token, if any, specified in
+// the Authorization header, and makes the corresponding user token available through
+// getUserTokenFromContext.
+func (auth *Authenticator) authorizationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearer := getAuthorizationCredentials(r, "Bearer"); strings.HasPrefix(bearer, personalAccessTokenPrefix) {
+			userToken, err := auth.resolvePersonalAccessToken(r.Context(), bearer)
+			if err != nil {
+				log.Printf("Invalid personal access token: %v", err)
+				http.Error(w, "Invalid personal access token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userTokenContextKey, userToken)))
+			return
+		}
+		key := getApiKeyFromRequest(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var k apiKey
+		if err := auth.Store.Get(r.Context(), apiKeyStoreKey(key), &k); err != nil {
+			if err != errStoreNotFound {
+				log.Printf("Error reading API key: %v", err)
+			}
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		userToken := &UserToken{
+			UserId:        k.UserId,
+			Expires:       time.Now().Unix() + auth.TokenLifetimes.CrossOriginLifetimeSeconds(""),
+			LinkedUserIds: k.LinkedUserIds,
+			Groups:        k.Groups,
+			IssuedAt:      k.Created,
+		}
+		// Revoking all sessions of the user also revokes the keys created before.
+		if auth.Revocations.IsRevoked(r.Context(), userToken) {
+			log.Printf("AUDIT: revoked API key of %s used", k.UserId)
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userTokenContextKey, userToken)))
+	})
+}
+
+func (auth *Authenticator) writeApiKeyForm(w http.ResponseWriter, userToken *UserToken) {
+	fmt.Fprintf(w, `<form action="/api_keys" method="post">
+<input type="hidden" name="token" value="%s">
+<input type="text" name="description" placeholder="Description">
+<input type="submit" value="Create API key">
+</form>
+`, html.EscapeString(EncodeUserToken(auth.UserTokenKey, formUserTokenType, auth.makeTemporaryUserToken(*userToken, ""))))
+}
+
+func (auth *Authenticator) addApiKeyRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("POST").Path("/api_keys").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getFormUser(w, r)
+		if userToken == nil {
+			return
+		}
+		key := generateApiKey()
+		k := apiKey{
+			UserId:        userToken.UserId,
+			LinkedUserIds: userToken.LinkedUserIds,
+			Groups:        userToken.Groups,
+			Description:   r.PostForm.Get("description"),
+			Created:       time.Now().Unix(),
+		}
+		if err := auth.Store.Put(r.Context(), apiKeyStoreKey(key), k); err != nil {
+			log.Printf("Error storing API key for %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Created API key for %s", userToken.UserId)
+		w.Header().Add("x-frame-options", "deny")
+		w.Header().Add("content-type", "text/html")
+		w.Header().Set("cache-control", "no-store")
+		fmt.Fprintf(w, `<html><head><title>API key</title></head><body>
+<p>Your new API key is shown below.  It will not be shown again.</p>
+<pre>%s</pre>
+<p><a href="/">Done</a></p>
+</body></html>`, html.EscapeString(key))
+	})
+
+	// Revokes the API key specified in the Authorization header.
+	mux.Methods("POST").Path("/api_keys/revoke").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := getApiKeyFromRequest(r)
+		if getUserTokenFromContext(r.Context()) == nil || key == "" {
+			http.Error(w, "Missing API key", http.StatusUnauthorized)
+			return
+		}
+		if err := auth.Store.Delete(r.Context(), apiKeyStoreKey(key)); err != nil {
+			log.Printf("Error deleting API key: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -14,10 +14,13 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -28,86 +31,278 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	gorilla_mux "github.com/gorilla/mux"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
-	"google.golang.org/api/idtoken"
 	"google.golang.org/api/option"
 	"google.golang.org/api/transport"
-	policytroubleshooterpb "google.golang.org/genproto/googleapis/cloud/policytroubleshooter/v1"
-	"google.golang.org/protobuf/encoding/protojson"
 )
 
 type Authenticator struct {
 	ProjectID            string
 	Credentials          *google.Credentials
-	OAuth2Config         *oauth2.Config
 	AllowedOriginPattern *regexp.Regexp
 
-	// HMAC key for authenticating user login tokens
+	// Identity providers, in the order they are listed on the login page.
+	IdentityProviders []IdentityProvider
+
+	// Key from which the keys for authenticating and encrypting user login tokens are derived
 	UserTokenKey []byte
 
+	// Key from which the keys for encrypting the user tokens issued to clients are derived, so that
+	// they can be rotated independently of login cookies.
+	ClientTokenKey []byte
+
+	// Signs the user tokens issued to clients as JWTs, or nil to use ClientTokenKey.
+	UserTokenSigner *UserTokenSigner
+
+	// Buckets readable by members of identity provider groups, or nil.
+	GroupBuckets GroupBuckets
+
+	// Users allowed to log in, or nil to allow all users.
+	LoginAllowlist *LoginAllowlist
+
+	// Users, buckets and origins denied regardless of any other authorization, or nil.
+	DenyRules *DenyRules
+
+	// Google Groups whose members are allowed to log in, or nil to allow all users.
+	LoginRequiredGroups *GoogleGroupsChecker
+
+	// Identity provider claims, e.g. "email" or "realm_access.roles", to include in user tokens.
+	UserTokenClaims []string
+
+	// Whether refresh tokens are stored to renew login sessions without the login popup.
+	SessionRenewal bool
+
+	// Whether /token only issues tokens bound to a DPoP key.
+	DPoPRequired bool
+
+	// Whether /token only issues single-use tokens.
+	SingleUseTokens bool
+
+	// Whether /signed_urls issues signed URLs for objects.
+	SignedUrls bool
+
+	// Service account that signs URLs for buckets whose credentials do not identify one, or "".
+	SignedUrlServiceAccount string
+
+	// Whether /exchange exchanges id_tokens of the identity providers for tokens.
+	TokenExchange bool
+
+	// Whether login sessions are kept in the state store, with only a handle in the cookie.
+	ServerSideSessions bool
+
+	// Whether ngauth acts as an OpenID Connect provider for service clients with redirect URIs.
+	OpenIDProvider bool
+
+	// Whether client origins may obtain tokens through the browser's FedCM API.
+	FedCM bool
+
+	// Audiences, besides gcsTokenAudience, for which clients may request tokens, e.g. the URLs of
+	// other services that verify ngauth tokens.
+	TokenAudiences []string
+
+	// Permissions of access tokens issued for reading, in the form used by credential access
+	// boundaries.
+	ReadTokenPermissions []string
+
+	// Buckets readable without logging in, or nil to require login.
+	AnonymousBuckets []string
+
+	// World-readable buckets, which clients read without access tokens.
+	PublicBuckets []string
+
+	// User ids of administrators, who may impersonate other users.
+	AdminUsers map[string]bool
+
+	// External issuers whose tokens may be exchanged at /federate.
+	FederatedIssuers []*federatedIssuer
+
+	// Clients allowed to use the client credentials grant, or nil.
+	ServiceClients ServiceClients
+
+	// Determines whether users have read access to buckets according to IAM.
+	StorageAuthorizer StorageAuthorizer
+
+	// Authorizer evaluated, but not enforced, alongside StorageAuthorizer, or nil.
+	ShadowAuthorizer *ShadowAuthorizer
+
+	// Projects whose buckets use separate credentials, or nil.
+	Projects []*BrokeredProject
+
+	// Buckets for which access tokens may be issued, or nil to allow all buckets.
+	BucketFilter *BucketFilter
+
+	// Buckets for which clients at particular origins may obtain access tokens, or nil.
+	OriginBuckets OriginBuckets
+
+	// Origins that particular users may use, or nil.
+	OriginPolicies OriginPolicies
+
+	// Lifetimes of login sessions and cross-origin tokens, or nil to use the maximum lifetimes.
+	TokenLifetimes *TokenLifetimes
+
+	// Downscoped tokens reused across requests, or nil to exchange a token for every request.
+	DownscopedTokens *DownscopedTokenCache
+
+	// Impersonated credentials of the service accounts of datasets, created on first use.
+	serviceAccountCredentials sync.Map
+
+	// Recently granted access, which /gcs_token/refresh need not check again, or nil.
+	GrantCache *GrantCache
+
+	// Roles granted to users and groups, or nil.
+	RoleBindings *RoleBindings
+
+	// Grants of bucket access managed by data owners, or nil.
+	GrantsDatabase *GrantsDatabase
+
+	// External policy that makes the final access decision, or nil.
+	PolicyHook *PolicyHook
+
+	// External permission service used in place of StorageAuthorizer, or nil.
+	AuthorizationWebhook *AuthorizationWebhook
+
+	// Server-side state, such as registered WebAuthn credentials.
+	Store Store
+
+	// Limits on the number of access tokens issued, or nil.
+	Quotas *Quotas
+
+	// Datasets that may be requested by id, or nil.
+	Datasets *DatasetRegistry
+
+	// S3 copies of GCS buckets, by GCS bucket name, or nil.
+	S3Mirrors map[string]*S3Mirror
+
+	// S3 buckets to which access is brokered, by S3 bucket name, or nil.
+	S3Buckets map[string]*S3Bucket
+
+	// Swift containers to which access is brokered, by container name, or nil.
+	SwiftContainers map[string]*SwiftContainer
+
+	// Password-protected HTTP servers to which access is brokered, by source name, or nil.
+	HttpSources map[string]*HttpSource
+
+	// DVID servers for which tokens are issued, by server name, or nil.
+	DvidServers map[string]*DvidServer
+
+	// BossDB realm and collections to which access is brokered, or nil.
+	Boss *BossConfig
+
+	// Service account whose Brainmaps tokens are issued, or nil.
+	Brainmaps *BrainmapsConfig
+
+	// Services that accept middle_auth tokens issued by ngauth, or nil.
+	MiddleAuth *MiddleAuthConfig
+
+	// Brokers of the configured storage backends, by name.
+	CredentialBrokers map[string]CredentialBroker
+
+	// Brokers of datasource URLs, for /credential, or nil.
+	CredentialRoutes CredentialRoutes
+
+	// Customer-supplied encryption keys of buckets, or nil.
+	EncryptionKeys map[string]*EncryptionKey
+
+	// Buckets and prefixes restricted until their release, or nil.
+	Embargoes *Embargoes
+
+	// WebAuthn second factor configuration, or nil if disabled.
+	MFA *webAuthnMFA
+
+	// Revoked login sessions.
+	Revocations *RevocationList
+
+	// Buckets that require a recent interactive login, or nil.
+	FreshLogin *FreshLoginPolicy
+
+	// Client networks from which particular buckets may be accessed, or nil.
+	NetworkRestrictions *NetworkRestrictions
+
 	GoogleHttpClient *http.Client
 }
 
-func (auth *Authenticator) validateIdToken(ctx context.Context, idToken string) (userId string, err error) {
-	payload, err := idtoken.Validate(ctx, idToken, auth.OAuth2Config.ClientID)
-	if err != nil {
-		err = fmt.Errorf("Invalid id_token: %w", err)
-		return
-	}
-	switch v := payload.Claims["email"].(type) {
-	case string:
-		userId = v
-		break
-	default:
-		err = fmt.Errorf("id_token is missing email")
-		return
-	}
-	switch v := payload.Claims["email_verified"].(type) {
-	case bool:
-		if !v {
-			err = fmt.Errorf("id_token is is missing verified_email")
-			return
+func (auth *Authenticator) GetIdentityProvider(name string) IdentityProvider {
+	for _, provider := range auth.IdentityProviders {
+		if provider.Name() == name {
+			return provider
 		}
-		break
-	default:
-		err = fmt.Errorf("id_token is is missing verified_email")
-		return
 	}
-	return
+	return nil
 }
 
-func (auth *Authenticator) extractAndValidateIdToken(ctx context.Context, token *oauth2.Token) (idToken string, userId string, err error) {
+func extractAndValidateIdToken(ctx context.Context, provider OAuth2IdentityProvider, token *oauth2.Token) (idToken string, identity *Identity, err error) {
 	idToken, ok := token.Extra("id_token").(string)
 	if !ok {
 		err = fmt.Errorf("Missing id_token")
 		return
 	}
-	userId, err = auth.validateIdToken(ctx, idToken)
+	identity, err = provider.ValidateIdToken(ctx, idToken)
 	if err != nil {
 		return
 	}
+	if validator, ok := provider.(accessTokenValidator); ok {
+		if err = validator.ValidateAccessToken(ctx, token.AccessToken); err != nil {
+			return
+		}
+	}
 	return
 }
 
-// 1 year
+// 1 year.  Shorter lifetimes may be configured, see TokenLifetimes.
 const MaxUserTokenCookieLifetimeSeconds = 60 * 60 * 24 * 365
 
-// 1 hour
+// 1 hour.  Shorter lifetimes may be configured, see TokenLifetimes.
 const MaxUserTokenCrossOriginLifetimeSeconds = 60 * 60
 
-func makeTemporaryUserToken(token UserToken) UserToken {
-	newExpires := time.Now().Unix() + MaxUserTokenCrossOriginLifetimeSeconds
+// makeTemporaryUserToken returns a copy of token expiring no later than the cross-origin token
+// lifetime of origin.
+func (auth *Authenticator) makeTemporaryUserToken(token UserToken, origin string) UserToken {
+	newExpires := time.Now().Unix() + auth.TokenLifetimes.CrossOriginLifetimeSeconds(origin)
 	if newExpires < token.Expires {
 		token.Expires = newExpires
 	}
 	return token
 }
 
+// checkTokenOrigin returns an error if userToken was issued to a client origin other than that of
+// the browser making request r, so that a token leaked to one site cannot be used from another.
+// Requests without an Origin header, i.e. not made by a browser on behalf of a site, are not
+// checked.
+func checkTokenOrigin(r *http.Request, userToken *UserToken) error {
+	origin := r.Header.Get("origin")
+	if userToken.Origin != "" && origin != "" && origin != userToken.Origin {
+		log.Printf("AUDIT: token of %s issued to origin %s used from origin %s", userToken.UserId, userToken.Origin, origin)
+		return fmt.Errorf("Token issued to origin %s used from origin %s", userToken.Origin, origin)
+	}
+	return nil
+}
+
+// Audience of the tokens accepted by ngauth itself, e.g. by /gcs_token, which is the default
+// audience of the tokens issued to clients.
+const gcsTokenAudience = "gcs"
+
+// isTokenAudienceAllowed returns true if tokens may be issued for audience, where "" requests the
+// default audience.
+func (auth *Authenticator) isTokenAudienceAllowed(audience string) bool {
+	return audience == "" || audience == gcsTokenAudience || containsString(auth.TokenAudiences, audience)
+}
+
+// checkTokenAudience returns an error if userToken was issued for a service other than ngauth, so
+// that a token issued to another service cannot be replayed against ngauth, and vice versa.
+func checkTokenAudience(userToken *UserToken) error {
+	if userToken.Audience != "" && userToken.Audience != gcsTokenAudience {
+		return fmt.Errorf("Token issued for audience %q", userToken.Audience)
+	}
+	return nil
+}
+
 func getEnvOr(key string, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -115,6 +310,16 @@ func getEnvOr(key string, fallback string) string {
 	return fallback
 }
 
+// splitList splits a comma-separated list, ignoring whitespace and empty elements.
+func splitList(s string) (result []string) {
+	for _, element := range strings.Split(s, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			result = append(result, element)
+		}
+	}
+	return
+}
+
 const MacKeyMinLength = 32
 
 const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
@@ -132,14 +337,10 @@ func MakeAuthenticator(ctx context.Context) (*Authenticator, error) {
 	}
 	auth.Credentials = credentials
 
-	// Decode oauth2 credentials
-	clientCredentialsPath := getEnvOr("OAUTH2_CLIENT_CREDENTIALS_PATH", "secrets/client_credentials.json")
-	clientCredentials, err := ioutil.ReadFile(clientCredentialsPath)
-	if err == nil {
-		auth.OAuth2Config, err = google.ConfigFromJSON(clientCredentials)
-	}
+	// Initialize the identity providers, which also decodes their oauth2 credentials
+	auth.IdentityProviders, err = makeIdentityProviders(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading client credentials from %s: %w", clientCredentialsPath, err)
+		return nil, err
 	}
 
 	// Decode allowed origins
@@ -162,17 +363,337 @@ func MakeAuthenticator(ctx context.Context) (*Authenticator, error) {
 		return nil, fmt.Errorf("Login session MAC key length (%d) is less than %d", len(auth.UserTokenKey), MacKeyMinLength)
 	}
 
+	auth.ClientTokenKey, err = loadClientTokenKey(auth.UserTokenKey)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.UserTokenSigner, err = loadUserTokenSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.GroupBuckets, err = loadGroupBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.LoginAllowlist, err = loadLoginAllowlist()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.DenyRules, err = loadDenyRules()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.UserTokenClaims = splitList(os.Getenv("USER_TOKEN_CLAIMS"))
+	auth.SessionRenewal = os.Getenv("SESSION_RENEWAL") == "true"
+	auth.DPoPRequired = os.Getenv("DPOP_REQUIRED") == "true"
+	auth.SingleUseTokens = os.Getenv("SINGLE_USE_TOKENS") == "true"
+	auth.SignedUrls = os.Getenv("SIGNED_URLS") == "true"
+	auth.SignedUrlServiceAccount = os.Getenv("SIGNED_URL_SERVICE_ACCOUNT")
+	auth.TokenExchange = os.Getenv("TOKEN_EXCHANGE") == "true"
+	auth.ServerSideSessions = os.Getenv("SERVER_SIDE_SESSIONS") == "true"
+	auth.FedCM = os.Getenv("FEDCM") == "true"
+	auth.TokenAudiences = splitList(os.Getenv("TOKEN_AUDIENCES"))
+	auth.ReadTokenPermissions = defaultTokenPermissions
+	if os.Getenv("READ_TOKENS_ALLOW_LISTING") == "false" {
+		auth.ReadTokenPermissions = readOnlyTokenPermissions
+	}
+	auth.AnonymousBuckets = loadAnonymousBuckets()
+	auth.PublicBuckets = splitList(os.Getenv("PUBLIC_BUCKETS"))
+	auth.AdminUsers = loadAdminUsers()
+
+	auth.BucketFilter, err = loadBucketFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.OriginBuckets, err = loadOriginBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.OriginPolicies, err = loadOriginPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.TokenLifetimes, err = loadTokenLifetimes()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.DownscopedTokens = loadDownscopedTokenCache()
+
+	auth.GrantCache, err = loadGrantCache()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.RoleBindings, err = loadRoleBindings()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.GrantsDatabase, err = openGrantsDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.PolicyHook = loadPolicyHook()
+
+	auth.AuthorizationWebhook, err = loadAuthorizationWebhook()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.ServiceClients, err = loadServiceClients()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.OpenIDProvider = os.Getenv("OPENID_PROVIDER") == "true"
+	if auth.OpenIDProvider && (auth.UserTokenSigner == nil || auth.ServiceClients == nil) {
+		return nil, fmt.Errorf("OPENID_PROVIDER requires USER_TOKEN_FORMAT=jwt and SERVICE_CLIENTS_PATH")
+	}
+
+	auth.FederatedIssuers, err = loadFederatedIssuers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize IamCheckerClient
 	//auth.GoogleTokenSource, err = google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
 	auth.GoogleHttpClient = oauth2.NewClient(ctx, auth.Credentials.TokenSource)
 	// auth.IamCheckerClient, err = policytroubleshooter.NewIamCheckerClient(ctx)
 
+	auth.LoginRequiredGroups = makeGoogleGroupsChecker(auth.GoogleHttpClient)
+
+	auth.StorageAuthorizer, err = makeStorageAuthorizer(auth.GoogleHttpClient)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.ShadowAuthorizer, err = loadShadowAuthorizer(auth.GoogleHttpClient)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.Projects, err = loadBrokeredProjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.Store, err = makeStore(auth.GoogleHttpClient)
+	if err != nil {
+		return nil, err
+	}
+	auth.Revocations = &RevocationList{store: auth.Store}
+
+	auth.Quotas, err = loadQuotas(auth.Store)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.Datasets, err = loadDatasetRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.S3Mirrors, err = loadS3Mirrors()
+	if err != nil {
+		return nil, err
+	}
+	if auth.S3Mirrors != nil && auth.UserTokenSigner == nil {
+		return nil, fmt.Errorf("S3_MIRRORS_PATH requires USER_TOKEN_FORMAT=jwt")
+	}
+
+	auth.S3Buckets, err = loadS3Buckets()
+	if err != nil {
+		return nil, err
+	}
+	if s3BucketsUseWebIdentity(auth.S3Buckets) && auth.UserTokenSigner == nil {
+		return nil, fmt.Errorf("S3_BUCKETS_PATH requires USER_TOKEN_FORMAT=jwt")
+	}
+
+	auth.SwiftContainers, err = loadSwiftContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.HttpSources, err = loadHttpSources()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.DvidServers, err = loadDvidServers()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.Boss, err = loadBossConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.Brainmaps, err = loadBrainmapsConfig(ctx, auth.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.MiddleAuth, err = loadMiddleAuthConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.CredentialBrokers, err = makeCredentialBrokers(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.CredentialRoutes, err = loadCredentialRoutes(auth.CredentialBrokers)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.EncryptionKeys, err = loadEncryptionKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.Embargoes, err = loadEmbargoes()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.MFA, err = makeWebAuthnMFA()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.FreshLogin, err = loadFreshLoginPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	auth.NetworkRestrictions, err = loadNetworkRestrictions()
+	if err != nil {
+		return nil, err
+	}
+
 	return auth, nil
 }
 
 type UserToken struct {
 	UserId  string `json:"u"`
 	Expires int64  `json:"e"`
+
+	// Linked identities that are also considered when checking permissions.
+	LinkedUserIds []string `json:"l,omitempty"`
+
+	// Groups asserted by the identity provider.
+	Groups []string `json:"g,omitempty"`
+
+	// Whether the login was verified with a second factor.
+	MFA bool `json:"m,omitempty"`
+
+	// Buckets for which the token may be used, or empty for all buckets.
+	Buckets []string `json:"b,omitempty"`
+
+	// /gcs_token modes, e.g. "read", for which the token may be used, or empty for all modes.
+	Modes []string `json:"r,omitempty"`
+
+	// Administrator who created the token by impersonating the user, or empty.
+	ImpersonatedBy string `json:"i,omitempty"`
+
+	// Display name and picture URL asserted by the identity provider, if any.
+	Name    string `json:"n,omitempty"`
+	Picture string `json:"p,omitempty"`
+
+	// Additional identity provider claims selected by USER_TOKEN_CLAIMS.
+	Claims map[string]interface{} `json:"c,omitempty"`
+
+	// Client origin to which the token was issued, if any.
+	Origin string `json:"o,omitempty"`
+
+	// Restrictions of a share token, or nil if the token is not a share token.
+	Share *ShareScope `json:"s,omitempty"`
+
+	// Time, in seconds since the epoch, at which the user last authenticated interactively, or 0
+	// if the token was not issued by an interactive login.
+	AuthTime int64 `json:"t,omitempty"`
+
+	// Identifies the login session from which the token was derived, for revocation, or "".
+	SessionId string `json:"j,omitempty"`
+
+	// Time, in seconds since the epoch, at which the login session was issued.
+	IssuedAt int64 `json:"a,omitempty"`
+
+	// JWK SHA-256 thumbprint of the DPoP key to which the token is bound, or "".
+	DPoPKeyThumbprint string `json:"k,omitempty"`
+
+	// Service for which the token was issued: gcsTokenAudience for the endpoints of ngauth itself,
+	// one of TOKEN_AUDIENCES, or "" for tokens issued before audiences were recorded.
+	Audience string `json:"d,omitempty"`
+
+	// Unique id of a single-use token, or "" if the token may be used repeatedly.
+	TokenId string `json:"x,omitempty"`
+}
+
+// makeUserToken returns a token for a qualified identity, valid for lifetimeSeconds.
+func (auth *Authenticator) makeUserToken(identity *Identity, lifetimeSeconds int64) UserToken {
+	token := UserToken{
+		UserId:        identity.UserId,
+		Expires:       time.Now().Unix() + lifetimeSeconds,
+		LinkedUserIds: identity.LinkedUserIds,
+		Groups:        identity.Groups,
+		SessionId:     makeSessionId(),
+		IssuedAt:      time.Now().Unix(),
+	}
+	token.Name, _ = identity.Claims["name"].(string)
+	token.Picture, _ = identity.Claims["picture"].(string)
+	for _, path := range auth.UserTokenClaims {
+		if value := getClaim(identity.Claims, path); value != nil {
+			if token.Claims == nil {
+				token.Claims = make(map[string]interface{})
+			}
+			token.Claims[path] = value
+		}
+	}
+	return token
+}
+
+// AllowsBucket returns true if the token is not restricted from accessing bucket.
+func (token *UserToken) AllowsBucket(bucket string) bool {
+	if len(token.Buckets) == 0 {
+		return true
+	}
+	for _, b := range token.Buckets {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsMode returns true if the token is not restricted from requesting mode, where "" is
+// readMode.
+func (token *UserToken) AllowsMode(mode string) bool {
+	if len(token.Modes) == 0 {
+		return true
+	}
+	if mode == "" {
+		mode = readMode
+	}
+	return containsString(token.Modes, mode)
+}
+
+// Principals returns all user ids under which the user may be granted access.
+func (token *UserToken) Principals() []string {
+	return append([]string{token.UserId}, token.LinkedUserIds...)
 }
 
 const userTokenMacLength = 32
@@ -183,17 +704,98 @@ func computeUserTokenMac(key []byte, encodedJson []byte) []byte {
 	return hasher.Sum(nil)
 }
 
-func EncodeUserToken(key []byte, userToken UserToken) string {
+// userTokenCipher returns an AES-GCM cipher with a key derived from the user token key.
+func userTokenCipher(key []byte) cipher.AEAD {
+	hasher := hmac.New(sha256.New, key)
+	hasher.Write([]byte("ngauth user token encryption"))
+	block, err := aes.NewCipher(hasher.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// Types of encrypted user tokens.  The type is authenticated along with the token, so that a token
+// of one type, e.g. a temporary token issued to a client, is never accepted as another, e.g. the
+// login cookie.
+const (
+	cookieUserTokenType = "cookie"
+	clientUserTokenType = "client"
+	formUserTokenType   = "form"
+
+	// Tokens encoded before types were introduced, and share tokens, which have their own key and
+	// must remain valid.
+	untypedUserTokenType = ""
+)
+
+// loadClientTokenKey reads the key specified by CLIENT_TOKEN_KEY_PATH, or derives one from the
+// login session key if unset.
+func loadClientTokenKey(userTokenKey []byte) ([]byte, error) {
+	path := os.Getenv("CLIENT_TOKEN_KEY_PATH")
+	if path == "" {
+		hasher := hmac.New(sha256.New, userTokenKey)
+		hasher.Write([]byte("ngauth client token key"))
+		return hasher.Sum(nil), nil
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client token key from %s: %w", path, err)
+	}
+	if len(key) < MacKeyMinLength {
+		return nil, fmt.Errorf("Client token key length (%d) is less than %d", len(key), MacKeyMinLength)
+	}
+	return key, nil
+}
+
+// EncodeUserToken encrypts userToken, so that the identity it contains cannot be read by anything
+// that sees the token, e.g. in the login cookie.
+func EncodeUserToken(key []byte, tokenType string, userToken UserToken) string {
 	// Json encoding cannot fail
 	encodedJson, _ := json.Marshal(userToken)
-	return base64.StdEncoding.EncodeToString(append(computeUserTokenMac(key, encodedJson), encodedJson...))
+	aead := userTokenCipher(key)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, encodedJson, []byte(tokenType)))
 }
 
-func DecodeUserToken(key []byte, encryptedToken string) (userToken UserToken, err error) {
+// DecodeUserToken decrypts a token of type tokenType encoded by EncodeUserToken.  Untyped tokens
+// authenticated, but not encrypted, by earlier versions are also accepted until they expire.
+func DecodeUserToken(key []byte, tokenType string, encryptedToken string) (userToken UserToken, err error) {
 	encodedWithMac, err := base64.StdEncoding.DecodeString(encryptedToken)
 	if err != nil {
 		return
 	}
+	aead := userTokenCipher(key)
+	if len(encodedWithMac) > aead.NonceSize() {
+		nonce := encodedWithMac[:aead.NonceSize()]
+		if encodedJson, err := aead.Open(nil, nonce, encodedWithMac[aead.NonceSize():], []byte(tokenType)); err == nil {
+			return decodeUserTokenJson(encodedJson)
+		}
+	}
+	if tokenType != untypedUserTokenType {
+		err = fmt.Errorf("Invalid %s token", tokenType)
+		return
+	}
+	return decodeMacUserToken(key, encodedWithMac)
+}
+
+// DecodeLegacyUserToken decodes a token authenticated, but not encrypted, by versions of ngauth
+// before user tokens were encrypted, whose login cookies are accepted until they expire.
+func DecodeLegacyUserToken(key []byte, token string) (userToken UserToken, err error) {
+	encodedWithMac, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return
+	}
+	return decodeMacUserToken(key, encodedWithMac)
+}
+
+func decodeMacUserToken(key []byte, encodedWithMac []byte) (userToken UserToken, err error) {
 	if len(encodedWithMac) < 32 {
 		err = fmt.Errorf("User token length (%d) is less than MAC length (%d)", len(encodedWithMac), userTokenMacLength)
 		return
@@ -205,6 +807,10 @@ func DecodeUserToken(key []byte, encryptedToken string) (userToken UserToken, er
 		err = fmt.Errorf("Invalid MAC")
 		return
 	}
+	return decodeUserTokenJson(encodedJson)
+}
+
+func decodeUserTokenJson(encodedJson []byte) (userToken UserToken, err error) {
 	err = json.Unmarshal(encodedJson, &userToken)
 	if err != nil {
 		return
@@ -235,77 +841,544 @@ func GetOAuth2RedirectURI(r *http.Request) string {
 	return u.String()
 }
 
-func (auth *Authenticator) GetOAuth2Config(r *http.Request) *oauth2.Config {
-	config := *auth.OAuth2Config
+func (auth *Authenticator) GetOAuth2Config(r *http.Request, provider OAuth2IdentityProvider) *oauth2.Config {
+	config := *provider.OAuth2Config()
 	config.RedirectURL = GetOAuth2RedirectURI(r)
-	config.Scopes = []string{"email"}
 	return &config
 }
 
+// loginState is passed through the identity provider as the oauth2 state parameter.
+type loginState struct {
+	Provider string
+	Origin   string
+
+	// Local path to redirect to after a login not initiated by a client origin.
+	Return string
+
+	// If non-empty, identifies a pending account link to complete instead of logging in.
+	Link string
+
+	// If "login", the identity provider is asked to authenticate the user again even if they
+	// have an existing session.  Only used when starting the login.
+	Prompt string
+}
+
+func (state loginState) Encode() string {
+	values := url.Values{}
+	values.Set("p", state.Provider)
+	if state.Origin != "" {
+		values.Set("o", state.Origin)
+	}
+	if state.Return != "" {
+		values.Set("r", state.Return)
+	}
+	if state.Link != "" {
+		values.Set("k", state.Link)
+	}
+	return values.Encode()
+}
+
+func decodeLoginState(encoded string) (state loginState) {
+	values, _ := url.ParseQuery(encoded)
+	state.Provider = values.Get("p")
+	state.Origin = values.Get("o")
+	state.Return = values.Get("r")
+	state.Link = values.Get("k")
+	return
+}
+
+// isLocalPath returns true if path is an absolute path on this server, and not a
+// scheme-relative URL.
+func isLocalPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
+
+func (auth *Authenticator) writeIdentityProviderChooser(w http.ResponseWriter, state loginState) {
+	w.Header().Add("x-frame-options", "deny")
+	w.Header().Add("content-type", "text/html")
+	fmt.Fprint(w, `<html><head><title>Login</title></head><body>
+Login with:
+<ul>
+`)
+	for _, provider := range auth.IdentityProviders {
+		query := url.Values{}
+		query.Set("provider", provider.Name())
+		if state.Origin != "" {
+			query.Set("origin", state.Origin)
+		}
+		if state.Return != "" {
+			query.Set("return", state.Return)
+		}
+		if state.Prompt != "" {
+			query.Set("prompt", state.Prompt)
+		}
+		displayName := identityProviderDisplayNames[provider.Name()]
+		if displayName == "" {
+			displayName = provider.Name()
+		}
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString("/login?"+query.Encode()), html.EscapeString(displayName))
+	}
+	fmt.Fprint(w, "</ul></body></html>")
+}
+
+// startLogin starts the login flow of the provider specified by state, or shows the list of
+// providers if none is specified.
+func (auth *Authenticator) startLogin(w http.ResponseWriter, r *http.Request, state loginState) {
+	switch provider := auth.GetIdentityProvider(state.Provider).(type) {
+	case loginStarter:
+		provider.StartLogin(auth, w, r, state)
+	case OAuth2IdentityProvider:
+		options := append(startPKCE(w, r), provider.AuthCodeOptions()...)
+		if state.Prompt != "" {
+			options = append(options, oauth2.SetAuthURLParam("prompt", state.Prompt))
+		}
+		http.Redirect(w, r, auth.GetOAuth2Config(r, provider).AuthCodeURL(state.Encode(), options...), http.StatusFound)
+	default:
+		auth.writeIdentityProviderChooser(w, state)
+	}
+}
+
 type GcsTokenRequest struct {
 	Token  string `json:"token"`
 	Bucket string `json:"bucket"`
+
+	// Dataset id, in place of bucket and prefix.
+	Dataset string `json:"dataset,omitempty"`
+
+	// Optional object name prefix to which access is restricted.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Either "read" (the default) or "write".
+	Mode string `json:"mode,omitempty"`
 }
 
 type GcsTokenResponse struct {
 	Token string `json:"token"`
+
+	// Whether the bucket is world-readable, in which case the token is empty and clients should
+	// read it without credentials.
+	Public bool `json:"public,omitempty"`
+
+	// Location of the requested dataset, if any.
+	Bucket string `json:"bucket,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+
+	// Remaining lifetime of the access token in seconds, and its expiry time in seconds since the
+	// epoch, so that clients can obtain a new token before it expires.
+	ExpiresIn int64 `json:"expiresIn,omitempty"`
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+
+	// Permissions granted by the access token, and the object prefixes to which they are limited,
+	// if any.
+	Permissions []string `json:"permissions,omitempty"`
+	Prefixes    []string `json:"prefixes,omitempty"`
+}
+
+// credentialError describes why an access token, or other credential, was not issued.
+type credentialError struct {
+	status  int
+	message string
+
+	// WWW-Authenticate challenge, if any.
+	challenge string
+
+	// Seconds after which the request may be retried, or 0.
+	retryAfter int
+}
+
+func (e *credentialError) writeHeaders(w http.ResponseWriter) {
+	if e.challenge != "" {
+		w.Header().Set("www-authenticate", e.challenge)
+		w.Header().Set("access-control-expose-headers", "www-authenticate")
+	}
+	if e.retryAfter != 0 {
+		w.Header().Set("retry-after", strconv.Itoa(e.retryAfter))
+	}
+}
+
+// write writes the error response.
+func (e *credentialError) write(w http.ResponseWriter) {
+	e.writeHeaders(w)
+	http.Error(w, e.message, e.status)
+}
+
+// authorizeGcsToken checks the storage permissions of the user for a /gcs_token request, and returns
+// the object prefixes and permissions to which the access token is limited.
+func (auth *Authenticator) authorizeGcsToken(r *http.Request, userToken *UserToken, tokenRequest *GcsTokenRequest) (prefixes, permissions []string, tokenErr *credentialError) {
+	granted, prefixes, permissions, _, err := auth.authorizeStorageAccess(r, userToken, tokenRequest)
+	if err != nil {
+		log.Printf("Error querying permissions, user=%s, bucket=%s, err=%+v", userToken.UserId, tokenRequest.Bucket, err)
+		return nil, nil, &credentialError{status: http.StatusInternalServerError, message: "Failed to query bucket permissions"}
+	}
+	if auth.PolicyHook != nil {
+		granted, err = auth.PolicyHook.IsAllowed(r.Context(), makePolicyInput(r, userToken, tokenRequest, granted))
+		if err != nil {
+			log.Printf("Error evaluating access policy, user=%s, bucket=%s, err=%+v", userToken.UserId, tokenRequest.Bucket, err)
+			return nil, nil, &credentialError{status: http.StatusInternalServerError, message: "Failed to evaluate access policy"}
+		}
+	}
+	if !granted {
+		return nil, nil, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	return prefixes, permissions, nil
+}
+
+// gcsTokenGrant is the access that may be granted by the token issued for an authorized
+// /gcs_token request.
+type gcsTokenGrant struct {
+	// Service account from whose tokens the token is downscoped, or "" for the credentials of the
+	// bucket.
+	serviceAccount string
+
+	boundary BucketBoundary
+}
+
+// issueGcsToken authenticates and authorizes a /gcs_token request from origin and issues the
+// bounded access token.  If refresh is true, access granted within GRANT_CACHE_TTL is not checked
+// again.
+func (auth *Authenticator) issueGcsToken(r *http.Request, origin string, tokenRequest GcsTokenRequest, refresh bool) (*GcsTokenResponse, *credentialError) {
+	tokenResponse, grant, tokenErr := auth.authorizeGcsTokenRequest(r, origin, tokenRequest, refresh)
+	if tokenErr != nil || grant == nil {
+		return tokenResponse, tokenErr
+	}
+	token, expires, err := auth.generateBoundedAccessToken(grant.serviceAccount, []BucketBoundary{grant.boundary})
+	if err != nil {
+		return nil, makeBoundedTokenError(grant.boundary.Bucket, err)
+	}
+	tokenResponse.setToken(token, expires, &grant.boundary)
+	return tokenResponse, nil
+}
+
+// makeBoundedTokenError returns the error response for a failure to obtain a bounded token.
+func makeBoundedTokenError(bucket string, err error) *credentialError {
+	log.Printf("Error obtaining bounded token, bucket=%s, err=%+v", bucket, err)
+	if isTemporaryExchangeError(err) {
+		return &credentialError{status: http.StatusServiceUnavailable, message: "Token service temporarily unavailable", retryAfter: 1}
+	}
+	return &credentialError{status: http.StatusInternalServerError, message: "Failed to obtain bounded oauth2 token"}
+}
+
+// setToken sets the access token of a response, limited to boundary.
+func (tokenResponse *GcsTokenResponse) setToken(token string, expires time.Time, boundary *BucketBoundary) {
+	tokenResponse.Token = token
+	tokenResponse.ExpiresIn = int64(time.Until(expires).Seconds())
+	tokenResponse.ExpiresAt = expires.Unix()
+	tokenResponse.Permissions = boundary.Permissions
+	tokenResponse.Prefixes = boundary.Prefixes
+}
+
+// authorizeGcsTokenRequest authenticates and authorizes a /gcs_token request as for issueGcsToken,
+// and returns the response without a token, along with the access to be granted by the token, or
+// nil if no token is needed.
+func (auth *Authenticator) authorizeGcsTokenRequest(r *http.Request, origin string, tokenRequest GcsTokenRequest, refresh bool) (*GcsTokenResponse, *gcsTokenGrant, *credentialError) {
+	if tokenRequest.Dataset != "" {
+		if tokenRequest.Bucket != "" || tokenRequest.Prefix != "" {
+			return nil, nil, &credentialError{status: http.StatusBadRequest, message: "Specify either dataset or bucket"}
+		}
+		dataset := auth.Datasets.Get(tokenRequest.Dataset)
+		if dataset == nil {
+			return nil, nil, &credentialError{status: http.StatusNotFound, message: "Unknown dataset"}
+		}
+		tokenRequest.Bucket = dataset.Bucket
+		tokenRequest.Prefix = dataset.Prefix
+	}
+	if !auth.BucketFilter.IsBrokered(tokenRequest.Bucket) {
+		return nil, nil, &credentialError{status: http.StatusForbidden, message: "Bucket not served by this server"}
+	}
+	if denial := auth.checkEncryptedBucket(tokenRequest.Bucket); denial != nil {
+		return nil, nil, &credentialError{status: denial.status, message: denial.message + "; " + denial.remediation}
+	}
+	var tokenResponse GcsTokenResponse
+	if tokenRequest.Dataset != "" {
+		tokenResponse.Bucket = tokenRequest.Bucket
+		tokenResponse.Prefix = tokenRequest.Prefix
+	}
+	if tokenRequest.Mode != writeMode && auth.IsPublicBucket(tokenRequest.Bucket) {
+		// No login is needed, since no access token is issued.
+		tokenResponse.Public = true
+		return &tokenResponse, nil, nil
+	}
+	var userToken UserToken
+	var err error
+	if strings.HasPrefix(tokenRequest.Token, shareTokenPrefix) {
+		userToken, err = auth.decodeShareToken(tokenRequest.Token)
+		if err == nil && auth.Revocations.IsRevoked(r.Context(), &userToken) {
+			err = fmt.Errorf("Share token revoked")
+		}
+	} else {
+		userToken, err = auth.resolveRequestUserToken(r, tokenRequest.Token)
+	}
+	if err != nil {
+		log.Printf("Invalid authentication token: %+v", err)
+		return nil, nil, &credentialError{status: http.StatusUnauthorized, message: "Invalid authentication token"}
+	}
+	if userToken.Share != nil {
+		// Share tokens only allow reading the shared prefix.
+		if tokenRequest.Prefix == "" {
+			tokenRequest.Prefix = userToken.Share.Prefix
+		}
+		if tokenRequest.Mode == writeMode || !strings.HasPrefix(tokenRequest.Prefix, userToken.Share.Prefix) {
+			return nil, nil, &credentialError{status: http.StatusForbidden, message: "Token not valid for prefix"}
+		}
+		log.Printf("AUDIT: share link of %s used for bucket %s prefix %q", userToken.UserId, tokenRequest.Bucket, tokenRequest.Prefix)
+	}
+	if !isValidObjectPrefix(tokenRequest.Prefix) {
+		return nil, nil, &credentialError{status: http.StatusBadRequest, message: "Invalid prefix"}
+	}
+	if !isValidMode(tokenRequest.Mode) {
+		return nil, nil, &credentialError{status: http.StatusBadRequest, message: "Invalid mode"}
+	}
+	if userToken.ImpersonatedBy != "" {
+		log.Printf("AUDIT: %s requested bucket %s as %s", userToken.ImpersonatedBy, tokenRequest.Bucket, userToken.UserId)
+	}
+	if denial, _ := auth.checkTokenPolicies(r, origin, &userToken, &tokenRequest); denial != nil {
+		return nil, nil, &credentialError{status: denial.status, message: denial.message, challenge: denial.challenge}
+	}
+	var prefixes, permissions []string
+	if grant := auth.GrantCache.get(&userToken, &tokenRequest); refresh && grant != nil {
+		prefixes, permissions = grant.prefixes, grant.permissions
+	} else {
+		var tokenErr *credentialError
+		if prefixes, permissions, tokenErr = auth.authorizeGcsToken(r, &userToken, &tokenRequest); tokenErr != nil {
+			return nil, nil, tokenErr
+		}
+		auth.GrantCache.put(&userToken, &tokenRequest, prefixes, permissions)
+	}
+	if tokenErr := auth.consumeCredentialsQuota(r, &userToken, &tokenRequest); tokenErr != nil {
+		return nil, nil, tokenErr
+	}
+	if tokenRequest.Prefix != "" && len(prefixes) == 0 {
+		prefixes = []string{tokenRequest.Prefix}
+	}
+	return &tokenResponse, &gcsTokenGrant{
+		serviceAccount: auth.Datasets.GetServiceAccount(tokenRequest.Bucket, tokenRequest.Prefix),
+		boundary:       BucketBoundary{Bucket: tokenRequest.Bucket, Prefixes: prefixes, Permissions: permissions},
+	}, nil
 }
 
 func getBucketResourceName(bucket string) string {
 	return "//storage.googleapis.com/projects/_/buckets/" + bucket
 }
 
-func (auth *Authenticator) checkStoragePermission(userId string, bucket string) (granted bool, err error) {
-	policyRequest := policytroubleshooterpb.TroubleshootIamPolicyRequest{
-		AccessTuple: &policytroubleshooterpb.AccessTuple{
-			Principal:        userId,
-			FullResourceName: getBucketResourceName(bucket),
-			Permission:       "storage.objects.get",
-		},
+// isLoginAllowed checks a newly-authenticated, unqualified identity against the login allowlist
+// and required groups.
+func (auth *Authenticator) isLoginAllowed(ctx context.Context, provider IdentityProvider, identity *Identity) (bool, error) {
+	userId := QualifyUserId(provider.Name(), identity.UserId)
+	if auth.LoginAllowlist != nil && !auth.LoginAllowlist.IsAllowed(identity.UserId, userId) {
+		log.Printf("Login denied by allowlist: %s", userId)
+		return false, nil
+	}
+	if auth.DenyRules.IsDenied(&UserToken{UserId: userId, LinkedUserIds: identity.LinkedUserIds}, "") {
+		return false, nil
+	}
+	if auth.LoginRequiredGroups != nil {
+		// Group members are Google accounts, so only ids that are verified emails of Google
+		// accounts are checked.
+		for _, id := range append([]string{identity.UserId}, identity.LinkedUserIds...) {
+			email := getUserEmail(QualifyUserId(provider.Name(), id))
+			if email == "" {
+				continue
+			}
+			isMember, err := auth.LoginRequiredGroups.IsMember(ctx, email)
+			if err != nil || isMember {
+				return isMember, err
+			}
+		}
+		log.Printf("Login denied by required groups: %s", userId)
+		return false, nil
 	}
-	reqJson, err := protojson.Marshal(&policyRequest)
+	return true, nil
+}
+
+// checkLoginAllowed writes an error response and returns false if the identity may not log in.
+func (auth *Authenticator) checkLoginAllowed(w http.ResponseWriter, r *http.Request, provider IdentityProvider, identity *Identity) bool {
+	allowed, err := auth.isLoginAllowed(r.Context(), provider, identity)
 	if err != nil {
+		log.Printf("Error checking whether %s may log in: %v", identity.UserId, err)
+		http.Error(w, "Failed to check account", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "Account not allowed", http.StatusForbidden)
+	}
+	return allowed
+}
+
+// completeLogin sets the login session cookie for a newly-authenticated user and, if the login was
+// initiated by a client origin, sends it a temporary token.
+func (auth *Authenticator) completeLogin(w http.ResponseWriter, r *http.Request, provider IdentityProvider, identity *Identity, state loginState) {
+	if !auth.checkLoginAllowed(w, r, provider, identity) {
 		return
 	}
-	resp, err := auth.GoogleHttpClient.Post("https://policytroubleshooter.googleapis.com/v1/iam:troubleshoot", "application/json", bytes.NewBuffer(reqJson))
-	if err != nil {
+	origin := state.Origin
+	if !auth.IsOriginAllowed(origin) {
+		origin = ""
+	}
+	identity.qualify(provider.Name())
+	if state.Link != "" {
+		auth.completeAccountLink(w, r, identity, state.Link)
 		return
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	if err := auth.resolveAccountLinks(r.Context(), identity); err != nil {
+		log.Printf("Error resolving linked accounts for %s: %v", identity.UserId, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	userToken := auth.makeUserToken(identity, auth.TokenLifetimes.UserCookieLifetimeSeconds(origin, identity.UserId))
+	userToken.AuthTime = getAuthTime(identity)
+	if !auth.OriginPolicies.AllowsOrigin(&userToken, origin) {
+		http.Error(w, "Origin not allowed for user", http.StatusForbidden)
 		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error querying bucket %s user %s: %s %s", bucket, userId, resp.Status, string(body))
-		granted = false
+	if err := auth.setUserTokenCookie(w, r, userToken); err != nil {
+		log.Printf("Error setting login session of %s: %v", userToken.UserId, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
-	var policyResponse policytroubleshooterpb.TroubleshootIamPolicyResponse
-	err = protojson.Unmarshal(body, &policyResponse)
+	mfaRequired, err := auth.requiresMFA(r.Context(), userToken.UserId)
 	if err != nil {
-		err = fmt.Errorf("Error unmarshaling body: %s %w", string(body), err)
+		log.Printf("Error checking second factor for %s: %v", userToken.UserId, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if mfaRequired {
+		query := url.Values{}
+		if origin != "" {
+			query.Set("origin", origin)
+		}
+		if state.Return != "" {
+			query.Set("return", state.Return)
+		}
+		http.Redirect(w, r, "/mfa?"+query.Encode(), http.StatusFound)
 		return
 	}
-	if policyResponse.Access == policytroubleshooterpb.AccessState_GRANTED {
-		granted = true
+	if origin == "" {
+		returnPath := "/"
+		if isLocalPath(state.Return) {
+			returnPath = state.Return
+		}
+		http.Redirect(w, r, returnPath, http.StatusFound)
+		return
 	}
-	return
+	w.Header().Add("content-type", "text/html")
+	jsonOrigin, err := json.Marshal(origin)
+	if err != nil {
+		panic(err)
+	}
+	tempUserToken := auth.makeTemporaryUserToken(userToken, origin)
+	tempUserToken.Origin = origin
+	tempUserToken.Audience = gcsTokenAudience
+	jsonToken, err := json.Marshal(map[string]string{
+		"token": auth.EncodeClientToken(tempUserToken),
+	})
+	fmt.Fprintf(w, `<html>
+<body>
+<script>
+window.opener.postMessage(%s,%s);
+window.close();
+</script>
+</body>
+</html>`, jsonToken, jsonOrigin)
+}
+
+// getFormUser returns the logged-in user submitting a form, or writes an error response.  As for
+// /logout, the form must include a token for the logged-in user, to prevent cross-site request
+// forgery.  Forms that change the user's account may not be submitted while impersonating.
+func (auth *Authenticator) getFormUser(w http.ResponseWriter, r *http.Request) *UserToken {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return nil
+	}
+	userToken := auth.getUserTokenFromCookie(r)
+	formToken, err := DecodeUserToken(auth.UserTokenKey, formUserTokenType, r.PostForm.Get("token"))
+	if userToken == nil || err != nil || formToken.UserId != userToken.UserId {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return nil
+	}
+	if userToken.ImpersonatedBy != "" {
+		http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+		return nil
+	}
+	return userToken
+}
+
+// getApiUser returns the user making a JSON API request, or writes an error response.  The APIs
+// are authenticated only by the Authorization header, so that they are not subject to cross-site
+// request forgery.
+func (auth *Authenticator) getApiUser(w http.ResponseWriter, r *http.Request) *UserToken {
+	userToken := auth.getUserTokenFromAuthorization(r)
+	if userToken == nil || userToken.UserId == anonymousUserId {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return nil
+	}
+	return userToken
+}
+
+func (auth *Authenticator) getUserTokenFromCookie(r *http.Request) *UserToken {
+	cookie, _ := r.Cookie(UserTokenCookieName)
+	if cookie == nil {
+		return nil
+	}
+	token, err := auth.decodeUserTokenCookie(r, cookie.Value)
+	if err != nil || auth.Revocations.IsRevoked(r.Context(), &token) {
+		return nil
+	}
+	return &token
+}
+
+// setUserTokenCookie sets the login session cookie, replacing any previous login session.
+func (auth *Authenticator) setUserTokenCookie(w http.ResponseWriter, r *http.Request, userToken UserToken) error {
+	auth.setLoginStatus(w, true)
+	if !auth.ServerSideSessions {
+		http.SetCookie(w, newCookie(r, UserTokenCookieName, EncodeUserToken(auth.UserTokenKey, cookieUserTokenType, userToken), userToken.Expires))
+		return nil
+	}
+	handle, err := auth.createSession(r, userToken)
+	if err != nil {
+		return fmt.Errorf("Error storing login session: %w", err)
+	}
+	auth.deleteRequestSession(r)
+	http.SetCookie(w, newCookie(r, UserTokenCookieName, handle, userToken.Expires))
+	return nil
+}
+
+// newCookie returns a cookie that is also sent with cross-origin requests from Neuroglancer, when
+// served over https.
+func newCookie(r *http.Request, name string, value string, expires int64) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		HttpOnly: true,
+		Expires:  time.Unix(expires, 0),
+	}
+	if r.URL.Scheme == "https" {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	} else {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	return cookie
+}
+
+// ServerTLSConfig returns the TLS configuration to use when ngauth terminates TLS itself.
+func (auth *Authenticator) ServerTLSConfig() *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	for _, provider := range auth.IdentityProviders {
+		if p, ok := provider.(tlsConfigurer); ok {
+			p.ConfigureTLS(config)
+		}
+	}
+	return config
 }
 
 func (auth *Authenticator) Router() *gorilla_mux.Router {
 	mux := gorilla_mux.NewRouter()
+	mux.Use(auth.authorizationMiddleware)
 	mux.Methods("GET").Path("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("x-frame-options", "deny")
 		w.Header().Add("content-type", "text/html")
 
-		var userToken *UserToken
-		if cookie, _ := r.Cookie(UserTokenCookieName); cookie != nil {
-			token, err := DecodeUserToken(auth.UserTokenKey, cookie.Value)
-			if err == nil {
-				userToken = &token
-			}
-		}
+		userToken := auth.getUserTokenFromCookie(r)
 
 		title := auth.Credentials.ProjectID
 		if title == "" {
@@ -324,7 +1397,23 @@ func (auth *Authenticator) Router() *gorilla_mux.Router {
 <input type="hidden" name="token" value="%s">
 <input type="submit" value="Logout">
 </form>
-`, html.EscapeString(userToken.UserId), html.EscapeString(EncodeUserToken(auth.UserTokenKey, makeTemporaryUserToken(*userToken))))
+`, html.EscapeString(userToken.UserId), html.EscapeString(EncodeUserToken(auth.UserTokenKey, formUserTokenType, auth.makeTemporaryUserToken(*userToken, ""))))
+		if userToken.ImpersonatedBy != "" {
+			fmt.Fprintf(w, "<p>Impersonated by %s</p>\n", html.EscapeString(userToken.ImpersonatedBy))
+		} else if auth.isAdmin(userToken) {
+			fmt.Fprint(w, `<p><a href="/admin/impersonate">Impersonate user</a></p>`+"\n")
+		}
+		auth.writeApiKeyForm(w, userToken)
+		auth.writePersonalAccessTokens(w, r, userToken)
+		if userToken.ImpersonatedBy == "" {
+			auth.writeAccountLinks(w, r, userToken)
+		}
+		if auth.MFA != nil {
+			auth.writeWebAuthnRegistration(w, r, userToken)
+		}
+		if auth.ServerSideSessions && userToken.ImpersonatedBy == "" {
+			auth.writeSessions(w, r, userToken)
+		}
 	})
 
 	mux.Methods("GET").Path("/login").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -349,65 +1438,49 @@ window.close();
 </html>`, jsonOrigin)
 			return
 		}
-		http.Redirect(w, r, auth.GetOAuth2Config(r).AuthCodeURL(origin, oauth2.AccessTypeOffline), http.StatusFound)
+		providerName := r.URL.Query().Get("provider")
+		if providerName == "" && len(auth.IdentityProviders) == 1 {
+			providerName = auth.IdentityProviders[0].Name()
+		}
+		state := loginState{Provider: providerName, Origin: origin}
+		if r.URL.Query().Get("prompt") == "login" {
+			state.Prompt = "login"
+		}
+		if returnPath := r.URL.Query().Get("return"); isLocalPath(returnPath) {
+			state.Return = returnPath
+		}
+		auth.startLogin(w, r, state)
 	})
 
 	mux.Methods("GET").Path("/auth_redirect").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		code := r.URL.Query().Get("code")
-		origin := r.URL.Query().Get("state")
-		if !auth.IsOriginAllowed(origin) {
-			origin = ""
+		state := decodeLoginState(r.URL.Query().Get("state"))
+		provider, ok := auth.GetIdentityProvider(state.Provider).(OAuth2IdentityProvider)
+		if !ok {
+			http.Error(w, "Invalid login state", http.StatusBadRequest)
+			return
+		}
+		verifier := takePKCEVerifier(w, r)
+		if verifier == nil {
+			http.Error(w, "Login session expired", http.StatusBadRequest)
+			return
 		}
-		config := auth.GetOAuth2Config(r)
-		token, err := config.Exchange(r.Context(), code)
+		config := auth.GetOAuth2Config(r, provider)
+		token, err := config.Exchange(r.Context(), code, verifier)
 		if err != nil {
 			http.Error(w, "Invalid oauth2 code", http.StatusBadRequest)
 			return
 		}
-		_, userId, err := auth.extractAndValidateIdToken(r.Context(), token)
+		_, identity, err := extractAndValidateIdToken(r.Context(), provider, token)
 		if err != nil {
 			log.Printf("Invalid id token: %v", err)
 			http.Error(w, "Invalid id token", http.StatusBadRequest)
 			return
 		}
-		userToken := UserToken{
-			UserId:  userId,
-			Expires: time.Now().Unix() + MaxUserTokenCookieLifetimeSeconds,
-		}
-		cookie := &http.Cookie{
-			Name:     UserTokenCookieName,
-			Value:    EncodeUserToken(auth.UserTokenKey, userToken),
-			HttpOnly: true,
-			Expires:  time.Unix(userToken.Expires, 0),
-		}
-		if r.URL.Scheme == "https" {
-			cookie.Secure = true
-			cookie.SameSite = http.SameSiteNoneMode
-		} else {
-			cookie.SameSite = http.SameSiteLaxMode
-		}
-		http.SetCookie(w, cookie)
-		if origin == "" {
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
-		w.Header().Add("content-type", "text/html")
-		jsonOrigin, err := json.Marshal(origin)
-		if err != nil {
-			panic(err)
+		if auth.SessionRenewal && token.RefreshToken != "" && state.Link == "" {
+			auth.saveRefreshToken(w, r, provider, token.RefreshToken)
 		}
-		tempUserToken := makeTemporaryUserToken(userToken)
-		jsonToken, err := json.Marshal(map[string]string{
-			"token": EncodeUserToken(auth.UserTokenKey, tempUserToken),
-		})
-		fmt.Fprintf(w, `<html>
-<body>
-<script>
-window.opener.postMessage(%s,%s);
-window.close();
-</script>
-</body>
-</html>`, jsonToken, jsonOrigin)
+		auth.completeLogin(w, r, provider, identity, state)
 	})
 
 	mux.Methods("POST").Path("/logout").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -415,29 +1488,41 @@ window.close();
 			http.Error(w, "Missing token", http.StatusBadRequest)
 			return
 		}
-		var userTokenFromCookie *UserToken
-		if cookie, _ := r.Cookie(UserTokenCookieName); cookie != nil {
-			token, err := DecodeUserToken(auth.UserTokenKey, cookie.Value)
-			if err == nil {
-				userTokenFromCookie = &token
-			}
-		}
+		userTokenFromCookie := auth.getUserTokenFromCookie(r)
 
 		var userTokenFromForm *UserToken
-		if token, err := DecodeUserToken(auth.UserTokenKey, r.PostForm.Get("token")); err == nil {
+		if token, err := DecodeUserToken(auth.UserTokenKey, formUserTokenType, r.PostForm.Get("token")); err == nil {
 			userTokenFromForm = &token
 		}
 
 		if userTokenFromCookie != nil && userTokenFromForm != nil && userTokenFromCookie.UserId == userTokenFromForm.UserId {
+			// Copies of the cookie, and tokens derived from it, are no longer valid.
+			if err := auth.Revocations.RevokeSession(r.Context(), userTokenFromCookie); err != nil {
+				log.Printf("Error revoking login session of %s: %v", userTokenFromCookie.UserId, err)
+			}
+			auth.deleteRequestSession(r)
 			http.SetCookie(w, &http.Cookie{
 				Name:   UserTokenCookieName,
 				MaxAge: -1,
 			})
+			auth.deleteRefreshToken(w, r)
+			auth.setLoginStatus(w, false)
 		}
 		http.Redirect(w, r, "/", http.StatusFound)
 	})
 
 	mux.Methods("POST").Path("/token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if grantType := r.PostFormValue("grant_type"); grantType != "" {
+			switch {
+			case grantType == "client_credentials" && auth.ServiceClients != nil:
+				auth.handleClientCredentialsGrant(w, r)
+			case grantType == "authorization_code" && auth.OpenIDProvider:
+				auth.handleAuthorizationCodeGrant(w, r)
+			default:
+				writeOAuth2Error(w, "unsupported_grant_type")
+			}
+			return
+		}
 		w.Header().Add("x-frame-options", "deny")
 		origin := r.Header.Get("origin")
 		if origin != "" {
@@ -453,20 +1538,64 @@ window.close();
 				return
 			}
 		}
+		audience := r.FormValue("audience")
+		if !auth.isTokenAudienceAllowed(audience) {
+			http.Error(w, "Unknown audience", http.StatusBadRequest)
+			return
+		}
+		var dpopKeyThumbprint string
+		if r.Header.Get(dpopHeaderName) != "" || auth.DPoPRequired {
+			var err error
+			if dpopKeyThumbprint, err = verifyDpopProof(r, ""); err != nil {
+				log.Printf("Invalid DPoP proof: %v", err)
+				http.Error(w, "Invalid DPoP proof", http.StatusBadRequest)
+				return
+			}
+		}
 		var userToken *UserToken
 		if cookie, _ := r.Cookie(UserTokenCookieName); cookie != nil {
-			token, err := DecodeUserToken(auth.UserTokenKey, cookie.Value)
+			token, err := auth.decodeUserTokenCookie(r, cookie.Value)
+			if err == nil && auth.Revocations.IsRevoked(r.Context(), &token) {
+				err = fmt.Errorf("Token revoked")
+			}
+			if err == nil && !auth.TokenLifetimes.AllowsSession(&token, origin) {
+				err = fmt.Errorf("Login session too old for origin %s", origin)
+			}
 			if err == nil {
 				userToken = &token
 			} else {
 				log.Printf("Received invalid token: %+v", err)
 			}
 		}
+		if auth.SessionRenewal && (userToken == nil || (userToken.ImpersonatedBy == "" && userToken.Expires < time.Now().Unix()+auth.sessionRenewalWindowSeconds())) {
+			if renewedToken := auth.renewSession(w, r); renewedToken != nil {
+				userToken = renewedToken
+			}
+		}
+		if userToken == nil && auth.AnonymousBuckets != nil {
+			anonymousToken := auth.makeAnonymousUserToken()
+			userToken = &anonymousToken
+		}
 		if userToken == nil {
 			http.Error(w, "Not logged in", http.StatusUnauthorized)
 			return
 		}
-		encryptedToken := EncodeUserToken(auth.UserTokenKey, makeTemporaryUserToken(*userToken))
+		if auth.DenyRules.IsDenied(userToken, "", origin) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		if !auth.OriginPolicies.AllowsOrigin(userToken, origin) {
+			http.Error(w, "Origin not allowed for user", http.StatusForbidden)
+			return
+		}
+		tempUserToken := auth.makeTemporaryUserToken(*userToken, origin)
+		tempUserToken.Origin = origin
+		tempUserToken.DPoPKeyThumbprint = dpopKeyThumbprint
+		tempUserToken.Audience = audience
+		if auth.SingleUseTokens || r.FormValue("single_use") == "true" {
+			tempUserToken.TokenId = makeTokenId()
+		}
+		encryptedToken := auth.EncodeClientToken(tempUserToken)
 		w.Header().Add("content-type", "text/plain")
 		fmt.Fprint(w, encryptedToken)
 	})
@@ -483,37 +1612,106 @@ window.close();
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		userToken, err := DecodeUserToken(auth.UserTokenKey, tokenRequest.Token)
-		if err != nil {
-			log.Printf("Invalid authentication token: %+v %+v %+v", r.Body, tokenRequest.Token, err)
-			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
-			return
-		}
-		granted, err := auth.checkStoragePermission(userToken.UserId, tokenRequest.Bucket)
-		if err != nil {
-			http.Error(w, "Failed to query bucket permissions", http.StatusInternalServerError)
-			log.Printf("Error querying permissions, user=%s, bucket=%s, err=%+v", userToken.UserId, tokenRequest.Bucket, err)
-			return
-		}
-		if !granted {
-			http.Error(w, "Access denied", http.StatusForbidden)
-			return
-		}
-		boundedToken, err := auth.generateBoundedAccessToken(tokenRequest.Bucket)
-		if err != nil {
-			http.Error(w, "Failed to obtain bounded oauth2 token", http.StatusInternalServerError)
-			log.Printf("Error obtaining bounded token, bucket=%s, err=%+v", tokenRequest.Bucket, err)
+		tokenResponse, tokenErr := auth.issueGcsToken(r, origin, tokenRequest, false)
+		if tokenErr != nil {
+			tokenErr.writeHeaders(w)
+			http.Error(w, tokenErr.message, tokenErr.status)
 			return
 		}
-		var tokenResponse GcsTokenResponse
-		tokenResponse.Token = boundedToken
-		tokenResponseJson, err := json.Marshal(&tokenResponse)
+		tokenResponseJson, err := json.Marshal(tokenResponse)
 		if err != nil {
 			http.Error(w, "Internal error", http.StatusInternalServerError)
 			log.Printf("Error marshaling bounded token, bucket=%s, err=%+v", tokenRequest.Bucket, err)
+			return
 		}
 		w.Header().Set("content-type", "application/json")
 		w.Write(tokenResponseJson)
 	})
+
+	if auth.MFA != nil {
+		auth.addWebAuthnRoutes(mux)
+	}
+
+	auth.addDeviceAuthorizationRoutes(mux)
+	auth.addCredentialFileRoutes(mux)
+	auth.addApiKeyRoutes(mux)
+	auth.addPersonalAccessTokenRoutes(mux)
+	auth.addImpersonationRoutes(mux)
+	auth.addAccountLinkRoutes(mux)
+	auth.addUserInfoRoutes(mux)
+	if provider, ok := auth.GetIdentityProvider("google").(*googleProvider); ok && os.Getenv("GCLOUD_LOGIN") == "true" {
+		auth.addGcloudLoginRoutes(mux, provider)
+	}
+	if auth.FederatedIssuers != nil {
+		auth.addFederationRoutes(mux)
+	}
+	if auth.TokenExchange {
+		auth.addTokenExchangeRoutes(mux)
+	}
+	if auth.ServerSideSessions {
+		auth.addSessionRoutes(mux)
+	}
+	if auth.OpenIDProvider {
+		auth.addOpenIDProviderRoutes(mux)
+	}
+	if auth.FedCM {
+		auth.addFedCMRoutes(mux)
+	}
+	if auth.GrantsDatabase != nil {
+		auth.addGrantsDatabaseRoutes(mux)
+		auth.addAccessRequestRoutes(mux)
+	}
+	if auth.Datasets != nil {
+		auth.addAgreementRoutes(mux)
+	}
+	auth.addDpopRoutes(mux)
+	auth.addGcsTokenBatchRoutes(mux)
+	auth.addGrantCacheRoutes(mux)
+	if auth.SignedUrls {
+		auth.addSignedUrlRoutes(mux)
+	}
+	auth.addShareLinkRoutes(mux)
+	auth.addCheckAccessRoutes(mux)
+	auth.addCredentialBrokerRoutes(mux)
+	if auth.CredentialRoutes != nil {
+		auth.addCredentialRouteRoutes(mux)
+	}
+	if auth.UserTokenSigner != nil {
+		auth.addUserTokenJwksRoutes(mux)
+	}
+	if auth.S3Mirrors != nil {
+		auth.addS3MirrorRoutes(mux)
+	}
+	if auth.S3Buckets != nil {
+		auth.addS3BucketRoutes(mux)
+	}
+	if auth.SwiftContainers != nil {
+		auth.addSwiftRoutes(mux)
+	}
+	if auth.HttpSources != nil {
+		auth.addHttpGatewayRoutes(mux)
+	}
+	if auth.DvidServers != nil {
+		auth.addDvidRoutes(mux)
+	}
+	if auth.Boss != nil {
+		auth.addBossRoutes(mux)
+	}
+	if auth.Brainmaps != nil {
+		auth.addBrainmapsRoutes(mux)
+	}
+	if auth.MiddleAuth != nil {
+		auth.addMiddleAuthRoutes(mux)
+	}
+	if auth.ServiceClients != nil {
+		auth.addIntrospectionRoutes(mux)
+	}
+	auth.addRevocationRoutes(mux)
+
+	for _, provider := range auth.IdentityProviders {
+		if p, ok := provider.(routeProvider); ok {
+			p.AddRoutes(auth, mux)
+		}
+	}
 	return mux
 }
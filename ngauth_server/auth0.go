@@ -0,0 +1,78 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Auth0 identity provider.
+
+type auth0Provider struct {
+	*oidcProvider
+
+	// API identifier that access tokens must be issued for, or empty if the access token is not
+	// used.
+	audience string
+}
+
+func (p *auth0Provider) ValidateAccessToken(ctx context.Context, accessToken string) error {
+	if p.audience == "" {
+		return nil
+	}
+	claims, err := parseAndVerifyJwt(ctx, p.keys, accessToken)
+	if err != nil {
+		return fmt.Errorf("Invalid access_token: %w", err)
+	}
+	if err := validateJwtClaims(claims, p.issuer, p.audience); err != nil {
+		return fmt.Errorf("Invalid access_token: %w", err)
+	}
+	return nil
+}
+
+func makeAuth0Provider(ctx context.Context) (IdentityProvider, error) {
+	// May be either the tenant domain, e.g. "example.us.auth0.com", or a custom domain.
+	domain := strings.TrimSuffix(strings.TrimPrefix(os.Getenv("AUTH0_DOMAIN"), "https://"), "/")
+	if domain == "" {
+		return nil, fmt.Errorf("AUTH0_DOMAIN must be specified")
+	}
+	clientID := os.Getenv("AUTH0_CLIENT_ID")
+	if clientID == "" {
+		return nil, fmt.Errorf("AUTH0_CLIENT_ID must be specified")
+	}
+	clientSecretPath := getEnvOr("AUTH0_CLIENT_SECRET_PATH", "secrets/auth0_client_secret.txt")
+	clientSecret, err := readClientSecret(clientSecretPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client secret from %s: %w", clientSecretPath, err)
+	}
+	provider, err := newOIDCProvider(ctx, "auth0", "https://"+domain+"/", clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	provider.requireEmailVerified = true
+	provider.groupsClaim = os.Getenv("AUTH0_GROUPS_CLAIM")
+	auth0 := &auth0Provider{
+		oidcProvider: provider,
+		audience:     os.Getenv("AUTH0_AUDIENCE"),
+	}
+	if auth0.audience != "" {
+		provider.authCodeOptions = append(provider.authCodeOptions, oauth2.SetAuthURLParam("audience", auth0.audience))
+	}
+	return auth0, nil
+}
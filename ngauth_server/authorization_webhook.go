@@ -0,0 +1,121 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// AuthorizationWebhook delegates access decisions to an external permission service, e.g. a lab's
+// existing LIMS, in place of the storage authorizer.
+type AuthorizationWebhook struct {
+	url string
+
+	// Key used to sign requests, or nil.
+	secret []byte
+
+	client *http.Client
+}
+
+type webhookRequest struct {
+	User   policyUser `json:"user"`
+	Bucket string     `json:"bucket"`
+	Prefix string     `json:"prefix,omitempty"`
+	Mode   string     `json:"mode"`
+	Origin string     `json:"origin,omitempty"`
+
+	Dataset string `json:"dataset,omitempty"`
+}
+
+// webhookDecision is the response of the webhook.
+type webhookDecision struct {
+	Allow bool `json:"allow"`
+
+	// If non-empty, access is limited to objects whose names start with any of these prefixes.
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+func loadAuthorizationWebhook() (*AuthorizationWebhook, error) {
+	url, ok := os.LookupEnv("AUTHORIZATION_WEBHOOK_URL")
+	if !ok {
+		return nil, nil
+	}
+	webhook := &AuthorizationWebhook{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+	if secretPath, ok := os.LookupEnv("AUTHORIZATION_WEBHOOK_SECRET_PATH"); ok {
+		secret, err := ioutil.ReadFile(secretPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading authorization webhook secret from %s: %w", secretPath, err)
+		}
+		webhook.secret = secret
+	}
+	return webhook, nil
+}
+
+// Decide calls the webhook for a /gcs_token request.  The decision must only grant access within
+// the requested prefix, if any.
+func (h *AuthorizationWebhook) Decide(ctx context.Context, r *http.Request, userToken *UserToken, tokenRequest *GcsTokenRequest) (*webhookDecision, error) {
+	input := makePolicyInput(r, userToken, tokenRequest, false)
+	body, err := json.Marshal(webhookRequest{
+		User:   input.User,
+		Bucket: input.Bucket,
+		Prefix: input.Prefix,
+		Mode:   input.Mode,
+		Origin: input.Origin,
+
+		Dataset: input.Dataset,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	if h.secret != nil {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set("x-ngauth-signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Authorization webhook failed: %v %v", resp.Status, strings.TrimSpace(string(bodyBytes)))
+	}
+	var decision webhookDecision
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return nil, err
+	}
+	for _, prefix := range decision.Prefixes {
+		if !isValidObjectPrefix(prefix) || !strings.HasPrefix(prefix, tokenRequest.Prefix) {
+			return nil, fmt.Errorf("Authorization webhook returned invalid prefix %q", prefix)
+		}
+	}
+	return &decision, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backblaze B2 buckets are S3 buckets whose credentials are application keys created with the B2
+// native API rather than obtained from STS.  B2 has no session credentials, but application keys
+// may be limited to one bucket and name prefix, and expire after a given duration, so ngauth
+// creates a key for each request from an application key with the writeKeys capability.
+
+const b2AuthorizeAccountURL = "https://api.backblazeb2.com/b2api/v3/b2_authorize_account"
+
+// B2 account authorizations are valid for 24 hours, and are renewed well before they expire.
+const b2AuthorizationLifetime = 12 * time.Hour
+
+var b2HttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// B2Config specifies how application keys are created for a B2 bucket.
+type B2Config struct {
+	// Id of the bucket, as B2 application keys are limited by bucket id.
+	BucketId string `json:"bucketId"`
+
+	// Id of the application key with the writeKeys capability from which keys are created.
+	KeyId string `json:"keyId"`
+
+	// File containing the application key.
+	KeyPath string `json:"keyPath"`
+
+	key string
+
+	// Authorization of the account, which is reused until it expires.
+	mutex                sync.Mutex
+	accountId            string
+	apiUrl               string
+	authorizationToken   string
+	authorizationExpires time.Time
+}
+
+// load reads the application key, and sets the defaults of bucket b.
+func (c *B2Config) load(bucket string, b *S3Bucket) error {
+	if c.BucketId == "" || c.KeyId == "" || c.KeyPath == "" {
+		return fmt.Errorf("B2 bucket %s must specify bucketId, keyId and keyPath", bucket)
+	}
+	key, err := ioutil.ReadFile(c.KeyPath)
+	if err != nil {
+		return fmt.Errorf("Error reading B2 application key from %s: %w", c.KeyPath, err)
+	}
+	c.key = strings.TrimSpace(string(key))
+	// The S3 endpoint depends on the region of the account, e.g. "us-west-004".
+	if b.Region == "" {
+		return fmt.Errorf("B2 bucket %s must specify region", bucket)
+	}
+	if b.Endpoint == "" {
+		b.Endpoint = "https://s3." + b.Region + ".backblazeb2.com"
+	}
+	if b.DurationSeconds == 0 {
+		b.DurationSeconds = defaultAwsCredentialsDurationSeconds
+	}
+	return nil
+}
+
+// b2Call sends request, if any, to the B2 native API at url, and decodes the response into
+// response.
+func b2Call(ctx context.Context, method string, url string, authorization string, request interface{}, response interface{}) error {
+	var body []byte
+	if request != nil {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", authorization)
+	if request != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	resp, err := b2HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &TokenExchangeError{StatusCode: resp.StatusCode, Body: string(responseBody)}
+	}
+	return json.Unmarshal(responseBody, response)
+}
+
+// authorize returns the account id, API URL and authorization token of the application key,
+// authorizing the account if the previous authorization has expired.
+func (c *B2Config) authorize(ctx context.Context) (string, string, string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.authorizationToken != "" && time.Now().Before(c.authorizationExpires) {
+		return c.accountId, c.apiUrl, c.authorizationToken, nil
+	}
+	var response struct {
+		AccountId          string `json:"accountId"`
+		AuthorizationToken string `json:"authorizationToken"`
+		ApiInfo            struct {
+			StorageApi struct {
+				ApiUrl string `json:"apiUrl"`
+			} `json:"storageApi"`
+		} `json:"apiInfo"`
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(c.KeyId + ":" + c.key))
+	if err := b2Call(ctx, "GET", b2AuthorizeAccountURL, "Basic "+credentials, nil, &response); err != nil {
+		return "", "", "", err
+	}
+	if response.AuthorizationToken == "" || response.ApiInfo.StorageApi.ApiUrl == "" {
+		return "", "", "", fmt.Errorf("No authorization in B2 response")
+	}
+	c.accountId = response.AccountId
+	c.apiUrl = response.ApiInfo.StorageApi.ApiUrl
+	c.authorizationToken = response.AuthorizationToken
+	c.authorizationExpires = time.Now().Add(b2AuthorizationLifetime)
+	return c.accountId, c.apiUrl, c.authorizationToken, nil
+}
+
+// resetAuthorization discards the authorization of the account, e.g. after it was rejected.
+func (c *B2Config) resetAuthorization() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.authorizationToken = ""
+}
+
+// createCredentials creates an application key for the bucket, limited to prefix in mode.
+func (c *B2Config) createCredentials(ctx context.Context, prefix string, mode string, durationSeconds int64) (*awsCredentialsResponse, error) {
+	accountId, apiUrl, authorizationToken, err := c.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	capabilities := []string{"listFiles", "readFiles"}
+	if mode == writeMode {
+		capabilities = append(capabilities, "writeFiles", "deleteFiles")
+	}
+	request := map[string]interface{}{
+		"accountId":              accountId,
+		"capabilities":           capabilities,
+		"keyName":                fmt.Sprintf("ngauth-%d", time.Now().UnixNano()),
+		"validDurationInSeconds": durationSeconds,
+		"bucketId":               c.BucketId,
+	}
+	if prefix != "" {
+		request["namePrefix"] = prefix
+	}
+	var response struct {
+		ApplicationKeyId string `json:"applicationKeyId"`
+		ApplicationKey   string `json:"applicationKey"`
+	}
+	expires := time.Now().Unix() + durationSeconds
+	if err := b2Call(ctx, "POST", apiUrl+"/b2api/v3/b2_create_key", authorizationToken, request, &response); err != nil {
+		if exchangeErr, ok := err.(*TokenExchangeError); ok && exchangeErr.StatusCode == http.StatusUnauthorized {
+			c.resetAuthorization()
+		}
+		return nil, err
+	}
+	if response.ApplicationKeyId == "" {
+		return nil, fmt.Errorf("No application key in B2 response")
+	}
+	return &awsCredentialsResponse{
+		AccessKeyId:     response.ApplicationKeyId,
+		SecretAccessKey: response.ApplicationKey,
+		ExpiresAt:       expires,
+	}, nil
+}
+
+// issueB2Credentials creates an application key for the B2 bucket of tokenRequest, limited to its
+// prefix in the requested mode.
+func (auth *Authenticator) issueB2Credentials(r *http.Request, userToken *UserToken, tokenRequest *GcsTokenRequest, bucket *S3Bucket) (*awsCredentialsResponse, *credentialError) {
+	if tokenErr := auth.consumeCredentialsQuota(r, userToken, tokenRequest); tokenErr != nil {
+		return nil, tokenErr
+	}
+	credentials, err := bucket.B2.createCredentials(r.Context(), tokenRequest.Prefix, tokenRequest.Mode, bucket.DurationSeconds)
+	if err != nil {
+		return nil, makeCredentialsError(tokenRequest.Bucket, err)
+	}
+	credentials.Bucket = tokenRequest.Bucket
+	credentials.Region = bucket.Region
+	if tokenRequest.Prefix != "" {
+		credentials.Prefixes = []string{tokenRequest.Prefix}
+	}
+	return credentials, nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// BossDB: boss:// sources authenticate with access tokens of the BossDB Keycloak realm.  With
+// BOSS_PATH set, ngauth checks the user's access to the requested collection, and then obtains a
+// token for the user's BossDB account by Keycloak token exchange with impersonation, as a
+// confidential client permitted to impersonate users, so that boss:// and gs:// layers share one
+// login.
+
+var bossHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// BossConfig specifies the BossDB Keycloak realm and the collections to which access is brokered.
+type BossConfig struct {
+	// Token endpoint of the realm, e.g.
+	// https://auth.bossdb.io/auth/realms/BOSS/protocol/openid-connect/token.
+	TokenUrl string `json:"tokenUrl"`
+
+	// Confidential client with the token exchange and impersonation permissions.
+	ClientId         string `json:"clientId"`
+	ClientSecretPath string `json:"clientSecretPath"`
+
+	// Client for which the tokens are issued, e.g. "endpoint", or "" for the default audience.
+	Audience string `json:"audience,omitempty"`
+
+	// Domain of the user ids of BossDB accounts, e.g. "example.org", or "" if BossDB usernames are
+	// the users' email addresses.  Other users are denied.
+	UsernameDomain string `json:"usernameDomain,omitempty"`
+
+	// Members, as for role bindings, who may access each collection.  The collection "*" applies
+	// to all collections.
+	Collections map[string]*BossCollection `json:"collections"`
+
+	clientSecret string
+}
+
+// BossCollection specifies the members who may access a BossDB collection.
+type BossCollection struct {
+	Readers []string `json:"readers"`
+}
+
+// loadBossConfig loads the configuration specified by BOSS_PATH.
+func loadBossConfig() (*BossConfig, error) {
+	configPath, ok := os.LookupEnv("BOSS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading BossDB configuration from %s: %w", configPath, err)
+	}
+	var config BossConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Error parsing BossDB configuration from %s: %w", configPath, err)
+	}
+	if !strings.HasPrefix(config.TokenUrl, "https://") || config.ClientId == "" {
+		return nil, fmt.Errorf("BossDB configuration must specify an https tokenUrl and clientId")
+	}
+	secret, err := ioutil.ReadFile(config.ClientSecretPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading BossDB client secret from %s: %w", config.ClientSecretPath, err)
+	}
+	config.clientSecret = strings.TrimSpace(string(secret))
+	return &config, nil
+}
+
+// allowsCollection returns true if the user may access collection.
+func (c *BossConfig) allowsCollection(userToken *UserToken, collection string) bool {
+	for _, name := range []string{collection, "*"} {
+		if members := c.Collections[name]; members != nil && hasMember(members.Readers, userToken) {
+			return true
+		}
+	}
+	return false
+}
+
+// username returns the BossDB username of the user, or "" if the user has no BossDB account.
+func (c *BossConfig) username(userToken *UserToken) string {
+	email := getUserEmail(userToken.UserId)
+	if email == "" {
+		return ""
+	}
+	if c.UsernameDomain == "" {
+		return email
+	}
+	if name := strings.TrimSuffix(email, "@"+c.UsernameDomain); name != email {
+		return name
+	}
+	return ""
+}
+
+// impersonate obtains an access token for the BossDB user username.
+func (c *BossConfig) impersonate(ctx context.Context, username string) (string, int64, error) {
+	form := url.Values{
+		"grant_type":           {tokenExchangeGrantType},
+		"client_id":            {c.ClientId},
+		"client_secret":        {c.clientSecret},
+		"requested_subject":    {username},
+		"requested_token_type": {accessTokenTokenType},
+	}
+	if c.Audience != "" {
+		form.Set("audience", c.Audience)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	resp, err := bossHttpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, &TokenExchangeError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	var response struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", 0, err
+	}
+	if response.AccessToken == "" {
+		return "", 0, fmt.Errorf("No access token in token exchange response")
+	}
+	return response.AccessToken, time.Now().Unix() + response.ExpiresIn, nil
+}
+
+// bossBroker issues BossDB access tokens.  The resource is the collection.
+type bossBroker struct {
+	auth *Authenticator
+}
+
+func makeBossBroker(auth *Authenticator) CredentialBroker {
+	if auth.Boss == nil {
+		return nil
+	}
+	return &bossBroker{auth: auth}
+}
+
+// authorize checks the user's access to the collection of request, and returns the user token and
+// BossDB username.
+func (b *bossBroker) authorize(r *http.Request, origin string, request *CredentialRequest) (*UserToken, string, *credentialError) {
+	auth := b.auth
+	userToken, tokenErr := auth.authenticateCredentialRequest(r, request)
+	if tokenErr != nil {
+		return nil, "", tokenErr
+	}
+	if userToken.ImpersonatedBy != "" || auth.DenyRules.IsDenied(userToken, "", origin, userToken.Origin) || !auth.OriginPolicies.AllowsOrigin(userToken, origin) {
+		return nil, "", &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	username := auth.Boss.username(userToken)
+	if username == "" || !auth.Boss.allowsCollection(userToken, request.Resource) {
+		log.Printf("AUDIT: %s denied BossDB token for collection %q", userToken.UserId, request.Resource)
+		return nil, "", &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	return userToken, username, nil
+}
+
+func (b *bossBroker) CheckAccess(r *http.Request, origin string, request *CredentialRequest) *credentialError {
+	_, _, tokenErr := b.authorize(r, origin, request)
+	return tokenErr
+}
+
+func (b *bossBroker) IssueCredential(r *http.Request, origin string, request *CredentialRequest) (interface{}, *credentialError) {
+	userToken, username, tokenErr := b.authorize(r, origin, request)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	token, expires, err := b.auth.Boss.impersonate(r.Context(), username)
+	if err != nil {
+		log.Printf("Error obtaining BossDB token for %s: %+v", username, err)
+		if isTemporaryExchangeError(err) {
+			return nil, &credentialError{status: http.StatusServiceUnavailable, message: "Token service temporarily unavailable", retryAfter: 1}
+		}
+		return nil, &credentialError{status: http.StatusInternalServerError, message: "Failed to obtain BossDB token"}
+	}
+	log.Printf("AUDIT: %s obtained BossDB token as %s for collection %q", userToken.UserId, username, request.Resource)
+	return map[string]interface{}{"token": token, "expiresAt": expires}, nil
+}
+
+func (auth *Authenticator) addBossRoutes(mux *gorilla_mux.Router) {
+	// Returns a BossDB access token for a request with the same token as for /gcs_token.
+	mux.Methods("POST").Path("/boss_token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowCredentialOrigin(w, r)
+		var request struct {
+			Token      string `json:"token"`
+			Collection string `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveCredentialRequest(w, r, origin, auth.CredentialBrokers["boss"], &CredentialRequest{Token: request.Token, Resource: request.Collection})
+	})
+}
@@ -15,10 +15,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 type CredentialAccessBoundary struct {
@@ -40,6 +48,29 @@ type AccessBoundaryRule struct {
 	AvailabilityCondition *AvailabilityCondition `json:"availabilityCondition,omitempty"`
 }
 
+// Maximum number of rules in a credential access boundary.
+const maxAccessBoundaryRules = 10
+
+// BucketBoundary limits a downscoped token to permissions on a bucket or, if Prefixes is
+// non-empty, on objects in the bucket whose names start with any of Prefixes.
+type BucketBoundary struct {
+	Bucket      string
+	Prefixes    []string
+	Permissions []string
+}
+
+// rule returns the access boundary rule for b.
+func (b *BucketBoundary) rule() AccessBoundaryRule {
+	rule := AccessBoundaryRule{
+		AvailableResource:    getBucketResourceName(b.Bucket),
+		AvailablePermissions: b.Permissions,
+	}
+	if len(b.Prefixes) > 0 {
+		rule.AvailabilityCondition = getObjectPrefixesCondition(b.Bucket, b.Prefixes)
+	}
+	return rule
+}
+
 type DownscopedTokenResponse struct {
 	AccessToken     string `json:"access_token"`
 	IssuedTokenType string `json:"issued_token_type"`
@@ -47,49 +78,237 @@ type DownscopedTokenResponse struct {
 	ExpiresIn       int    `json:"expires_in"`
 }
 
-func (auth *Authenticator) generateBoundedAccessToken(bucket string) (token string, err error) {
-	// https://cloud.google.com/iam/docs/downscoping-short-lived-credentials?hl=en#create-credential
-	postReq := url.Values{}
-	boundary := CredentialAccessBoundary{
-		AccessBoundary: AccessBoundary{
-			AccessBoundaryRules: []AccessBoundaryRule{
-				AccessBoundaryRule{
-					AvailableResource: getBucketResourceName(bucket),
-					AvailablePermissions: []string{
-						"inRole:roles/storage.objectViewer",
-					},
-				},
-			},
-		},
+// getObjectPrefixesCondition returns a condition limiting reads and listing to objects whose names
+// start with any of prefixes.
+func getObjectPrefixesCondition(bucket string, prefixes []string) *AvailabilityCondition {
+	var expressions []string
+	for _, prefix := range prefixes {
+		expressions = append(expressions,
+			fmt.Sprintf("resource.name.startsWith('projects/_/buckets/%s/objects/%s')", bucket, prefix),
+			fmt.Sprintf("api.getAttribute('storage.googleapis.com/objectListPrefix', '').startsWith('%s')", prefix))
+	}
+	return &AvailabilityCondition{
+		Title:      "Object prefixes",
+		Expression: strings.Join(expressions, " || "),
+	}
+}
+
+// Downscoped tokens are reused until this long before they expire, so that clients receive tokens
+// with at least this much remaining lifetime.
+const downscopedTokenMinLifetime = 10 * time.Minute
+
+// DownscopedTokenCache holds downscoped tokens, so that users authorized for the same bucket,
+// prefixes and permissions share a token rather than each requiring a token exchange.  Concurrent
+// requests for a token not yet cached share a single exchange.
+type DownscopedTokenCache struct {
+	// Cache of boundary key to *downscopedToken.
+	tokens sync.Map
+
+	// Token exchanges in progress, by boundary key.
+	exchanges singleflight.Group
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+type downscopedToken struct {
+	token   string
+	expires time.Time
+}
+
+// loadDownscopedTokenCache returns a cache, or nil if DOWNSCOPED_TOKEN_CACHE is "false".
+func loadDownscopedTokenCache() *DownscopedTokenCache {
+	if getEnvOr("DOWNSCOPED_TOKEN_CACHE", "true") == "false" {
+		return nil
+	}
+	return &DownscopedTokenCache{}
+}
+
+func downscopedTokenKey(serviceAccount string, boundaries []BucketBoundary) string {
+	var parts []string
+	for _, b := range boundaries {
+		sortedPrefixes := append([]string(nil), b.Prefixes...)
+		sort.Strings(sortedPrefixes)
+		sortedPermissions := append([]string(nil), b.Permissions...)
+		sort.Strings(sortedPermissions)
+		part, _ := json.Marshal([]interface{}{b.Bucket, sortedPrefixes, sortedPermissions})
+		parts = append(parts, string(part))
+	}
+	// The order of the rules does not affect the token.
+	sort.Strings(parts)
+	key, _ := json.Marshal([]interface{}{serviceAccount, parts})
+	return string(key)
+}
+
+// isReusable returns true if the token has enough remaining lifetime to be returned to a client.
+func (t *downscopedToken) isReusable(now time.Time) bool {
+	return now.Add(downscopedTokenMinLifetime).Before(t.expires)
+}
+
+func (c *DownscopedTokenCache) get(key string) *downscopedToken {
+	if cached, ok := c.tokens.Load(key); ok && cached.(*downscopedToken).isReusable(time.Now()) {
+		return cached.(*downscopedToken)
+	}
+	return nil
+}
+
+func (c *DownscopedTokenCache) put(key string, token *downscopedToken) {
+	now := time.Now()
+	if !token.isReusable(now) {
+		return
+	}
+	c.tokens.Store(key, token)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) < downscopedTokenMinLifetime {
+		return
+	}
+	c.lastSweep = now
+	c.tokens.Range(func(key, value interface{}) bool {
+		if !value.(*downscopedToken).isReusable(now) {
+			c.tokens.Delete(key)
+		}
+		return true
+	})
+}
+
+// generateBoundedAccessToken returns an access token, and its expiry time, limited to the union of
+// boundaries, of which there may be at most maxAccessBoundaryRules.  The token is downscoped from a
+// token of serviceAccount, if not "", or else of the credentials of the first bucket, which must
+// also be the credentials of the other buckets.  Tokens are reused from DownscopedTokens, if
+// enabled, since they do not identify the user.
+func (auth *Authenticator) generateBoundedAccessToken(serviceAccount string, boundaries []BucketBoundary) (token string, expires time.Time, err error) {
+	if len(boundaries) == 0 || len(boundaries) > maxAccessBoundaryRules {
+		err = fmt.Errorf("Access boundary must have between 1 and %d rules", maxAccessBoundaryRules)
+		return
+	}
+	c := auth.DownscopedTokens
+	if c == nil {
+		return auth.exchangeBoundedAccessToken(serviceAccount, boundaries)
+	}
+	key := downscopedTokenKey(serviceAccount, boundaries)
+	if cached := c.get(key); cached != nil {
+		return cached.token, cached.expires, nil
+	}
+	result, err, _ := c.exchanges.Do(key, func() (interface{}, error) {
+		token, expires, err := auth.exchangeBoundedAccessToken(serviceAccount, boundaries)
+		if err != nil {
+			return nil, err
+		}
+		exchanged := &downscopedToken{token: token, expires: expires}
+		c.put(key, exchanged)
+		return exchanged, nil
+	})
+	if err != nil {
+		return
+	}
+	exchanged := result.(*downscopedToken)
+	return exchanged.token, exchanged.expires, nil
+}
+
+// Security Token Service endpoint for token exchange.
+// https://cloud.google.com/iam/docs/reference/sts/rest/v1/TopLevel/token
+const stsTokenEndpoint = "https://sts.googleapis.com/v1/token"
+
+// Number of attempts at a token exchange that fails transiently.
+const stsMaxAttempts = 3
+
+// Delay before the first retry of a token exchange, doubled for each subsequent retry.
+const stsInitialBackoff = 200 * time.Millisecond
+
+var stsHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// TokenExchangeError is returned when the Security Token Service rejects a token exchange.
+type TokenExchangeError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *TokenExchangeError) Error() string {
+	return fmt.Sprintf("Unable to exchange token: %d %s", e.StatusCode, e.Body)
+}
+
+// Temporary returns true if the exchange may succeed if retried.
+func (e *TokenExchangeError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// isTemporaryExchangeError returns true if err, from a token exchange, is a timeout, network error
+// or temporary rejection, rather than e.g. an invalid request or subject token.
+func isTemporaryExchangeError(err error) bool {
+	var exchangeErr *TokenExchangeError
+	if errors.As(err, &exchangeErr) {
+		return exchangeErr.Temporary()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// exchangeBoundedAccessToken obtains a new access token, as for generateBoundedAccessToken, from
+// the Security Token Service, retrying transient failures.
+func (auth *Authenticator) exchangeBoundedAccessToken(serviceAccount string, boundaries []BucketBoundary) (token string, expires time.Time, err error) {
+	// https://cloud.google.com/iam/docs/downscoping-short-lived-credentials#exchange-credential
+	var boundary CredentialAccessBoundary
+	for i := range boundaries {
+		boundary.AccessBoundary.AccessBoundaryRules = append(boundary.AccessBoundary.AccessBoundaryRules, boundaries[i].rule())
 	}
 	boundaryJson, err := json.Marshal(boundary)
 	if err != nil {
 		return
 	}
-	postReq.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
-	postReq.Set("options", url.QueryEscape(string(boundaryJson)))
-	postReq.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
-	origToken, err := auth.Credentials.TokenSource.Token()
+	credentials, err := auth.getServiceAccountCredentials(boundaries[0].Bucket, serviceAccount)
+	if err != nil {
+		return
+	}
+	origToken, err := credentials.TokenSource.Token()
 	if err != nil {
 		return
 	}
+	postReq := url.Values{}
+	postReq.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	postReq.Set("options", string(boundaryJson))
+	postReq.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
 	postReq.Set("subject_token", origToken.AccessToken)
 	postReq.Set("subject_token_type", "urn:ietf:params:oauth:token-type:access_token")
-	resp, err := http.PostForm("https://sts.googleapis.com/v1beta/token", postReq)
-	defer resp.Body.Close()
+	backoff := stsInitialBackoff
+	for attempt := 1; ; attempt++ {
+		var respMsg *DownscopedTokenResponse
+		respMsg, err = postTokenExchange(postReq)
+		if err == nil {
+			token = respMsg.AccessToken
+			if respMsg.ExpiresIn > 0 {
+				expires = time.Now().Add(time.Duration(respMsg.ExpiresIn) * time.Second)
+			} else {
+				// The downscoped token expires with the subject token.
+				expires = origToken.Expiry
+			}
+			return
+		}
+		if attempt == stsMaxAttempts || !isTemporaryExchangeError(err) {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postTokenExchange makes one token exchange request to the Security Token Service.
+func postTokenExchange(postReq url.Values) (*DownscopedTokenResponse, error) {
+	resp, err := stsHttpClient.PostForm(stsTokenEndpoint, postReq)
 	if err != nil {
-		return
+		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		err = fmt.Errorf("Unable to exchange token: %v %v %v", resp.StatusCode, resp.Status, string(bodyBytes))
-		return
+		return nil, &TokenExchangeError{StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 	var respMsg DownscopedTokenResponse
-	err = json.NewDecoder(resp.Body).Decode(&respMsg)
-	if err != nil {
-		return
+	if err := json.NewDecoder(resp.Body).Decode(&respMsg); err != nil {
+		return nil, err
+	}
+	if respMsg.AccessToken == "" {
+		return nil, fmt.Errorf("Token exchange returned no access token")
 	}
-	token = respMsg.AccessToken
-	return
+	return &respMsg, nil
 }
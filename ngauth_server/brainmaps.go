@@ -0,0 +1,143 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	gorilla_mux "github.com/gorilla/mux"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
+)
+
+// Brainmaps: brainmaps:// sources require Google access tokens with the brainmaps scope, which
+// users otherwise obtain through an OAuth client of their own.  With BRAINMAPS_PATH set, ngauth
+// issues entitled users access tokens of a service account with access to the volumes, limited to
+// the brainmaps scope, so that the tokens cannot be used for other Google APIs.
+
+const brainmapsScope = "https://www.googleapis.com/auth/brainmaps"
+
+// BrainmapsConfig specifies the service account whose tokens are issued, and who is entitled to
+// them.
+type BrainmapsConfig struct {
+	// Service account to impersonate, with access to the served volumes, or "" to use the default
+	// credentials.
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+
+	// Members, as for role bindings, who may obtain tokens.
+	Readers []string `json:"readers"`
+
+	credentials *google.Credentials
+}
+
+// loadBrainmapsConfig loads the configuration specified by BRAINMAPS_PATH, and obtains the
+// credentials of the service account using base.
+func loadBrainmapsConfig(ctx context.Context, base *google.Credentials) (*BrainmapsConfig, error) {
+	configPath, ok := os.LookupEnv("BRAINMAPS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Brainmaps configuration from %s: %w", configPath, err)
+	}
+	var config BrainmapsConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Error parsing Brainmaps configuration from %s: %w", configPath, err)
+	}
+	options := []option.ClientOption{option.WithScopes(brainmapsScope)}
+	if config.ServiceAccount != "" {
+		options = append(options, option.WithCredentials(base), option.ImpersonateCredentials(config.ServiceAccount))
+	} else if impersonateServiceAccount, ok := os.LookupEnv("IMPERSONATE_SERVICE_ACCOUNT"); ok {
+		options = append(options, option.ImpersonateCredentials(impersonateServiceAccount))
+	}
+	config.credentials, err = transport.Creds(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("Error obtaining Brainmaps credentials: %w", err)
+	}
+	return &config, nil
+}
+
+// brainmapsBroker issues Brainmaps access tokens.  Requests specify no resource.
+type brainmapsBroker struct {
+	auth *Authenticator
+}
+
+func makeBrainmapsBroker(auth *Authenticator) CredentialBroker {
+	if auth.Brainmaps == nil {
+		return nil
+	}
+	return &brainmapsBroker{auth: auth}
+}
+
+// authorize checks that the user is entitled to Brainmaps tokens, and returns the user token.
+func (b *brainmapsBroker) authorize(r *http.Request, origin string, request *CredentialRequest) (*UserToken, *credentialError) {
+	auth := b.auth
+	userToken, tokenErr := auth.authenticateCredentialRequest(r, request)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	if userToken.UserId == anonymousUserId || auth.DenyRules.IsDenied(userToken, "", origin, userToken.Origin) || !auth.OriginPolicies.AllowsOrigin(userToken, origin) {
+		return nil, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	if !hasMember(auth.Brainmaps.Readers, userToken) {
+		log.Printf("AUDIT: %s denied Brainmaps token", userToken.UserId)
+		return nil, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	return userToken, nil
+}
+
+func (b *brainmapsBroker) CheckAccess(r *http.Request, origin string, request *CredentialRequest) *credentialError {
+	_, tokenErr := b.authorize(r, origin, request)
+	return tokenErr
+}
+
+func (b *brainmapsBroker) IssueCredential(r *http.Request, origin string, request *CredentialRequest) (interface{}, *credentialError) {
+	userToken, tokenErr := b.authorize(r, origin, request)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	token, err := b.auth.Brainmaps.credentials.TokenSource.Token()
+	if err != nil {
+		log.Printf("Error obtaining Brainmaps token: %+v", err)
+		return nil, &credentialError{status: http.StatusInternalServerError, message: "Failed to obtain Brainmaps token"}
+	}
+	log.Printf("AUDIT: %s obtained Brainmaps token", userToken.UserId)
+	return map[string]interface{}{
+		"tokenType":   "Bearer",
+		"accessToken": token.AccessToken,
+		"expiresAt":   token.Expiry.Unix(),
+	}, nil
+}
+
+func (auth *Authenticator) addBrainmapsRoutes(mux *gorilla_mux.Router) {
+	// Returns a Brainmaps access token, as OAuth2 credentials of the Neuroglancer brainmaps data
+	// source, for a request with the same token as for /gcs_token.
+	mux.Methods("POST").Path("/brainmaps_token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowCredentialOrigin(w, r)
+		var request CredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveCredentialRequest(w, r, origin, auth.CredentialBrokers["brainmaps"], &request)
+	})
+}
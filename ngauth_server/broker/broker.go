@@ -0,0 +1,124 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package broker defines the interface of credential brokers implemented outside of the ngauth
+// server, and the registry through which the server finds them.
+//
+// A broker package registers a Factory with RegisterCredentialBroker from an init function, and is
+// linked into the server with a blank import.  The server then serves requests for the broker at
+// /credentials/NAME.  Brokers depend only on Host for authentication and authorization, so that
+// they are added without changes to the server.
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Request is a request for a credential for a resource of a broker.
+type Request struct {
+	// Authentication token, as for /gcs_token.
+	Token string `json:"token"`
+
+	// Resource of the broker, e.g. a bucket, Swift container, DVID server, or BossDB collection.
+	Resource string `json:"resource,omitempty"`
+
+	// Part of the resource to which the credential is limited, e.g. an object name prefix or DVID
+	// repo, if supported by the broker.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Either "read" (the default) or "write", if supported by the broker.
+	Mode string `json:"mode,omitempty"`
+
+	// Requested lifetime of the credential in seconds, if supported by the broker.
+	ExpiresIn int64 `json:"expiresIn,omitempty"`
+
+	// Options specific to the broker, which only that broker decodes.
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// Error is the error response to a request.
+type Error struct {
+	// HTTP status of the response.
+	Status int
+
+	// Message returned to the client.
+	Message string
+
+	// Seconds after which the request may be retried, or 0.
+	RetryAfter int
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Host authenticates and authorizes requests on behalf of brokers.
+type Host interface {
+	// Authorize authenticates request, made by r from origin, checks the deny rules and origin
+	// policies of the server, and checks that the user is one of members, as for role bindings.  It
+	// returns the qualified user id.
+	Authorize(r *http.Request, origin string, request *Request, members []string) (string, *Error)
+}
+
+// Broker issues credentials for the resources of one storage backend.
+type Broker interface {
+	// CheckAccess authorizes request, and returns nil if a credential would be issued, without
+	// issuing it.
+	CheckAccess(r *http.Request, origin string, request *Request) *Error
+
+	// IssueCredential authorizes request, and returns the credential, which is returned to the
+	// client as JSON.
+	IssueCredential(r *http.Request, origin string, request *Request) (interface{}, *Error)
+}
+
+// Factory returns the broker, or nil if it is not configured, e.g. by its environment variables.
+type Factory func(host Host) (Broker, error)
+
+var (
+	mutex     sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// RegisterCredentialBroker registers the factory of the broker served at /credentials/NAME.  It
+// panics if a broker of the same name is already registered.
+func RegisterCredentialBroker(name string, factory Factory) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("Credential broker %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Names returns the names of the registered brokers, in sorted order.
+func Names() []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the factory of the named broker, or nil if none is registered.
+func Lookup(name string) Factory {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return factories[name]
+}
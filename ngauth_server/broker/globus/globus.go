@@ -0,0 +1,171 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package globus brokers access tokens for Globus collections.
+//
+// Facilities that publish datasets through Globus guest collections serve them over HTTPS to
+// bearer tokens with the collection's https scope.  With GLOBUS_COLLECTIONS_PATH set, ngauth holds
+// a confidential Globus client with which the collections are shared, obtains tokens for each
+// collection with the client credentials grant, so that users need not consent to the collection's
+// scope themselves, and issues them to users with access to the collection.
+package globus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+
+	"ngauth/broker"
+)
+
+const tokenURL = "https://auth.globus.org/v2/oauth2/token"
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func init() {
+	broker.RegisterCredentialBroker("globus", makeBroker)
+}
+
+// Config specifies the Globus client and the collections to which access is brokered.
+type Config struct {
+	// Confidential client, registered at https://app.globus.org/settings/developers, whose
+	// identity CLIENT_ID@clients.auth.globus.org has read access to the collections.
+	ClientId         string `json:"clientId"`
+	ClientSecretPath string `json:"clientSecretPath"`
+
+	// Collections, by name.
+	Collections map[string]*Collection `json:"collections"`
+}
+
+// Collection specifies a Globus guest collection served over HTTPS.
+type Collection struct {
+	// UUID of the collection.
+	CollectionId string `json:"collectionId"`
+
+	// HTTPS base URL of the collection, e.g. "https://g-abc123.fa5e.bd7c.data.globus.org".
+	HttpsServer string `json:"httpsServer"`
+
+	// Members, as for role bindings, who may read the collection.
+	Readers []string `json:"readers"`
+
+	tokenSource oauth2.TokenSource
+}
+
+// loadConfig loads the configuration specified by GLOBUS_COLLECTIONS_PATH.
+func loadConfig() (*Config, error) {
+	configPath, ok := os.LookupEnv("GLOBUS_COLLECTIONS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Globus collections from %s: %w", configPath, err)
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Error parsing Globus collections from %s: %w", configPath, err)
+	}
+	if config.ClientId == "" || config.ClientSecretPath == "" {
+		return nil, fmt.Errorf("Globus collections configuration must specify clientId and clientSecretPath")
+	}
+	clientSecret, err := ioutil.ReadFile(config.ClientSecretPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Globus client secret from %s: %w", config.ClientSecretPath, err)
+	}
+	// Tokens are cached until they expire, so they are not obtained in the context of a request.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	for name, collection := range config.Collections {
+		httpsServer, err := url.Parse(collection.HttpsServer)
+		if err != nil || httpsServer.Scheme != "https" || httpsServer.Host == "" || collection.CollectionId == "" {
+			return nil, fmt.Errorf("Globus collection %s must specify collectionId and an https httpsServer", name)
+		}
+		collection.HttpsServer = strings.TrimSuffix(collection.HttpsServer, "/")
+		tokenConfig := &clientcredentials.Config{
+			ClientID:     config.ClientId,
+			ClientSecret: strings.TrimSpace(string(clientSecret)),
+			TokenURL:     tokenURL,
+			Scopes:       []string{"https://auth.globus.org/scopes/" + collection.CollectionId + "/https"},
+			AuthStyle:    oauth2.AuthStyleInHeader,
+		}
+		collection.tokenSource = tokenConfig.TokenSource(ctx)
+	}
+	return &config, nil
+}
+
+// globusBroker issues access tokens for Globus collections.  The resource is the collection name.
+type globusBroker struct {
+	host   broker.Host
+	config *Config
+}
+
+func makeBroker(host broker.Host) (broker.Broker, error) {
+	config, err := loadConfig()
+	if config == nil || err != nil {
+		return nil, err
+	}
+	return &globusBroker{host: host, config: config}, nil
+}
+
+// authorize checks the user's access to the collection of request, and returns the user id and
+// collection.
+func (b *globusBroker) authorize(r *http.Request, origin string, request *broker.Request) (string, *Collection, *broker.Error) {
+	collection := b.config.Collections[request.Resource]
+	if collection == nil {
+		return "", nil, &broker.Error{Status: http.StatusNotFound, Message: "Unknown collection"}
+	}
+	userId, tokenErr := b.host.Authorize(r, origin, request, collection.Readers)
+	if tokenErr != nil {
+		return "", nil, tokenErr
+	}
+	return userId, collection, nil
+}
+
+func (b *globusBroker) CheckAccess(r *http.Request, origin string, request *broker.Request) *broker.Error {
+	_, _, tokenErr := b.authorize(r, origin, request)
+	return tokenErr
+}
+
+func (b *globusBroker) IssueCredential(r *http.Request, origin string, request *broker.Request) (interface{}, *broker.Error) {
+	userId, collection, tokenErr := b.authorize(r, origin, request)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	token, err := collection.tokenSource.Token()
+	if err != nil {
+		log.Printf("Error obtaining Globus token for collection %s: %+v", collection.CollectionId, err)
+		// Rejected requests, e.g. because the collection is not shared with the client, are not
+		// retried.
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.Response.StatusCode < 500 {
+			return nil, &broker.Error{Status: http.StatusInternalServerError, Message: "Failed to obtain Globus token"}
+		}
+		return nil, &broker.Error{Status: http.StatusServiceUnavailable, Message: "Token service temporarily unavailable", RetryAfter: 1}
+	}
+	log.Printf("AUDIT: %s obtained Globus token for collection %s", userId, request.Resource)
+	return map[string]interface{}{
+		"token":     token.AccessToken,
+		"expiresAt": token.Expiry.Unix(),
+		"url":       collection.HttpsServer,
+	}, nil
+}
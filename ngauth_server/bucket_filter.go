@@ -0,0 +1,79 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// BucketFilter restricts the buckets for which ngauth issues access tokens, so that the server
+// cannot be used to mint tokens for arbitrary buckets readable by its service account.
+//
+// Patterns are bucket names, in which "*" matches any sequence of characters, e.g. "lab-*".
+type BucketFilter struct {
+	// Buckets must match one of these patterns, unless empty.
+	allowed []string
+
+	// Buckets must not match any of these patterns.
+	denied []string
+}
+
+func parseBucketPatterns(s string) ([]string, error) {
+	patterns := splitList(s)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid bucket pattern %q: %w", pattern, err)
+		}
+	}
+	return patterns, nil
+}
+
+func matchesAnyPattern(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, s); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// loadBucketFilter returns the filter specified by BUCKET_ALLOWLIST and BUCKET_DENYLIST, or nil
+// if neither is specified.
+func loadBucketFilter() (*BucketFilter, error) {
+	allowed, err := parseBucketPatterns(os.Getenv("BUCKET_ALLOWLIST"))
+	if err != nil {
+		return nil, err
+	}
+	denied, err := parseBucketPatterns(os.Getenv("BUCKET_DENYLIST"))
+	if err != nil {
+		return nil, err
+	}
+	if allowed == nil && denied == nil {
+		return nil, nil
+	}
+	return &BucketFilter{allowed: allowed, denied: denied}, nil
+}
+
+// IsBrokered returns true if ngauth may issue access tokens for bucket.
+func (f *BucketFilter) IsBrokered(bucket string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.allowed) > 0 && !matchesAnyPattern(f.allowed, bucket) {
+		return false
+	}
+	return !matchesAnyPattern(f.denied, bucket)
+}
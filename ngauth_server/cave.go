@@ -0,0 +1,162 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// caveAuthorizer delegates access decisions to the dataset-level permissions of a CAVE
+// middle_auth server, so that segmentation and proofreading deployments can reuse their existing
+// permission system.  Buckets, or object prefixes, are mapped to middle_auth datasets; the "view"
+// permission grants read access, and "edit" grants write access.
+type caveAuthorizer struct {
+	// Base URL of the middle_auth server, e.g. "https://global.daf-apis.com/auth".
+	url string
+
+	// middle_auth token of a service account with administrator access, used to look up users.
+	token string
+
+	// Maps bucket names, or "BUCKET/PREFIX", to middle_auth dataset names.
+	datasets map[string]string
+
+	client *http.Client
+
+	// Cache of email address to *cachedCavePermissions.
+	permissions sync.Map
+}
+
+const cavePermissionsCacheDuration = time.Minute
+
+type cachedCavePermissions struct {
+	// Map of dataset name to permission names.
+	permissions map[string][]string
+	expires     time.Time
+}
+
+func loadCaveAuthorizer() (*caveAuthorizer, error) {
+	a := &caveAuthorizer{
+		url:    strings.TrimSuffix(os.Getenv("CAVE_URL"), "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if a.url == "" {
+		return nil, fmt.Errorf("CAVE_URL must be specified when AUTHORIZATION_MODE=cave")
+	}
+	tokenPath := getEnvOr("CAVE_TOKEN_PATH", "secrets/cave_token.txt")
+	token, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CAVE token from %s: %w", tokenPath, err)
+	}
+	a.token = strings.TrimSpace(string(token))
+	datasetsPath := getEnvOr("CAVE_DATASETS_PATH", "secrets/cave_datasets.json")
+	data, err := ioutil.ReadFile(datasetsPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CAVE datasets from %s: %w", datasetsPath, err)
+	}
+	if err := json.Unmarshal(data, &a.datasets); err != nil {
+		return nil, fmt.Errorf("Error parsing CAVE datasets from %s: %w", datasetsPath, err)
+	}
+	return a, nil
+}
+
+// getDataset returns the dataset of the most specific resource that includes all objects in
+// bucket whose names start with prefix, or "" if there is none.
+func (a *caveAuthorizer) getDataset(bucket string, prefix string) (dataset string) {
+	longest := -1
+	for resource, d := range a.datasets {
+		if resourceCoversPrefix(resource, bucket, prefix) && len(resource) > longest {
+			longest = len(resource)
+			dataset = d
+		}
+	}
+	return
+}
+
+func (a *caveAuthorizer) get(ctx context.Context, path string, value interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", a.url+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "Bearer "+a.token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("middle_auth request %s failed: %s %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+// getPermissions returns the dataset permissions of the middle_auth user with the specified email
+// address, or nil if there is no such user.
+func (a *caveAuthorizer) getPermissions(ctx context.Context, email string) (map[string][]string, error) {
+	if cached, ok := a.permissions.Load(email); ok && time.Now().Before(cached.(*cachedCavePermissions).expires) {
+		return cached.(*cachedCavePermissions).permissions, nil
+	}
+	var users []struct {
+		Id    int64  `json:"id"`
+		Email string `json:"email"`
+	}
+	if err := a.get(ctx, "/api/v1/user?email="+url.QueryEscape(email), &users); err != nil {
+		return nil, err
+	}
+	var permissions map[string][]string
+	for _, user := range users {
+		if !strings.EqualFold(user.Email, email) {
+			continue
+		}
+		var userPermissions struct {
+			PermissionsV2 map[string][]string `json:"permissions_v2"`
+		}
+		if err := a.get(ctx, fmt.Sprintf("/api/v1/user/%d/permissions", user.Id), &userPermissions); err != nil {
+			return nil, err
+		}
+		permissions = userPermissions.PermissionsV2
+		break
+	}
+	a.permissions.Store(email, &cachedCavePermissions{permissions: permissions, expires: time.Now().Add(cavePermissionsCacheDuration)})
+	return permissions, nil
+}
+
+func (a *caveAuthorizer) CheckStoragePermission(ctx context.Context, userId string, bucket string, prefix string, permission string) (bool, error) {
+	email := getUserEmail(userId)
+	if email == "" {
+		return false, nil
+	}
+	dataset := a.getDataset(bucket, prefix)
+	if dataset == "" {
+		return false, nil
+	}
+	permissions, err := a.getPermissions(ctx, email)
+	if err != nil {
+		return false, err
+	}
+	required := "view"
+	if permission == storageWritePermission {
+		required = "edit"
+	}
+	return containsString(permissions[dataset], required), nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// accessDenial describes why a /gcs_token request is denied.
+type accessDenial struct {
+	status int
+
+	// Identifies the check that denied the request, as reported by /check_access.
+	check string
+
+	message string
+
+	// Suggested action for the user, or "".
+	remediation string
+
+	// WWW-Authenticate challenge, or "".
+	challenge string
+}
+
+// checkTokenPolicies applies the deployment's policies, other than storage permissions, to a
+// /gcs_token request made by r from origin, and returns nil if none of them deny it.
+func (auth *Authenticator) checkTokenPolicies(r *http.Request, origin string, userToken *UserToken, tokenRequest *GcsTokenRequest) (*accessDenial, error) {
+	bucket := tokenRequest.Bucket
+	// Deny rules override all other authorization.
+	if auth.DenyRules.IsDenied(userToken, bucket, origin, userToken.Origin) {
+		return &accessDenial{status: http.StatusForbidden, check: "deny_rules", message: "Access denied", remediation: "Contact the administrators of this server"}, nil
+	}
+	if !auth.OriginPolicies.AllowsOrigin(userToken, origin) || !auth.OriginPolicies.AllowsOrigin(userToken, userToken.Origin) {
+		return &accessDenial{status: http.StatusForbidden, check: "origin_policies", message: "Origin not allowed for user", remediation: "Use a Neuroglancer deployment permitted for your account"}, nil
+	}
+	// Both the origin to which the token was issued and the origin of the request apply.
+	if !auth.OriginBuckets.IsAllowed(userToken.Origin, bucket) || !auth.OriginBuckets.IsAllowed(origin, bucket) {
+		return &accessDenial{status: http.StatusForbidden, check: "origin_buckets", message: "Bucket not allowed for origin", remediation: "Use a Neuroglancer deployment permitted to access this bucket"}, nil
+	}
+	if !auth.NetworkRestrictions.IsAllowed(r, bucket) {
+		return &accessDenial{status: http.StatusForbidden, check: "network", message: "Client network not allowed for bucket", remediation: "Connect from an allowed network, e.g. through a VPN"}, nil
+	}
+	if !userToken.AllowsBucket(bucket) {
+		if userToken.UserId == anonymousUserId {
+			// Prompts the client to log in.
+			return &accessDenial{status: http.StatusUnauthorized, check: "login", message: "Login required", remediation: "Log in"}, nil
+		}
+		return &accessDenial{status: http.StatusForbidden, check: "token_scope", message: "Token not valid for bucket", remediation: "Obtain a token that includes this bucket"}, nil
+	}
+	if !userToken.AllowsMode(tokenRequest.Mode) {
+		return &accessDenial{status: http.StatusForbidden, check: "token_scope", message: "Token not valid for mode", remediation: "Obtain a token that includes this mode"}, nil
+	}
+	if auth.MFA != nil && auth.MFA.IsRequired(bucket) && !userToken.MFA {
+		return &accessDenial{status: http.StatusForbidden, check: "mfa", message: "Second factor required", remediation: "Verify a second factor at /mfa"}, nil
+	}
+	if !auth.FreshLogin.IsSatisfied(userToken, bucket) {
+		return &accessDenial{status: http.StatusUnauthorized, check: "fresh_login", message: "Fresh login required", remediation: "Log in again at /login?prompt=login", challenge: auth.FreshLogin.Challenge()}, nil
+	}
+	// Embargoes override all other grants until the release.
+	if release := auth.Embargoes.GetEmbargo(userToken, bucket, tokenRequest.Prefix); !release.IsZero() {
+		return &accessDenial{status: http.StatusForbidden, check: "embargo", message: "Embargoed until " + release.UTC().Format(time.RFC3339), remediation: "Wait until the release"}, nil
+	}
+	// Agreements apply whether the datasets are requested by id or by location.
+	for datasetId, dataset := range auth.Datasets.GetAgreements(bucket, tokenRequest.Prefix) {
+		if userToken.UserId == anonymousUserId {
+			return &accessDenial{status: http.StatusUnauthorized, check: "login", message: "Login required", remediation: "Log in"}, nil
+		}
+		accepted, err := auth.hasAcceptedAgreement(r.Context(), userToken.UserId, datasetId, dataset)
+		if err != nil {
+			log.Printf("Error checking agreement, user=%s, dataset=%s, err=%+v", userToken.UserId, datasetId, err)
+			return &accessDenial{status: http.StatusInternalServerError, check: "agreement", message: "Failed to check data use agreement"}, err
+		}
+		if !accepted {
+			return &accessDenial{status: http.StatusForbidden, check: "agreement", message: "Data use agreement not accepted for dataset " + datasetId, remediation: "Accept the agreement at /datasets/" + datasetId + "/agreement"}, nil
+		}
+	}
+	return nil, nil
+}
+
+type checkAccessResponse struct {
+	Granted bool   `json:"granted"`
+	Bucket  string `json:"bucket"`
+	Prefix  string `json:"prefix,omitempty"`
+	Mode    string `json:"mode"`
+
+	// Identifies the check or grant that decided the request, e.g. "deny_rules" or "roles".
+	DecidedBy string `json:"decidedBy"`
+
+	Reason string `json:"reason"`
+
+	// Suggested action for the user, if access is denied.
+	Remediation string `json:"remediation,omitempty"`
+
+	// Object prefixes to which an access token would be limited, if any.
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// Descriptions of the sources reported by authorizeStorageAccess.
+var storageAccessSourceReasons = map[string]string{
+	"dataset":               "Decided by the readers and writers of the dataset",
+	"roles":                 "Granted by a role binding",
+	"anonymous":             "The bucket may be read without logging in",
+	"group_buckets":         "Granted to one of your groups",
+	"grants_database":       "Granted by the grants database",
+	"authorization_webhook": "Decided by the authorization webhook",
+	"authorization_mode":    "Decided by AUTHORIZATION_MODE=",
+}
+
+func (auth *Authenticator) addCheckAccessRoutes(mux *gorilla_mux.Router) {
+	// Evaluates a /gcs_token request, without issuing an access token, and reports the check that
+	// decided it, so that clients can show actionable error messages.  Quotas are neither checked
+	// nor consumed.
+	mux.Methods("POST").Path("/check_access").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin != "" {
+			w.Header().Set("access-control-allow-origin", origin)
+			w.Header().Set("vary", "origin")
+		}
+		var tokenRequest GcsTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&tokenRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tokenRequest.Dataset != "" {
+			if tokenRequest.Bucket != "" || tokenRequest.Prefix != "" {
+				http.Error(w, "Specify either dataset or bucket", http.StatusBadRequest)
+				return
+			}
+			dataset := auth.Datasets.Get(tokenRequest.Dataset)
+			if dataset == nil {
+				http.Error(w, "Unknown dataset", http.StatusNotFound)
+				return
+			}
+			tokenRequest.Bucket = dataset.Bucket
+			tokenRequest.Prefix = dataset.Prefix
+		}
+		if !isValidObjectPrefix(tokenRequest.Prefix) {
+			http.Error(w, "Invalid prefix", http.StatusBadRequest)
+			return
+		}
+		if tokenRequest.Mode == "" {
+			tokenRequest.Mode = readMode
+		}
+		if !isValidMode(tokenRequest.Mode) {
+			http.Error(w, "Invalid mode", http.StatusBadRequest)
+			return
+		}
+		userToken, err := auth.resolveRequestUserToken(r, tokenRequest.Token)
+		if err != nil {
+			log.Printf("Invalid authentication token: %+v", err)
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		response := checkAccessResponse{
+			Bucket: tokenRequest.Bucket,
+			Prefix: tokenRequest.Prefix,
+			Mode:   tokenRequest.Mode,
+		}
+		respond := func() {
+			w.Header().Set("content-type", "application/json")
+			w.Header().Set("cache-control", "no-store")
+			json.NewEncoder(w).Encode(&response)
+		}
+		if !auth.BucketFilter.IsBrokered(tokenRequest.Bucket) {
+			response.DecidedBy = "bucket_filter"
+			response.Reason = "Bucket not served by this server"
+			response.Remediation = "Use the ngauth server configured for this bucket"
+			respond()
+			return
+		}
+		if denial := auth.checkEncryptedBucket(tokenRequest.Bucket); denial != nil {
+			response.DecidedBy = denial.check
+			response.Reason = denial.message
+			response.Remediation = denial.remediation
+			respond()
+			return
+		}
+		denial, err := auth.checkTokenPolicies(r, origin, &userToken, &tokenRequest)
+		if err != nil {
+			http.Error(w, denial.message, denial.status)
+			return
+		}
+		if denial != nil {
+			response.DecidedBy = denial.check
+			response.Reason = denial.message
+			response.Remediation = denial.remediation
+			respond()
+			return
+		}
+		granted, prefixes, _, source, err := auth.authorizeStorageAccess(r, &userToken, &tokenRequest)
+		if err != nil {
+			http.Error(w, "Failed to query bucket permissions", http.StatusInternalServerError)
+			log.Printf("Error querying permissions, user=%s, bucket=%s, err=%+v", userToken.UserId, tokenRequest.Bucket, err)
+			return
+		}
+		response.DecidedBy = source
+		response.Reason = storageAccessSourceReasons[source]
+		if source == "authorization_mode" {
+			response.Reason += getEnvOr("AUTHORIZATION_MODE", "troubleshooter")
+		}
+		if auth.PolicyHook != nil {
+			hookGranted, err := auth.PolicyHook.IsAllowed(r.Context(), makePolicyInput(r, &userToken, &tokenRequest, granted))
+			if err != nil {
+				http.Error(w, "Failed to evaluate access policy", http.StatusInternalServerError)
+				log.Printf("Error evaluating access policy, user=%s, bucket=%s, err=%+v", userToken.UserId, tokenRequest.Bucket, err)
+				return
+			}
+			if hookGranted != granted {
+				granted = hookGranted
+				response.DecidedBy = "policy_hook"
+				response.Reason = "Decided by the access policy"
+			}
+		}
+		response.Granted = granted
+		if !granted {
+			if userToken.UserId == anonymousUserId {
+				response.Remediation = "Log in"
+			} else if auth.GrantsDatabase != nil {
+				response.Remediation = "Request access at /access_requests"
+			} else {
+				response.Remediation = "Ask an administrator of the bucket to grant you access"
+			}
+		} else {
+			response.Prefixes = prefixes
+		}
+		respond()
+	})
+}
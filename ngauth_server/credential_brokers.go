@@ -0,0 +1,246 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	gorilla_mux "github.com/gorilla/mux"
+
+	"ngauth/broker"
+)
+
+// Credential brokers: each storage backend for which ngauth issues credentials, e.g. GCS access
+// tokens or S3 credentials, implements CredentialBroker.  The backends built into the server are
+// listed in credentialBrokerFactories, and others, in their own packages, register with
+// broker.RegisterCredentialBroker and depend only on broker.Host.  /credentials/BROKER serves
+// requests for any broker, so that a backend is added without changes to the router; the
+// backend-specific endpoints, e.g. /s3_token, remain as aliases.
+
+// CredentialRequest is a request for a credential for a resource of a broker.  Options specific to
+// a broker, e.g. the S3Target of the s3 broker, are only decoded by that broker.
+type CredentialRequest = broker.Request
+
+// CredentialBroker issues credentials for the resources of one storage backend.
+type CredentialBroker interface {
+	// CheckAccess authenticates and authorizes request, and returns nil if a credential would be
+	// issued, without issuing it.
+	CheckAccess(r *http.Request, origin string, request *CredentialRequest) *credentialError
+
+	// IssueCredential authenticates and authorizes request, and returns the credential, which is
+	// returned to the client as JSON.
+	IssueCredential(r *http.Request, origin string, request *CredentialRequest) (interface{}, *credentialError)
+}
+
+// credentialBrokerFactories returns the broker of each backend, or nil if the backend is not
+// configured.
+var credentialBrokerFactories = map[string]func(auth *Authenticator) CredentialBroker{
+	"gcs":       makeGcsBroker,
+	"s3":        makeS3BucketBroker,
+	"swift":     makeSwiftBroker,
+	"http":      makeHttpGatewayBroker,
+	"dvid":      makeDvidBroker,
+	"boss":      makeBossBroker,
+	"brainmaps": makeBrainmapsBroker,
+}
+
+// makeCredentialBrokers returns the brokers of the configured backends, built in or registered, by
+// name.
+func makeCredentialBrokers(auth *Authenticator) (map[string]CredentialBroker, error) {
+	brokers := make(map[string]CredentialBroker)
+	for name, factory := range credentialBrokerFactories {
+		if builtIn := factory(auth); builtIn != nil {
+			brokers[name] = builtIn
+		}
+	}
+	for _, name := range broker.Names() {
+		if credentialBrokerFactories[name] != nil {
+			return nil, fmt.Errorf("Credential broker %q is already built in", name)
+		}
+		registered, err := broker.Lookup(name)(&brokerHost{auth: auth, name: name})
+		if err != nil {
+			return nil, fmt.Errorf("Error configuring credential broker %q: %w", name, err)
+		}
+		if registered != nil {
+			brokers[name] = &registeredBroker{broker: registered}
+		}
+	}
+	return brokers, nil
+}
+
+// brokerHost authenticates and authorizes the requests of a registered broker.
+type brokerHost struct {
+	auth *Authenticator
+	name string
+}
+
+func (h *brokerHost) Authorize(r *http.Request, origin string, request *broker.Request, members []string) (string, *broker.Error) {
+	auth := h.auth
+	userToken, tokenErr := auth.authenticateCredentialRequest(r, request)
+	if tokenErr != nil {
+		return "", &broker.Error{Status: tokenErr.status, Message: tokenErr.message}
+	}
+	if auth.DenyRules.IsDenied(userToken, "", origin, userToken.Origin) || !auth.OriginPolicies.AllowsOrigin(userToken, origin) {
+		return "", &broker.Error{Status: http.StatusForbidden, Message: "Access denied"}
+	}
+	if !hasMember(members, userToken) {
+		log.Printf("AUDIT: %s denied %s credential for %q", userToken.UserId, h.name, request.Resource)
+		return "", &broker.Error{Status: http.StatusForbidden, Message: "Access denied"}
+	}
+	return userToken.UserId, nil
+}
+
+// registeredBroker adapts a broker registered with broker.RegisterCredentialBroker to
+// CredentialBroker.
+type registeredBroker struct {
+	broker broker.Broker
+}
+
+func makeBrokerCredentialError(err *broker.Error) *credentialError {
+	if err == nil {
+		return nil
+	}
+	return &credentialError{status: err.Status, message: err.Message, retryAfter: err.RetryAfter}
+}
+
+func (b *registeredBroker) CheckAccess(r *http.Request, origin string, request *CredentialRequest) *credentialError {
+	return makeBrokerCredentialError(b.broker.CheckAccess(r, origin, request))
+}
+
+func (b *registeredBroker) IssueCredential(r *http.Request, origin string, request *CredentialRequest) (interface{}, *credentialError) {
+	credential, err := b.broker.IssueCredential(r, origin, request)
+	return credential, makeBrokerCredentialError(err)
+}
+
+// authenticateCredentialRequest returns the user token of request.
+func (auth *Authenticator) authenticateCredentialRequest(r *http.Request, request *CredentialRequest) (*UserToken, *credentialError) {
+	userToken, err := auth.resolveRequestUserToken(r, request.Token)
+	if err != nil {
+		log.Printf("Invalid authentication token: %+v", err)
+		return nil, &credentialError{status: http.StatusUnauthorized, message: "Invalid authentication token"}
+	}
+	return &userToken, nil
+}
+
+// allowCredentialOrigin allows the origin of r, if any, to read the response, as for /gcs_token,
+// and returns it.
+func allowCredentialOrigin(w http.ResponseWriter, r *http.Request) string {
+	origin := r.Header.Get("origin")
+	if origin != "" {
+		w.Header().Set("access-control-allow-origin", origin)
+		w.Header().Set("vary", "origin")
+	}
+	return origin
+}
+
+// serveCredentialRequest issues a credential from broker for request, made by r from origin, and
+// writes the response.
+func serveCredentialRequest(w http.ResponseWriter, r *http.Request, origin string, broker CredentialBroker, request *CredentialRequest) {
+	credential, tokenErr := broker.IssueCredential(r, origin, request)
+	if tokenErr != nil {
+		tokenErr.write(w)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	json.NewEncoder(w).Encode(credential)
+}
+
+func (auth *Authenticator) addCredentialBrokerRoutes(mux *gorilla_mux.Router) {
+	// Returns a credential from the named broker, for a CredentialRequest.
+	mux.Methods("POST").Path("/credentials/{broker}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowCredentialOrigin(w, r)
+		broker := auth.CredentialBrokers[gorilla_mux.Vars(r)["broker"]]
+		if broker == nil {
+			http.Error(w, "Unknown credential broker", http.StatusNotFound)
+			return
+		}
+		var request CredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveCredentialRequest(w, r, origin, broker, &request)
+	})
+
+	// Checks whether the named broker would issue a credential for a CredentialRequest, and returns
+	// 204 if so, or the error response.
+	mux.Methods("POST").Path("/credentials/{broker}/check").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowCredentialOrigin(w, r)
+		broker := auth.CredentialBrokers[gorilla_mux.Vars(r)["broker"]]
+		if broker == nil {
+			http.Error(w, "Unknown credential broker", http.StatusNotFound)
+			return
+		}
+		var request CredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tokenErr := broker.CheckAccess(r, origin, &request); tokenErr != nil {
+			tokenErr.write(w)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// gcsBroker issues access tokens for GCS buckets, as /gcs_token does.
+type gcsBroker struct {
+	auth *Authenticator
+}
+
+func makeGcsBroker(auth *Authenticator) CredentialBroker {
+	return &gcsBroker{auth: auth}
+}
+
+func (b *gcsBroker) tokenRequest(request *CredentialRequest) GcsTokenRequest {
+	return GcsTokenRequest{Token: request.Token, Bucket: request.Resource, Prefix: request.Prefix, Mode: request.Mode}
+}
+
+func (b *gcsBroker) CheckAccess(r *http.Request, origin string, request *CredentialRequest) *credentialError {
+	auth := b.auth
+	tokenRequest := b.tokenRequest(request)
+	if !auth.BucketFilter.IsBrokered(tokenRequest.Bucket) {
+		return &credentialError{status: http.StatusForbidden, message: "Bucket not served by this server"}
+	}
+	if denial := auth.checkEncryptedBucket(tokenRequest.Bucket); denial != nil {
+		return &credentialError{status: denial.status, message: denial.message + "; " + denial.remediation}
+	}
+	if !isValidObjectPrefix(tokenRequest.Prefix) {
+		return &credentialError{status: http.StatusBadRequest, message: "Invalid prefix"}
+	}
+	if !isValidMode(tokenRequest.Mode) {
+		return &credentialError{status: http.StatusBadRequest, message: "Invalid mode"}
+	}
+	if tokenRequest.Mode != writeMode && auth.IsPublicBucket(tokenRequest.Bucket) {
+		return nil
+	}
+	userToken, tokenErr := auth.authenticateCredentialRequest(r, request)
+	if tokenErr != nil {
+		return tokenErr
+	}
+	if denial, _ := auth.checkTokenPolicies(r, origin, userToken, &tokenRequest); denial != nil {
+		return &credentialError{status: denial.status, message: denial.message, challenge: denial.challenge}
+	}
+	_, _, tokenErr = auth.authorizeGcsToken(r, userToken, &tokenRequest)
+	return tokenErr
+}
+
+func (b *gcsBroker) IssueCredential(r *http.Request, origin string, request *CredentialRequest) (interface{}, *credentialError) {
+	return b.auth.issueGcsToken(r, origin, b.tokenRequest(request), false)
+}
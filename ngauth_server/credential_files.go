@@ -0,0 +1,303 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Credential files, for Python and command-line tools such as cloud-volume and tensorstore: as
+// with `gcloud auth application-default login`, the user authorizes the tool once using the device
+// flow, and the tool saves a credential file containing a long-lived refresh token, which it
+// exchanges for short-lived ngauth tokens as needed.  A refresh token has the form
+// "ngrt_ID.SECRET"; only a hash of the secret is stored.
+
+const refreshTokenPrefix = "ngrt_"
+
+const refreshTokenGrantType = "refresh_token"
+
+// Value of the "type" member of credential files.
+const credentialFileType = "ngauth_refresh_token"
+
+// 1 year
+const credentialLifetimeSeconds = 60 * 60 * 24 * 365
+
+// Minimum interval between updates of the last use time of a credential.
+const credentialLastUsedInterval = time.Hour
+
+type storedCredential struct {
+	Id           string `json:"id"`
+	SecretSha256 string `json:"secretSha256"`
+
+	// Template for the tokens issued on refresh.  The template has its own session id, so that
+	// logging out of the browser session that approved the device does not revoke the credential.
+	UserToken UserToken `json:"userToken"`
+
+	Created  int64 `json:"created"`
+	Expires  int64 `json:"expires"`
+	LastUsed int64 `json:"lastUsed,omitempty"`
+}
+
+// credentialFile is the documented format of credential files.
+type credentialFile struct {
+	Type         string `json:"type"`
+	Server       string `json:"server"`
+	TokenUri     string `json:"token_uri"`
+	RefreshToken string `json:"refresh_token"`
+	UserId       string `json:"user_id"`
+
+	// Expiry time of the refresh token, in seconds since the epoch.
+	Expires int64 `json:"expires"`
+}
+
+func credentialKey(id string) string {
+	return "credentials/by_id/" + id
+}
+
+func credentialUserPrefix(userId string) string {
+	return "credentials/by_user/" + userId + "/"
+}
+
+// getCredential returns the stored credential for a refresh token.
+func (auth *Authenticator) getCredential(ctx context.Context, refreshToken string) (*storedCredential, error) {
+	parts := strings.SplitN(strings.TrimPrefix(refreshToken, refreshTokenPrefix), ".", 2)
+	if !strings.HasPrefix(refreshToken, refreshTokenPrefix) || len(parts) != 2 {
+		return nil, fmt.Errorf("Malformed refresh token")
+	}
+	var credential storedCredential
+	if err := auth.Store.Get(ctx, credentialKey(parts[0]), &credential); err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashPersonalAccessTokenSecret(parts[1])), []byte(credential.SecretSha256)) != 1 {
+		return nil, fmt.Errorf("Invalid refresh token")
+	}
+	if credential.Expires < time.Now().Unix() {
+		return nil, fmt.Errorf("Refresh token expired")
+	}
+	return &credential, nil
+}
+
+func (auth *Authenticator) deleteCredential(ctx context.Context, credential *storedCredential) error {
+	if err := auth.Store.Delete(ctx, credentialUserPrefix(credential.UserToken.UserId)+credential.Id); err != nil && err != errStoreNotFound {
+		return err
+	}
+	if err := auth.Store.Delete(ctx, credentialKey(credential.Id)); err != nil && err != errStoreNotFound {
+		return err
+	}
+	return nil
+}
+
+// createCredential stores a credential for the user of approved, and returns its refresh token.
+func (auth *Authenticator) createCredential(ctx context.Context, approved *UserToken) (string, *storedCredential, error) {
+	idBytes := make([]byte, 12)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		panic(err)
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		panic(err)
+	}
+	id := base64url.EncodeToString(idBytes)
+	secret := base64url.EncodeToString(secretBytes)
+	now := time.Now().Unix()
+	credential := &storedCredential{
+		Id:           id,
+		SecretSha256: hashPersonalAccessTokenSecret(secret),
+		// As for personal access tokens, tokens obtained from a credential never satisfy a second
+		// factor requirement.
+		UserToken: UserToken{
+			UserId:        approved.UserId,
+			LinkedUserIds: approved.LinkedUserIds,
+			Groups:        approved.Groups,
+			Name:          approved.Name,
+			Picture:       approved.Picture,
+			Claims:        approved.Claims,
+			SessionId:     makeSessionId(),
+			IssuedAt:      now,
+		},
+		Created: now,
+		Expires: now + credentialLifetimeSeconds,
+	}
+	err := auth.Store.Put(ctx, credentialKey(id), credential)
+	if err == nil {
+		err = auth.Store.Put(ctx, credentialUserPrefix(approved.UserId)+id, struct{}{})
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return refreshTokenPrefix + id + "." + secret, credential, nil
+}
+
+func (auth *Authenticator) listCredentials(ctx context.Context, userId string) (credentials []storedCredential, err error) {
+	prefix := credentialUserPrefix(userId)
+	keys, err := auth.Store.List(ctx, prefix)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		var credential storedCredential
+		err = auth.Store.Get(ctx, credentialKey(strings.TrimPrefix(key, prefix)), &credential)
+		if err == errStoreNotFound {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		credentials = append(credentials, credential)
+	}
+	err = nil
+	return
+}
+
+func (auth *Authenticator) addCredentialFileRoutes(mux *gorilla_mux.Router) {
+	// Polled like /device_token, but returns a credential file once the user approves the device.
+	mux.Methods("POST").Path("/device_credentials").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		approved := auth.pollDeviceAuthorization(w, r)
+		if approved == nil {
+			return
+		}
+		if approved.ImpersonatedBy != "" {
+			writeOAuth2Error(w, "access_denied")
+			return
+		}
+		refreshToken, credential, err := auth.createCredential(r.Context(), approved)
+		if err != nil {
+			log.Printf("Error storing credential for %s: %v", approved.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Created credential %s for %s", credential.Id, approved.UserId)
+		baseURL := getBaseURL(r)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(credentialFile{
+			Type:         credentialFileType,
+			Server:       baseURL,
+			TokenUri:     baseURL + "/credentials/refresh",
+			RefreshToken: refreshToken,
+			UserId:       approved.UserId,
+			Expires:      credential.Expires,
+		})
+	})
+
+	mux.Methods("POST").Path("/credentials/refresh").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		if r.PostForm.Get("grant_type") != refreshTokenGrantType {
+			writeOAuth2Error(w, "unsupported_grant_type")
+			return
+		}
+		audience := r.PostForm.Get("audience")
+		if !auth.isTokenAudienceAllowed(audience) {
+			writeOAuth2Error(w, "invalid_target")
+			return
+		}
+		credential, err := auth.getCredential(r.Context(), r.PostForm.Get("refresh_token"))
+		if err != nil {
+			log.Printf("Invalid refresh token: %v", err)
+			writeOAuth2Error(w, "invalid_grant")
+			return
+		}
+		if auth.Revocations.IsRevoked(r.Context(), &credential.UserToken) {
+			if err := auth.deleteCredential(r.Context(), credential); err != nil {
+				log.Printf("Error deleting revoked credential %s: %v", credential.Id, err)
+			}
+			writeOAuth2Error(w, "invalid_grant")
+			return
+		}
+		now := time.Now()
+		if now.Sub(time.Unix(credential.LastUsed, 0)) >= credentialLastUsedInterval {
+			credential.LastUsed = now.Unix()
+			if err := auth.Store.Put(r.Context(), credentialKey(credential.Id), credential); err != nil {
+				log.Printf("Error updating credential %s: %v", credential.Id, err)
+			}
+		}
+		lifetime := auth.TokenLifetimes.CrossOriginLifetimeSeconds("")
+		userToken := credential.UserToken
+		userToken.Expires = now.Unix() + lifetime
+		if credential.Expires < userToken.Expires {
+			userToken.Expires = credential.Expires
+		}
+		userToken.Audience = audience
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": auth.EncodeClientToken(userToken),
+			"token_type":   "Bearer",
+			"expires_in":   userToken.Expires - now.Unix(),
+		})
+	})
+
+	// Revokes a credential, e.g. when the tool logs out.
+	mux.Methods("POST").Path("/credentials/revoke").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		credential, err := auth.getCredential(r.Context(), r.PostForm.Get("refresh_token"))
+		if err != nil {
+			writeOAuth2Error(w, "invalid_grant")
+			return
+		}
+		if err := auth.deleteCredential(r.Context(), credential); err != nil {
+			log.Printf("Error deleting credential %s: %v", credential.Id, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		// Tokens already issued from the credential are no longer valid either.
+		if err := auth.Revocations.RevokeSession(r.Context(), &credential.UserToken); err != nil {
+			log.Printf("Error revoking credential %s: %v", credential.Id, err)
+		}
+		log.Printf("Revoked credential %s of %s", credential.Id, credential.UserToken.UserId)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.Methods("GET").Path("/credentials").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getUserTokenFromCookie(r)
+		if userToken == nil {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		credentials, err := auth.listCredentials(r.Context(), userToken.UserId)
+		if err != nil {
+			log.Printf("Error listing credentials for %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		type credentialInfo struct {
+			Id       string `json:"id"`
+			Created  int64  `json:"created"`
+			Expires  int64  `json:"expires"`
+			LastUsed int64  `json:"lastUsed,omitempty"`
+		}
+		infos := []credentialInfo{}
+		for _, credential := range credentials {
+			infos = append(infos, credentialInfo{Id: credential.Id, Created: credential.Created, Expires: credential.Expires, LastUsed: credential.LastUsed})
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	})
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Credential routes: a deployment serving several backends may map datasource URLs, e.g.
+// "gs://lab-bucket/...", "s3://..." or "https://dvid.example.org/...", to the broker and resource
+// that serve them, so that the client requests a credential for a URL from /credential without
+// knowing how the deployment is configured.
+
+// CredentialRoute maps the datasource URLs starting with Url to a broker.
+type CredentialRoute struct {
+	// Prefix of the datasource URLs, e.g. "gs://lab-bucket/" or "s3://".
+	Url string `json:"url"`
+
+	// Name of the broker, as for /credentials/BROKER.
+	Broker string `json:"broker"`
+
+	// Resource of the broker, or "" to use the first path component following Url, e.g. the bucket
+	// of "gs://BUCKET/PATH" for the route "gs://".
+	Resource string `json:"resource,omitempty"`
+
+	// Prefix of the credential, or "" to use the rest of the URL as the object name prefix, for the
+	// brokers that limit credentials by prefix.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Members, as for role bindings, who may use the route, in addition to the checks of the
+	// broker, or empty to not restrict it.
+	Members []string `json:"members,omitempty"`
+
+	// Regular expression matching the origins, as for the allowed origins, from which the route
+	// may be used, or "" to not restrict it.
+	Origin string `json:"origin,omitempty"`
+
+	// If true, only read credentials are issued.
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	originPattern *regexp.Regexp
+}
+
+// CredentialRoutes maps datasource URLs to brokers.  The route with the longest matching Url
+// applies.
+type CredentialRoutes []*CredentialRoute
+
+// objectPrefixBrokers are the brokers whose credentials are limited to an object name prefix.
+var objectPrefixBrokers = map[string]bool{
+	"gcs":   true,
+	"s3":    true,
+	"swift": true,
+}
+
+// loadCredentialRoutes loads the routes specified by CREDENTIAL_ROUTES_PATH, each of which must
+// name one of brokers.
+func loadCredentialRoutes(brokers map[string]CredentialBroker) (CredentialRoutes, error) {
+	routesPath, ok := os.LookupEnv("CREDENTIAL_ROUTES_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(routesPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading credential routes from %s: %w", routesPath, err)
+	}
+	var routes CredentialRoutes
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("Error parsing credential routes from %s: %w", routesPath, err)
+	}
+	for _, route := range routes {
+		if !strings.Contains(route.Url, "://") {
+			return nil, fmt.Errorf("Credential route %q must specify a URL prefix including the scheme", route.Url)
+		}
+		if brokers[route.Broker] == nil {
+			return nil, fmt.Errorf("Credential route %q specifies unconfigured broker %q", route.Url, route.Broker)
+		}
+		if route.Origin != "" {
+			if route.originPattern, err = regexp.Compile(route.Origin); err != nil {
+				return nil, fmt.Errorf("Invalid origin pattern %q: %w", route.Origin, err)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// Match returns the route of datasourceUrl, and the resource and prefix of its credential, or nil
+// if no route matches.
+func (routes CredentialRoutes) Match(datasourceUrl string) (*CredentialRoute, string, string) {
+	var match *CredentialRoute
+	for _, route := range routes {
+		if strings.HasPrefix(datasourceUrl, route.Url) && (match == nil || len(route.Url) > len(match.Url)) {
+			match = route
+		}
+	}
+	if match == nil {
+		return nil, "", ""
+	}
+	rest := strings.TrimPrefix(datasourceUrl, match.Url)
+	resource := match.Resource
+	if resource == "" {
+		rest = strings.TrimPrefix(rest, "/")
+		if i := strings.Index(rest, "/"); i >= 0 {
+			resource, rest = rest[:i], rest[i+1:]
+		} else {
+			resource, rest = rest, ""
+		}
+	}
+	prefix := match.Prefix
+	if prefix == "" && objectPrefixBrokers[match.Broker] {
+		prefix = strings.TrimPrefix(rest, "/")
+	}
+	return match, resource, prefix
+}
+
+// routedCredentialRequest is a request to /credential.
+type routedCredentialRequest struct {
+	// Authentication token, as for /gcs_token.
+	Token string `json:"token"`
+
+	// Datasource URL, e.g. "gs://lab-bucket/fly-brain".
+	Url string `json:"url"`
+
+	Mode      string `json:"mode,omitempty"`
+	ExpiresIn int64  `json:"expiresIn,omitempty"`
+}
+
+// resolveCredentialRoute returns the broker and CredentialRequest of request, after checking the
+// policies of its route.  r must have a consumed token memo, as the broker authenticates the
+// request again.
+func (auth *Authenticator) resolveCredentialRoute(r *http.Request, origin string, request *routedCredentialRequest) (*CredentialRoute, *CredentialRequest, *credentialError) {
+	route, resource, prefix := auth.CredentialRoutes.Match(request.Url)
+	if route == nil {
+		return nil, nil, &credentialError{status: http.StatusNotFound, message: "Datasource not served by this server"}
+	}
+	credentialRequest := &CredentialRequest{
+		Token:     request.Token,
+		Resource:  resource,
+		Prefix:    prefix,
+		Mode:      request.Mode,
+		ExpiresIn: request.ExpiresIn,
+	}
+	if route.ReadOnly && request.Mode == writeMode {
+		return nil, nil, &credentialError{status: http.StatusForbidden, message: "Datasource is read-only"}
+	}
+	if route.originPattern != nil && (origin == "" || !route.originPattern.MatchString(origin)) {
+		return nil, nil, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	if len(route.Members) != 0 {
+		userToken, tokenErr := auth.authenticateCredentialRequest(r, credentialRequest)
+		if tokenErr != nil {
+			return nil, nil, tokenErr
+		}
+		if !hasMember(route.Members, userToken) {
+			log.Printf("AUDIT: %s denied credential for %q by route %q", userToken.UserId, request.Url, route.Url)
+			return nil, nil, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+		}
+	}
+	return route, credentialRequest, nil
+}
+
+func (auth *Authenticator) addCredentialRouteRoutes(mux *gorilla_mux.Router) {
+	// Returns a credential for a datasource URL from the broker of its route, with the broker,
+	// resource and prefix for which it was issued.
+	mux.Methods("POST").Path("/credential").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowCredentialOrigin(w, r)
+		var request routedCredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r = withConsumedTokenMemo(r)
+		route, credentialRequest, tokenErr := auth.resolveCredentialRoute(r, origin, &request)
+		if tokenErr != nil {
+			tokenErr.write(w)
+			return
+		}
+		credential, tokenErr := auth.CredentialBrokers[route.Broker].IssueCredential(r, origin, credentialRequest)
+		if tokenErr != nil {
+			tokenErr.write(w)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"broker":     route.Broker,
+			"resource":   credentialRequest.Resource,
+			"prefix":     credentialRequest.Prefix,
+			"credential": credential,
+		})
+	})
+
+	// Checks whether /credential would issue a credential for the same request, and returns 204 if
+	// so, or the error response.
+	mux.Methods("POST").Path("/credential/check").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowCredentialOrigin(w, r)
+		var request routedCredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r = withConsumedTokenMemo(r)
+		route, credentialRequest, tokenErr := auth.resolveCredentialRoute(r, origin, &request)
+		if tokenErr == nil {
+			tokenErr = auth.CredentialBrokers[route.Broker].CheckAccess(r, origin, credentialRequest)
+		}
+		if tokenErr != nil {
+			tokenErr.write(w)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
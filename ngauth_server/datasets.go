@@ -0,0 +1,188 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dataset is a named location in GCS, so that clients can request access tokens by dataset id
+// rather than by bucket, and datasets can be moved without changing clients.
+type Dataset struct {
+	Bucket string `json:"bucket"`
+
+	// Object name prefix, or "" for the whole bucket.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Members, as for role bindings, who may read the dataset.  If neither readers nor writers
+	// are specified, access is determined as for requests by bucket.
+	Readers []string `json:"readers,omitempty"`
+
+	// Members who may read and write the dataset.
+	Writers []string `json:"writers,omitempty"`
+
+	// Text of a data use agreement that users must accept before obtaining access tokens, or "".
+	Agreement string `json:"agreement,omitempty"`
+
+	// Service account, with access to only this dataset, whose impersonated tokens are downscoped
+	// for the dataset, or "" to use the credentials of the bucket.
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+}
+
+// hasAccessControl returns true if the dataset's own members determine access.
+func (d *Dataset) hasAccessControl() bool {
+	return d.Readers != nil || d.Writers != nil
+}
+
+// Allows returns true if the dataset's members grant the user access in mode.
+func (d *Dataset) Allows(userToken *UserToken, mode string) bool {
+	if hasMember(d.Writers, userToken) {
+		return true
+	}
+	return mode != writeMode && hasMember(d.Readers, userToken)
+}
+
+// DatasetRegistry maps dataset ids to datasets, as specified by the JSON object in the file at
+// DATASETS_PATH.  The file is reloaded whenever it is modified.
+type DatasetRegistry struct {
+	path string
+
+	mutex    sync.Mutex
+	modTime  time.Time
+	datasets map[string]*Dataset
+}
+
+// reload reads the registry file if it has been modified since it was last read.
+func (d *DatasetRegistry) reload() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(d.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	var datasets map[string]*Dataset
+	if err := json.Unmarshal(data, &datasets); err != nil {
+		return err
+	}
+	for id, dataset := range datasets {
+		if dataset.Bucket == "" || strings.Contains(dataset.Bucket, "/") || !isValidObjectPrefix(dataset.Prefix) {
+			return fmt.Errorf("Invalid location for dataset %q", id)
+		}
+		if dataset.ServiceAccount != "" && !strings.Contains(dataset.ServiceAccount, "@") {
+			return fmt.Errorf("Invalid service account %q for dataset %q", dataset.ServiceAccount, id)
+		}
+		for _, members := range [][]string{dataset.Readers, dataset.Writers} {
+			for i, member := range members {
+				member = strings.ToLower(member)
+				if _, err := path.Match(member, ""); err != nil {
+					return fmt.Errorf("Invalid member pattern %q for dataset %q: %w", member, id, err)
+				}
+				members[i] = member
+			}
+		}
+	}
+	d.datasets = datasets
+	d.modTime = info.ModTime()
+	return nil
+}
+
+func loadDatasetRegistry() (*DatasetRegistry, error) {
+	path, ok := os.LookupEnv("DATASETS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	registry := &DatasetRegistry{path: path}
+	if err := registry.reload(); err != nil {
+		return nil, fmt.Errorf("Error reading datasets from %s: %w", path, err)
+	}
+	return registry, nil
+}
+
+// Get returns the dataset with the specified id, or nil if there is no such dataset.
+func (d *DatasetRegistry) Get(id string) *Dataset {
+	if d == nil || id == "" {
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.reload(); err != nil {
+		// Continue to use the previously-loaded datasets.
+		log.Printf("Error reloading datasets from %s: %v", d.path, err)
+	}
+	return d.datasets[id]
+}
+
+// GetAgreements returns the datasets with data use agreements that include any objects in bucket
+// whose names start with prefix, keyed by dataset id.
+func (d *DatasetRegistry) GetAgreements(bucket string, prefix string) map[string]*Dataset {
+	if d == nil {
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.reload(); err != nil {
+		// Continue to use the previously-loaded datasets.
+		log.Printf("Error reloading datasets from %s: %v", d.path, err)
+	}
+	datasets := make(map[string]*Dataset)
+	for id, dataset := range d.datasets {
+		if dataset.Agreement == "" || dataset.Bucket != bucket {
+			continue
+		}
+		if strings.HasPrefix(prefix, dataset.Prefix) || strings.HasPrefix(dataset.Prefix, prefix) {
+			datasets[id] = dataset
+		}
+	}
+	return datasets
+}
+
+// GetServiceAccount returns the service account of the most specific dataset that includes all
+// objects in bucket whose names start with prefix, or "" if no such dataset has a service account.
+func (d *DatasetRegistry) GetServiceAccount(bucket string, prefix string) string {
+	if d == nil {
+		return ""
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.reload(); err != nil {
+		// Continue to use the previously-loaded datasets.
+		log.Printf("Error reloading datasets from %s: %v", d.path, err)
+	}
+	var match *Dataset
+	for _, dataset := range d.datasets {
+		if dataset.ServiceAccount == "" || dataset.Bucket != bucket || !strings.HasPrefix(prefix, dataset.Prefix) {
+			continue
+		}
+		if match == nil || len(dataset.Prefix) > len(match.Prefix) {
+			match = dataset
+		}
+	}
+	if match == nil {
+		return ""
+	}
+	return match.ServiceAccount
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type denyRulesFile struct {
+	// Patterns, as for the login allowlist, matched against qualified user ids and email
+	// addresses.
+	Users []string `json:"users"`
+
+	// Bucket patterns, as for BUCKET_ALLOWLIST.
+	Buckets []string `json:"buckets"`
+
+	// Regular expressions matching origins.
+	Origins []string `json:"origins"`
+}
+
+// DenyRules lock out users, buckets and origins regardless of any other authorization, e.g. in
+// response to a compromised account.  The file is reloaded whenever it is modified, so that rules
+// take effect without a restart.
+type DenyRules struct {
+	path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	rules   denyRulesFile
+	origins []*regexp.Regexp
+}
+
+// reload reads the rules file if it has been modified since it was last read.
+func (d *DenyRules) reload() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(d.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	var rules denyRulesFile
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	for i, pattern := range rules.Users {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid user pattern %q: %w", pattern, err)
+		}
+		rules.Users[i] = pattern
+	}
+	for _, pattern := range rules.Buckets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid bucket pattern %q: %w", pattern, err)
+		}
+	}
+	var origins []*regexp.Regexp
+	for _, pattern := range rules.Origins {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid origin pattern %q: %w", pattern, err)
+		}
+		origins = append(origins, re)
+	}
+	d.rules = rules
+	d.origins = origins
+	d.modTime = info.ModTime()
+	return nil
+}
+
+func loadDenyRules() (*DenyRules, error) {
+	path, ok := os.LookupEnv("DENY_RULES_PATH")
+	if !ok {
+		return nil, nil
+	}
+	rules := &DenyRules{path: path}
+	if err := rules.reload(); err != nil {
+		return nil, fmt.Errorf("Error reading deny rules from %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func (d *DenyRules) deniesUser(userId string) bool {
+	if userId == "" {
+		return false
+	}
+	// Rules also match the id without the provider name, of any provider, since denying too much
+	// is safe.
+	_, id := SplitUserId(userId)
+	ids := []string{strings.ToLower(userId), strings.ToLower(id)}
+	for _, id := range ids {
+		for _, pattern := range d.rules.Users {
+			if matched, _ := path.Match(pattern, id); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsDenied returns true if any rule matches the user (including linked user ids and the
+// impersonating administrator), the bucket or any of origins.  Empty values are ignored.
+func (d *DenyRules) IsDenied(userToken *UserToken, bucket string, origins ...string) bool {
+	if d == nil {
+		return false
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.reload(); err != nil {
+		// Continue to use the previously-loaded rules.
+		log.Printf("Error reloading deny rules from %s: %v", d.path, err)
+	}
+	if userToken != nil {
+		for _, userId := range append(userToken.Principals(), userToken.ImpersonatedBy) {
+			if d.deniesUser(userId) {
+				log.Printf("Denied by deny rules: user %s", userId)
+				return true
+			}
+		}
+	}
+	if bucket != "" && matchesAnyPattern(d.rules.Buckets, bucket) {
+		log.Printf("Denied by deny rules: bucket %s", bucket)
+		return true
+	}
+	for _, origin := range origins {
+		if origin == "" {
+			continue
+		}
+		for _, re := range d.origins {
+			if re.MatchString(origin) {
+				log.Printf("Denied by deny rules: origin %s", origin)
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,329 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// OAuth 2.0 device authorization grant (RFC 8628), for scripts and other clients that cannot open
+// a browser on the same machine.  The client obtains a user code, which the user enters on the
+// /device page of the ngauth server in any browser, and then polls for a token.
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+const deviceCodeLifetime = 10 * time.Minute
+
+// Minimum interval between token requests, in seconds.
+const devicePollInterval = 5
+
+// 1 day
+const MaxUserTokenDeviceLifetimeSeconds = 60 * 60 * 24
+
+// Excludes vowels, to avoid forming words, and easily-confused characters.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+const userCodeLength = 8
+
+type deviceAuthorization struct {
+	Expires  int64 `json:"expires"`
+	LastPoll int64 `json:"lastPoll,omitempty"`
+}
+
+// deviceDecision records the user's decision on a request.  It is stored separately from the
+// deviceAuthorization, which is updated by each poll, and created only once.
+type deviceDecision struct {
+	// Set if the user approves the request.
+	Approved *UserToken `json:"approved,omitempty"`
+	Denied   bool       `json:"denied,omitempty"`
+}
+
+// Device codes are stored only as hashes.
+func hashDeviceCode(deviceCode string) string {
+	hash := sha256.Sum256([]byte(deviceCode))
+	return base64url.EncodeToString(hash[:])
+}
+
+func deviceCodeKey(deviceCodeHash string) string {
+	return "device/codes/" + deviceCodeHash
+}
+
+func deviceDecisionKey(deviceCodeHash string) string {
+	return "device/decisions/" + deviceCodeHash
+}
+
+// Created when the approved token is returned, so that it is returned only once.
+func deviceRedeemedKey(deviceCodeHash string) string {
+	return "device/redeemed/" + deviceCodeHash
+}
+
+func deviceUserCodeKey(userCode string) string {
+	return "device/user_codes/" + userCode
+}
+
+func generateUserCode() (string, error) {
+	var code strings.Builder
+	for i := 0; i < userCodeLength; i++ {
+		if i == userCodeLength/2 {
+			code.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// normalizeUserCode converts a user code as entered by the user to canonical form.
+func normalizeUserCode(userCode string) string {
+	var code strings.Builder
+	for _, c := range strings.ToUpper(userCode) {
+		if strings.ContainsRune(userCodeAlphabet, c) {
+			if code.Len() == userCodeLength/2 {
+				code.WriteByte('-')
+			}
+			code.WriteRune(c)
+		}
+	}
+	return code.String()
+}
+
+func getBaseURL(r *http.Request) string {
+	u := url.URL{Scheme: r.URL.Scheme, Host: r.Host}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	return u.String()
+}
+
+func writeOAuth2Error(w http.ResponseWriter, code string) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (auth *Authenticator) writeDevicePage(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Add("x-frame-options", "deny")
+	w.Header().Add("content-type", "text/html")
+	fmt.Fprint(w, `<html><head><title>Authorize device</title></head><body>`)
+	defer fmt.Fprint(w, "</body></html>")
+	if message != "" {
+		fmt.Fprintf(w, "<p>%s</p>\n", html.EscapeString(message))
+	}
+	userCode := normalizeUserCode(r.FormValue("user_code"))
+	userToken := auth.getUserTokenFromCookie(r)
+	if userToken == nil {
+		returnPath := "/device"
+		if userCode != "" {
+			returnPath += "?user_code=" + url.QueryEscape(userCode)
+		}
+		fmt.Fprintf(w, `Not logged in.  <a href="%s">Login</a>`, html.EscapeString("/login?return="+url.QueryEscape(returnPath)))
+		return
+	}
+	fmt.Fprintf(w, `<p>Logged in as %s</p>
+<p>Enter the code displayed by the application.  Only approve requests that you started yourself.</p>
+<form action="/device" method="post">
+<input type="hidden" name="token" value="%s">
+<input type="text" name="user_code" value="%s" autocomplete="off" autofocus>
+<input type="submit" name="action" value="Approve">
+<input type="submit" name="action" value="Deny">
+</form>
+`, html.EscapeString(userToken.UserId), html.EscapeString(EncodeUserToken(auth.UserTokenKey, formUserTokenType, auth.makeTemporaryUserToken(*userToken, ""))), html.EscapeString(userCode))
+}
+
+// pollDeviceAuthorization handles a device token request, and returns the token approved by the
+// user, or writes an error response if the request is not, or no longer, approved.  The device
+// code may only be redeemed once.
+func (auth *Authenticator) pollDeviceAuthorization(w http.ResponseWriter, r *http.Request) *UserToken {
+	if err := r.ParseForm(); err != nil {
+		writeOAuth2Error(w, "invalid_request")
+		return nil
+	}
+	if r.PostForm.Get("grant_type") != deviceCodeGrantType {
+		writeOAuth2Error(w, "unsupported_grant_type")
+		return nil
+	}
+	deviceCodeHash := hashDeviceCode(r.PostForm.Get("device_code"))
+	key := deviceCodeKey(deviceCodeHash)
+	var authorization deviceAuthorization
+	if err := auth.Store.Get(r.Context(), key, &authorization); err != nil {
+		writeOAuth2Error(w, "invalid_grant")
+		return nil
+	}
+	var decision deviceDecision
+	err := auth.Store.Get(r.Context(), deviceDecisionKey(deviceCodeHash), &decision)
+	if err != nil && err != errStoreNotFound {
+		log.Printf("Error reading device authorization: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return nil
+	}
+	now := time.Now().Unix()
+	switch {
+	case authorization.Expires < now:
+		writeOAuth2Error(w, "expired_token")
+	case decision.Denied:
+		writeOAuth2Error(w, "access_denied")
+	case decision.Approved != nil:
+		// Created atomically, so that concurrent polls cannot both obtain the token.
+		err := auth.Store.Create(r.Context(), deviceRedeemedKey(deviceCodeHash), authorization.Expires)
+		if err == errStoreExists {
+			writeOAuth2Error(w, "invalid_grant")
+			return nil
+		}
+		if err != nil {
+			log.Printf("Error redeeming device authorization: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return nil
+		}
+		auth.Store.Delete(r.Context(), key)
+		auth.Store.Delete(r.Context(), deviceDecisionKey(deviceCodeHash))
+		return decision.Approved
+	case now-authorization.LastPoll < devicePollInterval:
+		writeOAuth2Error(w, "slow_down")
+	default:
+		authorization.LastPoll = now
+		if err := auth.Store.Put(r.Context(), key, authorization); err != nil {
+			log.Printf("Error storing device authorization: %v", err)
+		}
+		writeOAuth2Error(w, "authorization_pending")
+	}
+	return nil
+}
+
+func (auth *Authenticator) addDeviceAuthorizationRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("POST").Path("/device_authorize").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceCodeBytes := make([]byte, 32)
+		if _, err := rand.Read(deviceCodeBytes); err != nil {
+			panic(err)
+		}
+		deviceCode := base64url.EncodeToString(deviceCodeBytes)
+		userCode, err := generateUserCode()
+		if err != nil {
+			panic(err)
+		}
+		deviceCodeHash := hashDeviceCode(deviceCode)
+		authorization := deviceAuthorization{Expires: time.Now().Add(deviceCodeLifetime).Unix()}
+		err = auth.Store.Put(r.Context(), deviceCodeKey(deviceCodeHash), authorization)
+		if err == nil {
+			err = auth.Store.Put(r.Context(), deviceUserCodeKey(userCode), deviceCodeHash)
+		}
+		if err != nil {
+			log.Printf("Error storing device authorization: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		verificationURI := getBaseURL(r) + "/device"
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":               deviceCode,
+			"user_code":                 userCode,
+			"verification_uri":          verificationURI,
+			"verification_uri_complete": verificationURI + "?user_code=" + url.QueryEscape(userCode),
+			"expires_in":                int64(deviceCodeLifetime.Seconds()),
+			"interval":                  devicePollInterval,
+		})
+	})
+
+	mux.Methods("GET").Path("/device").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.writeDevicePage(w, r, "")
+	})
+
+	mux.Methods("POST").Path("/device").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form", http.StatusBadRequest)
+			return
+		}
+		// As for /logout, the form must include a token for the logged-in user, to prevent
+		// cross-site request forgery.
+		userToken := auth.getUserTokenFromCookie(r)
+		formToken, err := DecodeUserToken(auth.UserTokenKey, formUserTokenType, r.PostForm.Get("token"))
+		if userToken == nil || err != nil || formToken.UserId != userToken.UserId {
+			auth.writeDevicePage(w, r, "Login session expired.")
+			return
+		}
+		userCode := normalizeUserCode(r.PostForm.Get("user_code"))
+		var deviceCodeHash string
+		if err := auth.Store.Get(r.Context(), deviceUserCodeKey(userCode), &deviceCodeHash); err != nil {
+			auth.writeDevicePage(w, r, "Invalid code.")
+			return
+		}
+		var authorization deviceAuthorization
+		if err := auth.Store.Get(r.Context(), deviceCodeKey(deviceCodeHash), &authorization); err != nil || authorization.Expires < time.Now().Unix() {
+			auth.writeDevicePage(w, r, "Invalid code.")
+			return
+		}
+		// Each user code may only be used once.
+		if err := auth.Store.Delete(r.Context(), deviceUserCodeKey(userCode)); err != nil {
+			log.Printf("Error deleting device user code: %v", err)
+		}
+		var decision deviceDecision
+		if r.PostForm.Get("action") == "Approve" {
+			approved := *userToken
+			if expires := time.Now().Unix() + MaxUserTokenDeviceLifetimeSeconds; expires < approved.Expires {
+				approved.Expires = expires
+			}
+			decision.Approved = &approved
+		} else {
+			decision.Denied = true
+		}
+		// Only the first decision on a request applies.
+		err = auth.Store.Create(r.Context(), deviceDecisionKey(deviceCodeHash), decision)
+		if err == errStoreExists {
+			auth.writeDevicePage(w, r, "Invalid code.")
+			return
+		}
+		if err != nil {
+			log.Printf("Error storing device authorization: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("x-frame-options", "deny")
+		w.Header().Add("content-type", "text/html")
+		if decision.Denied {
+			fmt.Fprint(w, "<html><body>Request denied.</body></html>")
+		} else {
+			fmt.Fprint(w, "<html><body>Device authorized.  You may close this window.</body></html>")
+		}
+	})
+
+	mux.Methods("POST").Path("/device_token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		approved := auth.pollDeviceAuthorization(w, r)
+		if approved == nil {
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": auth.EncodeClientToken(*approved),
+			"token_type":   "Bearer",
+			"expires_in":   approved.Expires - time.Now().Unix(),
+		})
+	})
+}
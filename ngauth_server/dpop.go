@@ -0,0 +1,211 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// DPoP (RFC 9449): a client may prove possession of a private key when obtaining a temporary token
+// from /token, which binds the token to the key.  The bound token is then only accepted along with
+// a fresh proof signed by the key, so that a token stolen from browser storage or logs is useless
+// without the key, which the browser keeps non-extractable.
+
+const dpopHeaderName = "dpop"
+
+// Maximum age of a DPoP proof, in addition to jwtClockSkew.
+const dpopProofLifetime = time.Minute
+
+// dpopProofs records the jti of recently accepted DPoP proofs, to reject replayed proofs.  Proofs
+// are only tracked per instance.
+var dpopProofs struct {
+	sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+type dpopProofHeader struct {
+	Typ string          `json:"typ"`
+	Alg string          `json:"alg"`
+	Jwk json.RawMessage `json:"jwk"`
+}
+
+// jwkThumbprint returns the RFC 7638 SHA-256 thumbprint of a public key.
+func jwkThumbprint(key *jsonWebKey) (string, error) {
+	var canonical []byte
+	switch key.Kty {
+	case "RSA":
+		canonical, _ = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{key.E, key.Kty, key.N})
+	case "EC":
+		canonical, _ = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{key.Crv, key.Kty, key.X, key.Y})
+	default:
+		return "", fmt.Errorf("Unsupported key type: %q", key.Kty)
+	}
+	hash := sha256.Sum256(canonical)
+	return base64url.EncodeToString(hash[:]), nil
+}
+
+// recordDpopProof returns false if a proof with the same jti was already accepted.
+func recordDpopProof(jti string, now time.Time) bool {
+	dpopProofs.Lock()
+	defer dpopProofs.Unlock()
+	if dpopProofs.seen == nil {
+		dpopProofs.seen = make(map[string]time.Time)
+	}
+	if now.Sub(dpopProofs.lastSweep) > dpopProofLifetime {
+		dpopProofs.lastSweep = now
+		for id, expires := range dpopProofs.seen {
+			if now.After(expires) {
+				delete(dpopProofs.seen, id)
+			}
+		}
+	}
+	if _, ok := dpopProofs.seen[jti]; ok {
+		return false
+	}
+	dpopProofs.seen[jti] = now.Add(dpopProofLifetime + 2*jwtClockSkew)
+	return true
+}
+
+// verifyDpopProof checks the DPoP proof of request r and returns the thumbprint of its key.  If
+// accessToken is non-empty, the proof must be bound to it.
+func verifyDpopProof(r *http.Request, accessToken string) (thumbprint string, err error) {
+	proofs := r.Header.Values(dpopHeaderName)
+	if len(proofs) != 1 {
+		return "", fmt.Errorf("Expected one DPoP proof")
+	}
+	proof := proofs[0]
+	headerPart := strings.SplitN(proof, ".", 2)[0]
+	headerJson, err := base64.RawURLEncoding.DecodeString(headerPart)
+	if err != nil {
+		return "", err
+	}
+	var header dpopProofHeader
+	if err := json.Unmarshal(headerJson, &header); err != nil {
+		return "", err
+	}
+	if header.Typ != "dpop+jwt" || (header.Alg != "ES256" && header.Alg != "RS256") {
+		return "", fmt.Errorf("Unsupported DPoP proof type %q or algorithm %q", header.Typ, header.Alg)
+	}
+	var jwk jsonWebKey
+	var members map[string]interface{}
+	if err := json.Unmarshal(header.Jwk, &jwk); err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(header.Jwk, &members); err != nil {
+		return "", err
+	}
+	if _, ok := members["d"]; ok {
+		return "", fmt.Errorf("DPoP proof key must be a public key")
+	}
+	key, err := jwk.publicKey()
+	if err != nil {
+		return "", err
+	}
+	if k, ok := key.(*ecdsa.PublicKey); ok && !k.Curve.IsOnCurve(k.X, k.Y) {
+		return "", fmt.Errorf("Invalid DPoP proof key")
+	}
+	claims, err := parseAndVerifyJwtWithKey(proof, func(kid string) (crypto.PublicKey, error) {
+		return key, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if htm, _ := claims["htm"].(string); htm != r.Method {
+		return "", fmt.Errorf("DPoP proof for method %q", htm)
+	}
+	// The scheme is not compared, since TLS may be terminated by a proxy.
+	htuString, _ := claims["htu"].(string)
+	htu, err := url.Parse(htuString)
+	if err != nil || (htu.Scheme != "https" && htu.Scheme != "http") || !strings.EqualFold(htu.Host, r.Host) || htu.Path != r.URL.Path {
+		return "", fmt.Errorf("DPoP proof for URL %q", htuString)
+	}
+	now := time.Now()
+	iat, ok := getNumericClaim(claims, "iat")
+	if !ok || now.Sub(time.Unix(iat, 0)) > dpopProofLifetime+jwtClockSkew || time.Unix(iat, 0).Sub(now) > jwtClockSkew {
+		return "", fmt.Errorf("DPoP proof expired")
+	}
+	if accessToken != "" {
+		hash := sha256.Sum256([]byte(accessToken))
+		if ath, _ := claims["ath"].(string); ath != base64url.EncodeToString(hash[:]) {
+			return "", fmt.Errorf("DPoP proof not bound to token")
+		}
+	}
+	thumbprint, err = jwkThumbprint(&jwk)
+	if err != nil {
+		return "", err
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" || !recordDpopProof(thumbprint+" "+jti, now) {
+		return "", fmt.Errorf("DPoP proof replayed")
+	}
+	return thumbprint, nil
+}
+
+// checkTokenBinding returns an error if userToken, presented as token in request r, is bound to a
+// DPoP key without a valid proof of possession of the key.
+func checkTokenBinding(r *http.Request, token string, userToken *UserToken) error {
+	if userToken.DPoPKeyThumbprint == "" {
+		return nil
+	}
+	thumbprint, err := verifyDpopProof(r, token)
+	if err != nil {
+		return fmt.Errorf("Invalid DPoP proof: %w", err)
+	}
+	if thumbprint != userToken.DPoPKeyThumbprint {
+		return fmt.Errorf("DPoP proof signed by a different key")
+	}
+	return nil
+}
+
+func (auth *Authenticator) addDpopRoutes(mux *gorilla_mux.Router) {
+	// Sending a DPoP header requires a CORS preflight request.
+	mux.Methods("OPTIONS").Path("/{path:token|gcs_token|gcs_tokens|gcs_token/refresh}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin == "" || !OriginPattern.MatchString(origin) || !auth.IsOriginAllowed(origin) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("access-control-allow-origin", origin)
+		w.Header().Set("vary", "origin")
+		w.Header().Set("access-control-allow-methods", "POST")
+		w.Header().Set("access-control-allow-headers", dpopHeaderName)
+		w.Header().Set("access-control-max-age", "3600")
+		if r.URL.Path == "/token" {
+			w.Header().Set("access-control-allow-credentials", "true")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,250 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// DVID servers: ngauth issues the JWTs that DVID servers configured with a shared secret key
+// accept, so that dvid:// sources are authorized by the same login as GCS sources.  Each token
+// names the repos, by UUID or alias, that the user may access, and the access mode for each.
+
+const defaultDvidTokenLifetimeSeconds = 24 * 60 * 60
+
+// DvidServer specifies a DVID server for which ngauth issues tokens.
+type DvidServer struct {
+	// File containing the secret key with which the server verifies HS256 tokens.
+	SecretKeyPath string `json:"secretKeyPath"`
+
+	// Lifetime of the tokens, in seconds, or 0 for 1 day.
+	LifetimeSeconds int64 `json:"lifetimeSeconds,omitempty"`
+
+	// Members, as for role bindings, who may read or write each repo, by UUID or alias.  The repo
+	// "*" applies to all repos.
+	Repos map[string]*DvidRepo `json:"repos"`
+
+	secretKey []byte
+}
+
+// DvidRepo specifies the members who may access a DVID repo.
+type DvidRepo struct {
+	Readers []string `json:"readers,omitempty"`
+	Writers []string `json:"writers,omitempty"`
+}
+
+// loadDvidServers loads the servers specified by DVID_SERVERS_PATH, a JSON object mapping server
+// names to DvidServer.
+func loadDvidServers() (map[string]*DvidServer, error) {
+	serversPath, ok := os.LookupEnv("DVID_SERVERS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(serversPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading DVID servers from %s: %w", serversPath, err)
+	}
+	var servers map[string]*DvidServer
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, fmt.Errorf("Error parsing DVID servers from %s: %w", serversPath, err)
+	}
+	for name, server := range servers {
+		if server.secretKey, err = ioutil.ReadFile(server.SecretKeyPath); err != nil {
+			return nil, fmt.Errorf("Error reading secret key of DVID server %s from %s: %w", name, server.SecretKeyPath, err)
+		}
+		server.secretKey = []byte(strings.TrimSpace(string(server.secretKey)))
+		if len(server.secretKey) < MacKeyMinLength {
+			return nil, fmt.Errorf("Secret key length of DVID server %s (%d) is less than %d", name, len(server.secretKey), MacKeyMinLength)
+		}
+		if server.LifetimeSeconds == 0 {
+			server.LifetimeSeconds = defaultDvidTokenLifetimeSeconds
+		}
+	}
+	return servers, nil
+}
+
+// repoModes returns the access mode, "read" or "write", of the user for each repo, or only for
+// repo if not "".
+func (s *DvidServer) repoModes(userToken *UserToken, repo string) map[string]string {
+	modes := make(map[string]string)
+	for name, r := range s.Repos {
+		if repo != "" && name != repo && name != "*" {
+			continue
+		}
+		if repo != "" {
+			name = repo
+		}
+		if hasMember(r.Writers, userToken) {
+			modes[name] = writeMode
+		} else if hasMember(r.Readers, userToken) && modes[name] != writeMode {
+			modes[name] = readMode
+		}
+	}
+	return modes
+}
+
+// makeToken returns an HS256 JWT identifying the user to the server, valid for the repos of modes.
+func (s *DvidServer) makeToken(userToken *UserToken, modes map[string]string) (string, int64) {
+	// Users of other providers are identified by their qualified user id, which cannot be mistaken
+	// for the email address of another account.
+	user := userToken.UserId
+	email := getUserEmail(userToken.UserId)
+	if email != "" {
+		user = email
+	}
+	now := time.Now().Unix()
+	expires := now + s.LifetimeSeconds
+	claims := map[string]interface{}{
+		"user":  user,
+		"iat":   now,
+		"exp":   expires,
+		"repos": modes,
+	}
+	if email != "" {
+		claims["email"] = email
+	}
+	// Json encoding cannot fail
+	headerJson, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	claimsJson, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+	hasher := hmac.New(sha256.New, s.secretKey)
+	hasher.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(hasher.Sum(nil)), expires
+}
+
+// authorizeDvidToken checks the user's access to repo, or all repos if "", of server, and returns
+// the server and the access mode for each repo.
+func (auth *Authenticator) authorizeDvidToken(userToken *UserToken, serverName string, repo string, origin string) (*DvidServer, map[string]string, *credentialError) {
+	server := auth.DvidServers[serverName]
+	if server == nil {
+		return nil, nil, &credentialError{status: http.StatusNotFound, message: "Unknown DVID server"}
+	}
+	if userToken.UserId == anonymousUserId || auth.DenyRules.IsDenied(userToken, "", origin, userToken.Origin) || !auth.OriginPolicies.AllowsOrigin(userToken, origin) {
+		return nil, nil, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	modes := server.repoModes(userToken, repo)
+	if len(modes) == 0 {
+		log.Printf("AUDIT: %s denied DVID token for server %s repo %q", userToken.UserId, serverName, repo)
+		return nil, nil, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	return server, modes, nil
+}
+
+// issueDvidToken checks the user's access to server, and returns a token and its expiry time.
+func (auth *Authenticator) issueDvidToken(userToken *UserToken, serverName string, repo string, origin string) (string, int64, *credentialError) {
+	server, modes, tokenErr := auth.authorizeDvidToken(userToken, serverName, repo, origin)
+	if tokenErr != nil {
+		return "", 0, tokenErr
+	}
+	repos := make([]string, 0, len(modes))
+	for repo := range modes {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	log.Printf("AUDIT: %s obtained DVID token for server %s repos %s", userToken.UserId, serverName, strings.Join(repos, ","))
+	token, expires := server.makeToken(userToken, modes)
+	return token, expires, nil
+}
+
+// dvidBroker issues DVID tokens.  The resource is the server name, and the prefix the repo, if
+// any.
+type dvidBroker struct {
+	auth *Authenticator
+}
+
+func makeDvidBroker(auth *Authenticator) CredentialBroker {
+	if auth.DvidServers == nil {
+		return nil
+	}
+	return &dvidBroker{auth: auth}
+}
+
+func (b *dvidBroker) CheckAccess(r *http.Request, origin string, request *CredentialRequest) *credentialError {
+	userToken, tokenErr := b.auth.authenticateCredentialRequest(r, request)
+	if tokenErr != nil {
+		return tokenErr
+	}
+	_, _, tokenErr = b.auth.authorizeDvidToken(userToken, request.Resource, request.Prefix, origin)
+	return tokenErr
+}
+
+func (b *dvidBroker) IssueCredential(r *http.Request, origin string, request *CredentialRequest) (interface{}, *credentialError) {
+	userToken, tokenErr := b.auth.authenticateCredentialRequest(r, request)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	token, expires, tokenErr := b.auth.issueDvidToken(userToken, request.Resource, request.Prefix, origin)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	return map[string]interface{}{"token": token, "expiresAt": expires}, nil
+}
+
+func (auth *Authenticator) addDvidRoutes(mux *gorilla_mux.Router) {
+	// Returns a token as text, authenticated by the login cookie, as DVID token APIs do, so that the
+	// viewer can use this endpoint as a DVID authorization server.
+	mux.Methods("GET").Path("/dvid_token/{server}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin != "" {
+			w.Header().Set("vary", "origin")
+			if !OriginPattern.MatchString(origin) || !auth.IsOriginAllowed(origin) {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("access-control-allow-origin", origin)
+			w.Header().Set("access-control-allow-credentials", "true")
+		}
+		userToken := auth.getUserTokenFromCookie(r)
+		if userToken == nil {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		token, _, tokenErr := auth.issueDvidToken(userToken, gorilla_mux.Vars(r)["server"], r.URL.Query().Get("repo"), origin)
+		if tokenErr != nil {
+			tokenErr.write(w)
+			return
+		}
+		w.Header().Set("content-type", "text/plain")
+		w.Header().Set("cache-control", "no-store")
+		fmt.Fprint(w, token)
+	})
+
+	// Returns a token for a request with the same token as for /gcs_token.
+	mux.Methods("POST").Path("/dvid_token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowCredentialOrigin(w, r)
+		var request struct {
+			Token  string `json:"token"`
+			Server string `json:"server"`
+			Repo   string `json:"repo,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveCredentialRequest(w, r, origin, auth.CredentialBrokers["dvid"], &CredentialRequest{Token: request.Token, Resource: request.Server, Prefix: request.Repo})
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type embargo struct {
+	// Either a bucket name or "BUCKET/PREFIX".
+	Resource string `json:"resource"`
+
+	// Time at which the embargo ends.
+	Release time.Time `json:"release"`
+
+	// Members, as for role bindings, who may obtain access tokens before the release.
+	Allowed []string `json:"allowed"`
+}
+
+// Embargoes restrict access to pre-publication datasets, staged in place, until their release
+// time, as specified by the JSON list in the file at EMBARGOES_PATH.  The file is reloaded
+// whenever it is modified.
+type Embargoes struct {
+	path string
+
+	mutex     sync.Mutex
+	modTime   time.Time
+	embargoes []embargo
+}
+
+// reload reads the embargoes file if it has been modified since it was last read.
+func (e *Embargoes) reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(e.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	var embargoes []embargo
+	if err := json.Unmarshal(data, &embargoes); err != nil {
+		return err
+	}
+	for _, embargo := range embargoes {
+		if embargo.Resource == "" || !isValidObjectPrefix(embargo.Resource) {
+			return fmt.Errorf("Invalid resource %q", embargo.Resource)
+		}
+		if embargo.Release.IsZero() {
+			return fmt.Errorf("Missing release time for %q", embargo.Resource)
+		}
+		for i, member := range embargo.Allowed {
+			member = strings.ToLower(member)
+			if _, err := path.Match(member, ""); err != nil {
+				return fmt.Errorf("Invalid member pattern %q: %w", member, err)
+			}
+			embargo.Allowed[i] = member
+		}
+	}
+	e.embargoes = embargoes
+	e.modTime = info.ModTime()
+	return nil
+}
+
+func loadEmbargoes() (*Embargoes, error) {
+	path, ok := os.LookupEnv("EMBARGOES_PATH")
+	if !ok {
+		return nil, nil
+	}
+	embargoes := &Embargoes{path: path}
+	if err := embargoes.reload(); err != nil {
+		return nil, fmt.Errorf("Error reading embargoes from %s: %w", path, err)
+	}
+	return embargoes, nil
+}
+
+// GetEmbargo returns the release time of an embargo, not allowing the user, that applies to any
+// objects in bucket whose names start with prefix, or the zero time if there is none.
+func (e *Embargoes) GetEmbargo(userToken *UserToken, bucket string, prefix string) (release time.Time) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.reload(); err != nil {
+		// Continue to use the previously-loaded embargoes.
+		log.Printf("Error reloading embargoes from %s: %v", e.path, err)
+	}
+	now := time.Now()
+	for _, embargo := range e.embargoes {
+		if !now.Before(embargo.Release) {
+			continue
+		}
+		// The embargo applies if it includes either all or some of the requested objects.
+		parts := strings.SplitN(embargo.Resource, "/", 2)
+		if parts[0] != bucket || (len(parts) == 2 && !strings.HasPrefix(prefix, parts[1]) && !strings.HasPrefix(parts[1], prefix)) {
+			continue
+		}
+		if hasMember(embargo.Allowed, userToken) {
+			continue
+		}
+		if release.IsZero() || embargo.Release.After(release) {
+			release = embargo.Release
+		}
+	}
+	return
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Customer-supplied encryption keys: objects encrypted with a CSEK can only be read with the key
+// in the x-goog-encryption-* headers of each request, so access tokens alone do not allow reading
+// them.  The keys of such buckets are kept by ngauth, which refuses to issue access tokens or
+// signed URLs for them, with an error naming the alternative, and adds the headers when proxying
+// requests to the bucket through the HTTP gateway.  Buckets encrypted with customer-managed
+// (Cloud KMS) keys need no handling, since GCS decrypts them for any reader.
+
+// EncryptionKey specifies the customer-supplied encryption key of a bucket.
+type EncryptionKey struct {
+	// File containing the base64-encoded AES-256 key, as for the encryption_key option of gsutil.
+	KeyPath string `json:"keyPath"`
+
+	key       string
+	keySha256 string
+}
+
+// loadEncryptionKeys loads the keys specified by ENCRYPTION_KEYS_PATH, a JSON object mapping
+// bucket names to EncryptionKey.
+func loadEncryptionKeys() (map[string]*EncryptionKey, error) {
+	keysPath, ok := os.LookupEnv("ENCRYPTION_KEYS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(keysPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading encryption keys from %s: %w", keysPath, err)
+	}
+	var keys map[string]*EncryptionKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("Error parsing encryption keys from %s: %w", keysPath, err)
+	}
+	for bucket, key := range keys {
+		encoded, err := ioutil.ReadFile(key.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading encryption key of bucket %s from %s: %w", bucket, key.KeyPath, err)
+		}
+		key.key = strings.TrimSpace(string(encoded))
+		decoded, err := base64.StdEncoding.DecodeString(key.key)
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("Encryption key of bucket %s must be a base64-encoded 256-bit key", bucket)
+		}
+		hash := sha256.Sum256(decoded)
+		key.keySha256 = base64.StdEncoding.EncodeToString(hash[:])
+	}
+	return keys, nil
+}
+
+// setHeaders sets the headers with which GCS decrypts the objects of a request.
+func (k *EncryptionKey) setHeaders(header http.Header) {
+	header.Set("x-goog-encryption-algorithm", "AES256")
+	header.Set("x-goog-encryption-key", k.key)
+	header.Set("x-goog-encryption-key-sha256", k.keySha256)
+}
+
+// checkEncryptedBucket returns the denial of requests for access tokens or signed URLs for bucket
+// if it is encrypted with a customer-supplied key, or nil.
+func (auth *Authenticator) checkEncryptedBucket(bucket string) *accessDenial {
+	if auth.EncryptionKeys[bucket] == nil {
+		return nil
+	}
+	var sources []string
+	for name, source := range auth.HttpSources {
+		if source.GcsBucket == bucket {
+			sources = append(sources, name)
+		}
+	}
+	remediation := "Contact the administrators of this server"
+	if len(sources) != 0 {
+		sort.Strings(sources)
+		remediation = "Read the bucket through the HTTP gateway source " + strings.Join(sources, " or ")
+	}
+	return &accessDenial{
+		status:      http.StatusForbidden,
+		check:       "encryption",
+		message:     "Bucket is encrypted with a customer-supplied key, which is not issued to clients",
+		remediation: remediation,
+	}
+}
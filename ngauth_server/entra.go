@@ -0,0 +1,80 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Microsoft Entra ID (formerly Azure AD) identity provider.
+
+// Tenant aliases that accept accounts from arbitrary tenants.  For these the email claim is not
+// controlled by a single directory, so they are rejected.
+var entraMultiTenantAliases = map[string]bool{
+	"common":        true,
+	"organizations": true,
+	"consumers":     true,
+}
+
+type entraProvider struct {
+	*oidcProvider
+}
+
+// ValidateIdToken identifies the user by object id, as the user principal name
+// (preferred_username) and email address can be changed, and reassigned to other users.  The email
+// address, if the tenant has verified that its domain is owned by the tenant, is linked to the
+// user, so that role bindings may refer to it.
+func (p *entraProvider) ValidateIdToken(ctx context.Context, idToken string) (*Identity, error) {
+	identity, err := p.oidcProvider.ValidateIdToken(ctx, idToken)
+	if err != nil {
+		return nil, err
+	}
+	email, _ := identity.Claims["email"].(string)
+	verified, _ := identity.Claims["xms_edov"].(bool)
+	if !verified {
+		verified, _ = identity.Claims["email_verified"].(bool)
+	}
+	if email != "" && verified {
+		identity.LinkedUserIds = append(identity.LinkedUserIds, email)
+	}
+	return identity, nil
+}
+
+func makeEntraProvider(ctx context.Context) (IdentityProvider, error) {
+	tenantID := os.Getenv("ENTRA_TENANT_ID")
+	if tenantID == "" {
+		return nil, fmt.Errorf("ENTRA_TENANT_ID must be specified")
+	}
+	if entraMultiTenantAliases[tenantID] {
+		return nil, fmt.Errorf("ENTRA_TENANT_ID must identify a single tenant, not %q", tenantID)
+	}
+	clientID := os.Getenv("ENTRA_CLIENT_ID")
+	if clientID == "" {
+		return nil, fmt.Errorf("ENTRA_CLIENT_ID must be specified")
+	}
+	clientSecretPath := getEnvOr("ENTRA_CLIENT_SECRET_PATH", "secrets/entra_client_secret.txt")
+	clientSecret, err := readClientSecret(clientSecretPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client secret from %s: %w", clientSecretPath, err)
+	}
+	provider, err := newOIDCProvider(ctx, "entra", "https://login.microsoftonline.com/"+tenantID+"/v2.0", clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	// The object id is immutable and unique within the tenant.
+	provider.userIdClaim = "oid"
+	return &entraProvider{oidcProvider: provider}, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Federated Credential Management (https://w3c-fedid.github.io/FedCM/): browsers that block
+// third-party cookies do not send the login cookie with the cross-site /token request, which
+// breaks the popup flow.  With FEDCM=true, client origins may instead obtain a token with
+// navigator.credentials.get({identity: ...}), for which the browser itself sends the login cookie
+// to the accounts and assertion endpoints, after showing the user which account is used.
+
+// Value of the Sec-Fetch-Dest header of requests made by the browser for FedCM.
+const fedcmFetchDest = "webidentity"
+
+// setLoginStatus informs the browser, through the FedCM login status API, whether the user is
+// logged in to ngauth.
+func (auth *Authenticator) setLoginStatus(w http.ResponseWriter, loggedIn bool) {
+	if !auth.FedCM {
+		return
+	}
+	if loggedIn {
+		w.Header().Set("set-login", "logged-in")
+	} else {
+		w.Header().Set("set-login", "logged-out")
+	}
+}
+
+// getFedCMUser returns the logged-in user of a request made by the browser for FedCM, or writes an
+// error response.
+func (auth *Authenticator) getFedCMUser(w http.ResponseWriter, r *http.Request) *UserToken {
+	if r.Header.Get("sec-fetch-dest") != fedcmFetchDest {
+		http.Error(w, "Not a FedCM request", http.StatusBadRequest)
+		return nil
+	}
+	userToken := auth.getUserTokenFromCookie(r)
+	if userToken == nil {
+		auth.setLoginStatus(w, false)
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return nil
+	}
+	return userToken
+}
+
+func (auth *Authenticator) addFedCMRoutes(mux *gorilla_mux.Router) {
+	// Only effective if ngauth is served at the root of its registrable domain, e.g.
+	// ngauth.example.org rather than example.org; otherwise the same document must also be served
+	// by the registrable domain.
+	mux.Methods("GET").Path("/.well-known/web-identity").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"provider_urls": []string{getBaseURL(r) + "/fedcm/config.json"},
+		})
+	})
+
+	mux.Methods("GET").Path("/fedcm/config.json").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"accounts_endpoint":        "/fedcm/accounts",
+			"client_metadata_endpoint": "/fedcm/client_metadata",
+			"id_assertion_endpoint":    "/fedcm/assertion",
+			"login_url":                "/login?return=/fedcm/logged_in",
+		})
+	})
+
+	mux.Methods("GET").Path("/fedcm/accounts").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getFedCMUser(w, r)
+		if userToken == nil {
+			return
+		}
+		_, id := SplitUserId(userToken.UserId)
+		name := userToken.Name
+		if name == "" {
+			name = id
+		}
+		account := map[string]interface{}{
+			"id":    userToken.UserId,
+			"name":  name,
+			"email": id,
+		}
+		if userToken.Picture != "" {
+			account["picture"] = userToken.Picture
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{"accounts": []interface{}{account}})
+	})
+
+	mux.Methods("GET").Path("/fedcm/client_metadata").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	})
+
+	// Shown in the login window opened by the browser; closes it once the user has logged in.
+	mux.Methods("GET").Path("/fedcm/logged_in").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.setLoginStatus(w, auth.getUserTokenFromCookie(r) != nil)
+		w.Header().Add("content-type", "text/html")
+		fmt.Fprint(w, `<html>
+<body>
+<script>
+if (window.IdentityProvider) IdentityProvider.close();
+</script>
+</body>
+</html>`)
+	})
+
+	// Issues a temporary token to the client origin, as for /token.  The client id is the origin.
+	mux.Methods("POST").Path("/fedcm/assertion").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin == "" || !OriginPattern.MatchString(origin) {
+			http.Error(w, "Missing Origin header", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("access-control-allow-origin", origin)
+		w.Header().Set("access-control-allow-credentials", "true")
+		w.Header().Set("vary", "origin")
+		if !auth.IsOriginAllowed(origin) || r.PostFormValue("client_id") != origin {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		userToken := auth.getFedCMUser(w, r)
+		if userToken == nil {
+			return
+		}
+		if r.PostFormValue("account_id") != userToken.UserId {
+			http.Error(w, "Account not logged in", http.StatusUnauthorized)
+			return
+		}
+		if !auth.TokenLifetimes.AllowsSession(userToken, origin) {
+			http.Error(w, "Login session too old", http.StatusUnauthorized)
+			return
+		}
+		if auth.DenyRules.IsDenied(userToken, "", origin) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		if !auth.OriginPolicies.AllowsOrigin(userToken, origin) {
+			http.Error(w, "Origin not allowed for user", http.StatusForbidden)
+			return
+		}
+		tempUserToken := auth.makeTemporaryUserToken(*userToken, origin)
+		tempUserToken.Origin = origin
+		log.Printf("Issued FedCM token for %s to %s", userToken.UserId, origin)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(map[string]string{"token": auth.EncodeClientToken(tempUserToken)})
+	})
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Workload identity federation: OIDC tokens issued to workloads by trusted external issuers, such
+// as GitHub Actions or Kubernetes, are exchanged at /federate for ngauth tokens (RFC 8693).
+
+const tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+const jwtTokenType = "urn:ietf:params:oauth:token-type:jwt"
+
+const idTokenTokenType = "urn:ietf:params:oauth:token-type:id_token"
+
+const accessTokenTokenType = "urn:ietf:params:oauth:token-type:access_token"
+
+// federatedIssuer is a trusted external OIDC issuer.  It implements IdentityProvider so that user
+// ids are qualified, and the login allowlist applies, in the same way as for interactive logins.
+type federatedIssuer struct {
+	// Name used to qualify user ids, e.g. "github".
+	IssuerName string `json:"name"`
+
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+
+	// JWKS URI, if the issuer does not support OpenID discovery.
+	JwksURI string `json:"jwksUri,omitempty"`
+
+	// Claim from which the user id is taken (defaults to "sub").
+	SubjectClaim string `json:"subjectClaim,omitempty"`
+
+	// Patterns, as for the login allowlist, of which the subject must match at least one, e.g.
+	// "repo:example-org/pipeline:ref:refs/heads/main".
+	AllowedSubjects []string `json:"allowedSubjects"`
+
+	// Claim listing groups, or empty if groups are not used.
+	GroupsClaim string `json:"groupsClaim,omitempty"`
+
+	// Optional Google service account email address whose GCS IAM permissions apply.
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+
+	keys *jwksCache
+}
+
+func (issuer *federatedIssuer) Name() string {
+	return issuer.IssuerName
+}
+
+func (issuer *federatedIssuer) isSubjectAllowed(subject string) bool {
+	for _, pattern := range issuer.AllowedSubjects {
+		if matched, _ := path.Match(pattern, subject); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks a token issued by this issuer and returns the unqualified identity.
+func (issuer *federatedIssuer) validate(ctx context.Context, token string) (*Identity, error) {
+	claims, err := parseAndVerifyJwt(ctx, issuer.keys, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateJwtClaims(claims, issuer.Issuer, issuer.Audience); err != nil {
+		return nil, err
+	}
+	subject, _ := getClaim(claims, issuer.SubjectClaim).(string)
+	if subject == "" {
+		return nil, fmt.Errorf("Token is missing %s", issuer.SubjectClaim)
+	}
+	if !issuer.isSubjectAllowed(subject) {
+		return nil, fmt.Errorf("Subject %q is not allowed", subject)
+	}
+	identity := &Identity{UserId: subject, Claims: claims}
+	if issuer.GroupsClaim != "" {
+		identity.Groups = getStringListClaim(claims, issuer.GroupsClaim)
+	}
+	return identity, nil
+}
+
+// loadFederatedIssuers reads the issuers specified by FEDERATION_CONFIG_PATH.
+func loadFederatedIssuers(ctx context.Context) ([]*federatedIssuer, error) {
+	configPath, ok := os.LookupEnv("FEDERATION_CONFIG_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading federation config from %s: %w", configPath, err)
+	}
+	var issuers []*federatedIssuer
+	if err := json.Unmarshal(data, &issuers); err != nil {
+		return nil, fmt.Errorf("Error parsing federation config from %s: %w", configPath, err)
+	}
+	for _, issuer := range issuers {
+		if issuer.IssuerName == "" || issuer.Issuer == "" || issuer.Audience == "" {
+			return nil, fmt.Errorf("Federated issuers must specify name, issuer and audience")
+		}
+		if identityProviderFactories[issuer.IssuerName] != nil {
+			return nil, fmt.Errorf("Federated issuer name %q conflicts with an identity provider", issuer.IssuerName)
+		}
+		if len(issuer.AllowedSubjects) == 0 {
+			return nil, fmt.Errorf("Federated issuer %q must specify allowedSubjects", issuer.IssuerName)
+		}
+		for _, pattern := range issuer.AllowedSubjects {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid subject pattern %q: %w", pattern, err)
+			}
+		}
+		if issuer.SubjectClaim == "" {
+			issuer.SubjectClaim = "sub"
+		}
+		if issuer.JwksURI == "" {
+			doc, err := discoverOIDC(ctx, issuer.Issuer)
+			if err != nil {
+				return nil, fmt.Errorf("Error initializing federated issuer %q: %w", issuer.IssuerName, err)
+			}
+			issuer.JwksURI = doc.JwksURI
+		}
+		issuer.keys = newJwksCache(issuer.JwksURI)
+	}
+	return issuers, nil
+}
+
+// validateFederatedToken finds the issuer that accepts token and returns the issuer along with
+// the unqualified identity.
+func (auth *Authenticator) validateFederatedToken(ctx context.Context, token string) (*federatedIssuer, *Identity, error) {
+	// Select candidate issuers by the unverified iss claim; the token is then verified with the
+	// keys of the issuer.
+	var unverified struct {
+		Issuer string `json:"iss"`
+	}
+	if err := decodeUnverifiedJwtPayload(token, &unverified); err != nil {
+		return nil, nil, err
+	}
+	err := fmt.Errorf("Untrusted issuer: %q", unverified.Issuer)
+	for _, issuer := range auth.FederatedIssuers {
+		if issuer.Issuer != unverified.Issuer {
+			continue
+		}
+		// Several configurations may share an issuer, e.g. with different audiences.
+		var identity *Identity
+		if identity, err = issuer.validate(ctx, token); err == nil {
+			return issuer, identity, nil
+		}
+	}
+	return nil, nil, err
+}
+
+func (auth *Authenticator) addFederationRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("POST").Path("/federate").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		if r.PostForm.Get("grant_type") != tokenExchangeGrantType {
+			writeOAuth2Error(w, "unsupported_grant_type")
+			return
+		}
+		if tokenType := r.PostForm.Get("subject_token_type"); tokenType != jwtTokenType && tokenType != idTokenTokenType {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		audience := r.PostForm.Get("audience")
+		if !auth.isTokenAudienceAllowed(audience) {
+			writeOAuth2Error(w, "invalid_target")
+			return
+		}
+		issuer, identity, err := auth.validateFederatedToken(r.Context(), r.PostForm.Get("subject_token"))
+		if err != nil {
+			log.Printf("Rejected federated token: %v", err)
+			writeOAuth2Error(w, "invalid_grant")
+			return
+		}
+		allowed, err := auth.isLoginAllowed(r.Context(), issuer, identity)
+		if err != nil {
+			log.Printf("Error checking whether %s may log in: %v", identity.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			writeOAuth2Error(w, "invalid_grant")
+			return
+		}
+		identity.qualify(issuer.Name())
+		userToken := auth.makeUserToken(identity, auth.TokenLifetimes.CrossOriginLifetimeSeconds(""))
+		userToken.Audience = audience
+		if issuer.ServiceAccount != "" {
+			userToken.LinkedUserIds = append(userToken.LinkedUserIds, QualifyUserId("google", issuer.ServiceAccount))
+		}
+		log.Printf("Issued federated token to %s", userToken.UserId)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":      auth.EncodeClientToken(userToken),
+			"issued_token_type": accessTokenTokenType,
+			"token_type":        "Bearer",
+			"expires_in":        auth.TokenLifetimes.CrossOriginLifetimeSeconds(""),
+		})
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// FreshLoginPolicy requires that users authenticated interactively, by logging in or by verifying
+// a security key, within a recent window before they may access sensitive buckets, so that a
+// long-lived login session is not sufficient on its own.
+type FreshLoginPolicy struct {
+	buckets []string
+	maxAge  time.Duration
+}
+
+// loadFreshLoginPolicy returns the policy specified by FRESH_LOGIN_BUCKETS and
+// FRESH_LOGIN_MAX_AGE, or nil if no buckets require a fresh login.
+func loadFreshLoginPolicy() (*FreshLoginPolicy, error) {
+	buckets := splitList(os.Getenv("FRESH_LOGIN_BUCKETS"))
+	if buckets == nil {
+		return nil, nil
+	}
+	maxAge, err := time.ParseDuration(getEnvOr("FRESH_LOGIN_MAX_AGE", "1h"))
+	if err != nil || maxAge <= 0 {
+		return nil, fmt.Errorf("Invalid FRESH_LOGIN_MAX_AGE")
+	}
+	return &FreshLoginPolicy{buckets: buckets, maxAge: maxAge}, nil
+}
+
+// IsSatisfied returns true if bucket does not require a fresh login, or the user authenticated
+// recently enough.
+func (p *FreshLoginPolicy) IsSatisfied(userToken *UserToken, bucket string) bool {
+	if p == nil || !containsString(p.buckets, bucket) {
+		return true
+	}
+	return userToken.AuthTime != 0 && time.Since(time.Unix(userToken.AuthTime, 0)) <= p.maxAge
+}
+
+// Challenge returns the WWW-Authenticate challenge, as specified by RFC 9470, that instructs
+// clients to log in again.
+func (p *FreshLoginPolicy) Challenge() string {
+	return fmt.Sprintf(`Bearer error="insufficient_user_authentication", error_description="Fresh login required", max_age=%d`, int64(p.maxAge.Seconds()))
+}
+
+// getAuthTime returns the time at which the identity provider authenticated the user, if it
+// asserts one, or the current time.
+func getAuthTime(identity *Identity) int64 {
+	if authTime, ok := identity.Claims["auth_time"].(float64); ok && authTime > 0 {
+		return int64(authTime)
+	}
+	return time.Now().Unix()
+}
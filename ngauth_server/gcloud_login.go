@@ -0,0 +1,148 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Login with Google credentials obtained by `gcloud auth`, so that scripts run by users who have
+// already authenticated gcloud do not need the login popup.
+
+// OAuth2 client ids used by `gcloud auth login` and `gcloud auth application-default login`.
+const defaultGcloudClientIds = "32555940559.apps.googleusercontent.com,764086051850-6qr4p6gpi6hn506pt8ejuq83di341hur.apps.googleusercontent.com"
+
+// Only tokens issued to these OAuth2 clients are accepted.  Otherwise, any application to which
+// the user has given an access token could use it to log in as the user.
+func gcloudClientIds() []string {
+	return splitList(getEnvOr("GCLOUD_CLIENT_IDS", defaultGcloudClientIds))
+}
+
+type googleTokenInfo struct {
+	Azp           string `json:"azp"`
+	Email         string `json:"email"`
+	EmailVerified string `json:"email_verified"`
+}
+
+type googleUserInfo struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	HostedDomain  string `json:"hd"`
+}
+
+func fetchGoogleJson(ctx context.Context, requestURL string, accessToken string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return err
+	}
+	if accessToken != "" {
+		req.Header.Set("authorization", "Bearer "+accessToken)
+	}
+	resp, err := oidcHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request to %s failed: %s", requestURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// validateGcloudAccessToken returns the identity of a Google OAuth2 access token issued to gcloud.
+func (p *googleProvider) validateGcloudAccessToken(ctx context.Context, accessToken string) (*Identity, error) {
+	var tokenInfo googleTokenInfo
+	if err := fetchGoogleJson(ctx, "https://oauth2.googleapis.com/tokeninfo?access_token="+url.QueryEscape(accessToken), "", &tokenInfo); err != nil {
+		return nil, err
+	}
+	clientAllowed := false
+	for _, clientId := range gcloudClientIds() {
+		if tokenInfo.Azp == clientId {
+			clientAllowed = true
+		}
+	}
+	if !clientAllowed {
+		return nil, fmt.Errorf("Access token was issued to unexpected client %q", tokenInfo.Azp)
+	}
+	if tokenInfo.Email == "" || tokenInfo.EmailVerified != "true" {
+		return nil, fmt.Errorf("Access token does not have a verified email; include the userinfo.email scope")
+	}
+	if len(p.allowedHostedDomains) > 0 {
+		// The hosted domain is only available from the userinfo endpoint.
+		var userInfo googleUserInfo
+		if err := fetchGoogleJson(ctx, "https://openidconnect.googleapis.com/v1/userinfo", accessToken, &userInfo); err != nil {
+			return nil, err
+		}
+		if userInfo.Email != tokenInfo.Email || !p.allowedHostedDomains[userInfo.HostedDomain] {
+			return nil, fmt.Errorf("Account %s is not in an allowed hosted domain", tokenInfo.Email)
+		}
+	}
+	return &Identity{UserId: tokenInfo.Email}, nil
+}
+
+// validateGcloudToken accepts either an id token, from `gcloud auth print-identity-token`, or an
+// access token, from `gcloud auth print-access-token` or application default credentials.
+func (p *googleProvider) validateGcloudToken(ctx context.Context, token string) (identity *Identity, err error) {
+	if strings.Count(token, ".") != 2 {
+		return p.validateGcloudAccessToken(ctx, token)
+	}
+	err = fmt.Errorf("No allowed gcloud client ids")
+	for _, clientId := range gcloudClientIds() {
+		if identity, err = p.validateIdTokenForAudience(ctx, token, clientId); err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (auth *Authenticator) addGcloudLoginRoutes(mux *gorilla_mux.Router, provider *googleProvider) {
+	mux.Methods("POST").Path("/gcloud_login").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := getAuthorizationCredentials(r, "Bearer")
+		if token == "" {
+			http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
+			return
+		}
+		identity, err := provider.validateGcloudToken(r.Context(), token)
+		if err != nil {
+			log.Printf("Invalid gcloud token: %v", err)
+			http.Error(w, "Invalid Google credentials", http.StatusUnauthorized)
+			return
+		}
+		if !auth.checkLoginAllowed(w, r, provider, identity) {
+			return
+		}
+		identity.qualify(provider.Name())
+		if err := auth.resolveAccountLinks(r.Context(), identity); err != nil {
+			log.Printf("Error resolving linked accounts for %s: %v", identity.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		userToken := auth.makeUserToken(identity, auth.TokenLifetimes.CrossOriginLifetimeSeconds(""))
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": auth.EncodeClientToken(userToken),
+			"token_type":   "Bearer",
+			"expires_in":   auth.TokenLifetimes.CrossOriginLifetimeSeconds(""),
+		})
+	})
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Maximum number of requests in a /gcs_tokens batch.
+const maxGcsTokenBatchSize = 64
+
+type gcsTokenBatchRequest struct {
+	// Token used for requests that do not specify one.
+	Token string `json:"token"`
+
+	Requests []GcsTokenRequest `json:"requests"`
+
+	// Whether to issue a single access token covering all requests that share credentials, rather
+	// than a token per request, so that clients need fewer Authorization headers.
+	Combined bool `json:"combined,omitempty"`
+}
+
+type gcsTokenBatchResult struct {
+	*GcsTokenResponse
+
+	// HTTP status code that /gcs_token would return for the request.
+	Status int `json:"status"`
+
+	Error      string `json:"error,omitempty"`
+	Challenge  string `json:"challenge,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+type gcsTokenBatchResponse struct {
+	// Results, in the order of the requests.
+	Results []gcsTokenBatchResult `json:"results"`
+}
+
+func makeGcsTokenBatchError(tokenErr *credentialError) gcsTokenBatchResult {
+	return gcsTokenBatchResult{
+		Status:     tokenErr.status,
+		Error:      tokenErr.message,
+		Challenge:  tokenErr.challenge,
+		RetryAfter: tokenErr.retryAfter,
+	}
+}
+
+// issueCombinedGcsTokens authorizes each request of a batch as for /gcs_token, and issues one
+// access token, whose access boundary has a rule for each request, for all authorized requests
+// whose tokens would be downscoped from the same credentials, up to maxAccessBoundaryRules requests
+// per token.
+func (auth *Authenticator) issueCombinedGcsTokens(r *http.Request, origin string, batchRequest *gcsTokenBatchRequest) []gcsTokenBatchResult {
+	results := make([]gcsTokenBatchResult, len(batchRequest.Requests))
+	grants := make([]*gcsTokenGrant, len(batchRequest.Requests))
+	var wg sync.WaitGroup
+	for i, tokenRequest := range batchRequest.Requests {
+		if tokenRequest.Token == "" {
+			tokenRequest.Token = batchRequest.Token
+		}
+		wg.Add(1)
+		go func(i int, tokenRequest GcsTokenRequest) {
+			defer wg.Done()
+			tokenResponse, grant, tokenErr := auth.authorizeGcsTokenRequest(r, origin, tokenRequest, false)
+			if tokenErr != nil {
+				results[i] = makeGcsTokenBatchError(tokenErr)
+				return
+			}
+			results[i] = gcsTokenBatchResult{GcsTokenResponse: tokenResponse, Status: http.StatusOK}
+			grants[i] = grant
+		}(i, tokenRequest)
+	}
+	wg.Wait()
+
+	// Indices of the requests sharing each token.
+	var groups [][]int
+	groupByCredentials := make(map[serviceAccountCredentialsKey]int)
+	for i, grant := range grants {
+		if grant == nil {
+			continue
+		}
+		key := serviceAccountCredentialsKey{auth.getBucketCredentials(grant.boundary.Bucket), grant.serviceAccount}
+		group, ok := groupByCredentials[key]
+		if !ok || len(groups[group]) == maxAccessBoundaryRules {
+			group = len(groups)
+			groups = append(groups, nil)
+			groupByCredentials[key] = group
+		}
+		groups[group] = append(groups[group], i)
+	}
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group []int) {
+			defer wg.Done()
+			boundaries := make([]BucketBoundary, len(group))
+			for j, i := range group {
+				boundaries[j] = grants[i].boundary
+			}
+			token, expires, err := auth.generateBoundedAccessToken(grants[group[0]].serviceAccount, boundaries)
+			for j, i := range group {
+				if err != nil {
+					results[i] = makeGcsTokenBatchError(makeBoundedTokenError(boundaries[j].Bucket, err))
+				} else {
+					results[i].setToken(token, expires, &boundaries[j])
+				}
+			}
+		}(group)
+	}
+	wg.Wait()
+	return results
+}
+
+func (auth *Authenticator) addGcsTokenBatchRoutes(mux *gorilla_mux.Router) {
+	// Issues access tokens for several buckets at once, e.g. for all the layers of a viewer
+	// state.  Each request is handled as for /gcs_token, concurrently, and fails independently.
+	mux.Methods("POST").Path("/gcs_tokens").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin != "" {
+			w.Header().Set("access-control-allow-origin", origin)
+			w.Header().Set("vary", "origin")
+		}
+		var batchRequest gcsTokenBatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&batchRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(batchRequest.Requests) > maxGcsTokenBatchSize {
+			http.Error(w, fmt.Sprintf("At most %d requests may be batched", maxGcsTokenBatchSize), http.StatusBadRequest)
+			return
+		}
+		// A single-use token may be shared by all the requests of the batch.
+		r = withConsumedTokenMemo(r)
+		if batchRequest.Combined {
+			results := auth.issueCombinedGcsTokens(r, origin, &batchRequest)
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(gcsTokenBatchResponse{Results: results})
+			return
+		}
+		results := make([]gcsTokenBatchResult, len(batchRequest.Requests))
+		var wg sync.WaitGroup
+		for i, tokenRequest := range batchRequest.Requests {
+			if tokenRequest.Token == "" {
+				tokenRequest.Token = batchRequest.Token
+			}
+			wg.Add(1)
+			go func(result *gcsTokenBatchResult, tokenRequest GcsTokenRequest) {
+				defer wg.Done()
+				tokenResponse, tokenErr := auth.issueGcsToken(r, origin, tokenRequest, false)
+				if tokenErr != nil {
+					*result = makeGcsTokenBatchError(tokenErr)
+					return
+				}
+				*result = gcsTokenBatchResult{GcsTokenResponse: tokenResponse, Status: http.StatusOK}
+			}(&results[i], tokenRequest)
+		}
+		wg.Wait()
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(gcsTokenBatchResponse{Results: results})
+	})
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Globus Auth identity provider.
+//
+// A Globus account may link identities from many institutional and commercial identity
+// providers.  Linked identities from trusted providers are reported as additional user ids, so
+// that a user who logs in with an institutional identity can still be granted access to buckets
+// shared with, e.g., their linked Google account.
+
+const globusIssuer = "https://auth.globus.org"
+
+const globusIdentitySetScope = "urn:globus:auth:scope:auth.globus.org:view_identity_set"
+
+type globusProvider struct {
+	*oidcProvider
+
+	// Globus identity provider ids (UUIDs) whose linked identities are trusted for authorization.
+	trustedLinkedProviders map[string]bool
+}
+
+func (p *globusProvider) ValidateIdToken(ctx context.Context, idToken string) (*Identity, error) {
+	identity, err := p.oidcProvider.ValidateIdToken(ctx, idToken)
+	if err != nil {
+		return nil, err
+	}
+	identitySet, _ := identity.Claims["identity_set"].([]interface{})
+	for _, entry := range identitySet {
+		linked, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		provider, _ := linked["identity_provider"].(string)
+		if !p.trustedLinkedProviders[provider] {
+			continue
+		}
+		email, _ := linked["email"].(string)
+		if email == "" || email == identity.UserId {
+			continue
+		}
+		identity.LinkedUserIds = append(identity.LinkedUserIds, email)
+	}
+	return identity, nil
+}
+
+func makeGlobusProvider(ctx context.Context) (IdentityProvider, error) {
+	clientID := os.Getenv("GLOBUS_CLIENT_ID")
+	if clientID == "" {
+		return nil, fmt.Errorf("GLOBUS_CLIENT_ID must be specified")
+	}
+	clientSecretPath := getEnvOr("GLOBUS_CLIENT_SECRET_PATH", "secrets/globus_client_secret.txt")
+	clientSecret, err := readClientSecret(clientSecretPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client secret from %s: %w", clientSecretPath, err)
+	}
+	provider, err := newOIDCProvider(ctx, "globus", globusIssuer, clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	// Globus usernames, e.g. "alice@uchicago.edu", are unique and asserted by the linked
+	// identity provider.
+	provider.userIdClaim = "preferred_username"
+	globus := &globusProvider{
+		oidcProvider:           provider,
+		trustedLinkedProviders: make(map[string]bool),
+	}
+	if linkedProviders := os.Getenv("GLOBUS_TRUSTED_LINKED_PROVIDERS"); linkedProviders != "" {
+		for _, id := range strings.Split(linkedProviders, ",") {
+			globus.trustedLinkedProviders[strings.TrimSpace(id)] = true
+		}
+		provider.config.Scopes = append(provider.config.Scopes, globusIdentitySetScope)
+	}
+	return globus, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// GoogleGroupsChecker checks membership in Google Groups using the Cloud Identity API.  The
+// service account must be allowed to view the membership of the groups, e.g. by being added to
+// each group, or by being granted the Groups Reader admin role.
+type GoogleGroupsChecker struct {
+	client *http.Client
+
+	// Group email addresses.
+	groups []string
+
+	// Cache of group email address to resource name, e.g. "groups/01abcdef".
+	resourceNames sync.Map
+}
+
+func cloudIdentityGet(ctx context.Context, client *http.Client, requestURL string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Cloud Identity request failed: %v %v", resp.Status, string(bodyBytes))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *GoogleGroupsChecker) resourceName(ctx context.Context, group string) (string, error) {
+	if name, ok := c.resourceNames.Load(group); ok {
+		return name.(string), nil
+	}
+	var lookupResponse struct {
+		Name string `json:"name"`
+	}
+	query := url.Values{}
+	query.Set("groupKey.id", group)
+	if err := cloudIdentityGet(ctx, c.client, "https://cloudidentity.googleapis.com/v1/groups:lookup?"+query.Encode(), &lookupResponse); err != nil {
+		return "", fmt.Errorf("Error looking up group %s: %w", group, err)
+	}
+	c.resourceNames.Store(group, lookupResponse.Name)
+	return lookupResponse.Name, nil
+}
+
+// IsMemberOf returns true if email is a direct or indirect member of group.
+func (c *GoogleGroupsChecker) IsMemberOf(ctx context.Context, email string, group string) (bool, error) {
+	name, err := c.resourceName(ctx, group)
+	if err != nil {
+		return false, err
+	}
+	var checkResponse struct {
+		HasMembership bool `json:"hasMembership"`
+	}
+	query := url.Values{}
+	query.Set("query", fmt.Sprintf("member_key_id == '%s'", strings.ReplaceAll(email, "'", "")))
+	if err := cloudIdentityGet(ctx, c.client, "https://cloudidentity.googleapis.com/v1/"+name+"/memberships:checkTransitiveMembership?"+query.Encode(), &checkResponse); err != nil {
+		return false, fmt.Errorf("Error checking membership of %s in %s: %w", email, group, err)
+	}
+	return checkResponse.HasMembership, nil
+}
+
+// IsMember returns true if email is a direct or indirect member of any of the groups.
+func (c *GoogleGroupsChecker) IsMember(ctx context.Context, email string) (bool, error) {
+	for _, group := range c.groups {
+		isMember, err := c.IsMemberOf(ctx, email, group)
+		if err != nil || isMember {
+			return isMember, err
+		}
+	}
+	return false, nil
+}
+
+func makeGoogleGroupsChecker(client *http.Client) *GoogleGroupsChecker {
+	groups := os.Getenv("LOGIN_REQUIRED_GROUPS")
+	if groups == "" {
+		return nil
+	}
+	c := &GoogleGroupsChecker{client: client}
+	for _, group := range strings.Split(groups, ",") {
+		c.groups = append(c.groups, strings.TrimSpace(group))
+	}
+	return c
+}
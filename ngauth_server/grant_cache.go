@@ -0,0 +1,122 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// GrantCache remembers, for GRANT_CACHE_TTL, the storage access granted to a user, so that
+// /gcs_token/refresh can issue a new access token without repeating the permission check.  Token
+// policies, such as deny rules and quotas, are still checked on every refresh.
+type GrantCache struct {
+	ttl time.Duration
+
+	// Cache of grant key to *cachedGrant.
+	grants sync.Map
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+type cachedGrant struct {
+	prefixes    []string
+	permissions []string
+	expires     time.Time
+}
+
+// loadGrantCache returns the cache specified by GRANT_CACHE_TTL, or nil if grants are not cached.
+func loadGrantCache() (*GrantCache, error) {
+	ttlString, ok := os.LookupEnv("GRANT_CACHE_TTL")
+	if !ok {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(ttlString)
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("Invalid GRANT_CACHE_TTL")
+	}
+	return &GrantCache{ttl: ttl}, nil
+}
+
+// grantKey identifies the user, including the linked accounts, groups and claims on which access
+// may depend, e.g. through "claim:" role bindings, and the requested access.  Claims are maps,
+// which are encoded with sorted keys, so that equal claims have equal keys.
+func grantKey(userToken *UserToken, tokenRequest *GcsTokenRequest) string {
+	key, _ := json.Marshal([]interface{}{userToken.UserId, userToken.LinkedUserIds, userToken.Groups, userToken.Claims, tokenRequest.Bucket, tokenRequest.Prefix, tokenRequest.Mode})
+	return string(key)
+}
+
+// get returns the access previously granted for tokenRequest, or nil.
+func (c *GrantCache) get(userToken *UserToken, tokenRequest *GcsTokenRequest) *cachedGrant {
+	if c == nil {
+		return nil
+	}
+	if cached, ok := c.grants.Load(grantKey(userToken, tokenRequest)); ok && time.Now().Before(cached.(*cachedGrant).expires) {
+		return cached.(*cachedGrant)
+	}
+	return nil
+}
+
+// put records the access granted for tokenRequest.
+func (c *GrantCache) put(userToken *UserToken, tokenRequest *GcsTokenRequest, prefixes []string, permissions []string) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.grants.Store(grantKey(userToken, tokenRequest), &cachedGrant{prefixes: prefixes, permissions: permissions, expires: now.Add(c.ttl)})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+	c.grants.Range(func(key, value interface{}) bool {
+		if now.After(value.(*cachedGrant).expires) {
+			c.grants.Delete(key)
+		}
+		return true
+	})
+}
+
+func (auth *Authenticator) addGrantCacheRoutes(mux *gorilla_mux.Router) {
+	// Re-issues an access token as for /gcs_token, but without checking permissions again if the
+	// same access was granted to the user within GRANT_CACHE_TTL.
+	mux.Methods("POST").Path("/gcs_token/refresh").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin != "" {
+			w.Header().Set("access-control-allow-origin", origin)
+			w.Header().Set("vary", "origin")
+		}
+		var tokenRequest GcsTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&tokenRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tokenResponse, tokenErr := auth.issueGcsToken(r, origin, tokenRequest, true)
+		if tokenErr != nil {
+			tokenErr.writeHeaders(w)
+			http.Error(w, tokenErr.message, tokenErr.status)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse)
+	})
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// GroupBuckets maps identity provider groups to the buckets their members may read.
+type GroupBuckets map[string][]string
+
+func loadGroupBuckets() (GroupBuckets, error) {
+	path, ok := os.LookupEnv("GROUP_BUCKETS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading group buckets from %s: %w", path, err)
+	}
+	var groupBuckets GroupBuckets
+	if err := json.Unmarshal(data, &groupBuckets); err != nil {
+		return nil, fmt.Errorf("Error parsing group buckets from %s: %w", path, err)
+	}
+	return groupBuckets, nil
+}
+
+// IsGranted returns true if any of groups is allowed to read bucket.
+func (g GroupBuckets) IsGranted(groups []string, bucket string) bool {
+	for _, group := range groups {
+		for _, b := range g[group] {
+			if b == bucket {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,451 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// HTTP gateway: datasets served by password-protected HTTP servers may be gated by ngauth logins.
+// The upstream credentials are known only to ngauth.  A user with access to a source obtains a
+// short-lived gateway URL, which Neuroglancer uses as an ordinary https:// source, and ngauth
+// proxies read requests under it to the upstream server with the credentials added.  The gateway
+// URL contains an encrypted grant, so that it works without cookies or custom headers.  WebDAV
+// servers, e.g. Nextcloud, may additionally be listed with PROPFIND through the gateway.
+
+const gatewayUrlLifetimeSeconds = 60 * 60
+
+// Maximum size of the body of a PROPFIND request through the gateway.
+const maxPropfindBodySize = 1 << 16
+
+// Path of the gateway URL of a PROPFIND request, to which the hrefs of the response are rewritten.
+const gatewayPathContextKey contextKey = 2
+
+// Matches WebDAV href elements, with any namespace prefix.
+var webdavHrefPattern = regexp.MustCompile(`(<(?:[A-Za-z0-9_.-]+:)?href>)([^<]*)(<)`)
+
+// HttpSource specifies a protected HTTP server, or a directory of one.
+type HttpSource struct {
+	// Base URL to which the paths of gateway requests are appended.
+	URL string `json:"url"`
+
+	// File containing USERNAME:PASSWORD for HTTP basic authentication.
+	BasicAuthPath string `json:"basicAuthPath,omitempty"`
+
+	// File containing a bearer token.
+	BearerTokenPath string `json:"bearerTokenPath,omitempty"`
+
+	// Members, as for role bindings, who may read the source.
+	Readers []string `json:"readers"`
+
+	// GCS bucket read with the credentials of ngauth, e.g. because it is encrypted with a
+	// customer-supplied key, which is then added to upstream requests, or "".  The url defaults to
+	// https://storage.googleapis.com/BUCKET.
+	GcsBucket string `json:"gcsBucket,omitempty"`
+
+	// Whether the server is a WebDAV server whose collections may be listed with PROPFIND, with
+	// depth 0 or 1.
+	WebDAV bool `json:"webdav,omitempty"`
+
+	// Value of the Authorization header of upstream requests.
+	authorization string
+
+	baseURL *url.URL
+	proxy   *httputil.ReverseProxy
+}
+
+// gatewayGrant authorizes requests through the gateway to one source until it expires.  It carries
+// the principals of the user, so that deny rules and the readers of the source are checked again
+// for each request.
+type gatewayGrant struct {
+	Source         string                 `json:"s"`
+	UserId         string                 `json:"u"`
+	LinkedUserIds  []string               `json:"l,omitempty"`
+	Groups         []string               `json:"g,omitempty"`
+	Claims         map[string]interface{} `json:"c,omitempty"`
+	ImpersonatedBy string                 `json:"m,omitempty"`
+	SessionId      string                 `json:"i,omitempty"`
+	IssuedAt       int64                  `json:"a,omitempty"`
+	Origin         string                 `json:"o,omitempty"`
+	Expires        int64                  `json:"e"`
+}
+
+// userToken returns the user token, with the principals, of the user to whom the grant was issued.
+func (g *gatewayGrant) userToken() *UserToken {
+	return &UserToken{
+		UserId:         g.UserId,
+		LinkedUserIds:  g.LinkedUserIds,
+		Groups:         g.Groups,
+		Claims:         g.Claims,
+		ImpersonatedBy: g.ImpersonatedBy,
+		SessionId:      g.SessionId,
+		IssuedAt:       g.IssuedAt,
+	}
+}
+
+// loadHttpSources loads the sources specified by HTTP_SOURCES_PATH, a JSON object mapping source
+// names to HttpSource.
+func loadHttpSources() (map[string]*HttpSource, error) {
+	sourcesPath, ok := os.LookupEnv("HTTP_SOURCES_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(sourcesPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading HTTP sources from %s: %w", sourcesPath, err)
+	}
+	var sources map[string]*HttpSource
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return nil, fmt.Errorf("Error parsing HTTP sources from %s: %w", sourcesPath, err)
+	}
+	for name, source := range sources {
+		if err := source.load(name); err != nil {
+			return nil, err
+		}
+	}
+	return sources, nil
+}
+
+func (s *HttpSource) load(name string) error {
+	if s.GcsBucket != "" {
+		if s.BasicAuthPath != "" || s.BearerTokenPath != "" || s.WebDAV {
+			return fmt.Errorf("HTTP source %s for GCS bucket %s must not specify credentials or webdav", name, s.GcsBucket)
+		}
+		if s.URL == "" {
+			s.URL = "https://storage.googleapis.com/" + s.GcsBucket
+		}
+	}
+	baseURL, err := url.Parse(strings.TrimSuffix(s.URL, "/"))
+	if err != nil || (baseURL.Scheme != "https" && baseURL.Scheme != "http") || baseURL.Host == "" {
+		return fmt.Errorf("HTTP source %s must specify an http or https url", name)
+	}
+	s.baseURL = baseURL
+	switch {
+	case s.BasicAuthPath != "" && s.BearerTokenPath != "":
+		return fmt.Errorf("HTTP source %s must specify either basicAuthPath or bearerTokenPath", name)
+	case s.BasicAuthPath != "":
+		credentials, err := ioutil.ReadFile(s.BasicAuthPath)
+		if err != nil {
+			return fmt.Errorf("Error reading credentials of HTTP source %s from %s: %w", name, s.BasicAuthPath, err)
+		}
+		s.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(strings.TrimSpace(string(credentials))))
+	case s.BearerTokenPath != "":
+		token, err := ioutil.ReadFile(s.BearerTokenPath)
+		if err != nil {
+			return fmt.Errorf("Error reading token of HTTP source %s from %s: %w", name, s.BearerTokenPath, err)
+		}
+		s.authorization = "Bearer " + strings.TrimSpace(string(token))
+	}
+	s.proxy = &httputil.ReverseProxy{
+		// Requests are rewritten by the gateway handler.
+		Director: func(*http.Request) {},
+		ModifyResponse: func(resp *http.Response) error {
+			// Cookies and CORS headers of the upstream server do not apply to the gateway.
+			resp.Header.Del("set-cookie")
+			// Responses are specific to the grant, so they must not be stored by shared caches.
+			resp.Header.Set("cache-control", "private")
+			for name := range resp.Header {
+				if strings.HasPrefix(strings.ToLower(name), "access-control-") {
+					resp.Header.Del(name)
+				}
+			}
+			if resp.Request.Method == "PROPFIND" && resp.StatusCode == http.StatusMultiStatus {
+				return s.rewriteWebdavHrefs(resp)
+			}
+			return nil
+		},
+	}
+	return nil
+}
+
+// rewriteWebdavHrefs rewrites the hrefs of a PROPFIND response that refer to resources of the
+// source to the corresponding gateway URLs.
+func (s *HttpSource) rewriteWebdavHrefs(resp *http.Response) error {
+	gatewayPath, _ := resp.Request.Context().Value(gatewayPathContextKey).(string)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	basePath := s.baseURL.EscapedPath()
+	origin := s.baseURL.Scheme + "://" + s.baseURL.Host
+	body = webdavHrefPattern.ReplaceAllFunc(body, func(element []byte) []byte {
+		parts := webdavHrefPattern.FindSubmatch(element)
+		href := strings.TrimPrefix(strings.TrimSpace(string(parts[2])), origin)
+		if href != basePath && !strings.HasPrefix(href, basePath+"/") {
+			return element
+		}
+		return []byte(string(parts[1]) + gatewayPath + strings.TrimPrefix(href, basePath) + string(parts[3]))
+	})
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("content-length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// gatewayKey derives the key used to encrypt gateway grants from the login session key.
+func (auth *Authenticator) gatewayKey() []byte {
+	hasher := hmac.New(sha256.New, auth.UserTokenKey)
+	hasher.Write([]byte("ngauth http gateway"))
+	return hasher.Sum(nil)
+}
+
+// encodeGatewayGrant encrypts grant as a URL path segment.
+func (auth *Authenticator) encodeGatewayGrant(grant *gatewayGrant) string {
+	// Json encoding cannot fail
+	encodedJson, _ := json.Marshal(grant)
+	aead := userTokenCipher(auth.gatewayKey())
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return base64url.EncodeToString(aead.Seal(nonce, nonce, encodedJson, nil))
+}
+
+// decodeGatewayGrant decrypts a grant encoded by encodeGatewayGrant, and checks that it has not
+// expired or been revoked.
+func (auth *Authenticator) decodeGatewayGrant(r *http.Request, encoded string) (*gatewayGrant, error) {
+	sealed, err := base64url.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	aead := userTokenCipher(auth.gatewayKey())
+	if len(sealed) <= aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid gateway grant")
+	}
+	encodedJson, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gateway grant")
+	}
+	var grant gatewayGrant
+	if err := json.Unmarshal(encodedJson, &grant); err != nil {
+		return nil, err
+	}
+	if grant.Expires < time.Now().Unix() {
+		return nil, fmt.Errorf("Gateway grant expired")
+	}
+	if auth.Revocations.IsRevoked(r.Context(), grant.userToken()) {
+		return nil, fmt.Errorf("Gateway grant revoked")
+	}
+	return &grant, nil
+}
+
+// gatewayUpstreamURL returns the URL of source to which a gateway request for path is proxied, or
+// nil if path is not within the source.
+func gatewayUpstreamURL(source *HttpSource, path string, rawQuery string) *url.URL {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." || segment == "." {
+			return nil
+		}
+	}
+	target := *source.baseURL
+	target.Path = source.baseURL.Path + "/" + path
+	target.RawPath = ""
+	target.RawQuery = rawQuery
+	return &target
+}
+
+// httpGatewayBroker issues gateway URLs for HTTP sources.  The resource is the source name.
+type httpGatewayBroker struct {
+	auth *Authenticator
+}
+
+func makeHttpGatewayBroker(auth *Authenticator) CredentialBroker {
+	if auth.HttpSources == nil {
+		return nil
+	}
+	return &httpGatewayBroker{auth: auth}
+}
+
+// authorize checks the user's access to the source of request, and returns the user token.
+func (b *httpGatewayBroker) authorize(r *http.Request, origin string, request *CredentialRequest) (*UserToken, *credentialError) {
+	auth := b.auth
+	source := auth.HttpSources[request.Resource]
+	if source == nil {
+		return nil, &credentialError{status: http.StatusNotFound, message: "Unknown source"}
+	}
+	userToken, tokenErr := auth.authenticateCredentialRequest(r, request)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	if auth.DenyRules.IsDenied(userToken, "", origin, userToken.Origin) || !auth.OriginPolicies.AllowsOrigin(userToken, origin) {
+		return nil, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	if source.GcsBucket != "" {
+		// Policies of the bucket, e.g. embargoes, apply as they would to access tokens.
+		tokenRequest := GcsTokenRequest{Bucket: source.GcsBucket, Mode: readMode}
+		if denial, _ := auth.checkTokenPolicies(r, origin, userToken, &tokenRequest); denial != nil {
+			return nil, &credentialError{status: denial.status, message: denial.message, challenge: denial.challenge}
+		}
+	}
+	if !hasMember(source.Readers, userToken) {
+		log.Printf("AUDIT: %s denied gateway URL for HTTP source %s", userToken.UserId, request.Resource)
+		return nil, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	return userToken, nil
+}
+
+func (b *httpGatewayBroker) CheckAccess(r *http.Request, origin string, request *CredentialRequest) *credentialError {
+	_, tokenErr := b.authorize(r, origin, request)
+	return tokenErr
+}
+
+func (b *httpGatewayBroker) IssueCredential(r *http.Request, origin string, request *CredentialRequest) (interface{}, *credentialError) {
+	userToken, tokenErr := b.authorize(r, origin, request)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	grant := &gatewayGrant{
+		Source:         request.Resource,
+		UserId:         userToken.UserId,
+		LinkedUserIds:  userToken.LinkedUserIds,
+		Groups:         userToken.Groups,
+		Claims:         userToken.Claims,
+		ImpersonatedBy: userToken.ImpersonatedBy,
+		SessionId:      userToken.SessionId,
+		IssuedAt:       userToken.IssuedAt,
+		Origin:         origin,
+		Expires:        time.Now().Unix() + gatewayUrlLifetimeSeconds,
+	}
+	log.Printf("AUDIT: %s obtained gateway URL for HTTP source %s", userToken.UserId, request.Resource)
+	return map[string]interface{}{
+		"url":       getBaseURL(r) + "/http_gateway/" + b.auth.encodeGatewayGrant(grant) + "/",
+		"expiresAt": grant.Expires,
+	}, nil
+}
+
+func (auth *Authenticator) addHttpGatewayRoutes(mux *gorilla_mux.Router) {
+	// Returns a gateway URL for a source, for a request with the same token as for /gcs_token.
+	mux.Methods("POST").Path("/http_gateway_url").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowCredentialOrigin(w, r)
+		var request struct {
+			Token  string `json:"token"`
+			Source string `json:"source"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveCredentialRequest(w, r, origin, auth.CredentialBrokers["http"], &CredentialRequest{Token: request.Token, Resource: request.Source})
+	})
+
+	mux.Methods("GET", "HEAD", "OPTIONS", "PROPFIND").Path("/http_gateway/{grant}/{path:.*}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := gorilla_mux.Vars(r)
+		grant, err := auth.decodeGatewayGrant(r, vars["grant"])
+		if err != nil {
+			http.Error(w, "Invalid gateway URL", http.StatusForbidden)
+			return
+		}
+		// As for tokens issued to an origin, the URL may only be used by that origin's pages.  Requests
+		// without an origin, e.g. from other applications, are refused as well.
+		origin := r.Header.Get("origin")
+		if grant.Origin != "" && origin != grant.Origin {
+			log.Printf("AUDIT: gateway URL of %s issued to origin %s used from origin %s", grant.UserId, grant.Origin, origin)
+			http.Error(w, "Gateway URL not valid for origin", http.StatusForbidden)
+			return
+		}
+		if origin != "" {
+			w.Header().Set("access-control-allow-origin", origin)
+			w.Header().Set("access-control-expose-headers", "content-length, content-range, etag")
+			w.Header().Set("vary", "origin")
+		}
+		source := auth.HttpSources[grant.Source]
+		if source == nil {
+			http.Error(w, "Unknown source", http.StatusNotFound)
+			return
+		}
+		// Deny rules and the readers of the source may have changed since the grant was issued.
+		userToken := grant.userToken()
+		if auth.DenyRules.IsDenied(userToken, source.GcsBucket, origin) || !hasMember(source.Readers, userToken) {
+			log.Printf("AUDIT: %s denied gateway request for HTTP source %s", grant.UserId, grant.Source)
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		if r.Method == "OPTIONS" {
+			if source.WebDAV {
+				w.Header().Set("access-control-allow-methods", "GET, HEAD, PROPFIND")
+				w.Header().Set("access-control-allow-headers", "range, depth, content-type")
+			} else {
+				w.Header().Set("access-control-allow-methods", "GET, HEAD")
+				w.Header().Set("access-control-allow-headers", "range")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method == "PROPFIND" {
+			if !source.WebDAV {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			// As WebDAV servers commonly do, listing of entire trees is refused.
+			if depth := r.Header.Get("depth"); depth != "0" && depth != "1" {
+				http.Error(w, "Depth must be 0 or 1", http.StatusForbidden)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxPropfindBodySize)
+			r = r.WithContext(context.WithValue(r.Context(), gatewayPathContextKey, "/http_gateway/"+vars["grant"]))
+		}
+		target := gatewayUpstreamURL(source, vars["path"], r.URL.RawQuery)
+		if target == nil {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		upstream := r.Clone(r.Context())
+		upstream.URL = target
+		upstream.Host = ""
+		upstream.RequestURI = ""
+		upstream.Header.Del("cookie")
+		upstream.Header.Del("authorization")
+		upstream.Header.Del("origin")
+		if r.Method == "PROPFIND" {
+			// The response is rewritten, so it must not be compressed.
+			upstream.Header.Del("accept-encoding")
+		}
+		if source.authorization != "" {
+			upstream.Header.Set("authorization", source.authorization)
+		}
+		if source.GcsBucket != "" {
+			token, err := auth.getBucketCredentials(source.GcsBucket).TokenSource.Token()
+			if err != nil {
+				log.Printf("Error obtaining access token for bucket %s: %+v", source.GcsBucket, err)
+				http.Error(w, "Failed to obtain access token", http.StatusInternalServerError)
+				return
+			}
+			upstream.Header.Set("authorization", "Bearer "+token.AccessToken)
+			if key := auth.EncryptionKeys[source.GcsBucket]; key != nil {
+				key.setHeaders(upstream.Header)
+			}
+		}
+		source.proxy.ServeHTTP(w, upstream)
+	})
+}
@@ -0,0 +1,264 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	gorilla_mux "github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/idtoken"
+)
+
+// Identity is the result of validating an id_token.
+type Identity struct {
+	// User id, which is qualified with the provider name (see QualifyUserId) once the identity
+	// has been returned by the provider.
+	UserId string
+
+	// Additional user ids, verified by the provider, that are linked to the same account.
+	LinkedUserIds []string
+
+	// Groups or roles asserted by the provider.
+	Groups []string
+
+	// Claims from the validated id_token.
+	Claims map[string]interface{}
+}
+
+// IdentityProvider authenticates users.
+type IdentityProvider interface {
+	// Name identifies the provider, e.g. "google" or "entra".
+	Name() string
+}
+
+// OAuth2IdentityProvider is an IdentityProvider that authenticates users through an OAuth2
+// authorization code flow that returns an OpenID Connect id_token.
+type OAuth2IdentityProvider interface {
+	IdentityProvider
+
+	// OAuth2Config returns the client configuration.  The RedirectURL is filled in per request.
+	OAuth2Config() *oauth2.Config
+
+	// AuthCodeOptions returns additional parameters for the authorization request.
+	AuthCodeOptions() []oauth2.AuthCodeOption
+
+	// ValidateIdToken checks the signature and claims of the id_token returned by the token
+	// endpoint.
+	ValidateIdToken(ctx context.Context, idToken string) (*Identity, error)
+}
+
+// loginStarter is implemented by identity providers that do not use the OAuth2 flow.
+type loginStarter interface {
+	// StartLogin handles a /login request for this provider.  Once the user is authenticated,
+	// the provider calls auth.completeLogin.
+	StartLogin(auth *Authenticator, w http.ResponseWriter, r *http.Request, state loginState)
+}
+
+// routeProvider is implemented by identity providers that handle additional endpoints, e.g. to
+// receive the result of the login flow.
+type routeProvider interface {
+	AddRoutes(auth *Authenticator, mux *gorilla_mux.Router)
+}
+
+// tlsConfigurer is implemented by identity providers that require changes to the TLS
+// configuration when ngauth terminates TLS itself.
+type tlsConfigurer interface {
+	ConfigureTLS(config *tls.Config)
+}
+
+// accessTokenValidator is implemented by identity providers that also require the access token
+// returned by the token endpoint to be validated.
+type accessTokenValidator interface {
+	ValidateAccessToken(ctx context.Context, accessToken string) error
+}
+
+type googleProvider struct {
+	config *oauth2.Config
+
+	// If non-empty, only accounts in these Google Workspace domains (the "hd" claim) may log in.
+	allowedHostedDomains map[string]bool
+}
+
+func (p *googleProvider) Name() string {
+	return "google"
+}
+
+func (p *googleProvider) OAuth2Config() *oauth2.Config {
+	return p.config
+}
+
+func (p *googleProvider) AuthCodeOptions() []oauth2.AuthCodeOption {
+	options := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
+	if len(p.allowedHostedDomains) == 1 {
+		// Hint the account chooser to show only accounts in the allowed domain.
+		for domain := range p.allowedHostedDomains {
+			options = append(options, oauth2.SetAuthURLParam("hd", domain))
+		}
+	}
+	return options
+}
+
+func (p *googleProvider) ValidateIdToken(ctx context.Context, idToken string) (identity *Identity, err error) {
+	return p.validateIdTokenForAudience(ctx, idToken, p.config.ClientID)
+}
+
+func (p *googleProvider) validateIdTokenForAudience(ctx context.Context, idToken string, audience string) (identity *Identity, err error) {
+	payload, err := idtoken.Validate(ctx, idToken, audience)
+	if err != nil {
+		err = fmt.Errorf("Invalid id_token: %w", err)
+		return
+	}
+	var userId string
+	switch v := payload.Claims["email"].(type) {
+	case string:
+		userId = v
+		break
+	default:
+		err = fmt.Errorf("id_token is missing email")
+		return
+	}
+	switch v := payload.Claims["email_verified"].(type) {
+	case bool:
+		if !v {
+			err = fmt.Errorf("id_token is is missing verified_email")
+			return
+		}
+		break
+	default:
+		err = fmt.Errorf("id_token is is missing verified_email")
+		return
+	}
+	if len(p.allowedHostedDomains) > 0 {
+		hd, _ := payload.Claims["hd"].(string)
+		if !p.allowedHostedDomains[hd] {
+			err = fmt.Errorf("Account %s is not in an allowed hosted domain", userId)
+			return
+		}
+	}
+	identity = &Identity{UserId: userId, Claims: payload.Claims}
+	return
+}
+
+func makeGoogleProvider(ctx context.Context) (IdentityProvider, error) {
+	clientCredentialsPath := getEnvOr("OAUTH2_CLIENT_CREDENTIALS_PATH", "secrets/client_credentials.json")
+	clientCredentials, err := ioutil.ReadFile(clientCredentialsPath)
+	var config *oauth2.Config
+	if err == nil {
+		config, err = google.ConfigFromJSON(clientCredentials)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client credentials from %s: %w", clientCredentialsPath, err)
+	}
+	config.Scopes = []string{"email"}
+	provider := &googleProvider{config: config, allowedHostedDomains: make(map[string]bool)}
+	if domains := os.Getenv("GOOGLE_ALLOWED_HOSTED_DOMAINS"); domains != "" {
+		for _, domain := range strings.Split(domains, ",") {
+			provider.allowedHostedDomains[strings.ToLower(strings.TrimSpace(domain))] = true
+		}
+	}
+	return provider, nil
+}
+
+var identityProviderFactories = map[string]func(ctx context.Context) (IdentityProvider, error){
+	"google":   makeGoogleProvider,
+	"entra":    makeEntraProvider,
+	"globus":   makeGlobusProvider,
+	"keycloak": makeKeycloakProvider,
+	"okta":     makeOktaProvider,
+	"auth0":    makeAuth0Provider,
+	"orcid":    makeOrcidProvider,
+	"saml":     makeSamlProvider,
+	"ldap":     makeLdapProvider,
+	"kerberos": makeKerberosProvider,
+	"mtls":     makeMtlsProvider,
+}
+
+var identityProviderDisplayNames = map[string]string{
+	"google":   "Google",
+	"entra":    "Microsoft",
+	"globus":   "Globus",
+	"keycloak": "Keycloak",
+	"okta":     "Okta",
+	"auth0":    "Auth0",
+	"orcid":    "ORCID",
+	"saml":     "Institutional login (SAML)",
+	"ldap":     "Directory login (LDAP)",
+	"kerberos": "Single sign-on (Kerberos)",
+	"mtls":     "Client certificate",
+}
+
+// QualifyUserId namespaces a provider-specific user id with the provider name, e.g.
+// "google:alice@example.com" or "orcid:0000-0002-1825-0097".
+func QualifyUserId(provider string, id string) string {
+	return provider + ":" + id
+}
+
+// SplitUserId splits a qualified user id into the provider name and the provider-specific id.
+// Unqualified user ids, issued before multiple providers were supported, are Google accounts.
+func SplitUserId(userId string) (provider string, id string) {
+	if i := strings.Index(userId, ":"); i != -1 {
+		return userId[:i], userId[i+1:]
+	}
+	return "google", userId
+}
+
+func qualifyAll(provider string, ids []string) []string {
+	var result []string
+	for _, id := range ids {
+		result = append(result, QualifyUserId(provider, id))
+	}
+	return result
+}
+
+// qualify namespaces the user ids and groups of identity with the provider name.
+func (identity *Identity) qualify(provider string) {
+	identity.UserId = QualifyUserId(provider, identity.UserId)
+	identity.LinkedUserIds = qualifyAll(provider, identity.LinkedUserIds)
+	identity.Groups = qualifyAll(provider, identity.Groups)
+}
+
+func makeIdentityProvider(ctx context.Context, name string) (IdentityProvider, error) {
+	factory, ok := identityProviderFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown identity provider: %q", name)
+	}
+	provider, err := factory(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing %s identity provider: %w", name, err)
+	}
+	return provider, nil
+}
+
+// makeIdentityProviders initializes the comma-separated list of providers specified by the
+// IDENTITY_PROVIDERS environment variable.
+func makeIdentityProviders(ctx context.Context) (providers []IdentityProvider, err error) {
+	for _, name := range strings.Split(getEnvOr("IDENTITY_PROVIDERS", "google"), ",") {
+		name = strings.TrimSpace(name)
+		var provider IdentityProvider
+		provider, err = makeIdentityProvider(ctx, name)
+		if err != nil {
+			return
+		}
+		providers = append(providers, provider)
+	}
+	return
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Impersonation allows administrators to log in as another user, in order to reproduce
+// permission problems.  Each impersonation is logged and recorded in the store.
+
+type impersonationRecord struct {
+	Admin      string   `json:"admin"`
+	UserId     string   `json:"userId"`
+	Groups     []string `json:"groups,omitempty"`
+	RemoteAddr string   `json:"remoteAddr"`
+	Time       int64    `json:"time"`
+}
+
+// loadAdminUsers returns the qualified user ids specified by ADMIN_USERS.
+func loadAdminUsers() map[string]bool {
+	admins := make(map[string]bool)
+	for _, userId := range splitList(os.Getenv("ADMIN_USERS")) {
+		admins[userId] = true
+	}
+	return admins
+}
+
+// isAdmin returns true if the token identifies an administrator.  Impersonated tokens never do,
+// even when impersonating an administrator.
+func (auth *Authenticator) isAdmin(token *UserToken) bool {
+	return token != nil && token.ImpersonatedBy == "" && auth.AdminUsers[token.UserId]
+}
+
+func (auth *Authenticator) addImpersonationRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("GET").Path("/admin/impersonate").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getUserTokenFromCookie(r)
+		if !auth.isAdmin(userToken) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Add("x-frame-options", "deny")
+		w.Header().Add("content-type", "text/html")
+		fmt.Fprintf(w, `<html><head><title>Impersonate user</title></head><body>
+<p>Log in as another user for 1 hour.  This action is audited.</p>
+<form action="/admin/impersonate" method="post">
+<input type="hidden" name="token" value="%s">
+<p><input type="text" name="user_id" placeholder="User id, e.g. google:alice@example.org" size="50"></p>
+<p><input type="text" name="linked_user_ids" placeholder="Linked user ids (comma-separated, optional)" size="50"></p>
+<p><input type="text" name="groups" placeholder="Groups (comma-separated, optional)" size="50"></p>
+<input type="submit" value="Impersonate">
+</form>
+</body></html>`, html.EscapeString(EncodeUserToken(auth.UserTokenKey, formUserTokenType, auth.makeTemporaryUserToken(*userToken, ""))))
+	})
+
+	mux.Methods("POST").Path("/admin/impersonate").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Missing token", http.StatusBadRequest)
+			return
+		}
+		// As for /logout, the form must include a token for the logged-in user, to prevent
+		// cross-site request forgery.
+		userToken := auth.getUserTokenFromCookie(r)
+		formToken, err := DecodeUserToken(auth.UserTokenKey, formUserTokenType, r.PostForm.Get("token"))
+		if !auth.isAdmin(userToken) || err != nil || formToken.UserId != userToken.UserId {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		targetUserId := strings.TrimSpace(r.PostForm.Get("user_id"))
+		if targetUserId == "" {
+			http.Error(w, "Missing user id", http.StatusBadRequest)
+			return
+		}
+		impersonatedToken := UserToken{
+			UserId:         targetUserId,
+			Expires:        time.Now().Unix() + auth.TokenLifetimes.CrossOriginLifetimeSeconds(""),
+			LinkedUserIds:  splitList(r.PostForm.Get("linked_user_ids")),
+			Groups:         splitList(r.PostForm.Get("groups")),
+			MFA:            userToken.MFA,
+			ImpersonatedBy: userToken.UserId,
+			IssuedAt:       time.Now().Unix(),
+		}
+		record := impersonationRecord{
+			Admin:      userToken.UserId,
+			UserId:     targetUserId,
+			Groups:     impersonatedToken.Groups,
+			RemoteAddr: r.RemoteAddr,
+			Time:       time.Now().Unix(),
+		}
+		log.Printf("AUDIT: %s impersonated %s (linked=%v, groups=%v) from %s", record.Admin, record.UserId, impersonatedToken.LinkedUserIds, record.Groups, record.RemoteAddr)
+		key := fmt.Sprintf("audit/impersonation/%020d-%s", time.Now().UnixNano(), userToken.UserId)
+		if err := auth.Store.Put(r.Context(), key, record); err != nil {
+			// Refuse to impersonate without an audit record.
+			log.Printf("Error recording impersonation: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if err := auth.setUserTokenCookie(w, r, impersonatedToken); err != nil {
+			log.Printf("Error setting login session of %s: %v", impersonatedToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
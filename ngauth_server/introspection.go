@@ -0,0 +1,112 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Token introspection (RFC 7662): trusted backend services, registered as service clients with
+// "introspect": true, may determine whether an ngauth token is active and which user it
+// identifies, so that a family of services can share ngauth as their authentication authority.
+
+type introspectionResponse struct {
+	Active bool `json:"active"`
+
+	TokenType string `json:"token_type,omitempty"`
+
+	// Qualified user id.
+	Subject  string `json:"sub,omitempty"`
+	Username string `json:"username,omitempty"`
+	Expires  int64  `json:"exp,omitempty"`
+	Issuer   string `json:"iss,omitempty"`
+
+	// Service for which the token was issued.
+	Audience string `json:"aud,omitempty"`
+
+	Name          string   `json:"name,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+	LinkedUserIds []string `json:"linked_user_ids,omitempty"`
+
+	// Buckets for which the token may be used, if restricted.
+	Buckets []string `json:"buckets,omitempty"`
+
+	MFA bool `json:"mfa,omitempty"`
+
+	// Confirmation of the DPoP key to which the token is bound, as specified by RFC 9449.
+	Confirmation map[string]string `json:"cnf,omitempty"`
+}
+
+func (auth *Authenticator) addIntrospectionRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("POST").Path("/introspect").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		clientId := auth.authenticateServiceClient(r)
+		if clientId == "" || !auth.ServiceClients[clientId].Introspect {
+			w.Header().Set("content-type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		token := r.PostForm.Get("token")
+		if token == "" {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		var userToken UserToken
+		var err error
+		if strings.HasPrefix(token, personalAccessTokenPrefix) {
+			var pat *UserToken
+			if pat, err = auth.resolvePersonalAccessToken(r.Context(), token); err == nil {
+				userToken = *pat
+			}
+		} else {
+			userToken, err = auth.DecodeClientToken(r.Context(), token)
+		}
+		var response introspectionResponse
+		if err == nil && !auth.DenyRules.IsDenied(&userToken, "") {
+			response = introspectionResponse{
+				Active:        true,
+				TokenType:     "Bearer",
+				Subject:       userToken.UserId,
+				Username:      userToken.UserId,
+				Expires:       userToken.Expires,
+				Name:          userToken.Name,
+				Groups:        userToken.Groups,
+				LinkedUserIds: userToken.LinkedUserIds,
+				Buckets:       userToken.Buckets,
+				MFA:           userToken.MFA,
+				Audience:      userToken.Audience,
+			}
+			if auth.UserTokenSigner != nil {
+				response.Issuer = auth.UserTokenSigner.issuer
+			}
+			if userToken.DPoPKeyThumbprint != "" {
+				response.TokenType = "DPoP"
+				response.Confirmation = map[string]string{"jkt": userToken.DPoPKeyThumbprint}
+			}
+		}
+		log.Printf("Service client %s introspected token, active=%v, user=%s", clientId, response.Active, response.Subject)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(&response)
+	})
+}
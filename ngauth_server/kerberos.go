@@ -0,0 +1,105 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jcmturner/goidentity/v6"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// Kerberos identity provider, using SPNEGO (HTTP Negotiate) authentication.
+//
+// On intranets where browsers are configured to send Kerberos tickets to ngauth, the login
+// popup completes immediately without any user interaction.
+
+type kerberosProvider struct {
+	keytab   *keytab.Keytab
+	settings []func(*service.Settings)
+
+	// Realm of the accepted principals.  Principals of other realms, which may be trusted by the
+	// KDC, are rejected.
+	realm string
+
+	// If non-empty, principals are mapped to email addresses in emailDomain, e.g.
+	// "alice@EXAMPLE.ORG" to "alice@example.org", and otherwise identified by the principal name
+	// without the realm, e.g. "alice".
+	emailDomain string
+}
+
+func (p *kerberosProvider) Name() string {
+	return "kerberos"
+}
+
+// identity returns the identity of the principal id, or nil if the principal is not accepted.
+func (p *kerberosProvider) identity(id goidentity.Identity) *Identity {
+	// Enterprise principal names, e.g. "alice@example.org@EXAMPLE.ORG", would be mistaken for email
+	// addresses.
+	if id.Domain() != p.realm || id.UserName() == "" || strings.Contains(id.UserName(), "@") {
+		return nil
+	}
+	userId := id.UserName()
+	if p.emailDomain != "" {
+		userId = id.UserName() + "@" + p.emailDomain
+	}
+	return &Identity{
+		UserId: userId,
+		// With an Active Directory KDC, these are the security identifiers of the user's groups.
+		Groups: id.AuthzAttributes(),
+	}
+}
+
+func (p *kerberosProvider) StartLogin(auth *Authenticator, w http.ResponseWriter, r *http.Request, state loginState) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := goidentity.FromHTTPRequestContext(r)
+		if id == nil || !id.Authenticated() {
+			http.Error(w, "Kerberos authentication failed", http.StatusUnauthorized)
+			return
+		}
+		identity := p.identity(id)
+		if identity == nil {
+			http.Error(w, "Kerberos principal not accepted", http.StatusForbidden)
+			return
+		}
+		auth.completeLogin(w, r, p, identity, state)
+	})
+	spnego.SPNEGOKRB5Authenticate(inner, p.keytab, p.settings...).ServeHTTP(w, r)
+}
+
+func makeKerberosProvider(ctx context.Context) (IdentityProvider, error) {
+	keytabPath := getEnvOr("KERBEROS_KEYTAB_PATH", "secrets/krb5.keytab")
+	kt, err := keytab.Load(keytabPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading keytab from %s: %w", keytabPath, err)
+	}
+	p := &kerberosProvider{
+		keytab:      kt,
+		realm:       os.Getenv("KERBEROS_REALM"),
+		emailDomain: os.Getenv("KERBEROS_EMAIL_DOMAIN"),
+	}
+	if p.realm == "" {
+		return nil, fmt.Errorf("KERBEROS_REALM must be specified")
+	}
+	if principal := os.Getenv("KERBEROS_SERVICE_PRINCIPAL"); principal != "" {
+		p.settings = append(p.settings, service.KeytabPrincipal(strings.TrimSpace(principal)))
+	}
+	return p, nil
+}
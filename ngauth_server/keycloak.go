@@ -0,0 +1,64 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Keycloak realm identity provider.
+
+// Prefix applied to realm roles when they are reported as groups.
+const keycloakRealmRolePrefix = "role:"
+
+type keycloakProvider struct {
+	*oidcProvider
+}
+
+func (p *keycloakProvider) ValidateIdToken(ctx context.Context, idToken string) (*Identity, error) {
+	identity, err := p.oidcProvider.ValidateIdToken(ctx, idToken)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range getStringListClaim(identity.Claims, "realm_access.roles") {
+		identity.Groups = append(identity.Groups, keycloakRealmRolePrefix+role)
+	}
+	return identity, nil
+}
+
+func makeKeycloakProvider(ctx context.Context) (IdentityProvider, error) {
+	realmURL := strings.TrimSuffix(os.Getenv("KEYCLOAK_REALM_URL"), "/")
+	if realmURL == "" {
+		return nil, fmt.Errorf("KEYCLOAK_REALM_URL must be specified")
+	}
+	clientID := os.Getenv("KEYCLOAK_CLIENT_ID")
+	if clientID == "" {
+		return nil, fmt.Errorf("KEYCLOAK_CLIENT_ID must be specified")
+	}
+	clientSecretPath := getEnvOr("KEYCLOAK_CLIENT_SECRET_PATH", "secrets/keycloak_client_secret.txt")
+	clientSecret, err := readClientSecret(clientSecretPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client secret from %s: %w", clientSecretPath, err)
+	}
+	provider, err := newOIDCProvider(ctx, "keycloak", realmURL, clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	provider.requireEmailVerified = true
+	provider.groupsClaim = getEnvOr("KEYCLOAK_GROUPS_CLAIM", "groups")
+	return &keycloakProvider{oidcProvider: provider}, nil
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// LDAP / Active Directory identity provider, for deployments that cannot use an external OAuth2
+// provider.  Users enter their directory username and password into a login form served by
+// ngauth, which verifies them with an LDAP simple bind.
+
+const ldapTimeout = 10 * time.Second
+
+// Failed logins are limited per username and per client address within each window, to limit
+// password guessing.  The limits apply per instance of ngauth.
+const (
+	ldapLoginWindow           = 15 * time.Minute
+	ldapMaxFailuresPerUser    = 5
+	ldapMaxFailuresPerAddress = 20
+)
+
+var errLdapInvalidCredentials = errors.New("Invalid credentials")
+
+// Usernames are restricted to characters that need no escaping in DNs.
+var ldapUsernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._@-]+$`)
+
+// loginThrottle counts failed logins per key, e.g. username or client address, within fixed
+// windows.
+type loginThrottle struct {
+	mutex    sync.Mutex
+	failures map[string]*quotaCounter
+}
+
+// blockedUntil returns the end of the current window if key has failed limit times within it, or
+// the zero time.
+func (t *loginThrottle) blockedUntil(key string, limit int) time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	counter := t.failures[key]
+	if counter == nil || !time.Now().Before(counter.Expires) || counter.Count < limit {
+		return time.Time{}
+	}
+	return counter.Expires
+}
+
+// fail records a failed login for each of keys.
+func (t *loginThrottle) fail(keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	for k, counter := range t.failures {
+		if !now.Before(counter.Expires) {
+			delete(t.failures, k)
+		}
+	}
+	for _, key := range keys {
+		counter := t.failures[key]
+		if counter == nil {
+			counter = &quotaCounter{Expires: now.Add(ldapLoginWindow)}
+			t.failures[key] = counter
+		}
+		counter.Count++
+	}
+}
+
+// reset forgets the failed logins of key, e.g. after a successful login.
+func (t *loginThrottle) reset(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.failures, key)
+}
+
+func dialLdap(serverURL *url.URL) (*ldap.Conn, error) {
+	if serverURL.Scheme != "ldap" && serverURL.Scheme != "ldaps" {
+		return nil, fmt.Errorf("Unsupported LDAP URL scheme: %q", serverURL.Scheme)
+	}
+	tlsConfig := &tls.Config{ServerName: serverURL.Hostname()}
+	conn, err := ldap.DialURL(serverURL.String(), ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if serverURL.Scheme == "ldap" {
+		// Passwords are never sent over an unencrypted connection.
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+type ldapProvider struct {
+	serverURL *url.URL
+
+	// Template for the bind DN, with %s replaced by the username, e.g.
+	// "uid=%s,ou=people,dc=example,dc=org", or "%s@example.org" for Active Directory.
+	bindDNTemplate string
+
+	// If searchBase is non-empty, the user's entry is located by searching the subtree for
+	// searchAttribute=username.  Otherwise the bind DN is the user's entry.
+	searchBase      string
+	searchAttribute string
+
+	// Attribute of the user's entry holding the user id, or empty to use the username.  It should
+	// be immutable, e.g. entryUUID, as user ids are granted access.
+	userIdAttribute string
+
+	// Attribute of the user's entry listing the user's groups, or empty if groups are not used.
+	groupsAttribute string
+
+	throttle loginThrottle
+}
+
+func (p *ldapProvider) Name() string {
+	return "ldap"
+}
+
+// ldapAttributeValue returns the first value of attribute of entry as a string.  Active
+// Directory GUIDs, which are binary, are formatted in their usual string form.
+func ldapAttributeValue(entry *ldap.Entry, attribute string) string {
+	if strings.EqualFold(attribute, "objectGUID") {
+		guid := entry.GetEqualFoldRawAttributeValue(attribute)
+		if len(guid) != 16 {
+			return ""
+		}
+		// The first three fields are little-endian.
+		return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%x-%x", guid[3], guid[2], guid[1], guid[0], guid[5], guid[4], guid[7], guid[6], guid[8:10], guid[10:])
+	}
+	return entry.GetEqualFoldAttributeValue(attribute)
+}
+
+func (p *ldapProvider) authenticate(username string, password string) (*Identity, error) {
+	if !ldapUsernamePattern.MatchString(username) || password == "" {
+		// An empty password would result in an unauthenticated bind, which always succeeds.
+		return nil, errLdapInvalidCredentials
+	}
+	conn, err := dialLdap(p.serverURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	bindDN := fmt.Sprintf(p.bindDNTemplate, username)
+	if err := conn.Bind(bindDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errLdapInvalidCredentials
+		}
+		return nil, err
+	}
+	identity := &Identity{UserId: username}
+	if p.userIdAttribute == "" && p.groupsAttribute == "" {
+		return identity, nil
+	}
+	var attributes []string
+	for _, attribute := range []string{p.userIdAttribute, p.groupsAttribute} {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	base, scope, filter := bindDN, ldap.ScopeBaseObject, "(objectClass=*)"
+	if p.searchBase != "" {
+		base, scope, filter = p.searchBase, ldap.ScopeWholeSubtree, "("+ldap.EscapeFilter(p.searchAttribute)+"="+ldap.EscapeFilter(username)+")"
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(base, scope, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false, filter, attributes, nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("Expected exactly one entry for %q, found %d", username, len(result.Entries))
+	}
+	entry := result.Entries[0]
+	if p.userIdAttribute != "" {
+		identity.UserId = ldapAttributeValue(entry, p.userIdAttribute)
+		if identity.UserId == "" {
+			return nil, fmt.Errorf("Entry %q is missing %s", entry.DN, p.userIdAttribute)
+		}
+	}
+	if p.groupsAttribute != "" {
+		identity.Groups = entry.GetEqualFoldAttributeValues(p.groupsAttribute)
+	}
+	return identity, nil
+}
+
+func writeLdapLoginForm(w http.ResponseWriter, status int, state loginState, message string) {
+	w.Header().Add("x-frame-options", "deny")
+	w.Header().Add("content-type", "text/html")
+	w.WriteHeader(status)
+	fmt.Fprint(w, `<html><head><title>Login</title></head><body>`)
+	if message != "" {
+		fmt.Fprintf(w, "<p>%s</p>\n", html.EscapeString(message))
+	}
+	fmt.Fprintf(w, `<form action="/ldap_login" method="post">
+<input type="hidden" name="state" value="%s">
+<label>Username <input type="text" name="username" autocomplete="username" autofocus></label><br>
+<label>Password <input type="password" name="password" autocomplete="current-password"></label><br>
+<input type="submit" value="Login">
+</form>
+</body></html>`, html.EscapeString(state.Encode()))
+}
+
+func (p *ldapProvider) StartLogin(auth *Authenticator, w http.ResponseWriter, r *http.Request, state loginState) {
+	writeLdapLoginForm(w, http.StatusOK, state, "")
+}
+
+func (p *ldapProvider) AddRoutes(auth *Authenticator, mux *gorilla_mux.Router) {
+	mux.Methods("POST").Path("/ldap_login").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid login form", http.StatusBadRequest)
+			return
+		}
+		state := decodeLoginState(r.PostForm.Get("state"))
+		username := strings.TrimSpace(r.PostForm.Get("username"))
+		userKey := "user:" + strings.ToLower(username)
+		addressKey := "address:" + auth.getSessionClientIP(r)
+		blockedUntil := p.throttle.blockedUntil(userKey, ldapMaxFailuresPerUser)
+		if addressBlockedUntil := p.throttle.blockedUntil(addressKey, ldapMaxFailuresPerAddress); addressBlockedUntil.After(blockedUntil) {
+			blockedUntil = addressBlockedUntil
+		}
+		if !blockedUntil.IsZero() {
+			log.Printf("AUDIT: LDAP login of %q from %s refused after repeated failures", username, addressKey)
+			w.Header().Set("retry-after", strconv.Itoa(int(time.Until(blockedUntil).Seconds())+1))
+			writeLdapLoginForm(w, http.StatusTooManyRequests, state, "Too many failed logins.  Try again later.")
+			return
+		}
+		identity, err := p.authenticate(username, r.PostForm.Get("password"))
+		if err == errLdapInvalidCredentials {
+			p.throttle.fail(userKey, addressKey)
+			writeLdapLoginForm(w, http.StatusUnauthorized, state, "Invalid username or password.")
+			return
+		}
+		if err != nil {
+			log.Printf("Error authenticating LDAP user %s: %v", username, err)
+			http.Error(w, "Failed to query directory", http.StatusInternalServerError)
+			return
+		}
+		p.throttle.reset(userKey)
+		auth.completeLogin(w, r, p, identity, state)
+	})
+}
+
+func makeLdapProvider(ctx context.Context) (IdentityProvider, error) {
+	serverURL, err := url.Parse(os.Getenv("LDAP_URL"))
+	if err != nil || serverURL.Host == "" {
+		return nil, fmt.Errorf("LDAP_URL must specify an ldap:// or ldaps:// URL")
+	}
+	p := &ldapProvider{
+		serverURL:       serverURL,
+		bindDNTemplate:  os.Getenv("LDAP_BIND_DN_TEMPLATE"),
+		searchBase:      os.Getenv("LDAP_USER_SEARCH_BASE"),
+		searchAttribute: getEnvOr("LDAP_USER_SEARCH_ATTRIBUTE", "uid"),
+		userIdAttribute: getEnvOr("LDAP_USER_ID_ATTRIBUTE", "entryUUID"),
+		groupsAttribute: getEnvOr("LDAP_GROUPS_ATTRIBUTE", "memberOf"),
+		throttle:        loginThrottle{failures: make(map[string]*quotaCounter)},
+	}
+	if strings.Count(p.bindDNTemplate, "%s") != 1 {
+		return nil, fmt.Errorf("LDAP_BIND_DN_TEMPLATE must contain exactly one %%s")
+	}
+	return p, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginAllowlist restricts which users may log in.
+//
+// The allowlist file contains one pattern per line, e.g. "alice@example.org" or "*@example.org".
+// "*" matches any sequence of characters.  Blank lines and lines starting with "#" are ignored.
+// The file is reloaded whenever it is modified.
+type LoginAllowlist struct {
+	path string
+
+	mutex    sync.Mutex
+	modTime  time.Time
+	patterns []string
+}
+
+func parseLoginAllowlist(data []byte) (patterns []string, err error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err = path.Match(line, ""); err != nil {
+			err = fmt.Errorf("Invalid pattern %q: %w", line, err)
+			return
+		}
+		patterns = append(patterns, line)
+	}
+	return
+}
+
+// reload reads the allowlist file if it has been modified since it was last read.
+func (l *LoginAllowlist) reload() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(l.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	patterns, err := parseLoginAllowlist(data)
+	if err != nil {
+		return err
+	}
+	l.patterns = patterns
+	l.modTime = info.ModTime()
+	return nil
+}
+
+// IsAllowed returns true if any of userIds matches a pattern in the allowlist.
+func (l *LoginAllowlist) IsAllowed(userIds ...string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.reload(); err != nil {
+		// Continue to use the previously-loaded allowlist.
+		log.Printf("Error reloading login allowlist from %s: %v", l.path, err)
+	}
+	for _, userId := range userIds {
+		userId = strings.ToLower(userId)
+		for _, pattern := range l.patterns {
+			if matched, _ := path.Match(pattern, userId); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func loadLoginAllowlist() (*LoginAllowlist, error) {
+	path, ok := os.LookupEnv("LOGIN_ALLOWLIST_PATH")
+	if !ok {
+		return nil, nil
+	}
+	allowlist := &LoginAllowlist{path: path}
+	if err := allowlist.reload(); err != nil {
+		return nil, fmt.Errorf("Error reading login allowlist from %s: %w", path, err)
+	}
+	return allowlist, nil
+}
@@ -21,8 +21,21 @@ import (
 
 	gorilla_handlers "github.com/gorilla/handlers"
 	gorilla_mux "github.com/gorilla/mux"
+
+	// Credential brokers registered with broker.RegisterCredentialBroker.
+	_ "ngauth/broker/globus"
 )
 
+// setTLSScheme records the request scheme when ngauth terminates TLS itself.
+func setTLSScheme(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			r.URL.Scheme = "https"
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func main() {
 
 	ctx := context.Background()
@@ -33,6 +46,7 @@ func main() {
 	}
 
 	mux := gorilla_mux.NewRouter()
+	mux.Use(setTLSScheme)
 	if os.Getenv("GAE_INSTANCE") != "" || os.Getenv("K_SERVICE") != "" {
 		// When running on AppEngine or Cloud Run, trust the reverse proxy to provide the real scheme and hostname.
 		mux.Use(gorilla_handlers.ProxyHeaders)
@@ -45,8 +59,19 @@ func main() {
 		log.Printf("Defaulting to port %s", port)
 	}
 
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: gorilla_handlers.RecoveryHandler()(mux),
+	}
 	log.Printf("Listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, gorilla_handlers.RecoveryHandler()(mux)); err != nil {
+	if certPath := os.Getenv("TLS_CERT_PATH"); certPath != "" {
+		// Terminate TLS directly, e.g. to receive client certificates.
+		server.TLSConfig = authenticator.ServerTLSConfig()
+		err = server.ListenAndServeTLS(certPath, getEnvOr("TLS_KEY_PATH", "secrets/tls_key.pem"))
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
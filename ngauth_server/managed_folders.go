@@ -0,0 +1,133 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Managed folders have their own IAM policies, which grant access to the objects within them in
+// addition to the bucket's policy.  A managed folder named "a/b/" contains the objects whose names
+// start with "a/b/".
+// https://cloud.google.com/storage/docs/managed-folders
+
+const managedFolderCacheDuration = time.Minute
+
+// getManagedFolderResourceName returns the full resource name of a managed folder, e.g. "a/b/".
+func getManagedFolderResourceName(bucket string, folder string) string {
+	return getBucketResourceName(bucket) + "/managedFolders/" + folder
+}
+
+// managedFolderCandidates returns the managed folder names that would contain all objects whose
+// names start with prefix, outermost first.  For example, "a/b/c" is contained in "a/" and "a/b/".
+func managedFolderCandidates(prefix string) (folders []string) {
+	for i := 0; i < len(prefix); i++ {
+		if prefix[i] == '/' {
+			folders = append(folders, prefix[:i+1])
+		}
+	}
+	return
+}
+
+type cachedManagedFolders struct {
+	folders []string
+	expires time.Time
+}
+
+// managedFolderLister determines which managed folders exist, so that only their policies need to
+// be evaluated.
+type managedFolderLister struct {
+	client *http.Client
+
+	// Cache of "BUCKET/FOLDER" to *cachedManagedFolders, listing the managed folders within
+	// FOLDER, a top-level managed folder name.
+	cache sync.Map
+}
+
+func (l *managedFolderLister) list(ctx context.Context, bucket string, folder string) (folders []string, err error) {
+	query := url.Values{}
+	query.Set("prefix", folder)
+	query.Set("fields", "items/name,nextPageToken")
+	for {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, "GET", "https://storage.googleapis.com/storage/v1/b/"+url.PathEscape(bucket)+"/managedFolders?"+query.Encode(), nil)
+		if err != nil {
+			return
+		}
+		var resp *http.Response
+		resp, err = l.client.Do(req)
+		if err != nil {
+			return
+		}
+		var listResponse struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			err = fmt.Errorf("Error listing managed folders of bucket %s: %s %s", bucket, resp.Status, string(body))
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&listResponse)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+		for _, item := range listResponse.Items {
+			folders = append(folders, item.Name)
+		}
+		if listResponse.NextPageToken == "" {
+			return
+		}
+		query.Set("pageToken", listResponse.NextPageToken)
+	}
+}
+
+// GetContainingFolders returns the existing managed folders in bucket that contain all objects
+// whose names start with prefix, outermost first.  Errors are logged, and treated as there being
+// no managed folders.
+func (l *managedFolderLister) GetContainingFolders(ctx context.Context, bucket string, prefix string) (folders []string) {
+	candidates := managedFolderCandidates(prefix)
+	if len(candidates) == 0 {
+		return nil
+	}
+	key := bucket + "/" + candidates[0]
+	var existing []string
+	if cached, ok := l.cache.Load(key); ok && time.Now().Before(cached.(*cachedManagedFolders).expires) {
+		existing = cached.(*cachedManagedFolders).folders
+	} else {
+		var err error
+		existing, err = l.list(ctx, bucket, candidates[0])
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		l.cache.Store(key, &cachedManagedFolders{folders: existing, expires: time.Now().Add(managedFolderCacheDuration)})
+	}
+	for _, folder := range candidates {
+		if containsString(existing, folder) {
+			folders = append(folders, folder)
+		}
+	}
+	return
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// middle_auth compatibility: graphene:// segmentation sources served by PyChunkedGraph, like other
+// CAVE services, authenticate users with tokens of a middle_auth server, which the services
+// validate with its /api/v1/user/cache API.  With MIDDLE_AUTH_PATH set, ngauth serves the subset
+// of the middle_auth API used by Neuroglancer and by middle_auth_client under /middle_auth, so that
+// these services can be configured with ngauth as their middle_auth server, and issues the tokens
+// from the ngauth login session.  CAVE annotation and materialization services use the same API,
+// with the tables of each service mapped to datasets, and their clients, e.g. caveclient, obtain
+// tokens from /cave_token or /middle_auth/api/v1/create_token.
+
+// Audience of the tokens issued to middle_auth clients, which are not accepted by ngauth itself.
+const middleAuthTokenAudience = "middle_auth"
+
+const middleAuthPathPrefix = "/middle_auth"
+
+// MiddleAuthConfig specifies the services that accept ngauth middle_auth tokens, and the
+// permissions reported to them.
+type MiddleAuthConfig struct {
+	// Base URLs of the services, e.g. "https://pcg.example.org/segmentation", which Neuroglancer
+	// sends the tokens to.
+	AppUrls []string `json:"appUrls"`
+
+	// Members, as for role bindings, with each middle_auth dataset permission.
+	Datasets map[string]*MiddleAuthDataset `json:"datasets"`
+
+	// Members who are middle_auth administrators.
+	Admins []string `json:"admins,omitempty"`
+
+	// Dataset of each table, e.g. annotation table or datastack, by service namespace and table
+	// name.  The table "*" applies to all tables of the namespace.
+	Tables map[string]map[string]string `json:"tables,omitempty"`
+}
+
+// MiddleAuthDataset specifies the members with permissions on a middle_auth dataset.
+type MiddleAuthDataset struct {
+	// Members with the "view" permission.
+	Viewers []string `json:"viewers,omitempty"`
+
+	// Members with the "view" and "edit" permissions.
+	Editors []string `json:"editors,omitempty"`
+}
+
+// middleAuthUser is the user information returned by /api/v1/user/cache.
+type middleAuthUser struct {
+	Id             int64               `json:"id"`
+	Name           string              `json:"name"`
+	Email          string              `json:"email"`
+	Admin          bool                `json:"admin"`
+	Groups         []string            `json:"groups"`
+	PermissionsV2  map[string][]string `json:"permissions_v2"`
+	MissingTos     []string            `json:"missing_tos"`
+	ServiceAccount bool                `json:"service_account"`
+}
+
+// loadMiddleAuthConfig loads the configuration specified by MIDDLE_AUTH_PATH.
+func loadMiddleAuthConfig() (*MiddleAuthConfig, error) {
+	configPath, ok := os.LookupEnv("MIDDLE_AUTH_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading middle_auth configuration from %s: %w", configPath, err)
+	}
+	var config MiddleAuthConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Error parsing middle_auth configuration from %s: %w", configPath, err)
+	}
+	if len(config.AppUrls) == 0 {
+		return nil, fmt.Errorf("middle_auth configuration must specify appUrls")
+	}
+	return &config, nil
+}
+
+// permissions returns the permission names of the user for each dataset on which the user has
+// any.
+func (c *MiddleAuthConfig) permissions(userToken *UserToken) map[string][]string {
+	permissions := make(map[string][]string)
+	for name, d := range c.Datasets {
+		if hasMember(d.Editors, userToken) {
+			permissions[name] = []string{"view", "edit"}
+		} else if hasMember(d.Viewers, userToken) {
+			permissions[name] = []string{"view"}
+		}
+	}
+	return permissions
+}
+
+// tableDataset returns the dataset of table in the service namespace, or "".
+func (c *MiddleAuthConfig) tableDataset(namespace string, table string) string {
+	tables := c.Tables[namespace]
+	if dataset, ok := tables[table]; ok {
+		return dataset
+	}
+	return tables["*"]
+}
+
+// middleAuthUserId returns the numeric id by which middle_auth clients identify the user, e.g. as
+// the author of proofreading edits, derived from the qualified user id and less than 2^53, so
+// that it is exactly representable in JavaScript.
+func middleAuthUserId(userId string) int64 {
+	hash := sha256.Sum256([]byte(userId))
+	return int64(binary.BigEndian.Uint64(hash[:8]) >> 11)
+}
+
+// getMiddleAuthPopupOrigin returns the origin of the page that opened the authorization popup,
+// specified by the origin parameter or, on the initial request, by the referrer, or "".
+func getMiddleAuthPopupOrigin(r *http.Request) string {
+	if origin := r.URL.Query().Get("origin"); origin != "" {
+		return origin
+	}
+	referrer, err := url.Parse(r.Referer())
+	if err != nil || referrer.Host == "" {
+		return ""
+	}
+	return referrer.Scheme + "://" + referrer.Host
+}
+
+// encodeMiddleAuthToken returns a token for middle_auth client services, valid for the lifetime
+// of userToken.
+func (auth *Authenticator) encodeMiddleAuthToken(userToken UserToken) string {
+	userToken.Audience = middleAuthTokenAudience
+	return auth.EncodeClientToken(userToken)
+}
+
+// decodeMiddleAuthToken returns the user token of the middle_auth token in the Authorization
+// header of r.
+func (auth *Authenticator) decodeMiddleAuthToken(r *http.Request) (UserToken, error) {
+	userToken, err := auth.DecodeClientToken(r.Context(), getAuthorizationCredentials(r, "Bearer"))
+	if err == nil && userToken.Audience != middleAuthTokenAudience {
+		err = fmt.Errorf("Token issued for audience %q", userToken.Audience)
+	}
+	return userToken, err
+}
+
+func (auth *Authenticator) addMiddleAuthRoutes(mux *gorilla_mux.Router) {
+	// Authorization popup opened by Neuroglancer, which posts a token and the app URLs to the page
+	// that opened it.  Neuroglancer does not specify its origin, so the token is only posted to the
+	// allowed origin of the referrer.
+	mux.Methods("GET").Path(middleAuthPathPrefix + "/api/v1/authorize").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := getMiddleAuthPopupOrigin(r)
+		if !OriginPattern.MatchString(origin) || !auth.IsOriginAllowed(origin) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		userToken := auth.getUserTokenFromCookie(r)
+		if userToken == nil || !auth.TokenLifetimes.AllowsSession(userToken, origin) {
+			returnPath := middleAuthPathPrefix + "/api/v1/authorize?" + url.Values{"origin": {origin}}.Encode()
+			http.Redirect(w, r, "/login?"+url.Values{"return": {returnPath}}.Encode(), http.StatusFound)
+			return
+		}
+		if userToken.ImpersonatedBy != "" || auth.DenyRules.IsDenied(userToken, "", origin, userToken.Origin) || !auth.OriginPolicies.AllowsOrigin(userToken, origin) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		token := auth.makeTemporaryUserToken(*userToken, origin)
+		token.Origin = origin
+		log.Printf("AUDIT: %s obtained middle_auth token for origin %s", userToken.UserId, origin)
+		// Json encoding cannot fail
+		jsonMessage, _ := json.Marshal(map[string]interface{}{
+			"token":    auth.encodeMiddleAuthToken(token),
+			"app_urls": auth.MiddleAuth.AppUrls,
+		})
+		jsonOrigin, _ := json.Marshal(origin)
+		w.Header().Add("content-type", "text/html")
+		fmt.Fprintf(w, `<html>
+<body>
+<script>
+window.opener.postMessage(%s,%s);
+window.close();
+</script>
+</body>
+</html>`, jsonMessage, jsonOrigin)
+	})
+
+	// Validates a token for a middle_auth client service, and returns the user's information and
+	// dataset permissions.
+	mux.Methods("GET").Path(middleAuthPathPrefix + "/api/v1/user/cache").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken, err := auth.decodeMiddleAuthToken(r)
+		if err != nil {
+			log.Printf("Invalid middle_auth token: %+v", err)
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		if auth.DenyRules.IsDenied(&userToken, "") {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		groups := append([]string{}, userToken.Groups...)
+		sort.Strings(groups)
+		user := middleAuthUser{
+			Id:            middleAuthUserId(userToken.UserId),
+			Name:          userToken.Name,
+			Email:         getUserEmail(userToken.UserId),
+			Admin:         hasMember(auth.MiddleAuth.Admins, &userToken),
+			Groups:        groups,
+			PermissionsV2: auth.MiddleAuth.permissions(&userToken),
+			MissingTos:    []string{},
+		}
+		if user.Name == "" {
+			user.Name = user.Email
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(&user)
+	})
+
+	// Returns the dataset of a table of a service, which services check the permissions of, for a
+	// request authenticated by any middle_auth token, e.g. of the service's account.
+	mux.Methods("GET").Path(middleAuthPathPrefix + "/api/v1/service/{namespace}/table/{table}/dataset").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := auth.decodeMiddleAuthToken(r); err != nil {
+			log.Printf("Invalid middle_auth token: %+v", err)
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		vars := gorilla_mux.Vars(r)
+		dataset := auth.MiddleAuth.tableDataset(vars["namespace"], vars["table"])
+		if dataset == "" {
+			http.Error(w, "Unknown table", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(dataset)
+	})
+
+	// Returns a token as a JSON string, authenticated by the login cookie, as the middle_auth page
+	// to which caveclient directs users to obtain a token.
+	mux.Methods("GET").Path(middleAuthPathPrefix + "/api/v1/create_token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("x-frame-options", "deny")
+		userToken := auth.getUserTokenFromCookie(r)
+		if userToken == nil {
+			http.Redirect(w, r, "/login?"+url.Values{"return": {middleAuthPathPrefix + "/api/v1/create_token"}}.Encode(), http.StatusFound)
+			return
+		}
+		if userToken.ImpersonatedBy != "" || auth.DenyRules.IsDenied(userToken, "") {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		log.Printf("AUDIT: %s obtained middle_auth token", userToken.UserId)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(auth.encodeMiddleAuthToken(*userToken))
+	})
+
+	// Returns a middle_auth token for CAVE services for a request with the same token as for
+	// /gcs_token.
+	mux.Methods("POST").Path("/cave_token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin != "" {
+			w.Header().Set("access-control-allow-origin", origin)
+			w.Header().Set("vary", "origin")
+		}
+		var request struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		userToken, err := auth.resolveRequestUserToken(r, request.Token)
+		if err != nil {
+			log.Printf("Invalid authentication token: %+v", err)
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		if userToken.UserId == anonymousUserId || userToken.ImpersonatedBy != "" || auth.DenyRules.IsDenied(&userToken, "", origin, userToken.Origin) || !auth.OriginPolicies.AllowsOrigin(&userToken, origin) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		log.Printf("AUDIT: %s obtained middle_auth token for CAVE", userToken.UserId)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":     auth.encodeMiddleAuthToken(userToken),
+			"expiresAt": userToken.Expires,
+		})
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// TLS client certificate identity provider.
+//
+// Requires that ngauth terminate TLS itself (see TLS_CERT_PATH), since client certificates are
+// not forwarded by the App Engine and Cloud Run frontends.
+
+type mtlsProvider struct {
+	clientCAs *x509.CertPool
+
+	// Certificate field identifying the user: "email" for the first email subject alternative
+	// name, or "cn" for the subject common name.
+	userIdField string
+}
+
+func (p *mtlsProvider) Name() string {
+	return "mtls"
+}
+
+// ConfigureTLS requests client certificates signed by the trusted CAs.  Connections without a
+// client certificate are still accepted, so that other identity providers remain usable.
+func (p *mtlsProvider) ConfigureTLS(config *tls.Config) {
+	config.ClientCAs = p.clientCAs
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+}
+
+func (p *mtlsProvider) identity(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, fmt.Errorf("No verified client certificate")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	var userId string
+	switch p.userIdField {
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			userId = cert.EmailAddresses[0]
+		}
+	case "cn":
+		userId = cert.Subject.CommonName
+	}
+	if userId == "" {
+		return nil, fmt.Errorf("Client certificate %q has no %s", cert.Subject, p.userIdField)
+	}
+	return &Identity{UserId: userId}, nil
+}
+
+func (p *mtlsProvider) StartLogin(auth *Authenticator, w http.ResponseWriter, r *http.Request, state loginState) {
+	identity, err := p.identity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	auth.completeLogin(w, r, p, identity, state)
+}
+
+func (p *mtlsProvider) AddRoutes(auth *Authenticator, mux *gorilla_mux.Router) {
+	// Returns a temporary token for use with /gcs_token, for automated clients that do not
+	// maintain a cookie jar.
+	mux.Methods("POST").Path("/mtls_token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := p.identity(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !auth.checkLoginAllowed(w, r, p, identity) {
+			return
+		}
+		identity.qualify(p.Name())
+		if err := auth.resolveAccountLinks(r.Context(), identity); err != nil {
+			log.Printf("Error resolving linked accounts for %s: %v", identity.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		userToken := auth.makeUserToken(identity, auth.TokenLifetimes.CrossOriginLifetimeSeconds(""))
+		w.Header().Add("content-type", "text/plain")
+		fmt.Fprint(w, auth.EncodeClientToken(userToken))
+	})
+}
+
+func makeMtlsProvider(ctx context.Context) (IdentityProvider, error) {
+	caPath := getEnvOr("MTLS_CLIENT_CA_PATH", "secrets/mtls_client_ca.pem")
+	caPEM, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client CA certificates from %s: %w", caPath, err)
+	}
+	p := &mtlsProvider{
+		clientCAs:   x509.NewCertPool(),
+		userIdField: getEnvOr("MTLS_USER_ID_FIELD", "email"),
+	}
+	if !p.clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("No certificates found in %s", caPath)
+	}
+	if p.userIdField != "email" && p.userIdField != "cn" {
+		return nil, fmt.Errorf("MTLS_USER_ID_FIELD must be \"email\" or \"cn\"")
+	}
+	return p, nil
+}
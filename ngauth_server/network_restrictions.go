@@ -0,0 +1,113 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+type networkRestriction struct {
+	// Bucket patterns, as for BUCKET_ALLOWLIST.
+	Buckets []string `json:"buckets"`
+
+	// Client networks, in CIDR notation, from which access tokens may be requested.
+	Networks []string `json:"networks"`
+
+	networks []*net.IPNet
+}
+
+// NetworkRestrictions limit the client networks from which access tokens for particular buckets
+// may be requested, e.g. to a campus network.  The first rule whose bucket patterns match applies;
+// buckets not matched by any rule are not restricted.
+type NetworkRestrictions struct {
+	rules []*networkRestriction
+
+	// Request header, set by a trusted proxy, that holds the client address, or "" to use the
+	// address of the connection.
+	clientIPHeader string
+}
+
+func loadNetworkRestrictions() (*NetworkRestrictions, error) {
+	rulesPath, ok := os.LookupEnv("NETWORK_RESTRICTIONS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(rulesPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading network restrictions from %s: %w", rulesPath, err)
+	}
+	restrictions := &NetworkRestrictions{clientIPHeader: os.Getenv("CLIENT_IP_HEADER")}
+	if err := json.Unmarshal(data, &restrictions.rules); err != nil {
+		return nil, fmt.Errorf("Error parsing network restrictions from %s: %w", rulesPath, err)
+	}
+	for _, rule := range restrictions.rules {
+		for _, pattern := range rule.Buckets {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid bucket pattern %q: %w", pattern, err)
+			}
+		}
+		for _, cidr := range rule.Networks {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid network %q: %w", cidr, err)
+			}
+			rule.networks = append(rule.networks, network)
+		}
+	}
+	return restrictions, nil
+}
+
+// getClientIP returns the address of the client making r, or nil if it cannot be determined.
+func (n *NetworkRestrictions) getClientIP(r *http.Request) net.IP {
+	if n != nil && n.clientIPHeader != "" {
+		// Only the last address, added by the trusted proxy itself, is reliable.
+		addresses := strings.Split(r.Header.Get(n.clientIPHeader), ",")
+		return net.ParseIP(strings.TrimSpace(addresses[len(addresses)-1]))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// IsAllowed returns true if the client making r may obtain access tokens for bucket.
+func (n *NetworkRestrictions) IsAllowed(r *http.Request, bucket string) bool {
+	if n == nil {
+		return true
+	}
+	for _, rule := range n.rules {
+		if !matchesAnyPattern(rule.Buckets, bucket) {
+			continue
+		}
+		ip := n.getClientIP(r)
+		if ip == nil {
+			return false
+		}
+		for _, network := range rule.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,480 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Generic OpenID Connect support: discovery, JWKS retrieval and id_token validation.
+
+type oidcDiscoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+var oidcHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+func fetchJson(ctx context.Context, url string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error fetching %s: %s %s", url, resp.Status, string(body))
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("Error decoding %s: %w", url, err)
+	}
+	return nil
+}
+
+func discoverOIDC(ctx context.Context, issuer string) (doc oidcDiscoveryDocument, err error) {
+	err = fetchJson(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return
+	}
+	if doc.Issuer != issuer {
+		err = fmt.Errorf("OpenID configuration issuer %q does not match %q", doc.Issuer, issuer)
+		return
+	}
+	return
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+func decodeBase64URLInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (key *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBase64URLInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URLInt(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("Unsupported curve: %q", key.Crv)
+		}
+		x, err := decodeBase64URLInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URLInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type: %q", key.Kty)
+}
+
+// Minimum interval between JWKS fetches triggered by unknown key ids.
+const jwksMinRefreshInterval = 5 * time.Minute
+
+// jwksCache holds the signing keys of an issuer, refreshing them when a token
+// references an unknown key id.
+type jwksCache struct {
+	url string
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	lastFetched time.Time
+}
+
+func newJwksCache(url string) *jwksCache {
+	return &jwksCache{url: url}
+}
+
+func (c *jwksCache) refresh(ctx context.Context) error {
+	var set jsonWebKeySet
+	if err := fetchJson(ctx, c.url, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		publicKey, err := key.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+	c.keys = keys
+	c.lastFetched = time.Now()
+	return nil
+}
+
+func (c *jwksCache) getKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(c.lastFetched) < jwksMinRefreshInterval && c.keys != nil {
+		return nil, fmt.Errorf("Unknown key id: %q", kid)
+	}
+	if err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown key id: %q", kid)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+func verifyJwtSignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported signing algorithm: %q", alg)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("Algorithm %q does not match RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("Algorithm %q does not match EC key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("Invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("Invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported key")
+}
+
+// parseAndVerifyJwt checks the signature of a compact-serialized JWT against the key set and
+// returns its claims.  The caller is responsible for validating the claims.
+func parseAndVerifyJwt(ctx context.Context, keys *jwksCache, token string) (claims map[string]interface{}, err error) {
+	return parseAndVerifyJwtWithKey(token, func(kid string) (crypto.PublicKey, error) {
+		return keys.getKey(ctx, kid)
+	})
+}
+
+// parseAndVerifyJwtWithKey is like parseAndVerifyJwt, but obtains the verification key by
+// calling getKey with the key id.
+func parseAndVerifyJwtWithKey(token string, getKey func(kid string) (crypto.PublicKey, error)) (claims map[string]interface{}, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		err = fmt.Errorf("Malformed JWT")
+		return
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return
+	}
+	var header jwtHeader
+	if err = json.Unmarshal(headerJson, &header); err != nil {
+		return
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return
+	}
+	key, err := getKey(header.Kid)
+	if err != nil {
+		return
+	}
+	if err = verifyJwtSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return
+	}
+	payloadJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(payloadJson)))
+	decoder.UseNumber()
+	err = decoder.Decode(&claims)
+	return
+}
+
+// decodeUnverifiedJwtPayload decodes the claims of a JWT without verifying its signature, e.g. to
+// determine which key should be used to verify it.
+func decodeUnverifiedJwtPayload(token string, result interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("Malformed JWT")
+	}
+	payloadJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payloadJson, result)
+}
+
+// Allowed clock skew when checking exp, nbf and iat claims.
+const jwtClockSkew = 2 * time.Minute
+
+func getNumericClaim(claims map[string]interface{}, name string) (value int64, ok bool) {
+	if n, isNumber := claims[name].(json.Number); isNumber {
+		if f, err := n.Float64(); err == nil {
+			return int64(f), true
+		}
+	}
+	return 0, false
+}
+
+func audienceContains(claims map[string]interface{}, audience string) bool {
+	switch v := claims["aud"].(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateJwtClaims checks the standard iss, aud, exp and nbf claims.
+func validateJwtClaims(claims map[string]interface{}, issuer string, audience string) error {
+	if iss, _ := claims["iss"].(string); iss != issuer {
+		return fmt.Errorf("Unexpected issuer: %q", iss)
+	}
+	if !audienceContains(claims, audience) {
+		return fmt.Errorf("Unexpected audience: %v", claims["aud"])
+	}
+	now := time.Now()
+	exp, ok := getNumericClaim(claims, "exp")
+	if !ok {
+		return fmt.Errorf("Missing exp claim")
+	}
+	if now.Add(-jwtClockSkew).Unix() > exp {
+		return fmt.Errorf("Token expired")
+	}
+	if nbf, ok := getNumericClaim(claims, "nbf"); ok && now.Add(jwtClockSkew).Unix() < nbf {
+		return fmt.Errorf("Token not yet valid")
+	}
+	return nil
+}
+
+// oidcProvider is an IdentityProvider for a standard OpenID Connect issuer.
+type oidcProvider struct {
+	name   string
+	issuer string
+	config oauth2.Config
+	keys   *jwksCache
+
+	// Claim from which the user id is taken.
+	userIdClaim string
+
+	// If true, the email_verified claim must be present and true.
+	requireEmailVerified bool
+
+	// Claim listing the user's groups, or empty if groups are not used.
+	groupsClaim string
+
+	// Additional parameters for the authorization request.
+	authCodeOptions []oauth2.AuthCodeOption
+}
+
+func (p *oidcProvider) Name() string {
+	return p.name
+}
+
+func (p *oidcProvider) OAuth2Config() *oauth2.Config {
+	return &p.config
+}
+
+func (p *oidcProvider) AuthCodeOptions() []oauth2.AuthCodeOption {
+	return p.authCodeOptions
+}
+
+func (p *oidcProvider) ValidateIdToken(ctx context.Context, idToken string) (identity *Identity, err error) {
+	claims, err := parseAndVerifyJwt(ctx, p.keys, idToken)
+	if err != nil {
+		err = fmt.Errorf("Invalid id_token: %w", err)
+		return
+	}
+	if err = validateJwtClaims(claims, p.issuer, p.config.ClientID); err != nil {
+		err = fmt.Errorf("Invalid id_token: %w", err)
+		return
+	}
+	userId, _ := claims[p.userIdClaim].(string)
+	if userId == "" {
+		err = fmt.Errorf("id_token is missing %s", p.userIdClaim)
+		return
+	}
+	if p.requireEmailVerified {
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			err = fmt.Errorf("id_token is missing email_verified")
+			return
+		}
+	}
+	identity = &Identity{UserId: userId, Claims: claims}
+	if p.groupsClaim != "" {
+		identity.Groups = getStringListClaim(claims, p.groupsClaim)
+	}
+	return
+}
+
+// newOIDCProvider creates a provider by retrieving the OpenID configuration of issuer.
+func newOIDCProvider(ctx context.Context, name string, issuer string, clientID string, clientSecret string) (*oidcProvider, error) {
+	doc, err := discoverOIDC(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &oidcProvider{
+		name:   name,
+		issuer: doc.Issuer,
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  doc.AuthorizationEndpoint,
+				TokenURL: doc.TokenEndpoint,
+			},
+			Scopes: []string{"openid", "email", "profile"},
+		},
+		keys:        newJwksCache(doc.JwksURI),
+		userIdClaim: "email",
+	}, nil
+}
+
+// readSecretFile reads a secret, such as an OAuth2 client secret, stored in a text file.
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readClientSecret reads an OAuth2 client secret from path.  An empty path indicates that ngauth
+// is registered as a public client, which relies on PKCE instead of a client secret.
+func readClientSecret(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	return readSecretFile(path)
+}
+
+// getClaim returns the claim at a dot-separated path, e.g. "realm_access.roles".  A top-level
+// claim whose name contains dots, e.g. "https://example.org/groups", may also be specified.
+func getClaim(claims map[string]interface{}, path string) interface{} {
+	if value, ok := claims[path]; ok {
+		return value
+	}
+	var value interface{} = claims
+	for _, component := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[component]
+	}
+	return value
+}
+
+// getStringListClaim returns a claim that holds a list of strings, or a single string.
+func getStringListClaim(claims map[string]interface{}, path string) (result []string) {
+	switch v := getClaim(claims, path).(type) {
+	case string:
+		result = append(result, v)
+	case []interface{}:
+		for _, element := range v {
+			if s, ok := element.(string); ok {
+				result = append(result, s)
+			}
+		}
+	}
+	return
+}
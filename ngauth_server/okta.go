@@ -0,0 +1,56 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Okta identity provider.
+
+func makeOktaProvider(ctx context.Context) (IdentityProvider, error) {
+	orgURL := strings.TrimSuffix(os.Getenv("OKTA_ORG_URL"), "/")
+	if orgURL == "" {
+		return nil, fmt.Errorf("OKTA_ORG_URL must be specified")
+	}
+	// Without an authorization server id, the Okta org authorization server is used.
+	issuer := orgURL
+	authorizationServerID := os.Getenv("OKTA_AUTHORIZATION_SERVER_ID")
+	if authorizationServerID != "" {
+		issuer = orgURL + "/oauth2/" + authorizationServerID
+	}
+	clientID := os.Getenv("OKTA_CLIENT_ID")
+	if clientID == "" {
+		return nil, fmt.Errorf("OKTA_CLIENT_ID must be specified")
+	}
+	clientSecretPath := getEnvOr("OKTA_CLIENT_SECRET_PATH", "secrets/okta_client_secret.txt")
+	clientSecret, err := readClientSecret(clientSecretPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client secret from %s: %w", clientSecretPath, err)
+	}
+	provider, err := newOIDCProvider(ctx, "okta", issuer, clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	provider.requireEmailVerified = true
+	provider.groupsClaim = os.Getenv("OKTA_GROUPS_CLAIM")
+	if provider.groupsClaim != "" && authorizationServerID == "" {
+		// The org authorization server only includes groups when the groups scope is requested.
+		provider.config.Scopes = append(provider.config.Scopes, "groups")
+	}
+	return provider, nil
+}
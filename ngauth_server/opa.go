@@ -0,0 +1,134 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// PolicyHook delegates the final grant/deny decision for /gcs_token requests to an Open Policy
+// Agent server, using its Data API.
+type PolicyHook struct {
+	// URL of the policy decision, e.g. "http://localhost:8181/v1/data/ngauth/allow".
+	url string
+
+	client *http.Client
+}
+
+type policyUser struct {
+	UserId         string                 `json:"userId"`
+	LinkedUserIds  []string               `json:"linkedUserIds,omitempty"`
+	Groups         []string               `json:"groups,omitempty"`
+	MFA            bool                   `json:"mfa"`
+	ImpersonatedBy string                 `json:"impersonatedBy,omitempty"`
+	Claims         map[string]interface{} `json:"claims,omitempty"`
+}
+
+// PolicyInput is the input document of the policy decision.
+type PolicyInput struct {
+	User   policyUser `json:"user"`
+	Bucket string     `json:"bucket"`
+	Prefix string     `json:"prefix,omitempty"`
+	Mode   string     `json:"mode"`
+	Origin string     `json:"origin,omitempty"`
+
+	// Requested dataset id, if any, in which case bucket and prefix are its location.
+	Dataset string `json:"dataset,omitempty"`
+
+	RemoteAddr string `json:"remoteAddr"`
+	UserAgent  string `json:"userAgent,omitempty"`
+	Time       int64  `json:"time"`
+
+	// Whether ngauth's own checks (IAM, roles, grants, etc.) granted access.
+	Granted bool `json:"granted"`
+}
+
+func loadPolicyHook() *PolicyHook {
+	url, ok := os.LookupEnv("OPA_URL")
+	if !ok {
+		return nil
+	}
+	return &PolicyHook{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func makePolicyInput(r *http.Request, userToken *UserToken, tokenRequest *GcsTokenRequest, granted bool) PolicyInput {
+	mode := tokenRequest.Mode
+	if mode == "" {
+		mode = readMode
+	}
+	return PolicyInput{
+		User: policyUser{
+			UserId:         userToken.UserId,
+			LinkedUserIds:  userToken.LinkedUserIds,
+			Groups:         userToken.Groups,
+			MFA:            userToken.MFA,
+			ImpersonatedBy: userToken.ImpersonatedBy,
+			Claims:         userToken.Claims,
+		},
+		Bucket:     tokenRequest.Bucket,
+		Prefix:     tokenRequest.Prefix,
+		Mode:       mode,
+		Origin:     r.Header.Get("origin"),
+		Dataset:    tokenRequest.Dataset,
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		Time:       time.Now().Unix(),
+		Granted:    granted,
+	}
+}
+
+// IsAllowed returns the policy decision, which must be either a boolean or an object with a
+// boolean "allow" member.  An undefined decision denies access.
+func (h *PolicyHook) IsAllowed(ctx context.Context, input PolicyInput) (bool, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("Policy decision failed: %v %v", resp.Status, strings.TrimSpace(string(bodyBytes)))
+	}
+	var decision struct {
+		Result interface{} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, err
+	}
+	switch result := decision.Result.(type) {
+	case bool:
+		return result, nil
+	case map[string]interface{}:
+		allow, _ := result["allow"].(bool)
+		return allow, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// OpenID Connect provider: with OPENID_PROVIDER=true, downstream services, e.g. state servers,
+// may authenticate ngauth users with the standard authorization code flow rather than the ngauth
+// token format.  Relying parties are service clients with redirectUris, and receive ID tokens
+// signed with the user token signing key.  Since relying parties are registered by the
+// administrator, users are not asked for consent.
+
+const openIDCodeLifetime = time.Minute
+
+type openIDAuthorization struct {
+	ClientId      string `json:"clientId"`
+	RedirectUri   string `json:"redirectUri"`
+	Nonce         string `json:"nonce,omitempty"`
+	CodeChallenge string `json:"codeChallenge,omitempty"`
+	Expires       int64  `json:"expires"`
+
+	UserToken UserToken `json:"userToken"`
+}
+
+// Authorization codes are stored only as hashes.
+func openIDCodeKey(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return "openid/codes/" + base64url.EncodeToString(hash[:])
+}
+
+// openIDConfiguration returns the OpenID Connect discovery document.
+func (auth *Authenticator) openIDConfiguration() map[string]interface{} {
+	issuer := strings.TrimSuffix(auth.UserTokenSigner.issuer, "/")
+	config := map[string]interface{}{
+		"issuer":                                auth.UserTokenSigner.issuer,
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"id_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	}
+	if auth.OpenIDProvider {
+		config["authorization_endpoint"] = issuer + "/authorize"
+		config["token_endpoint"] = issuer + "/token"
+		config["response_types_supported"] = []string{"code"}
+		config["grant_types_supported"] = []string{"authorization_code"}
+		config["scopes_supported"] = []string{"openid", "profile"}
+		config["token_endpoint_auth_methods_supported"] = []string{"client_secret_basic", "client_secret_post", "private_key_jwt"}
+		config["code_challenge_methods_supported"] = []string{"S256"}
+		config["claims_supported"] = []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "name", "picture", "groups"}
+	}
+	return config
+}
+
+// makeIdToken returns an ID token for userToken, issued to clientId.
+func (auth *Authenticator) makeIdToken(userToken *UserToken, clientId string, nonce string) string {
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss": auth.UserTokenSigner.issuer,
+		"aud": clientId,
+		"sub": userToken.UserId,
+		"iat": now,
+		"exp": userToken.Expires,
+	}
+	if userToken.AuthTime != 0 {
+		claims["auth_time"] = userToken.AuthTime
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if userToken.Name != "" {
+		claims["name"] = userToken.Name
+	}
+	if userToken.Picture != "" {
+		claims["picture"] = userToken.Picture
+	}
+	if len(userToken.Groups) > 0 {
+		claims["groups"] = userToken.Groups
+	}
+	return auth.UserTokenSigner.sign(claims)
+}
+
+// redirectToRelyingParty sends the user back to redirectUri with the response parameters, along
+// with the state of the authorization request.
+func redirectToRelyingParty(w http.ResponseWriter, r *http.Request, redirectUri string, response url.Values) {
+	if state := r.URL.Query().Get("state"); state != "" {
+		response.Set("state", state)
+	}
+	separator := "?"
+	if strings.Contains(redirectUri, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, redirectUri+separator+response.Encode(), http.StatusFound)
+}
+
+// redirectWithAuthorizationError sends the user back to the relying party with an error.
+func redirectWithAuthorizationError(w http.ResponseWriter, r *http.Request, redirectUri string, code string) {
+	redirectToRelyingParty(w, r, redirectUri, url.Values{"error": {code}})
+}
+
+// handleAuthorizationCodeGrant redeems an authorization code issued by /authorize for an ID token.
+func (auth *Authenticator) handleAuthorizationCodeGrant(w http.ResponseWriter, r *http.Request) {
+	clientId := auth.authenticateServiceClient(r)
+	if clientId == "" {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	key := openIDCodeKey(r.PostForm.Get("code"))
+	var authorization openIDAuthorization
+	if err := auth.Store.Get(r.Context(), key, &authorization); err != nil {
+		writeOAuth2Error(w, "invalid_grant")
+		return
+	}
+	// Each code may only be redeemed once.
+	if err := auth.Store.Delete(r.Context(), key); err != nil {
+		log.Printf("Error deleting authorization code: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if authorization.ClientId != clientId || authorization.RedirectUri != r.PostForm.Get("redirect_uri") || authorization.Expires < time.Now().Unix() {
+		writeOAuth2Error(w, "invalid_grant")
+		return
+	}
+	if authorization.CodeChallenge != "" {
+		hash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if subtle.ConstantTimeCompare([]byte(base64url.EncodeToString(hash[:])), []byte(authorization.CodeChallenge)) != 1 {
+			writeOAuth2Error(w, "invalid_grant")
+			return
+		}
+	}
+	userToken := authorization.UserToken
+	if auth.Revocations.IsRevoked(r.Context(), &userToken) {
+		writeOAuth2Error(w, "invalid_grant")
+		return
+	}
+	lifetime := auth.TokenLifetimes.CrossOriginLifetimeSeconds("")
+	if expires := time.Now().Unix() + lifetime; expires < userToken.Expires {
+		userToken.Expires = expires
+	}
+	// The access token is only accepted by services that trust ngauth tokens for the client's
+	// audience.
+	accessToken := userToken
+	accessToken.Audience = clientId
+	log.Printf("Issued ID token for %s to %s", userToken.UserId, clientId)
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": auth.EncodeClientToken(accessToken),
+		"token_type":   "Bearer",
+		"expires_in":   userToken.Expires - time.Now().Unix(),
+		"id_token":     auth.makeIdToken(&userToken, clientId, authorization.Nonce),
+	})
+}
+
+func (auth *Authenticator) addOpenIDProviderRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("GET").Path("/authorize").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		clientId := query.Get("client_id")
+		redirectUri := query.Get("redirect_uri")
+		// Errors are only returned to redirect URIs registered for the client.
+		client := auth.ServiceClients[clientId]
+		if client == nil || redirectUri == "" || !containsString(client.RedirectUris, redirectUri) {
+			http.Error(w, "Invalid client or redirect URI", http.StatusBadRequest)
+			return
+		}
+		if query.Get("response_type") != "code" {
+			redirectWithAuthorizationError(w, r, redirectUri, "unsupported_response_type")
+			return
+		}
+		if !containsString(strings.Fields(query.Get("scope")), "openid") {
+			redirectWithAuthorizationError(w, r, redirectUri, "invalid_scope")
+			return
+		}
+		codeChallenge := query.Get("code_challenge")
+		if codeChallenge != "" && query.Get("code_challenge_method") != "S256" {
+			redirectWithAuthorizationError(w, r, redirectUri, "invalid_request")
+			return
+		}
+		userToken := auth.getUserTokenFromCookie(r)
+		if userToken != nil && userToken.ImpersonatedBy != "" {
+			redirectWithAuthorizationError(w, r, redirectUri, "access_denied")
+			return
+		}
+		if userToken == nil || query.Get("prompt") == "login" {
+			if query.Get("prompt") == "none" {
+				redirectWithAuthorizationError(w, r, redirectUri, "login_required")
+				return
+			}
+			// Return here after logging in, without forcing another login.
+			loginQuery := url.Values{}
+			if query.Get("prompt") == "login" {
+				loginQuery.Set("prompt", "login")
+			}
+			query.Del("prompt")
+			loginQuery.Set("return", "/authorize?"+query.Encode())
+			http.Redirect(w, r, "/login?"+loginQuery.Encode(), http.StatusFound)
+			return
+		}
+		codeBytes := make([]byte, 32)
+		if _, err := rand.Read(codeBytes); err != nil {
+			panic(err)
+		}
+		code := base64url.EncodeToString(codeBytes)
+		authorization := openIDAuthorization{
+			ClientId:      clientId,
+			RedirectUri:   redirectUri,
+			Nonce:         query.Get("nonce"),
+			CodeChallenge: codeChallenge,
+			Expires:       time.Now().Add(openIDCodeLifetime).Unix(),
+			UserToken:     *userToken,
+		}
+		if err := auth.Store.Put(r.Context(), openIDCodeKey(code), authorization); err != nil {
+			log.Printf("Error storing authorization code: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		redirectToRelyingParty(w, r, redirectUri, url.Values{"code": {code}})
+	})
+}
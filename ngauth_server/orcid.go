@@ -0,0 +1,43 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// ORCID identity provider.
+
+func makeOrcidProvider(ctx context.Context) (IdentityProvider, error) {
+	clientID := os.Getenv("ORCID_CLIENT_ID")
+	if clientID == "" {
+		return nil, fmt.Errorf("ORCID_CLIENT_ID must be specified")
+	}
+	clientSecretPath := getEnvOr("ORCID_CLIENT_SECRET_PATH", "secrets/orcid_client_secret.txt")
+	clientSecret, err := readClientSecret(clientSecretPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client secret from %s: %w", clientSecretPath, err)
+	}
+	provider, err := newOIDCProvider(ctx, "orcid", getEnvOr("ORCID_ISSUER", "https://orcid.org"), clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	// ORCID does not release email addresses in the id_token; users are identified by their
+	// ORCID iD.
+	provider.config.Scopes = []string{"openid"}
+	provider.userIdClaim = "sub"
+	return provider, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+)
+
+type originBucketsRule struct {
+	// Regular expression matching origins, as for the allowed origins.
+	Origin string `json:"origin"`
+
+	// Bucket patterns, as for BUCKET_ALLOWLIST.
+	Buckets []string `json:"buckets"`
+
+	originPattern *regexp.Regexp
+}
+
+// OriginBuckets restricts the buckets for which clients at particular origins may obtain access
+// tokens, so that, e.g., a public Neuroglancer deployment can only read its own datasets.  The
+// first rule whose origin pattern matches applies; origins not matched by any rule are not
+// restricted.
+type OriginBuckets []*originBucketsRule
+
+func loadOriginBuckets() (OriginBuckets, error) {
+	rulesPath, ok := os.LookupEnv("ORIGIN_BUCKETS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(rulesPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading origin buckets from %s: %w", rulesPath, err)
+	}
+	var rules OriginBuckets
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("Error parsing origin buckets from %s: %w", rulesPath, err)
+	}
+	for _, rule := range rules {
+		if rule.originPattern, err = regexp.Compile(rule.Origin); err != nil {
+			return nil, fmt.Errorf("Invalid origin pattern %q: %w", rule.Origin, err)
+		}
+		for _, pattern := range rule.Buckets {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid bucket pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// IsAllowed returns true if clients at origin may obtain access tokens for bucket.  An empty
+// origin is not restricted.
+func (o OriginBuckets) IsAllowed(origin string, bucket string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, rule := range o {
+		if rule.originPattern.MatchString(origin) {
+			return matchesAnyPattern(rule.Buckets, bucket)
+		}
+	}
+	return true
+}
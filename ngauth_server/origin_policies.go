@@ -0,0 +1,82 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type originPolicy struct {
+	// Members, as for role bindings, to whom the policy applies.
+	Members []string `json:"members"`
+
+	// Regular expression matching the origins the members may use, in addition to matching the
+	// allowed origins.
+	Origins string `json:"origins"`
+
+	originPattern *regexp.Regexp
+}
+
+// OriginPolicies restricts the client origins that particular users may use, e.g. so that external
+// collaborators can only use a public viewer while staff can also use internal tools.  The first
+// policy whose members match the user applies; users not matched by any policy may use any allowed
+// origin.
+type OriginPolicies []*originPolicy
+
+func loadOriginPolicies() (OriginPolicies, error) {
+	policiesPath, ok := os.LookupEnv("ORIGIN_POLICIES_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(policiesPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading origin policies from %s: %w", policiesPath, err)
+	}
+	var policies OriginPolicies
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("Error parsing origin policies from %s: %w", policiesPath, err)
+	}
+	for _, policy := range policies {
+		if policy.originPattern, err = regexp.Compile(policy.Origins); err != nil {
+			return nil, fmt.Errorf("Invalid origin pattern %q: %w", policy.Origins, err)
+		}
+		for i, member := range policy.Members {
+			member = strings.ToLower(member)
+			if _, err := path.Match(member, ""); err != nil {
+				return nil, fmt.Errorf("Invalid member pattern %q: %w", member, err)
+			}
+			policy.Members[i] = member
+		}
+	}
+	return policies, nil
+}
+
+// AllowsOrigin returns true if the user may use origin.  An empty origin is always allowed.
+func (p OriginPolicies) AllowsOrigin(userToken *UserToken, origin string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, policy := range p {
+		if hasMember(policy.Members, userToken) {
+			return policy.originPattern.MatchString(origin)
+		}
+	}
+	return true
+}
@@ -0,0 +1,287 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Personal access tokens are long-lived tokens, optionally restricted to specific buckets and
+// modes, that users create for notebooks and batch jobs.  A token has the form "ngpat_ID.SECRET";
+// only a hash of the secret is stored.
+
+const personalAccessTokenPrefix = "ngpat_"
+
+const defaultPersonalAccessTokenLifetimeDays = 90
+
+const maxPersonalAccessTokenLifetimeDays = 365
+
+type personalAccessToken struct {
+	Id           string `json:"id"`
+	SecretSha256 string `json:"secretSha256"`
+
+	// Identity of the user who created the token.
+	UserId        string   `json:"userId"`
+	LinkedUserIds []string `json:"linkedUserIds,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+
+	Name string `json:"name,omitempty"`
+
+	// Buckets for which the token may be used, or empty for all buckets.
+	Buckets []string `json:"buckets,omitempty"`
+
+	// /gcs_token modes for which the token may be used, or empty for all modes.
+	Modes []string `json:"modes,omitempty"`
+
+	Created int64 `json:"created"`
+	Expires int64 `json:"expires"`
+}
+
+func personalAccessTokenKey(id string) string {
+	return "personal_access_tokens/by_id/" + id
+}
+
+func personalAccessTokenUserPrefix(userId string) string {
+	return "personal_access_tokens/by_user/" + userId + "/"
+}
+
+func hashPersonalAccessTokenSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return base64url.EncodeToString(hash[:])
+}
+
+// resolvePersonalAccessToken returns a user token corresponding to a personal access token.
+func (auth *Authenticator) resolvePersonalAccessToken(ctx context.Context, token string) (*UserToken, error) {
+	parts := strings.SplitN(strings.TrimPrefix(token, personalAccessTokenPrefix), ".", 2)
+	if !strings.HasPrefix(token, personalAccessTokenPrefix) || len(parts) != 2 {
+		return nil, fmt.Errorf("Malformed personal access token")
+	}
+	var pat personalAccessToken
+	if err := auth.Store.Get(ctx, personalAccessTokenKey(parts[0]), &pat); err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashPersonalAccessTokenSecret(parts[1])), []byte(pat.SecretSha256)) != 1 {
+		return nil, fmt.Errorf("Invalid personal access token")
+	}
+	now := time.Now().Unix()
+	if pat.Expires < now {
+		return nil, fmt.Errorf("Personal access token expired")
+	}
+	userToken := &UserToken{
+		UserId:        pat.UserId,
+		Expires:       now + auth.TokenLifetimes.CrossOriginLifetimeSeconds(""),
+		LinkedUserIds: pat.LinkedUserIds,
+		Groups:        pat.Groups,
+		Buckets:       pat.Buckets,
+		Modes:         pat.Modes,
+		IssuedAt:      pat.Created,
+	}
+	if pat.Expires < userToken.Expires {
+		userToken.Expires = pat.Expires
+	}
+	// Revoking all sessions of the user also revokes the tokens created before.
+	if auth.Revocations.IsRevoked(ctx, userToken) {
+		return nil, fmt.Errorf("Personal access token revoked")
+	}
+	return userToken, nil
+}
+
+func (auth *Authenticator) listPersonalAccessTokens(ctx context.Context, userId string) (tokens []personalAccessToken, err error) {
+	prefix := personalAccessTokenUserPrefix(userId)
+	keys, err := auth.Store.List(ctx, prefix)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		var pat personalAccessToken
+		err = auth.Store.Get(ctx, personalAccessTokenKey(strings.TrimPrefix(key, prefix)), &pat)
+		if err == errStoreNotFound {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		tokens = append(tokens, pat)
+	}
+	err = nil
+	return
+}
+
+func (auth *Authenticator) writePersonalAccessTokens(w http.ResponseWriter, r *http.Request, userToken *UserToken) {
+	tokens, err := auth.listPersonalAccessTokens(r.Context(), userToken.UserId)
+	if err != nil {
+		log.Printf("Error listing personal access tokens for %s: %v", userToken.UserId, err)
+		return
+	}
+	formToken := html.EscapeString(EncodeUserToken(auth.UserTokenKey, formUserTokenType, auth.makeTemporaryUserToken(*userToken, "")))
+	fmt.Fprint(w, "<p>Personal access tokens:</p>\n<ul>\n")
+	for _, pat := range tokens {
+		buckets := "all buckets"
+		if len(pat.Buckets) > 0 {
+			buckets = strings.Join(pat.Buckets, ", ")
+		}
+		modes := "all modes"
+		if len(pat.Modes) > 0 {
+			modes = strings.Join(pat.Modes, ", ")
+		}
+		fmt.Fprintf(w, `<li>%s (%s; %s), expires %s
+<form action="/personal_access_tokens/%s/revoke" method="post" style="display:inline">
+<input type="hidden" name="token" value="%s">
+<input type="submit" value="Revoke">
+</form></li>
+`, html.EscapeString(pat.Name), html.EscapeString(buckets), html.EscapeString(modes), time.Unix(pat.Expires, 0).UTC().Format("2006-01-02"), html.EscapeString(pat.Id), formToken)
+	}
+	fmt.Fprintf(w, `</ul>
+<form action="/personal_access_tokens" method="post">
+<input type="hidden" name="token" value="%s">
+<input type="text" name="name" placeholder="Name">
+<input type="text" name="buckets" placeholder="Buckets (comma-separated, optional)">
+<input type="text" name="modes" placeholder="Modes (read, list, write; optional)">
+<input type="number" name="expires_in_days" value="%d" min="1" max="%d"> days
+<input type="submit" value="Create personal access token">
+</form>
+`, formToken, defaultPersonalAccessTokenLifetimeDays, maxPersonalAccessTokenLifetimeDays)
+}
+
+func (auth *Authenticator) addPersonalAccessTokenRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("GET").Path("/personal_access_tokens").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getUserTokenFromCookie(r)
+		if userToken == nil {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		tokens, err := auth.listPersonalAccessTokens(r.Context(), userToken.UserId)
+		if err != nil {
+			log.Printf("Error listing personal access tokens for %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		type tokenInfo struct {
+			Id      string   `json:"id"`
+			Name    string   `json:"name"`
+			Buckets []string `json:"buckets"`
+			Modes   []string `json:"modes"`
+			Created int64    `json:"created"`
+			Expires int64    `json:"expires"`
+		}
+		infos := []tokenInfo{}
+		for _, pat := range tokens {
+			infos = append(infos, tokenInfo{Id: pat.Id, Name: pat.Name, Buckets: pat.Buckets, Modes: pat.Modes, Created: pat.Created, Expires: pat.Expires})
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	})
+
+	mux.Methods("POST").Path("/personal_access_tokens").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getFormUser(w, r)
+		if userToken == nil {
+			return
+		}
+		days := defaultPersonalAccessTokenLifetimeDays
+		if s := r.PostForm.Get("expires_in_days"); s != "" {
+			var err error
+			days, err = strconv.Atoi(s)
+			if err != nil || days < 1 || days > maxPersonalAccessTokenLifetimeDays {
+				http.Error(w, fmt.Sprintf("Lifetime must be between 1 and %d days", maxPersonalAccessTokenLifetimeDays), http.StatusBadRequest)
+				return
+			}
+		}
+		buckets := splitList(r.PostForm.Get("buckets"))
+		modes := splitList(r.PostForm.Get("modes"))
+		for _, mode := range modes {
+			if mode != readMode && mode != listMode && mode != writeMode {
+				http.Error(w, fmt.Sprintf("Invalid mode: %q", mode), http.StatusBadRequest)
+				return
+			}
+		}
+		idBytes := make([]byte, 12)
+		secretBytes := make([]byte, 32)
+		if _, err := rand.Read(idBytes); err != nil {
+			panic(err)
+		}
+		if _, err := rand.Read(secretBytes); err != nil {
+			panic(err)
+		}
+		id := base64url.EncodeToString(idBytes)
+		secret := base64url.EncodeToString(secretBytes)
+		now := time.Now()
+		pat := personalAccessToken{
+			Id:            id,
+			SecretSha256:  hashPersonalAccessTokenSecret(secret),
+			UserId:        userToken.UserId,
+			LinkedUserIds: userToken.LinkedUserIds,
+			Groups:        userToken.Groups,
+			Name:          r.PostForm.Get("name"),
+			Buckets:       buckets,
+			Modes:         modes,
+			Created:       now.Unix(),
+			Expires:       now.AddDate(0, 0, days).Unix(),
+		}
+		err := auth.Store.Put(r.Context(), personalAccessTokenKey(id), pat)
+		if err == nil {
+			err = auth.Store.Put(r.Context(), personalAccessTokenUserPrefix(userToken.UserId)+id, struct{}{})
+		}
+		if err != nil {
+			log.Printf("Error storing personal access token for %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Created personal access token %s for %s", id, userToken.UserId)
+		w.Header().Add("x-frame-options", "deny")
+		w.Header().Add("content-type", "text/html")
+		w.Header().Set("cache-control", "no-store")
+		fmt.Fprintf(w, `<html><head><title>Personal access token</title></head><body>
+<p>Your new personal access token is shown below.  It will not be shown again.</p>
+<pre>%s</pre>
+<p><a href="/">Done</a></p>
+</body></html>`, html.EscapeString(personalAccessTokenPrefix+id+"."+secret))
+	})
+
+	mux.Methods("POST").Path("/personal_access_tokens/{id}/revoke").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getFormUser(w, r)
+		if userToken == nil {
+			return
+		}
+		id := gorilla_mux.Vars(r)["id"]
+		var pat personalAccessToken
+		if err := auth.Store.Get(r.Context(), personalAccessTokenKey(id), &pat); err != nil || pat.UserId != userToken.UserId {
+			http.Error(w, "Unknown token", http.StatusNotFound)
+			return
+		}
+		err := auth.Store.Delete(r.Context(), personalAccessTokenKey(id))
+		if err == nil {
+			err = auth.Store.Delete(r.Context(), personalAccessTokenUserPrefix(userToken.UserId)+id)
+		}
+		if err != nil {
+			log.Printf("Error deleting personal access token %s: %v", id, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Revoked personal access token %s for %s", id, userToken.UserId)
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
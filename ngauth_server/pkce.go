@@ -0,0 +1,71 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// Proof Key for Code Exchange (RFC 7636).  The code verifier is kept in a short-lived cookie
+// between /login and /auth_redirect, which binds the authorization code to the browser that
+// started the login.
+
+const pkceCookieName = "ngauth_pkce"
+
+const pkceCookieMaxAgeSeconds = 10 * 60
+
+// startPKCE generates a code verifier, stores it in a cookie, and returns the corresponding
+// authorization request parameters.
+func startPKCE(w http.ResponseWriter, r *http.Request) []oauth2.AuthCodeOption {
+	verifierBytes := make([]byte, 32)
+	if _, err := rand.Read(verifierBytes); err != nil {
+		panic(err)
+	}
+	verifier := base64url.EncodeToString(verifierBytes)
+	challenge := sha256.Sum256([]byte(verifier))
+	cookie := &http.Cookie{
+		Name:     pkceCookieName,
+		Value:    verifier,
+		Path:     "/auth_redirect",
+		MaxAge:   pkceCookieMaxAgeSeconds,
+		HttpOnly: true,
+		// The identity provider redirects back with a top-level navigation.
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.URL.Scheme == "https",
+	}
+	http.SetCookie(w, cookie)
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", base64url.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// takePKCEVerifier returns the token request parameter for the code verifier stored by
+// startPKCE, and clears the cookie.  Returns nil if there is no verifier.
+func takePKCEVerifier(w http.ResponseWriter, r *http.Request) oauth2.AuthCodeOption {
+	cookie, _ := r.Cookie(pkceCookieName)
+	if cookie == nil || cookie.Value == "" {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   pkceCookieName,
+		Path:   "/auth_redirect",
+		MaxAge: -1,
+	})
+	return oauth2.SetAuthURLParam("code_verifier", cookie.Value)
+}
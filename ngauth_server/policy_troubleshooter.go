@@ -0,0 +1,249 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Policy Troubleshooter v3 API, which, unlike v1, evaluates IAM conditions and deny policies using
+// the condition context of the access tuple.
+// https://cloud.google.com/policy-intelligence/docs/reference/troubleshooter/rest/v3/iam/troubleshoot
+
+const policyTroubleshooterURL = "https://policytroubleshooter.googleapis.com/v3/iam:troubleshoot"
+
+type troubleshooterResource struct {
+	Service string `json:"service"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+}
+
+type troubleshooterRequest struct {
+	ReceiveTime string `json:"receiveTime"`
+}
+
+type troubleshooterConditionContext struct {
+	Resource *troubleshooterResource `json:"resource,omitempty"`
+	Request  *troubleshooterRequest  `json:"request,omitempty"`
+}
+
+type troubleshooterAccessTuple struct {
+	Principal        string                          `json:"principal"`
+	FullResourceName string                          `json:"fullResourceName"`
+	Permission       string                          `json:"permission"`
+	ConditionContext *troubleshooterConditionContext `json:"conditionContext,omitempty"`
+}
+
+type troubleshooterBindingExplanation struct {
+	AllowAccessState string `json:"allowAccessState"`
+	Role             string `json:"role"`
+	RolePermission   string `json:"rolePermission"`
+	Memberships      map[string]struct {
+		Membership string `json:"membership"`
+	} `json:"memberships"`
+	Condition *struct {
+		Expression string `json:"expression"`
+	} `json:"condition"`
+	ConditionExplanation *struct {
+		Value interface{} `json:"value"`
+	} `json:"conditionExplanation"`
+}
+
+type troubleshooterResponse struct {
+	OverallAccessState     string `json:"overallAccessState"`
+	AllowPolicyExplanation struct {
+		ExplainedPolicies []struct {
+			FullResourceName    string                             `json:"fullResourceName"`
+			BindingExplanations []troubleshooterBindingExplanation `json:"bindingExplanations"`
+		} `json:"explainedPolicies"`
+	} `json:"allowPolicyExplanation"`
+	DenyPolicyExplanation struct {
+		DenyAccessState string `json:"denyAccessState"`
+	} `json:"denyPolicyExplanation"`
+}
+
+// makeConditionContext returns the context in which IAM conditions are evaluated: the object named
+// by prefix, or the bucket, and the current time.  The access token is valid for up to 1 hour, but
+// conditions on request.time are only evaluated for the time at which it is issued.
+func makeConditionContext(bucket string, prefix string) *troubleshooterConditionContext {
+	resource := &troubleshooterResource{
+		Service: "storage.googleapis.com",
+		Name:    "projects/_/buckets/" + bucket,
+		Type:    "storage.googleapis.com/Bucket",
+	}
+	if prefix != "" {
+		resource.Name += "/objects/" + prefix
+		resource.Type = "storage.googleapis.com/Object"
+	}
+	return &troubleshooterConditionContext{
+		Resource: resource,
+		Request:  &troubleshooterRequest{ReceiveTime: time.Now().UTC().Format(time.RFC3339)},
+	}
+}
+
+// policyTroubleshooterAuthorizer uses the Policy Troubleshooter API, which resolves all IAM
+// policies that apply to the bucket, but requires the service account to be able to read them,
+// e.g. by having the Security Reviewer role.
+type policyTroubleshooterAuthorizer struct {
+	client *http.Client
+
+	// Used to resolve membership of groups that the Policy Troubleshooter could not resolve, or
+	// nil.
+	groups *GoogleGroupsChecker
+
+	// Used to find managed folders whose policies may grant access to a prefix.
+	folders *managedFolderLister
+}
+
+// conditionHolds returns true if the binding has no condition, or its condition evaluated to true
+// or is known to hold for objects in bucket whose names start with prefix.
+func (binding *troubleshooterBindingExplanation) conditionHolds(bucket string, prefix string) bool {
+	if binding.Condition == nil {
+		return true
+	}
+	if binding.ConditionExplanation != nil && binding.ConditionExplanation.Value == true {
+		return true
+	}
+	return conditionCoversPrefix(binding.Condition.Expression, bucket, prefix)
+}
+
+// unresolvedGroups returns the groups granted permission by the explained policies whose
+// membership the Policy Troubleshooter could not determine.
+func unresolvedGroups(response *troubleshooterResponse, bucket string, prefix string) (groups []string) {
+	for _, policy := range response.AllowPolicyExplanation.ExplainedPolicies {
+		for _, binding := range policy.BindingExplanations {
+			if binding.RolePermission != "ROLE_PERMISSION_INCLUDED" || !binding.conditionHolds(bucket, prefix) {
+				continue
+			}
+			for member, membership := range binding.Memberships {
+				switch membership.Membership {
+				case "MEMBERSHIP_UNKNOWN_INFO", "MEMBERSHIP_UNKNOWN_UNSUPPORTED":
+					if group := strings.TrimPrefix(member, "group:"); group != member && !containsString(groups, group) {
+						groups = append(groups, group)
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// logConditionalBindings logs the conditions that prevented a decision.
+func logConditionalBindings(response *troubleshooterResponse, userId string) {
+	for _, policy := range response.AllowPolicyExplanation.ExplainedPolicies {
+		for _, binding := range policy.BindingExplanations {
+			if binding.AllowAccessState == "ALLOW_ACCESS_STATE_UNKNOWN_CONDITIONAL" && binding.Condition != nil {
+				log.Printf("Unable to evaluate condition for %s in policy of %s, role %s: %s", userId, policy.FullResourceName, binding.Role, binding.Condition.Expression)
+			}
+		}
+	}
+}
+
+func (a *policyTroubleshooterAuthorizer) troubleshoot(ctx context.Context, tuple troubleshooterAccessTuple) (*troubleshooterResponse, error) {
+	reqJson, err := json.Marshal(map[string]interface{}{"accessTuple": tuple})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", policyTroubleshooterURL, bytes.NewBuffer(reqJson))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Error querying %s for %s: %s %s", tuple.FullResourceName, tuple.Principal, resp.Status, string(body))
+		return nil, nil
+	}
+	var response troubleshooterResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling body: %s %w", string(body), err)
+	}
+	return &response, nil
+}
+
+func (a *policyTroubleshooterAuthorizer) CheckStoragePermission(ctx context.Context, userId string, bucket string, prefix string, permission string) (granted bool, err error) {
+	email := getUserEmail(userId)
+	if email == "" {
+		return
+	}
+	// For a prefix, IAM conditions on resource.name are evaluated for an object named by the
+	// prefix.
+	resourceName := getBucketResourceName(bucket)
+	if prefix != "" {
+		resourceName += "/objects/" + prefix
+	}
+	granted, err = a.checkResource(ctx, userId, email, resourceName, bucket, prefix, permission)
+	if granted || err != nil || prefix == "" || a.folders == nil {
+		return
+	}
+	// Managed folders containing the prefix may grant access that the bucket policy does not.
+	for _, folder := range a.folders.GetContainingFolders(ctx, bucket, prefix) {
+		granted, err = a.checkResource(ctx, userId, email, getManagedFolderResourceName(bucket, folder), bucket, prefix, permission)
+		if granted || err != nil {
+			return
+		}
+	}
+	return
+}
+
+// checkResource troubleshoots access by email to the resource named resourceName.
+func (a *policyTroubleshooterAuthorizer) checkResource(ctx context.Context, userId string, email string, resourceName string, bucket string, prefix string, permission string) (granted bool, err error) {
+	response, err := a.troubleshoot(ctx, troubleshooterAccessTuple{
+		Principal:        email,
+		FullResourceName: resourceName,
+		Permission:       permission,
+		ConditionContext: makeConditionContext(bucket, prefix),
+	})
+	if err != nil || response == nil {
+		return
+	}
+	switch response.OverallAccessState {
+	case "CAN_ACCESS":
+		return true, nil
+	case "UNKNOWN_CONDITIONAL":
+		logConditionalBindings(response, userId)
+	}
+	// Membership of groups cannot grant access denied by a deny policy.
+	if a.groups == nil || response.DenyPolicyExplanation.DenyAccessState == "DENY_ACCESS_STATE_DENIED" {
+		return
+	}
+	for _, group := range unresolvedGroups(response, bucket, prefix) {
+		isMember, err := a.groups.IsMemberOf(ctx, email, group)
+		if err != nil {
+			// Other groups may still grant access.
+			log.Printf("Error resolving membership of %s in %s: %v", email, group, err)
+			continue
+		}
+		if isMember {
+			return true, nil
+		}
+	}
+	return
+}
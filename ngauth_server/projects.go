@@ -0,0 +1,140 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
+)
+
+// BrokeredProject specifies the credentials used for the buckets of one GCP project, so that one
+// deployment can broker access to datasets owned by several labs.
+type BrokeredProject struct {
+	Name string `json:"name"`
+
+	// Bucket patterns, as for BUCKET_ALLOWLIST.
+	Buckets []string `json:"buckets"`
+
+	// Service account key file, or "" to use the default credentials.
+	CredentialsPath string `json:"credentialsPath,omitempty"`
+
+	// Service account to impersonate, or "".
+	ImpersonateServiceAccount string `json:"impersonateServiceAccount,omitempty"`
+
+	credentials *google.Credentials
+
+	// Determines whether users have access to the buckets, using the project's credentials.
+	storageAuthorizer StorageAuthorizer
+}
+
+// loadBrokeredProjects loads the projects specified by PROJECTS_PATH, a JSON list of
+// BrokeredProject.  Buckets not matched by any project use the default credentials.
+func loadBrokeredProjects(ctx context.Context) ([]*BrokeredProject, error) {
+	projectsPath, ok := os.LookupEnv("PROJECTS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(projectsPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading projects from %s: %w", projectsPath, err)
+	}
+	var projects []*BrokeredProject
+	if err := json.Unmarshal(data, &projects); err != nil {
+		return nil, fmt.Errorf("Error parsing projects from %s: %w", projectsPath, err)
+	}
+	for _, project := range projects {
+		for _, pattern := range project.Buckets {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid bucket pattern %q for project %s: %w", pattern, project.Name, err)
+			}
+		}
+		options := []option.ClientOption{option.WithScopes(cloudPlatformScope)}
+		if project.CredentialsPath != "" {
+			options = append(options, option.WithCredentialsFile(project.CredentialsPath))
+		}
+		if project.ImpersonateServiceAccount != "" {
+			options = append(options, option.ImpersonateCredentials(project.ImpersonateServiceAccount))
+		}
+		project.credentials, err = transport.Creds(ctx, options...)
+		if err != nil {
+			return nil, fmt.Errorf("Error obtaining credentials for project %s: %w", project.Name, err)
+		}
+		project.storageAuthorizer, err = makeStorageAuthorizer(oauth2.NewClient(ctx, project.credentials.TokenSource))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return projects, nil
+}
+
+// getBucketProject returns the project whose credentials are used for bucket, or nil to use the
+// default credentials.
+func (auth *Authenticator) getBucketProject(bucket string) *BrokeredProject {
+	for _, project := range auth.Projects {
+		if matchesAnyPattern(project.Buckets, bucket) {
+			return project
+		}
+	}
+	return nil
+}
+
+// getBucketCredentials returns the credentials used to issue access tokens for bucket.
+func (auth *Authenticator) getBucketCredentials(bucket string) *google.Credentials {
+	if project := auth.getBucketProject(bucket); project != nil {
+		return project.credentials
+	}
+	return auth.Credentials
+}
+
+type serviceAccountCredentialsKey struct {
+	base           *google.Credentials
+	serviceAccount string
+}
+
+// getServiceAccountCredentials returns credentials that impersonate serviceAccount using the
+// credentials of bucket, or the credentials of bucket if serviceAccount is "".  The impersonated
+// tokens are obtained from the IAM Credentials generateAccessToken API and reused until they expire.
+func (auth *Authenticator) getServiceAccountCredentials(bucket string, serviceAccount string) (*google.Credentials, error) {
+	base := auth.getBucketCredentials(bucket)
+	if serviceAccount == "" {
+		return base, nil
+	}
+	key := serviceAccountCredentialsKey{base, serviceAccount}
+	if credentials, ok := auth.serviceAccountCredentials.Load(key); ok {
+		return credentials.(*google.Credentials), nil
+	}
+	credentials, err := transport.Creds(context.Background(), option.WithCredentials(base), option.WithScopes(cloudPlatformScope), option.ImpersonateCredentials(serviceAccount))
+	if err != nil {
+		return nil, fmt.Errorf("Error obtaining credentials for service account %s: %w", serviceAccount, err)
+	}
+	actual, _ := auth.serviceAccountCredentials.LoadOrStore(key, credentials)
+	return actual.(*google.Credentials), nil
+}
+
+// getStorageAuthorizer returns the authorizer that checks access to bucket.
+func (auth *Authenticator) getStorageAuthorizer(bucket string) StorageAuthorizer {
+	if project := auth.getBucketProject(bucket); project != nil {
+		return project.storageAuthorizer
+	}
+	return auth.StorageAuthorizer
+}
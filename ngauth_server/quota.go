@@ -0,0 +1,309 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quotas limit the number of access tokens issued by /gcs_token, to protect against scripts
+// requesting tokens in a loop.
+
+// A session is considered active until the last access token issued to it expires.
+const quotaSessionLifetime = time.Hour
+
+type userQuota struct {
+	// Pattern, as for the login allowlist, matched against the user id.
+	User string `json:"user"`
+
+	// Maximum number of access tokens per UTC day, or 0 for no limit.
+	TokensPerDay int `json:"tokensPerDay"`
+
+	// Maximum number of sessions, i.e. distinct login tokens, with unexpired access tokens, or 0
+	// for no limit.
+	ConcurrentSessions int `json:"concurrentSessions"`
+}
+
+type bucketQuota struct {
+	// Bucket pattern, as for BUCKET_ALLOWLIST.
+	Bucket string `json:"bucket"`
+
+	// Maximum number of access tokens per UTC day, over all users, or 0 for no limit.
+	TokensPerDay int `json:"tokensPerDay"`
+}
+
+// Quotas specifies the quotas, as specified by the file at QUOTA_PATH.  For each user and bucket,
+// the first matching entry applies.
+type Quotas struct {
+	Users   []userQuota   `json:"users"`
+	Buckets []bucketQuota `json:"buckets"`
+
+	store quotaStore
+}
+
+// quotaStore tracks quota usage.
+type quotaStore interface {
+	// Increment adds 1 to the counter key, which is reset at expires, and returns the new value.
+	Increment(ctx context.Context, key string, expires time.Time) (int, error)
+
+	// AddSession marks session active until expires in the set key, unless limit other sessions
+	// are already active.  Returns whether the session was added and, if not, when the earliest
+	// active session expires.
+	AddSession(ctx context.Context, key string, session string, expires time.Time, limit int) (bool, time.Time, error)
+}
+
+// memoryQuotaStore is a quotaStore for single-instance deployments.
+type memoryQuotaStore struct {
+	mutex    sync.Mutex
+	counters map[string]*quotaCounter
+	sessions map[string]map[string]time.Time
+}
+
+type quotaCounter struct {
+	Count   int       `json:"count"`
+	Expires time.Time `json:"expires"`
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{
+		counters: make(map[string]*quotaCounter),
+		sessions: make(map[string]map[string]time.Time),
+	}
+}
+
+func (s *memoryQuotaStore) Increment(ctx context.Context, key string, expires time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for k, counter := range s.counters {
+		if !now.Before(counter.Expires) {
+			delete(s.counters, k)
+		}
+	}
+	counter := s.counters[key]
+	if counter == nil {
+		counter = &quotaCounter{Expires: expires}
+		s.counters[key] = counter
+	}
+	counter.Count++
+	return counter.Count, nil
+}
+
+// addSession updates sessions as for quotaStore.AddSession.
+func addSession(sessions map[string]time.Time, session string, expires time.Time, limit int) (bool, time.Time) {
+	now := time.Now()
+	var earliest time.Time
+	for s, e := range sessions {
+		if !now.Before(e) {
+			delete(sessions, s)
+		} else if earliest.IsZero() || e.Before(earliest) {
+			earliest = e
+		}
+	}
+	if _, ok := sessions[session]; !ok && limit > 0 && len(sessions) >= limit {
+		return false, earliest
+	}
+	sessions[session] = expires
+	return true, time.Time{}
+}
+
+func (s *memoryQuotaStore) AddSession(ctx context.Context, key string, session string, expires time.Time, limit int) (bool, time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sessions := s.sessions[key]
+	if sessions == nil {
+		sessions = make(map[string]time.Time)
+		s.sessions[key] = sessions
+	}
+	added, reset := addSession(sessions, session, expires, limit)
+	return added, reset, nil
+}
+
+// stateQuotaStore is a quotaStore that keeps usage in the state store, so that it is shared
+// between instances.  Updates are not atomic, so concurrent requests may exceed quotas slightly.
+type stateQuotaStore struct {
+	store Store
+}
+
+func (s *stateQuotaStore) Increment(ctx context.Context, key string, expires time.Time) (int, error) {
+	key = "quota/counters/" + key
+	var counter quotaCounter
+	if err := s.store.Get(ctx, key, &counter); err != nil && !errors.Is(err, errStoreNotFound) {
+		return 0, err
+	}
+	if !time.Now().Before(counter.Expires) {
+		counter = quotaCounter{Expires: expires}
+	}
+	counter.Count++
+	if err := s.store.Put(ctx, key, &counter); err != nil {
+		return 0, err
+	}
+	return counter.Count, nil
+}
+
+func (s *stateQuotaStore) AddSession(ctx context.Context, key string, session string, expires time.Time, limit int) (bool, time.Time, error) {
+	key = "quota/sessions/" + key
+	sessions := make(map[string]time.Time)
+	if err := s.store.Get(ctx, key, &sessions); err != nil && !errors.Is(err, errStoreNotFound) {
+		return false, time.Time{}, err
+	}
+	added, reset := addSession(sessions, session, expires, limit)
+	if added {
+		if err := s.store.Put(ctx, key, sessions); err != nil {
+			return false, time.Time{}, err
+		}
+	}
+	return added, reset, nil
+}
+
+// loadQuotas loads the quotas, tracking usage in the store specified by QUOTA_STORE: either
+// "memory" (the default) or "state", to use the state store.
+func loadQuotas(store Store) (*Quotas, error) {
+	quotaPath, ok := os.LookupEnv("QUOTA_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(quotaPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading quotas from %s: %w", quotaPath, err)
+	}
+	var quotas Quotas
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return nil, fmt.Errorf("Error parsing quotas from %s: %w", quotaPath, err)
+	}
+	for i := range quotas.Users {
+		quota := &quotas.Users[i]
+		quota.User = strings.ToLower(quota.User)
+		if _, err := path.Match(quota.User, ""); err != nil {
+			return nil, fmt.Errorf("Invalid user pattern %q: %w", quota.User, err)
+		}
+	}
+	for _, quota := range quotas.Buckets {
+		if _, err := path.Match(quota.Bucket, ""); err != nil {
+			return nil, fmt.Errorf("Invalid bucket pattern %q: %w", quota.Bucket, err)
+		}
+	}
+	switch spec := getEnvOr("QUOTA_STORE", "memory"); spec {
+	case "memory":
+		quotas.store = newMemoryQuotaStore()
+	case "state":
+		quotas.store = &stateQuotaStore{store: store}
+	default:
+		return nil, fmt.Errorf("Invalid QUOTA_STORE: %q", spec)
+	}
+	return &quotas, nil
+}
+
+func (q *Quotas) getUserQuota(userId string) *userQuota {
+	userId = strings.ToLower(userId)
+	for i := range q.Users {
+		if matched, _ := path.Match(q.Users[i].User, userId); matched {
+			return &q.Users[i]
+		}
+	}
+	return nil
+}
+
+func (q *Quotas) getBucketQuota(bucket string) *bucketQuota {
+	for i := range q.Buckets {
+		if matched, _ := path.Match(q.Buckets[i].Bucket, bucket); matched {
+			return &q.Buckets[i]
+		}
+	}
+	return nil
+}
+
+// getQuotaSession returns an identifier of the session making a /gcs_token request, derived from
+// the login token it presents.
+func getQuotaSession(r *http.Request, tokenRequest *GcsTokenRequest) string {
+	credential := tokenRequest.Token
+	if credential == "" {
+		credential = r.Header.Get("authorization")
+	}
+	if credential == "" {
+		credential = r.RemoteAddr + " " + r.UserAgent()
+	}
+	hash := sha256.Sum256([]byte(credential))
+	return base64url.EncodeToString(hash[:16])
+}
+
+// Consume records the issuance of an access token for bucket to the session of userId.  If a
+// quota is exceeded, returns false and the time at which it resets.
+func (q *Quotas) Consume(ctx context.Context, userId string, bucket string, session string) (ok bool, reset time.Time, err error) {
+	now := time.Now().UTC()
+	year, month, day := now.Date()
+	endOfDay := time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+	dayKey := now.Format("2006-01-02")
+	userQuota := q.getUserQuota(userId)
+	if userQuota != nil && userQuota.ConcurrentSessions > 0 {
+		ok, reset, err = q.store.AddSession(ctx, "user/"+userId, session, now.Add(quotaSessionLifetime), userQuota.ConcurrentSessions)
+		if err != nil || !ok {
+			return
+		}
+	}
+	if userQuota != nil && userQuota.TokensPerDay > 0 {
+		var count int
+		count, err = q.store.Increment(ctx, "user/"+userId+"/"+dayKey, endOfDay)
+		if err != nil {
+			return
+		}
+		if count > userQuota.TokensPerDay {
+			return false, endOfDay, nil
+		}
+	}
+	if bucketQuota := q.getBucketQuota(bucket); bucketQuota != nil && bucketQuota.TokensPerDay > 0 {
+		var count int
+		count, err = q.store.Increment(ctx, "bucket/"+bucket+"/"+dayKey, endOfDay)
+		if err != nil {
+			return
+		}
+		if count > bucketQuota.TokensPerDay {
+			return false, endOfDay, nil
+		}
+	}
+	return true, time.Time{}, nil
+}
+
+// consumeCredentialsQuota consumes the user's quota for the bucket of tokenRequest, or returns the
+// error response if it is exceeded.
+func (auth *Authenticator) consumeCredentialsQuota(r *http.Request, userToken *UserToken, tokenRequest *GcsTokenRequest) *credentialError {
+	if auth.Quotas == nil {
+		return nil
+	}
+	ok, reset, err := auth.Quotas.Consume(r.Context(), userToken.UserId, tokenRequest.Bucket, getQuotaSession(r, tokenRequest))
+	if err != nil {
+		log.Printf("Error checking quota, user=%s, bucket=%s, err=%+v", userToken.UserId, tokenRequest.Bucket, err)
+		return &credentialError{status: http.StatusInternalServerError, message: "Failed to check quota"}
+	}
+	if !ok {
+		return &credentialError{
+			status:     http.StatusTooManyRequests,
+			message:    "Quota exceeded until " + reset.UTC().Format(time.RFC3339),
+			retryAfter: int(time.Until(reset).Seconds()) + 1,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Cloudflare R2 buckets are S3 buckets whose temporary credentials are obtained from the R2
+// temporary access credentials API rather than from STS.  The credentials are derived from an R2
+// API token with access to the bucket, and limited to the requested prefixes and mode.
+
+const cloudflareApiURL = "https://api.cloudflare.com/client/v4"
+
+var cloudflareHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// R2Config specifies how temporary credentials are obtained for an R2 bucket.
+type R2Config struct {
+	AccountId string `json:"accountId"`
+
+	// Access key id of the R2 API token from which the temporary credentials are derived.
+	ParentAccessKeyId string `json:"parentAccessKeyId"`
+
+	// File containing a Cloudflare API token with permission to create temporary credentials.
+	ApiTokenPath string `json:"apiTokenPath"`
+
+	apiToken string
+}
+
+// load reads the API token, and sets the defaults of bucket b.
+func (c *R2Config) load(bucket string, b *S3Bucket) error {
+	if c.AccountId == "" || c.ParentAccessKeyId == "" || c.ApiTokenPath == "" {
+		return fmt.Errorf("R2 bucket %s must specify accountId, parentAccessKeyId and apiTokenPath", bucket)
+	}
+	apiToken, err := ioutil.ReadFile(c.ApiTokenPath)
+	if err != nil {
+		return fmt.Errorf("Error reading Cloudflare API token from %s: %w", c.ApiTokenPath, err)
+	}
+	c.apiToken = strings.TrimSpace(string(apiToken))
+	if b.Endpoint == "" {
+		b.Endpoint = "https://" + c.AccountId + ".r2.cloudflarestorage.com"
+	}
+	// R2 ignores the region, but S3 clients require one.
+	if b.Region == "" {
+		b.Region = "auto"
+	}
+	if b.DurationSeconds == 0 {
+		b.DurationSeconds = defaultAwsCredentialsDurationSeconds
+	}
+	return nil
+}
+
+// createCredentials obtains temporary credentials for bucket, limited to prefixes in mode.
+func (c *R2Config) createCredentials(ctx context.Context, bucket string, prefixes []string, mode string, durationSeconds int64) (*awsCredentialsResponse, error) {
+	// Read-only credentials also allow listing.
+	permission := "object-read-only"
+	if mode == writeMode {
+		permission = "object-read-write"
+	}
+	request := map[string]interface{}{
+		"bucket":            bucket,
+		"parentAccessKeyId": c.ParentAccessKeyId,
+		"permission":        permission,
+		"ttlSeconds":        durationSeconds,
+	}
+	if len(prefixes) > 0 {
+		request["prefixes"] = prefixes
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", cloudflareApiURL+"/accounts/"+c.AccountId+"/r2/temp-access-credentials", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("authorization", "Bearer "+c.apiToken)
+	req.Header.Set("content-type", "application/json")
+	expires := time.Now().Unix() + durationSeconds
+	resp, err := cloudflareHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &TokenExchangeError{StatusCode: resp.StatusCode, Body: string(responseBody)}
+	}
+	var response struct {
+		Success bool `json:"success"`
+		Result  struct {
+			AccessKeyId     string `json:"accessKeyId"`
+			SecretAccessKey string `json:"secretAccessKey"`
+			SessionToken    string `json:"sessionToken"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		return nil, err
+	}
+	if !response.Success || response.Result.AccessKeyId == "" {
+		return nil, fmt.Errorf("No credentials in R2 response: %s", responseBody)
+	}
+	return &awsCredentialsResponse{
+		AccessKeyId:     response.Result.AccessKeyId,
+		SecretAccessKey: response.Result.SecretAccessKey,
+		SessionToken:    response.Result.SessionToken,
+		ExpiresAt:       expires,
+	}, nil
+}
+
+// issueR2Credentials obtains credentials for the R2 bucket of tokenRequest, limited to prefixes in
+// the requested mode.
+func (auth *Authenticator) issueR2Credentials(r *http.Request, userToken *UserToken, tokenRequest *GcsTokenRequest, bucket *S3Bucket, prefixes []string) (*awsCredentialsResponse, *credentialError) {
+	if tokenErr := auth.consumeCredentialsQuota(r, userToken, tokenRequest); tokenErr != nil {
+		return nil, tokenErr
+	}
+	credentials, err := bucket.R2.createCredentials(r.Context(), tokenRequest.Bucket, prefixes, tokenRequest.Mode, bucket.DurationSeconds)
+	if err != nil {
+		return nil, makeCredentialsError(tokenRequest.Bucket, err)
+	}
+	credentials.Bucket = tokenRequest.Bucket
+	credentials.Region = bucket.Region
+	credentials.Prefixes = prefixes
+	return credentials, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Token revocation: a login session, along with the user tokens derived from it, may be revoked
+// before it expires, as may all sessions of a user issued before a given time.  Revocations are
+// recorded in the state store, so that they apply to all instances sharing the store.
+
+// Duration for which revocation lookups are cached.  Revocations made by other instances take
+// effect within this period.
+const revocationCacheDuration = time.Minute
+
+// RevocationList records revoked login sessions in the state store.
+type RevocationList struct {
+	store Store
+
+	// Cache of store key to *cachedRevocation.
+	cache sync.Map
+}
+
+type cachedRevocation struct {
+	value   int64
+	expires time.Time
+}
+
+// makeSessionId returns a new random login session id.
+func makeSessionId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return base64url.EncodeToString(id)
+}
+
+func revokedSessionKey(sessionId string) string {
+	return "revocations/sessions/" + sessionId
+}
+
+func revokedUserKey(userId string) string {
+	hash := sha256.Sum256([]byte(userId))
+	return "revocations/users/" + base64url.EncodeToString(hash[:])
+}
+
+// lookup returns the value stored under key, or 0 if there is none.
+func (l *RevocationList) lookup(ctx context.Context, key string) int64 {
+	if cached, ok := l.cache.Load(key); ok && time.Now().Before(cached.(*cachedRevocation).expires) {
+		return cached.(*cachedRevocation).value
+	}
+	var value int64
+	if err := l.store.Get(ctx, key, &value); err != nil && err != errStoreNotFound {
+		// Tokens remain usable while the store is unavailable.
+		log.Printf("Error checking revocation %s: %v", key, err)
+		return 0
+	}
+	l.cache.Store(key, &cachedRevocation{value: value, expires: time.Now().Add(revocationCacheDuration)})
+	return value
+}
+
+func (l *RevocationList) put(ctx context.Context, key string, value int64) error {
+	if err := l.store.Put(ctx, key, value); err != nil {
+		return err
+	}
+	l.cache.Store(key, &cachedRevocation{value: value, expires: time.Now().Add(revocationCacheDuration)})
+	return nil
+}
+
+// RevokeSession revokes the login session of userToken.
+func (l *RevocationList) RevokeSession(ctx context.Context, userToken *UserToken) error {
+	if userToken.SessionId == "" {
+		return fmt.Errorf("Token does not identify a login session")
+	}
+	// The expiry of the session is recorded so that the entry may be removed once it has passed.
+	return l.put(ctx, revokedSessionKey(userToken.SessionId), userToken.Expires)
+}
+
+// RevokeUser revokes all login sessions of userId issued until now.
+func (l *RevocationList) RevokeUser(ctx context.Context, userId string) error {
+	return l.put(ctx, revokedUserKey(userId), time.Now().Unix())
+}
+
+// IsRevoked returns true if the login session of userToken, or all sessions of the user issued
+// when it was, have been revoked.
+func (l *RevocationList) IsRevoked(ctx context.Context, userToken *UserToken) bool {
+	if l == nil {
+		return false
+	}
+	if userToken.SessionId != "" && l.lookup(ctx, revokedSessionKey(userToken.SessionId)) != 0 {
+		return true
+	}
+	revokedBefore := l.lookup(ctx, revokedUserKey(userToken.UserId))
+	return revokedBefore != 0 && userToken.IssuedAt <= revokedBefore
+}
+
+func (auth *Authenticator) addRevocationRoutes(mux *gorilla_mux.Router) {
+	// Revokes a user token (RFC 7009), and the login session from which it was derived.  With
+	// all_sessions=true, revokes all login sessions of the user.  Holding the token is sufficient
+	// to revoke it, and, as specified by RFC 7009, invalid tokens are ignored.
+	mux.Methods("POST").Path("/revoke").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("origin"); origin != "" {
+			w.Header().Set("vary", "origin")
+			if !OriginPattern.MatchString(origin) || !auth.IsOriginAllowed(origin) {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("access-control-allow-origin", origin)
+		}
+		if err := r.ParseForm(); err != nil {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		token := r.PostForm.Get("token")
+		if token == "" {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		if strings.HasPrefix(token, personalAccessTokenPrefix) {
+			// Personal access tokens are revoked from the home page.
+			writeOAuth2Error(w, "unsupported_token_type")
+			return
+		}
+		userToken, err := auth.DecodeClientToken(r.Context(), token)
+		if err != nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.PostForm.Get("all_sessions") == "true" {
+			err = auth.Revocations.RevokeUser(r.Context(), userToken.UserId)
+		} else {
+			err = auth.Revocations.RevokeSession(r.Context(), &userToken)
+		}
+		if err != nil {
+			log.Printf("Error revoking token, user=%s, err=%v", userToken.UserId, err)
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("AUDIT: revoked token of %s (all_sessions=%v)", userToken.UserId, r.PostForm.Get("all_sessions") == "true")
+		w.WriteHeader(http.StatusOK)
+	})
+}
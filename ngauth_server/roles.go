@@ -0,0 +1,209 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Role-based access control: named roles are bound to users and groups for sets of buckets.  Role
+// bindings are evaluated before the storage authorizer, and the roles determine the permissions
+// carried by the access token returned by /gcs_token.
+
+// Permissions, in the form used by credential access boundaries, of the access tokens issued to
+// users who are granted read access by IAM or the storage authorizer.
+var defaultTokenPermissions = []string{"inRole:roles/storage.objectViewer"}
+
+// Predefined roles.  The service account must itself have the corresponding permissions on the
+// bucket.
+var predefinedRoles = map[string][]string{
+	"viewer":    defaultTokenPermissions,
+	"annotator": {"inRole:roles/storage.objectViewer", "inRole:roles/storage.objectCreator"},
+	"admin":     {"inRole:roles/storage.objectAdmin"},
+}
+
+type roleBinding struct {
+	Role string `json:"role"`
+
+	// Patterns, as for the login allowlist, matched against qualified user ids, "group:GROUP" for
+	// qualified identity provider groups, or "claim:NAME=PATTERN" for identity provider claims.
+	Members []string `json:"members"`
+
+	// Bucket patterns, as for BUCKET_ALLOWLIST.
+	Buckets []string `json:"buckets"`
+}
+
+// RoleBindings grants roles to users and groups, as specified by the file at ROLES_PATH.
+type RoleBindings struct {
+	// Permissions of each role, including any additional roles defined in the file.
+	Roles map[string][]string `json:"roles"`
+
+	Bindings []roleBinding `json:"bindings"`
+}
+
+func loadRoleBindings() (*RoleBindings, error) {
+	rolesPath, ok := os.LookupEnv("ROLES_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(rolesPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading roles from %s: %w", rolesPath, err)
+	}
+	var rb RoleBindings
+	if err := json.Unmarshal(data, &rb); err != nil {
+		return nil, fmt.Errorf("Error parsing roles from %s: %w", rolesPath, err)
+	}
+	if rb.Roles == nil {
+		rb.Roles = make(map[string][]string)
+	}
+	for name, permissions := range predefinedRoles {
+		if rb.Roles[name] == nil {
+			rb.Roles[name] = permissions
+		}
+	}
+	for i := range rb.Bindings {
+		binding := &rb.Bindings[i]
+		if rb.Roles[binding.Role] == nil {
+			return nil, fmt.Errorf("Unknown role %q in %s", binding.Role, rolesPath)
+		}
+		for j, member := range binding.Members {
+			member = strings.ToLower(member)
+			if _, err := path.Match(member, ""); err != nil {
+				return nil, fmt.Errorf("Invalid member pattern %q: %w", member, err)
+			}
+			binding.Members[j] = member
+		}
+		for _, pattern := range binding.Buckets {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid bucket pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return &rb, nil
+}
+
+// matchesClaim returns true if spec, of the form "NAME=PATTERN", matches the claim NAME selected
+// by USER_TOKEN_CLAIMS.  String values are matched against PATTERN as for the login allowlist,
+// ignoring case; other scalar values are compared in their JSON representation; lists match if any
+// element matches.
+func matchesClaim(spec string, claims map[string]interface{}) bool {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	var matchesValue func(value interface{}) bool
+	matchesValue = func(value interface{}) bool {
+		switch v := value.(type) {
+		case nil:
+			return false
+		case string:
+			matched, _ := path.Match(parts[1], strings.ToLower(v))
+			return matched
+		case []interface{}:
+			for _, element := range v {
+				if matchesValue(element) {
+					return true
+				}
+			}
+			return false
+		default:
+			encoded, _ := json.Marshal(v)
+			return string(encoded) == parts[1]
+		}
+	}
+	for name, value := range claims {
+		if strings.ToLower(name) == parts[0] {
+			return matchesValue(value)
+		}
+	}
+	return false
+}
+
+// hasMember returns true if any of members, as for role bindings, matches the user.
+func hasMember(members []string, userToken *UserToken) bool {
+	for _, member := range members {
+		if strings.HasPrefix(member, "claim:") {
+			if matchesClaim(strings.TrimPrefix(member, "claim:"), userToken.Claims) {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(member, "group:") {
+			group := strings.TrimPrefix(member, "group:")
+			for _, g := range userToken.Groups {
+				if strings.ToLower(g) == group {
+					return true
+				}
+			}
+			continue
+		}
+		for _, userId := range userToken.Principals() {
+			if matched, _ := path.Match(member, strings.ToLower(userId)); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowsWrite returns true if permissions include creating objects.
+func allowsWrite(permissions []string) bool {
+	for _, permission := range permissions {
+		switch permission {
+		case "inRole:roles/storage.objectCreator", "inRole:roles/storage.objectUser", "inRole:roles/storage.objectAdmin", "inRole:roles/storage.legacyBucketWriter":
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole returns true if the user is granted role for bucket.
+func (rb *RoleBindings) HasRole(userToken *UserToken, bucket string, role string) bool {
+	if rb == nil {
+		return false
+	}
+	for i := range rb.Bindings {
+		binding := &rb.Bindings[i]
+		if binding.Role == role && matchesAnyPattern(binding.Buckets, bucket) && hasMember(binding.Members, userToken) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPermissions returns the union of the permissions of the roles granted to the user for
+// bucket, or nil if no roles are granted.
+func (rb *RoleBindings) GetPermissions(userToken *UserToken, bucket string) (permissions []string) {
+	if rb == nil {
+		return nil
+	}
+	for i := range rb.Bindings {
+		binding := &rb.Bindings[i]
+		if !matchesAnyPattern(binding.Buckets, bucket) || !hasMember(binding.Members, userToken) {
+			continue
+		}
+		for _, permission := range rb.Roles[binding.Role] {
+			if !containsString(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return
+}
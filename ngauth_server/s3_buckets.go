@@ -0,0 +1,302 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// S3 buckets: datasets stored only in Amazon S3, e.g. s3:// Neuroglancer sources, may be gated by
+// the same login.  /s3_token, like /gcs_token, checks the user's access to the bucket, here
+// granted by the members configured for it, and returns temporary AWS credentials obtained as for
+// S3 mirrors.
+
+// Global S3 endpoint of Tigris.
+const tigrisEndpoint = "https://t3.storage.dev"
+
+// S3Bucket specifies an S3 bucket to which ngauth brokers access.
+type S3Bucket struct {
+	// Name of the bucket in its object store, if different from its key in S3_BUCKETS_PATH, so
+	// that buckets of the same name in several stores may be served.
+	Bucket string `json:"bucket,omitempty"`
+
+	// Role with access to the bucket, in write mode if there are writers.  For R2 and B2 buckets,
+	// only the region and duration apply.
+	awsRole
+
+	// Specifies that the bucket is in Cloudflare R2, or nil.
+	R2 *R2Config `json:"r2,omitempty"`
+
+	// Specifies that the bucket is in Backblaze B2, or nil.
+	B2 *B2Config `json:"b2,omitempty"`
+
+	// Whether the bucket is in Tigris, whose endpoint and region are then the defaults.
+	Tigris bool `json:"tigris,omitempty"`
+
+	// URL of an S3-compatible object store, e.g. MinIO or Ceph RGW, or "" for Amazon S3.
+	// Unless specified separately, its STS API is assumed to be served at the same URL.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Whether objects are addressed as ENDPOINT/BUCKET/OBJECT rather than BUCKET.ENDPOINT/OBJECT,
+	// as most S3-compatible stores require.
+	PathStyle bool `json:"pathStyle,omitempty"`
+
+	// Members, as for role bindings, who may read and list the bucket.
+	Readers []string `json:"readers,omitempty"`
+
+	// Members who may read, list and write the bucket.
+	Writers []string `json:"writers,omitempty"`
+}
+
+// S3Target selects the object store of an S3 bucket, and the addressing of its objects, in a
+// request for credentials.  Unspecified fields match any configured bucket of the requested name.
+type S3Target struct {
+	// URL of the object store, as for S3Bucket, or "" for any store.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Region of the bucket, or "" for any region.
+	Region string `json:"region,omitempty"`
+
+	// Whether the client addresses objects path-style, or nil for the default of the store.
+	PathStyle *bool `json:"pathStyle,omitempty"`
+}
+
+// Allows returns true if the bucket's members grant the user access in mode.
+func (b *S3Bucket) Allows(userToken *UserToken, mode string) bool {
+	if hasMember(b.Writers, userToken) {
+		return true
+	}
+	return mode != writeMode && hasMember(b.Readers, userToken)
+}
+
+// loadS3Buckets loads the buckets specified by S3_BUCKETS_PATH, a JSON object mapping S3 bucket
+// names to S3Bucket.
+func loadS3Buckets() (map[string]*S3Bucket, error) {
+	bucketsPath, ok := os.LookupEnv("S3_BUCKETS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(bucketsPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading S3 buckets from %s: %w", bucketsPath, err)
+	}
+	var buckets map[string]*S3Bucket
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		return nil, fmt.Errorf("Error parsing S3 buckets from %s: %w", bucketsPath, err)
+	}
+	for bucket, b := range buckets {
+		if b.Bucket == "" {
+			b.Bucket = bucket
+		}
+		if b.R2 != nil {
+			if err := b.R2.load(bucket, b); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if b.B2 != nil {
+			if err := b.B2.load(bucket, b); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if b.Tigris {
+			if b.Endpoint == "" {
+				b.Endpoint = tigrisEndpoint
+			}
+			if b.Region == "" {
+				b.Region = "auto"
+			}
+			// Tigris does not serve STS at its S3 endpoint.
+			if b.StsEndpoint == "" {
+				return nil, fmt.Errorf("Tigris bucket %s must specify stsEndpoint", bucket)
+			}
+		}
+		if b.Endpoint != "" && b.StsEndpoint == "" {
+			b.StsEndpoint = b.Endpoint
+		}
+		if err := b.validate(bucket); err != nil {
+			return nil, err
+		}
+	}
+	for bucket, b := range buckets {
+		for other, o := range buckets {
+			if other < bucket && o.Bucket == b.Bucket && o.Endpoint == b.Endpoint && o.Region == b.Region {
+				return nil, fmt.Errorf("S3 buckets %s and %s specify the same bucket, endpoint and region", other, bucket)
+			}
+		}
+	}
+	return buckets, nil
+}
+
+// findS3Bucket returns the configured bucket named name in the store selected by target.
+func findS3Bucket(buckets map[string]*S3Bucket, name string, target *S3Target) (*S3Bucket, *credentialError) {
+	endpoint := strings.TrimSuffix(target.Endpoint, "/")
+	var match *S3Bucket
+	for _, b := range buckets {
+		if b.Bucket != name || (endpoint != "" && strings.TrimSuffix(b.Endpoint, "/") != endpoint) || (target.Region != "" && b.Region != target.Region) {
+			continue
+		}
+		if match != nil {
+			return nil, &credentialError{status: http.StatusBadRequest, message: "Bucket is served by several object stores; specify endpoint and region"}
+		}
+		match = b
+	}
+	if match == nil {
+		return nil, &credentialError{status: http.StatusNotFound, message: "Bucket not served by this server"}
+	}
+	if target.PathStyle != nil && !*target.PathStyle && match.PathStyle {
+		return nil, &credentialError{status: http.StatusBadRequest, message: "Bucket must be addressed path-style"}
+	}
+	return match, nil
+}
+
+// s3BucketsUseWebIdentity returns true if credentials for any of buckets are obtained with web
+// identity tokens, which requires JWT user tokens.
+func s3BucketsUseWebIdentity(buckets map[string]*S3Bucket) bool {
+	for _, b := range buckets {
+		if b.R2 == nil && b.B2 == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// s3BucketBroker issues temporary AWS credentials for S3 buckets.  The resource is the name of the
+// S3 bucket.
+type s3BucketBroker struct {
+	auth *Authenticator
+}
+
+func makeS3BucketBroker(auth *Authenticator) CredentialBroker {
+	if auth.S3Buckets == nil {
+		return nil
+	}
+	return &s3BucketBroker{auth: auth}
+}
+
+// s3RequestTarget decodes the S3Target of the options of request.
+func s3RequestTarget(request *CredentialRequest) (*S3Target, *credentialError) {
+	var target S3Target
+	if len(request.Options) != 0 {
+		if err := json.Unmarshal(request.Options, &target); err != nil {
+			return nil, &credentialError{status: http.StatusBadRequest, message: "Invalid options"}
+		}
+	}
+	return &target, nil
+}
+
+// authorize checks the user's access to the bucket of request, and returns the user token, the
+// bucket, and the request as for /gcs_token.
+func (b *s3BucketBroker) authorize(r *http.Request, origin string, request *CredentialRequest) (*UserToken, *S3Bucket, *GcsTokenRequest, *credentialError) {
+	auth := b.auth
+	tokenRequest := &GcsTokenRequest{Token: request.Token, Bucket: request.Resource, Prefix: request.Prefix, Mode: request.Mode}
+	target, tokenErr := s3RequestTarget(request)
+	if tokenErr != nil {
+		return nil, nil, nil, tokenErr
+	}
+	bucket, tokenErr := findS3Bucket(auth.S3Buckets, tokenRequest.Bucket, target)
+	if tokenErr != nil {
+		return nil, nil, nil, tokenErr
+	}
+	if !isValidMode(tokenRequest.Mode) {
+		return nil, nil, nil, &credentialError{status: http.StatusBadRequest, message: "Invalid mode"}
+	}
+	if !isValidObjectPrefix(tokenRequest.Prefix) {
+		return nil, nil, nil, &credentialError{status: http.StatusBadRequest, message: "Invalid prefix"}
+	}
+	userToken, tokenErr := auth.authenticateCredentialRequest(r, request)
+	if tokenErr != nil {
+		return nil, nil, nil, tokenErr
+	}
+	// Policies keyed by bucket name, e.g. deny rules and embargoes, apply to the S3 bucket name.
+	if denial, _ := auth.checkTokenPolicies(r, origin, userToken, tokenRequest); denial != nil {
+		return nil, nil, nil, &credentialError{status: denial.status, message: denial.message, challenge: denial.challenge}
+	}
+	if !bucket.Allows(userToken, tokenRequest.Mode) {
+		log.Printf("AUDIT: %s denied AWS credentials for S3 bucket %s prefix %q mode %s", userToken.UserId, tokenRequest.Bucket, tokenRequest.Prefix, tokenRequest.Mode)
+		return nil, nil, nil, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	return userToken, bucket, tokenRequest, nil
+}
+
+func (b *s3BucketBroker) CheckAccess(r *http.Request, origin string, request *CredentialRequest) *credentialError {
+	_, _, _, tokenErr := b.authorize(r, origin, request)
+	return tokenErr
+}
+
+func (b *s3BucketBroker) IssueCredential(r *http.Request, origin string, request *CredentialRequest) (interface{}, *credentialError) {
+	userToken, bucket, tokenRequest, tokenErr := b.authorize(r, origin, request)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	var prefixes []string
+	if tokenRequest.Prefix != "" {
+		prefixes = []string{tokenRequest.Prefix}
+	}
+	var credentials *awsCredentialsResponse
+	if bucket.R2 != nil {
+		credentials, tokenErr = b.auth.issueR2Credentials(r, userToken, tokenRequest, bucket, prefixes)
+	} else if bucket.B2 != nil {
+		credentials, tokenErr = b.auth.issueB2Credentials(r, userToken, tokenRequest, bucket)
+	} else {
+		credentials, tokenErr = b.auth.issueAwsCredentials(r, userToken, tokenRequest, &bucket.awsRole, tokenRequest.Bucket, prefixes)
+	}
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	// The options were decoded by authorize.
+	target, _ := s3RequestTarget(request)
+	credentials.Endpoint = bucket.Endpoint
+	credentials.PathStyle = bucket.PathStyle || (target.PathStyle != nil && *target.PathStyle)
+	log.Printf("AUDIT: %s obtained AWS credentials for S3 bucket %s prefix %q mode %s", userToken.UserId, tokenRequest.Bucket, tokenRequest.Prefix, tokenRequest.Mode)
+	return credentials, nil
+}
+
+func (auth *Authenticator) addS3BucketRoutes(mux *gorilla_mux.Router) {
+	// Returns temporary AWS credentials for an S3 bucket, limited to the requested prefix and mode.
+	// The body is as for /gcs_token, with the name of the S3 bucket.
+	mux.Methods("POST").Path("/s3_token").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowCredentialOrigin(w, r)
+		var request struct {
+			GcsTokenRequest
+			S3Target
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.Dataset != "" {
+			http.Error(w, "Datasets are not supported for S3 buckets", http.StatusBadRequest)
+			return
+		}
+		// Json encoding cannot fail
+		options, _ := json.Marshal(&request.S3Target)
+		serveCredentialRequest(w, r, origin, auth.CredentialBrokers["s3"], &CredentialRequest{
+			Token:    request.Token,
+			Resource: request.Bucket,
+			Prefix:   request.Prefix,
+			Mode:     request.Mode,
+			Options:  options,
+		})
+	})
+}
@@ -0,0 +1,373 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// S3 mirrors: datasets mirrored to Amazon S3 may be read with temporary AWS credentials, obtained
+// from /aws_credentials with the same request as for /gcs_token.  Access is checked against the
+// GCS bucket, and ngauth then calls the AWS STS AssumeRoleWithWebIdentity API with a JWT user
+// token whose audience is AWS STS, so that ngauth acts as an OIDC identity provider trusted by the
+// IAM role.  AssumeRoleWithWebIdentity requests are not signed, so no AWS credentials are needed.
+
+// Audience of web identity tokens, as expected by AWS STS.
+const awsStsAudience = "sts.amazonaws.com"
+
+// Lifetime of the web identity tokens, which are only used for one STS request.
+const awsWebIdentityTokenLifetimeSeconds = 5 * 60
+
+const defaultAwsCredentialsDurationSeconds = 60 * 60
+
+// Minimum session duration allowed by AWS STS.
+const minAwsCredentialsDurationSeconds = 15 * 60
+
+// awsRole specifies the IAM role whose temporary credentials are issued for an S3 bucket.
+type awsRole struct {
+	// Region of the S3 bucket, whose STS endpoint is used.
+	Region string `json:"region"`
+
+	// IAM role with access to the S3 bucket, whose trust policy allows AssumeRoleWithWebIdentity
+	// for tokens issued by USER_TOKEN_ISSUER.  Optional for S3-compatible stores that derive the
+	// policy from the token, e.g. MinIO.
+	RoleArn string `json:"roleArn,omitempty"`
+
+	// URL of the STS API, or "" for the AWS STS endpoint of the region.  S3-compatible stores,
+	// e.g. MinIO and Ceph RGW, serve it at their S3 endpoint.
+	StsEndpoint string `json:"stsEndpoint,omitempty"`
+
+	// Lifetime of the temporary credentials, in seconds, or 0 for 1 hour.  It may not exceed the
+	// maximum session duration of the role.
+	DurationSeconds int64 `json:"durationSeconds,omitempty"`
+}
+
+// validate checks the role specified for bucket, and sets the default duration.
+func (role *awsRole) validate(bucket string) error {
+	if role.StsEndpoint != "" {
+		// Credentials are returned by the endpoint, so it must be authenticated.
+		if !strings.HasPrefix(role.StsEndpoint, "https://") {
+			return fmt.Errorf("STS endpoint for S3 bucket %s must be an https URL", bucket)
+		}
+		if role.RoleArn != "" && !strings.HasPrefix(role.RoleArn, "arn:") {
+			return fmt.Errorf("Invalid roleArn for S3 bucket %s", bucket)
+		}
+		if role.Region == "" {
+			// Default region of MinIO and Ceph RGW.
+			role.Region = "us-east-1"
+		}
+	} else if role.Region == "" || !strings.HasPrefix(role.RoleArn, "arn:aws:iam::") {
+		return fmt.Errorf("S3 bucket %s must specify region and roleArn", bucket)
+	}
+	if role.DurationSeconds == 0 {
+		role.DurationSeconds = defaultAwsCredentialsDurationSeconds
+	}
+	if role.DurationSeconds < minAwsCredentialsDurationSeconds {
+		return fmt.Errorf("Duration for S3 bucket %s must be at least %d seconds", bucket, minAwsCredentialsDurationSeconds)
+	}
+	return nil
+}
+
+// stsEndpoint returns the URL of the STS API for role.
+func (role *awsRole) stsEndpoint() string {
+	if role.StsEndpoint != "" {
+		return role.StsEndpoint
+	}
+	return "https://sts." + role.Region + ".amazonaws.com/"
+}
+
+// S3Mirror specifies the S3 copy of a GCS bucket.
+type S3Mirror struct {
+	// Name of the S3 bucket, whose object names are the same as in the GCS bucket.
+	Bucket string `json:"bucket"`
+
+	// Role with read access to the S3 bucket.
+	awsRole
+}
+
+type awsCredentialsResponse struct {
+	AccessKeyId     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken"`
+
+	// Expiry time of the credentials, in seconds since the epoch.
+	ExpiresAt int64 `json:"expiresAt"`
+
+	// Location of the mirrored data.
+	Bucket string `json:"bucket"`
+	Region string `json:"region"`
+
+	// URL of the S3-compatible object store, or "" for Amazon S3.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Whether objects must be addressed as ENDPOINT/BUCKET/OBJECT rather than BUCKET.ENDPOINT/OBJECT.
+	PathStyle bool `json:"pathStyle,omitempty"`
+
+	// Object prefixes to which the credentials are limited, or empty for the whole bucket.
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// loadS3Mirrors loads the mirrors specified by S3_MIRRORS_PATH, a JSON object mapping GCS bucket
+// names to S3Mirror.
+func loadS3Mirrors() (map[string]*S3Mirror, error) {
+	mirrorsPath, ok := os.LookupEnv("S3_MIRRORS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(mirrorsPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading S3 mirrors from %s: %w", mirrorsPath, err)
+	}
+	var mirrors map[string]*S3Mirror
+	if err := json.Unmarshal(data, &mirrors); err != nil {
+		return nil, fmt.Errorf("Error parsing S3 mirrors from %s: %w", mirrorsPath, err)
+	}
+	for bucket, mirror := range mirrors {
+		if mirror.Bucket == "" {
+			return nil, fmt.Errorf("S3 mirror of %s must specify bucket", bucket)
+		}
+		if err := mirror.validate(mirror.Bucket); err != nil {
+			return nil, err
+		}
+	}
+	return mirrors, nil
+}
+
+// awsRoleSessionName returns a role session name, which appears in CloudTrail logs, for userId.
+func awsRoleSessionName(userId string) string {
+	name := []byte(userId)
+	for i, c := range name {
+		if !(('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("_+=,.@-", c) >= 0) {
+			name[i] = '-'
+		}
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	if len(name) < 2 {
+		return "ngauth"
+	}
+	return string(name)
+}
+
+// awsSessionPolicy returns a session policy that limits the credentials to reading, in list mode
+// listing, and in write mode writing, objects under prefixes.
+func awsSessionPolicy(bucket string, prefixes []string, mode string) string {
+	type statement struct {
+		Effect    string                       `json:"Effect"`
+		Action    string                       `json:"Action"`
+		Resource  []string                     `json:"Resource"`
+		Condition map[string]map[string]string `json:"Condition,omitempty"`
+	}
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	bucketArn := "arn:aws:s3:::" + bucket
+	var statements []statement
+	for _, prefix := range prefixes {
+		statements = append(statements, statement{Effect: "Allow", Action: "s3:GetObject", Resource: []string{bucketArn + "/" + prefix + "*"}})
+		if mode == writeMode {
+			for _, action := range []string{"s3:PutObject", "s3:DeleteObject"} {
+				statements = append(statements, statement{Effect: "Allow", Action: action, Resource: []string{bucketArn + "/" + prefix + "*"}})
+			}
+		}
+		if mode == listMode || mode == writeMode {
+			statements = append(statements, statement{
+				Effect:    "Allow",
+				Action:    "s3:ListBucket",
+				Resource:  []string{bucketArn},
+				Condition: map[string]map[string]string{"StringLike": {"s3:prefix": prefix + "*"}},
+			})
+		}
+	}
+	// Json encoding cannot fail
+	policyJson, _ := json.Marshal(map[string]interface{}{"Version": "2012-10-17", "Statement": statements})
+	return string(policyJson)
+}
+
+// assumeAwsRole exchanges webIdentityToken for temporary credentials for role.
+func assumeAwsRole(ctx context.Context, role *awsRole, webIdentityToken string, sessionName string, policy string) (*awsCredentialsResponse, error) {
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {webIdentityToken},
+		"DurationSeconds":  {strconv.FormatInt(role.DurationSeconds, 10)},
+		"Policy":           {policy},
+	}
+	if role.RoleArn != "" {
+		form.Set("RoleArn", role.RoleArn)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", role.stsEndpoint(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	resp, err := stsHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &TokenExchangeError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	var response struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	if response.Credentials.AccessKeyId == "" {
+		return nil, fmt.Errorf("No credentials in AssumeRoleWithWebIdentity response")
+	}
+	return &awsCredentialsResponse{
+		AccessKeyId:     response.Credentials.AccessKeyId,
+		SecretAccessKey: response.Credentials.SecretAccessKey,
+		SessionToken:    response.Credentials.SessionToken,
+		ExpiresAt:       response.Credentials.Expiration.Unix(),
+		Region:          role.Region,
+	}, nil
+}
+
+// makeCredentialsError returns the error response for a failure to obtain credentials.
+func makeCredentialsError(bucket string, err error) *credentialError {
+	log.Printf("Error obtaining AWS credentials, bucket=%s, err=%+v", bucket, err)
+	if isTemporaryExchangeError(err) {
+		return &credentialError{status: http.StatusServiceUnavailable, message: "Token service temporarily unavailable", retryAfter: 1}
+	}
+	return &credentialError{status: http.StatusInternalServerError, message: "Failed to obtain AWS credentials"}
+}
+
+// issueAwsCredentials obtains credentials for role, limited to prefixes of the S3 bucket in the
+// mode of tokenRequest, on behalf of the user.  The user's quota is consumed for the bucket of
+// tokenRequest.
+func (auth *Authenticator) issueAwsCredentials(r *http.Request, userToken *UserToken, tokenRequest *GcsTokenRequest, role *awsRole, bucket string, prefixes []string) (*awsCredentialsResponse, *credentialError) {
+	if tokenErr := auth.consumeCredentialsQuota(r, userToken, tokenRequest); tokenErr != nil {
+		return nil, tokenErr
+	}
+	webIdentityToken := UserToken{
+		UserId:    userToken.UserId,
+		Expires:   time.Now().Unix() + awsWebIdentityTokenLifetimeSeconds,
+		SessionId: userToken.SessionId,
+		IssuedAt:  userToken.IssuedAt,
+		Audience:  awsStsAudience,
+	}
+	credentials, err := assumeAwsRole(r.Context(), role, auth.UserTokenSigner.Encode(webIdentityToken), awsRoleSessionName(userToken.UserId), awsSessionPolicy(bucket, prefixes, tokenRequest.Mode))
+	if err != nil {
+		return nil, makeCredentialsError(bucket, err)
+	}
+	credentials.Bucket = bucket
+	credentials.Prefixes = prefixes
+	return credentials, nil
+}
+
+func (auth *Authenticator) addS3MirrorRoutes(mux *gorilla_mux.Router) {
+	// Returns temporary AWS credentials for reading the S3 mirror of a bucket, checking access as
+	// for a /gcs_token request for the GCS bucket.
+	mux.Methods("POST").Path("/aws_credentials").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin != "" {
+			w.Header().Set("access-control-allow-origin", origin)
+			w.Header().Set("vary", "origin")
+		}
+		var tokenRequest GcsTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&tokenRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tokenRequest.Dataset != "" {
+			if tokenRequest.Bucket != "" || tokenRequest.Prefix != "" {
+				http.Error(w, "Specify either dataset or bucket", http.StatusBadRequest)
+				return
+			}
+			dataset := auth.Datasets.Get(tokenRequest.Dataset)
+			if dataset == nil {
+				http.Error(w, "Unknown dataset", http.StatusNotFound)
+				return
+			}
+			tokenRequest.Bucket = dataset.Bucket
+			tokenRequest.Prefix = dataset.Prefix
+		}
+		mirror := auth.S3Mirrors[tokenRequest.Bucket]
+		if mirror == nil || !auth.BucketFilter.IsBrokered(tokenRequest.Bucket) {
+			http.Error(w, "No S3 mirror for bucket", http.StatusNotFound)
+			return
+		}
+		if tokenRequest.Mode == writeMode {
+			http.Error(w, "S3 mirrors are read-only", http.StatusBadRequest)
+			return
+		}
+		if !isValidMode(tokenRequest.Mode) {
+			http.Error(w, "Invalid mode", http.StatusBadRequest)
+			return
+		}
+		if !isValidObjectPrefix(tokenRequest.Prefix) {
+			http.Error(w, "Invalid prefix", http.StatusBadRequest)
+			return
+		}
+		userToken, err := auth.resolveRequestUserToken(r, tokenRequest.Token)
+		if err != nil {
+			log.Printf("Invalid authentication token: %+v", err)
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		if denial, _ := auth.checkTokenPolicies(r, origin, &userToken, &tokenRequest); denial != nil {
+			if denial.challenge != "" {
+				w.Header().Set("www-authenticate", denial.challenge)
+				w.Header().Set("access-control-expose-headers", "www-authenticate")
+			}
+			http.Error(w, denial.message, denial.status)
+			return
+		}
+		prefixes, _, tokenErr := auth.authorizeGcsToken(r, &userToken, &tokenRequest)
+		if tokenErr != nil {
+			http.Error(w, tokenErr.message, tokenErr.status)
+			return
+		}
+		if tokenRequest.Prefix != "" && len(prefixes) == 0 {
+			prefixes = []string{tokenRequest.Prefix}
+		}
+		credentials, tokenErr := auth.issueAwsCredentials(r, &userToken, &tokenRequest, &mirror.awsRole, mirror.Bucket, prefixes)
+		if tokenErr != nil {
+			tokenErr.write(w)
+			return
+		}
+		log.Printf("AUDIT: %s obtained AWS credentials for S3 mirror %s of bucket %s prefix %q", userToken.UserId, mirror.Bucket, tokenRequest.Bucket, tokenRequest.Prefix)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(credentials)
+	})
+}
@@ -0,0 +1,411 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	gorilla_mux "github.com/gorilla/mux"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// SAML 2.0 service provider, for institutions whose identity provider (e.g. Shibboleth or ADFS)
+// only supports SAML.
+//
+// Only the HTTP-Redirect binding for authentication requests and the HTTP-POST binding for
+// responses are supported.  Encrypted assertions are not supported.
+
+const (
+	samlProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlRedirectBinding    = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlPostBinding        = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearerMethod       = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// Cookie that binds a SAML response to the browser that sent the authentication request.
+const samlRequestCookieName = "ngauth_saml_request"
+
+// Maximum time between the authentication request and the response.
+const samlRequestLifetime = 10 * time.Minute
+
+// Allowed clock skew when checking assertion validity intervals.
+const samlClockSkew = 2 * time.Minute
+
+type samlEntityDescriptor struct {
+	EntityID         string `xml:"entityID,attr"`
+	IDPSSODescriptor struct {
+		KeyDescriptors []struct {
+			Use         string `xml:"use,attr"`
+			Certificate string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SingleSignOnServices []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"SingleSignOnService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+type samlAssertion struct {
+	ID      string `xml:"ID,attr"`
+	Issuer  string `xml:"Issuer"`
+	Subject struct {
+		NameID struct {
+			Format string `xml:"Format,attr"`
+			Value  string `xml:",chardata"`
+		} `xml:"NameID"`
+		SubjectConfirmations []struct {
+			Method string `xml:"Method,attr"`
+			Data   struct {
+				InResponseTo string    `xml:"InResponseTo,attr"`
+				Recipient    string    `xml:"Recipient,attr"`
+				NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+			} `xml:"SubjectConfirmationData"`
+		} `xml:"SubjectConfirmation"`
+	} `xml:"Subject"`
+	Conditions struct {
+		NotBefore            time.Time `xml:"NotBefore,attr"`
+		NotOnOrAfter         time.Time `xml:"NotOnOrAfter,attr"`
+		AudienceRestrictions []struct {
+			Audiences []string `xml:"Audience"`
+		} `xml:"AudienceRestriction"`
+	} `xml:"Conditions"`
+	AttributeStatements []struct {
+		Attributes []struct {
+			Name         string   `xml:"Name,attr"`
+			FriendlyName string   `xml:"FriendlyName,attr"`
+			Values       []string `xml:"AttributeValue"`
+		} `xml:"Attribute"`
+	} `xml:"AttributeStatement"`
+}
+
+// attribute returns the values of the attribute with the specified name or friendly name.
+func (assertion *samlAssertion) attribute(name string) (values []string) {
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name == name || attribute.FriendlyName == name {
+				values = append(values, attribute.Values...)
+			}
+		}
+	}
+	return
+}
+
+type samlProvider struct {
+	idpEntityID  string
+	ssoURL       string
+	certificates []*x509.Certificate
+
+	// SP entity id, or empty to use the metadata URL.
+	entityID string
+
+	// Attribute holding the user id, or empty to use the NameID.
+	userIdAttribute string
+
+	// Attribute holding the user's groups, or empty if groups are not used.
+	groupsAttribute string
+}
+
+func (p *samlProvider) Name() string {
+	return "saml"
+}
+
+func getSamlURL(r *http.Request, path string) string {
+	u := url.URL{Scheme: r.URL.Scheme, Host: r.Host, Path: path}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	return u.String()
+}
+
+func (p *samlProvider) getEntityID(r *http.Request) string {
+	if p.entityID != "" {
+		return p.entityID
+	}
+	return getSamlURL(r, "/saml/metadata")
+}
+
+func makeSamlRequestID() string {
+	var b [20]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return "id-" + hex.EncodeToString(b[:])
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func (p *samlProvider) StartLogin(auth *Authenticator, w http.ResponseWriter, r *http.Request, state loginState) {
+	requestID := makeSamlRequestID()
+	request := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s"><saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`,
+		samlProtocolNamespace, samlAssertionNamespace, requestID,
+		time.Now().UTC().Format(time.RFC3339), xmlEscape(p.ssoURL),
+		xmlEscape(getSamlURL(r, "/saml/acs")), samlPostBinding, xmlEscape(p.getEntityID(r)))
+	var compressed bytes.Buffer
+	writer, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	writer.Write([]byte(request))
+	writer.Close()
+	query := url.Values{}
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(compressed.Bytes()))
+	query.Set("RelayState", state.Encode())
+	redirectURL := p.ssoURL
+	if strings.Contains(redirectURL, "?") {
+		redirectURL += "&"
+	} else {
+		redirectURL += "?"
+	}
+	cookie := &http.Cookie{
+		Name:     samlRequestCookieName,
+		Value:    requestID,
+		Path:     "/saml/acs",
+		MaxAge:   int(samlRequestLifetime.Seconds()),
+		HttpOnly: true,
+	}
+	if r.URL.Scheme == "https" {
+		// The response is POSTed by the identity provider's origin.
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, redirectURL+query.Encode(), http.StatusFound)
+}
+
+func findChildElement(el *etree.Element, space string, tag string) *etree.Element {
+	for _, child := range el.ChildElements() {
+		if child.Tag == tag && child.NamespaceURI() == space {
+			return child
+		}
+	}
+	return nil
+}
+
+// validateResponse checks the signature and conditions of a SAML response and returns the
+// authenticated assertion.
+func (p *samlProvider) validateResponse(r *http.Request, encodedResponse string, requestID string) (assertion *samlAssertion, err error) {
+	responseXml, err := base64.StdEncoding.DecodeString(encodedResponse)
+	if err != nil {
+		return
+	}
+	doc := etree.NewDocument()
+	if err = doc.ReadFromBytes(responseXml); err != nil {
+		return
+	}
+	response := doc.Root()
+	if response == nil || response.Tag != "Response" || response.NamespaceURI() != samlProtocolNamespace {
+		err = fmt.Errorf("Expected Response element")
+		return
+	}
+	acsURL := getSamlURL(r, "/saml/acs")
+	if destination := response.SelectAttrValue("Destination", ""); destination != "" && destination != acsURL {
+		err = fmt.Errorf("Unexpected destination: %q", destination)
+		return
+	}
+	if inResponseTo := response.SelectAttrValue("InResponseTo", ""); inResponseTo != requestID {
+		err = fmt.Errorf("Response is not for the pending request")
+		return
+	}
+	status := response.FindElement("./Status/StatusCode")
+	if status == nil || status.SelectAttrValue("Value", "") != samlStatusSuccess {
+		err = fmt.Errorf("Authentication failed")
+		return
+	}
+
+	// Only the content of a signed element is trusted.  Either the Response or the Assertion
+	// may be signed.
+	validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: p.certificates})
+	var assertionEl *etree.Element
+	if findChildElement(response, dsig.Namespace, dsig.SignatureTag) != nil {
+		var validatedResponse *etree.Element
+		validatedResponse, err = validationContext.Validate(response)
+		if err != nil {
+			return
+		}
+		assertionEl = findChildElement(validatedResponse, samlAssertionNamespace, "Assertion")
+	} else if el := findChildElement(response, samlAssertionNamespace, "Assertion"); el != nil {
+		assertionEl, err = validationContext.Validate(el)
+		if err != nil {
+			return
+		}
+	}
+	if assertionEl == nil {
+		err = fmt.Errorf("Missing assertion")
+		return
+	}
+	assertionDoc := etree.NewDocument()
+	assertionDoc.SetRoot(assertionEl)
+	assertionXml, err := assertionDoc.WriteToBytes()
+	if err != nil {
+		return
+	}
+	assertion = &samlAssertion{}
+	if err = xml.Unmarshal(assertionXml, assertion); err != nil {
+		return
+	}
+
+	if assertion.Issuer != p.idpEntityID {
+		err = fmt.Errorf("Unexpected issuer: %q", assertion.Issuer)
+		return
+	}
+	now := time.Now()
+	conditions := &assertion.Conditions
+	if !conditions.NotBefore.IsZero() && now.Add(samlClockSkew).Before(conditions.NotBefore) {
+		err = fmt.Errorf("Assertion not yet valid")
+		return
+	}
+	if !conditions.NotOnOrAfter.IsZero() && !now.Add(-samlClockSkew).Before(conditions.NotOnOrAfter) {
+		err = fmt.Errorf("Assertion expired")
+		return
+	}
+	entityID := p.getEntityID(r)
+	for _, restriction := range conditions.AudienceRestrictions {
+		found := false
+		for _, audience := range restriction.Audiences {
+			if audience == entityID {
+				found = true
+			}
+		}
+		if !found {
+			err = fmt.Errorf("Assertion is not intended for this service provider")
+			return
+		}
+	}
+	confirmed := false
+	for _, confirmation := range assertion.Subject.SubjectConfirmations {
+		data := &confirmation.Data
+		if confirmation.Method != samlBearerMethod || data.Recipient != acsURL || data.InResponseTo != requestID {
+			continue
+		}
+		if data.NotOnOrAfter.IsZero() || !now.Add(-samlClockSkew).Before(data.NotOnOrAfter) {
+			continue
+		}
+		confirmed = true
+	}
+	if !confirmed {
+		err = fmt.Errorf("Missing valid bearer subject confirmation")
+		return
+	}
+	return
+}
+
+func (p *samlProvider) AddRoutes(auth *Authenticator, mux *gorilla_mux.Router) {
+	mux.Methods("GET").Path("/saml/metadata").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("content-type", "application/samlmetadata+xml")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="%s">
+  <md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">
+    <md:AssertionConsumerService Binding="%s" Location="%s" index="0"/>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>
+`, xmlEscape(p.getEntityID(r)), samlProtocolNamespace, samlPostBinding, xmlEscape(getSamlURL(r, "/saml/acs")))
+	})
+
+	mux.Methods("POST").Path("/saml/acs").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid SAML response", http.StatusBadRequest)
+			return
+		}
+		cookie, _ := r.Cookie(samlRequestCookieName)
+		if cookie == nil {
+			http.Error(w, "No pending SAML request", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: samlRequestCookieName, Path: "/saml/acs", MaxAge: -1})
+		assertion, err := p.validateResponse(r, r.PostForm.Get("SAMLResponse"), cookie.Value)
+		if err != nil {
+			log.Printf("Invalid SAML response: %v", err)
+			http.Error(w, "Invalid SAML response", http.StatusBadRequest)
+			return
+		}
+		identity := &Identity{UserId: assertion.Subject.NameID.Value}
+		if p.userIdAttribute != "" {
+			identity.UserId = ""
+			if values := assertion.attribute(p.userIdAttribute); len(values) > 0 {
+				identity.UserId = strings.TrimSpace(values[0])
+			}
+		}
+		if identity.UserId == "" {
+			http.Error(w, "SAML assertion does not identify the user", http.StatusBadRequest)
+			return
+		}
+		if p.groupsAttribute != "" {
+			identity.Groups = assertion.attribute(p.groupsAttribute)
+		}
+		auth.completeLogin(w, r, p, identity, decodeLoginState(r.PostForm.Get("RelayState")))
+	})
+}
+
+func makeSamlProvider(ctx context.Context) (IdentityProvider, error) {
+	metadataPath := getEnvOr("SAML_IDP_METADATA_PATH", "secrets/saml_idp_metadata.xml")
+	metadataXml, err := ioutil.ReadFile(metadataPath)
+	var metadata samlEntityDescriptor
+	if err == nil {
+		err = xml.Unmarshal(metadataXml, &metadata)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading SAML identity provider metadata from %s: %w", metadataPath, err)
+	}
+	p := &samlProvider{
+		idpEntityID:     metadata.EntityID,
+		entityID:        os.Getenv("SAML_SP_ENTITY_ID"),
+		userIdAttribute: os.Getenv("SAML_USER_ID_ATTRIBUTE"),
+		groupsAttribute: os.Getenv("SAML_GROUPS_ATTRIBUTE"),
+	}
+	for _, service := range metadata.IDPSSODescriptor.SingleSignOnServices {
+		if service.Binding == samlRedirectBinding {
+			p.ssoURL = service.Location
+		}
+	}
+	if p.ssoURL == "" {
+		return nil, fmt.Errorf("SAML identity provider does not support the HTTP-Redirect binding")
+	}
+	for _, key := range metadata.IDPSSODescriptor.KeyDescriptors {
+		if key.Use != "" && key.Use != "signing" {
+			continue
+		}
+		certData, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(key.Certificate), ""))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SAML identity provider certificate: %w", err)
+		}
+		cert, err := x509.ParseCertificate(certData)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SAML identity provider certificate: %w", err)
+		}
+		p.certificates = append(p.certificates, cert)
+	}
+	if len(p.certificates) == 0 {
+		return nil, fmt.Errorf("SAML identity provider metadata does not specify a signing certificate")
+	}
+	return p, nil
+}
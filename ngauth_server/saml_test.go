@@ -0,0 +1,263 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	testSamlIdpEntityID = "https://idp.example.org/metadata"
+	testSamlAcsURL      = "https://sp.example.org/saml/acs"
+	testSamlSpEntityID  = "https://sp.example.org/saml/metadata"
+	testSamlRequestID   = "id-request"
+)
+
+// testSamlAssertion holds the fields of an assertion that the tests vary.
+type testSamlAssertion struct {
+	id           string
+	issuer       string
+	nameID       string
+	audience     string
+	recipient    string
+	inResponseTo string
+	notOnOrAfter time.Time
+}
+
+func makeTestSamlAssertion() testSamlAssertion {
+	return testSamlAssertion{
+		id:           "id-assertion",
+		issuer:       testSamlIdpEntityID,
+		nameID:       "alice",
+		audience:     testSamlSpEntityID,
+		recipient:    testSamlAcsURL,
+		inResponseTo: testSamlRequestID,
+		notOnOrAfter: time.Now().Add(5 * time.Minute),
+	}
+}
+
+func parseTestXml(t *testing.T, s string) *etree.Element {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(s); err != nil {
+		t.Fatal(err)
+	}
+	return doc.Root()
+}
+
+func (a testSamlAssertion) element(t *testing.T) *etree.Element {
+	notOnOrAfter := a.notOnOrAfter.UTC().Format(time.RFC3339)
+	return parseTestXml(t, fmt.Sprintf(`<saml:Assertion xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s">`+
+		`<saml:Issuer>%s</saml:Issuer>`+
+		`<saml:Subject><saml:NameID>%s</saml:NameID>`+
+		`<saml:SubjectConfirmation Method="%s"><saml:SubjectConfirmationData InResponseTo="%s" Recipient="%s" NotOnOrAfter="%s"/></saml:SubjectConfirmation>`+
+		`</saml:Subject>`+
+		`<saml:Conditions NotOnOrAfter="%s"><saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`+
+		`</saml:Assertion>`,
+		samlAssertionNamespace, a.id, time.Now().UTC().Format(time.RFC3339), a.issuer, a.nameID, samlBearerMethod,
+		a.inResponseTo, a.recipient, notOnOrAfter, notOnOrAfter, a.audience))
+}
+
+// makeTestSamlResponse returns a successful response to the test request containing assertions.
+func makeTestSamlResponse(t *testing.T, assertions ...*etree.Element) *etree.Element {
+	response := parseTestXml(t, fmt.Sprintf(`<samlp:Response xmlns:samlp="%s" ID="id-response" Version="2.0" Destination="%s" InResponseTo="%s">`+
+		`<samlp:Status><samlp:StatusCode Value="%s"/></samlp:Status></samlp:Response>`,
+		samlProtocolNamespace, testSamlAcsURL, testSamlRequestID, samlStatusSuccess))
+	for _, assertion := range assertions {
+		response.AddChild(assertion)
+	}
+	return response
+}
+
+func signTestSamlElement(t *testing.T, keyStore dsig.X509KeyStore, el *etree.Element) *etree.Element {
+	signed, err := dsig.NewDefaultSigningContext(keyStore).SignEnveloped(el)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func getTestCertificate(t *testing.T, keyStore dsig.X509KeyStore) *x509.Certificate {
+	_, certData, err := keyStore.GetKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestSamlValidateResponse(t *testing.T) {
+	idpKeys := dsig.RandomKeyStoreForTest()
+	otherKeys := dsig.RandomKeyStoreForTest()
+	p := &samlProvider{
+		idpEntityID:  testSamlIdpEntityID,
+		certificates: []*x509.Certificate{getTestCertificate(t, idpKeys)},
+	}
+	signedAssertion := func(modify func(*testSamlAssertion)) *etree.Element {
+		a := makeTestSamlAssertion()
+		if modify != nil {
+			modify(&a)
+		}
+		return signTestSamlElement(t, idpKeys, a.element(t))
+	}
+
+	tests := []struct {
+		name     string
+		response func() *etree.Element
+
+		// Expected error, or "" if the response is valid.
+		err string
+	}{
+		{
+			name: "signed assertion",
+			response: func() *etree.Element {
+				return makeTestSamlResponse(t, signedAssertion(nil))
+			},
+		},
+		{
+			name: "signed response",
+			response: func() *etree.Element {
+				return signTestSamlElement(t, idpKeys, makeTestSamlResponse(t, makeTestSamlAssertion().element(t)))
+			},
+		},
+		{
+			name: "unsigned assertion",
+			response: func() *etree.Element {
+				return makeTestSamlResponse(t, makeTestSamlAssertion().element(t))
+			},
+			err: "Missing signature",
+		},
+		{
+			name: "signed by another key",
+			response: func() *etree.Element {
+				return makeTestSamlResponse(t, signTestSamlElement(t, otherKeys, makeTestSamlAssertion().element(t)))
+			},
+			err: "Could not verify certificate",
+		},
+		{
+			name: "name id modified after signing",
+			response: func() *etree.Element {
+				assertion := signedAssertion(nil)
+				assertion.FindElement("./Subject/NameID").SetText("mallory")
+				return makeTestSamlResponse(t, assertion)
+			},
+			err: "Signature could not be verified",
+		},
+		{
+			name: "unsigned assertion wrapped before signed assertion",
+			response: func() *etree.Element {
+				evil := makeTestSamlAssertion()
+				evil.id = "id-evil"
+				evil.nameID = "mallory"
+				return makeTestSamlResponse(t, evil.element(t), signedAssertion(nil))
+			},
+			err: "Missing signature",
+		},
+		{
+			name: "signed assertion copied into unsigned assertion",
+			response: func() *etree.Element {
+				evil := makeTestSamlAssertion()
+				evil.nameID = "mallory"
+				evilEl := evil.element(t)
+				evilEl.AddChild(signedAssertion(nil))
+				return makeTestSamlResponse(t, evilEl)
+			},
+			err: "Signature could not be verified",
+		},
+		{
+			name: "assertion added to signed response",
+			response: func() *etree.Element {
+				response := signTestSamlElement(t, idpKeys, makeTestSamlResponse(t))
+				evil := makeTestSamlAssertion()
+				evil.nameID = "mallory"
+				response.AddChild(evil.element(t))
+				return response
+			},
+			err: "Signature could not be verified",
+		},
+		{
+			name: "wrong audience",
+			response: func() *etree.Element {
+				return makeTestSamlResponse(t, signedAssertion(func(a *testSamlAssertion) { a.audience = "https://other.example.org/saml/metadata" }))
+			},
+			err: "not intended for this service provider",
+		},
+		{
+			name: "wrong issuer",
+			response: func() *etree.Element {
+				return makeTestSamlResponse(t, signedAssertion(func(a *testSamlAssertion) { a.issuer = "https://other-idp.example.org/metadata" }))
+			},
+			err: "Unexpected issuer",
+		},
+		{
+			name: "wrong recipient",
+			response: func() *etree.Element {
+				return makeTestSamlResponse(t, signedAssertion(func(a *testSamlAssertion) { a.recipient = "https://other.example.org/saml/acs" }))
+			},
+			err: "Missing valid bearer subject confirmation",
+		},
+		{
+			name: "confirmation of another request",
+			response: func() *etree.Element {
+				return makeTestSamlResponse(t, signedAssertion(func(a *testSamlAssertion) { a.inResponseTo = "id-other-request" }))
+			},
+			err: "Missing valid bearer subject confirmation",
+		},
+		{
+			name: "expired",
+			response: func() *etree.Element {
+				return makeTestSamlResponse(t, signedAssertion(func(a *testSamlAssertion) { a.notOnOrAfter = time.Now().Add(-10 * time.Minute) }))
+			},
+			err: "Assertion expired",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc := etree.NewDocument()
+			doc.SetRoot(test.response())
+			responseXml, err := doc.WriteToBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", testSamlAcsURL, nil)
+			assertion, err := p.validateResponse(r, base64.StdEncoding.EncodeToString(responseXml), testSamlRequestID)
+			if test.err != "" {
+				if err == nil {
+					t.Fatalf("Expected error %q, got assertion for %q", test.err, assertion.Subject.NameID.Value)
+				}
+				if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error %q, got %q", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if nameID := assertion.Subject.NameID.Value; nameID != "alice" {
+				t.Errorf("Got NameID %q, expected %q", nameID, "alice")
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// OAuth 2.0 client credentials grant, for automated pipelines and other service clients.
+
+const jwtBearerClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// Maximum lifetime of a signed JWT client assertion.  Assertion ids are also recorded in the store
+// to prevent replay.
+const maxClientAssertionLifetime = 5 * time.Minute
+
+// ServiceClient is a client registered for the client credentials grant.  A client authenticates
+// either with a secret or with a JWT signed by its private key.
+type ServiceClient struct {
+	// Hex-encoded SHA-256 hash of the client secret.
+	SecretSha256 string `json:"secretSha256,omitempty"`
+
+	// PEM-encoded public key, for verifying JWT client assertions.
+	PublicKey string `json:"publicKey,omitempty"`
+
+	// Optional Google service account email address whose GCS IAM permissions apply to the client.
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+
+	// Groups of which the client is considered a member, for GROUP_BUCKETS_PATH.
+	Groups []string `json:"groups,omitempty"`
+
+	// Whether the client may introspect user tokens.
+	Introspect bool `json:"introspect,omitempty"`
+
+	// Redirect URIs to which users may be sent with an authorization code, if the client is an
+	// OpenID Connect relying party.
+	RedirectUris []string `json:"redirectUris,omitempty"`
+
+	publicKey crypto.PublicKey
+}
+
+// ServiceClients maps client ids to registered clients.
+type ServiceClients map[string]*ServiceClient
+
+func loadServiceClients() (ServiceClients, error) {
+	path, ok := os.LookupEnv("SERVICE_CLIENTS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading service clients from %s: %w", path, err)
+	}
+	var clients ServiceClients
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return nil, fmt.Errorf("Error parsing service clients from %s: %w", path, err)
+	}
+	for id, client := range clients {
+		if client.SecretSha256 == "" && client.PublicKey == "" {
+			return nil, fmt.Errorf("Service client %q must specify secretSha256 or publicKey", id)
+		}
+		if client.PublicKey != "" {
+			block, _ := pem.Decode([]byte(client.PublicKey))
+			if block == nil {
+				return nil, fmt.Errorf("Invalid public key for service client %q", id)
+			}
+			client.publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid public key for service client %q: %w", id, err)
+			}
+		}
+	}
+	return clients, nil
+}
+
+func (client *ServiceClient) checkSecret(secret string) bool {
+	if client.SecretSha256 == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(client.SecretSha256)) == 1
+}
+
+// checkClientAssertion validates a signed JWT client assertion (RFC 7523).
+func (auth *Authenticator) checkClientAssertion(r *http.Request, clientId string, client *ServiceClient, assertion string) error {
+	if client.publicKey == nil {
+		return fmt.Errorf("Client has no public key")
+	}
+	claims, err := parseAndVerifyJwtWithKey(assertion, func(kid string) (crypto.PublicKey, error) {
+		return client.publicKey, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := validateJwtClaims(claims, clientId, getBaseURL(r)+"/token"); err != nil {
+		return err
+	}
+	if sub, _ := claims["sub"].(string); sub != clientId {
+		return fmt.Errorf("Unexpected subject: %q", sub)
+	}
+	exp, _ := getNumericClaim(claims, "exp")
+	if exp > time.Now().Add(maxClientAssertionLifetime).Unix() {
+		return fmt.Errorf("Assertion lifetime exceeds %v", maxClientAssertionLifetime)
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return fmt.Errorf("Missing jti claim")
+	}
+	hash := sha256.Sum256([]byte(clientId + "\x00" + jti))
+	key := "client_assertions/" + base64url.EncodeToString(hash[:])
+	// Created atomically, so that concurrent requests cannot both use the assertion.
+	err = auth.Store.Create(r.Context(), key, exp)
+	if err == errStoreExists {
+		return fmt.Errorf("Assertion already used")
+	}
+	return err
+}
+
+// authenticateServiceClient returns the client id of the client authenticated by the request, or
+// "" if authentication failed.  The client may authenticate using HTTP Basic authentication,
+// client_id and client_secret form parameters, or client_id along with a signed JWT client
+// assertion.
+func (auth *Authenticator) authenticateServiceClient(r *http.Request) string {
+	clientId, secret, basic := r.BasicAuth()
+	if !basic {
+		clientId = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	assertion := r.PostForm.Get("client_assertion")
+	if assertion != "" {
+		if r.PostForm.Get("client_assertion_type") != jwtBearerClientAssertionType {
+			return ""
+		}
+	}
+	client := auth.ServiceClients[clientId]
+	if client == nil {
+		return ""
+	}
+	if assertion != "" {
+		if err := auth.checkClientAssertion(r, clientId, client, assertion); err != nil {
+			log.Printf("Invalid client assertion for %s: %v", clientId, err)
+			return ""
+		}
+		return clientId
+	}
+	if !client.checkSecret(secret) {
+		log.Printf("Invalid client secret for %s", clientId)
+		return ""
+	}
+	return clientId
+}
+
+// handleClientCredentialsGrant issues a user token for a service client.
+func (auth *Authenticator) handleClientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	clientId := auth.authenticateServiceClient(r)
+	if clientId == "" {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	client := auth.ServiceClients[clientId]
+	userToken := UserToken{
+		UserId:  QualifyUserId("client", clientId),
+		Expires: time.Now().Unix() + auth.TokenLifetimes.CrossOriginLifetimeSeconds(""),
+		Groups:  qualifyAll("client", client.Groups),
+	}
+	if client.ServiceAccount != "" {
+		userToken.LinkedUserIds = []string{QualifyUserId("google", client.ServiceAccount)}
+	}
+	log.Printf("Issued token to service client %s", clientId)
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": auth.EncodeClientToken(userToken),
+		"token_type":   "Bearer",
+		"expires_in":   auth.TokenLifetimes.CrossOriginLifetimeSeconds(""),
+	})
+}
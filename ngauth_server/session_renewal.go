@@ -0,0 +1,203 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Session renewal: the refresh token returned by the identity provider at login is stored,
+// encrypted, so that the login session can be renewed without the login popup when it expires or
+// is near expiry.  The browser holds a separate long-lived cookie identifying the stored refresh
+// token.
+
+const renewalCookieName = "ngauth_renew"
+
+// 2 years, so that the renewal cookie outlives the login session cookie.
+const renewalCookieLifetimeSeconds = 2 * MaxUserTokenCookieLifetimeSeconds
+
+// Login sessions expiring within this period, or within a quarter of the login session lifetime if
+// shorter, are renewed.
+const maxSessionRenewalWindowSeconds = 30 * 24 * 60 * 60
+
+func (auth *Authenticator) sessionRenewalWindowSeconds() int64 {
+	window := auth.TokenLifetimes.CookieLifetimeSeconds("") / 4
+	if window > maxSessionRenewalWindowSeconds {
+		window = maxSessionRenewalWindowSeconds
+	}
+	return window
+}
+
+type storedRefreshToken struct {
+	Provider string `json:"provider"`
+
+	// Refresh token encrypted with the refresh token encryption key.
+	EncryptedRefreshToken []byte `json:"encryptedRefreshToken"`
+
+	// Time, in seconds since the epoch, of the login that returned the refresh token.
+	Created int64 `json:"created,omitempty"`
+}
+
+func refreshTokenKey(handle string) string {
+	hash := sha256.Sum256([]byte(handle))
+	return "refresh_tokens/" + base64url.EncodeToString(hash[:])
+}
+
+// refreshTokenCipher returns an AES-GCM cipher with a key derived from the login session key.
+func (auth *Authenticator) refreshTokenCipher() cipher.AEAD {
+	hasher := hmac.New(sha256.New, auth.UserTokenKey)
+	hasher.Write([]byte("ngauth refresh token encryption"))
+	block, err := aes.NewCipher(hasher.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func (auth *Authenticator) encryptRefreshToken(refreshToken string) []byte {
+	aead := auth.refreshTokenCipher()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, []byte(refreshToken), nil)
+}
+
+func (auth *Authenticator) decryptRefreshToken(encrypted []byte) (string, error) {
+	aead := auth.refreshTokenCipher()
+	if len(encrypted) < aead.NonceSize() {
+		return "", fmt.Errorf("Encrypted refresh token too short")
+	}
+	plaintext, err := aead.Open(nil, encrypted[:aead.NonceSize()], encrypted[aead.NonceSize():], nil)
+	return string(plaintext), err
+}
+
+// saveRefreshToken stores the refresh token returned at login and sets the renewal cookie.
+func (auth *Authenticator) saveRefreshToken(w http.ResponseWriter, r *http.Request, provider IdentityProvider, refreshToken string) {
+	handleBytes := make([]byte, 32)
+	if _, err := rand.Read(handleBytes); err != nil {
+		panic(err)
+	}
+	handle := base64url.EncodeToString(handleBytes)
+	stored := storedRefreshToken{
+		Provider:              provider.Name(),
+		EncryptedRefreshToken: auth.encryptRefreshToken(refreshToken),
+		Created:               time.Now().Unix(),
+	}
+	if err := auth.Store.Put(r.Context(), refreshTokenKey(handle), stored); err != nil {
+		log.Printf("Error storing refresh token: %v", err)
+		return
+	}
+	// Replace any previous refresh token.
+	auth.deleteRefreshToken(w, r)
+	http.SetCookie(w, newCookie(r, renewalCookieName, handle, time.Now().Unix()+renewalCookieLifetimeSeconds))
+}
+
+// deleteRefreshToken removes the stored refresh token, if any, and clears the renewal cookie.
+func (auth *Authenticator) deleteRefreshToken(w http.ResponseWriter, r *http.Request) {
+	cookie, _ := r.Cookie(renewalCookieName)
+	if cookie == nil {
+		return
+	}
+	if err := auth.Store.Delete(r.Context(), refreshTokenKey(cookie.Value)); err != nil {
+		log.Printf("Error deleting refresh token: %v", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   renewalCookieName,
+		MaxAge: -1,
+	})
+}
+
+// renewSession obtains a new id_token using the stored refresh token and, if the user may still
+// log in, sets a new login session cookie.  Returns nil if the session cannot be renewed.
+func (auth *Authenticator) renewSession(w http.ResponseWriter, r *http.Request) *UserToken {
+	cookie, _ := r.Cookie(renewalCookieName)
+	if cookie == nil {
+		return nil
+	}
+	ctx := r.Context()
+	var stored storedRefreshToken
+	if err := auth.Store.Get(ctx, refreshTokenKey(cookie.Value), &stored); err != nil {
+		if err != errStoreNotFound {
+			log.Printf("Error reading refresh token: %v", err)
+		}
+		return nil
+	}
+	provider, ok := auth.GetIdentityProvider(stored.Provider).(OAuth2IdentityProvider)
+	if !ok {
+		return nil
+	}
+	refreshToken, err := auth.decryptRefreshToken(stored.EncryptedRefreshToken)
+	if err != nil {
+		log.Printf("Error decrypting refresh token: %v", err)
+		return nil
+	}
+	token, err := auth.GetOAuth2Config(r, provider).TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		// The refresh token has likely been revoked or has expired.
+		log.Printf("Error refreshing login session: %v", err)
+		auth.deleteRefreshToken(w, r)
+		return nil
+	}
+	_, identity, err := extractAndValidateIdToken(ctx, provider, token)
+	if err != nil {
+		log.Printf("Invalid id token on refresh: %v", err)
+		return nil
+	}
+	if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+		// The provider rotates refresh tokens.
+		stored.EncryptedRefreshToken = auth.encryptRefreshToken(token.RefreshToken)
+		if err := auth.Store.Put(ctx, refreshTokenKey(cookie.Value), stored); err != nil {
+			log.Printf("Error storing refresh token: %v", err)
+		}
+	}
+	if allowed, err := auth.isLoginAllowed(ctx, provider, identity); err != nil || !allowed {
+		return nil
+	}
+	identity.qualify(provider.Name())
+	if err := auth.resolveAccountLinks(ctx, identity); err != nil {
+		log.Printf("Error resolving linked accounts for %s: %v", identity.UserId, err)
+		return nil
+	}
+	// A second factor cannot be verified without user interaction.
+	if mfaRequired, err := auth.requiresMFA(ctx, identity.UserId); err != nil || mfaRequired {
+		return nil
+	}
+	userToken := auth.makeUserToken(identity, auth.TokenLifetimes.UserCookieLifetimeSeconds("", identity.UserId))
+	// Revoking all sessions of the user also revokes the refresh tokens of earlier logins.
+	if auth.Revocations.IsRevoked(ctx, &UserToken{UserId: userToken.UserId, IssuedAt: stored.Created}) {
+		auth.deleteRefreshToken(w, r)
+		return nil
+	}
+	if err := auth.setUserTokenCookie(w, r, userToken); err != nil {
+		log.Printf("Error setting login session of %s: %v", userToken.UserId, err)
+		return nil
+	}
+	log.Printf("Renewed login session for %s", userToken.UserId)
+	return &userToken
+}
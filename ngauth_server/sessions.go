@@ -0,0 +1,361 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Server-side sessions: if SERVER_SIDE_SESSIONS is "true", the login session cookie holds only an
+// opaque handle, and the login session itself is stored in the state store under a hash of the
+// handle.  Sessions can then be listed, along with the address and user agent from which they
+// were started, and revoked immediately by deleting them.
+
+// Prefix of session handles, which distinguishes them from stateless login session cookies.
+const sessionHandlePrefix = "ngs_"
+
+// The last use of a session is only recorded if this long after the previously recorded use, to
+// limit writes to the state store.
+const sessionLastUsedInterval = 5 * time.Minute
+
+// Maximum number of client origins recorded per session.
+const maxSessionOrigins = 10
+
+type storedSession struct {
+	UserToken UserToken `json:"userToken"`
+
+	Created   int64  `json:"created"`
+	IPAddress string `json:"ipAddress,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+
+	// Time of the last use of the session, in seconds since the epoch.
+	LastUsed int64 `json:"lastUsed,omitempty"`
+
+	// Client origins to which tokens have been issued from the session.
+	Origins []string `json:"origins,omitempty"`
+}
+
+// sessionInfo describes a login session to its user.
+type sessionInfo struct {
+	Id        string   `json:"id"`
+	Created   int64    `json:"created"`
+	Expires   int64    `json:"expires"`
+	LastUsed  int64    `json:"lastUsed"`
+	IPAddress string   `json:"ipAddress,omitempty"`
+	UserAgent string   `json:"userAgent,omitempty"`
+	Origins   []string `json:"origins,omitempty"`
+
+	// Whether this is the session of the request.
+	Current bool `json:"current"`
+}
+
+// sessionIdFromHandle returns the id under which the session is stored, which does not allow the
+// handle to be recovered.
+func sessionIdFromHandle(handle string) string {
+	hash := sha256.Sum256([]byte(handle))
+	return base64url.EncodeToString(hash[:])
+}
+
+func sessionKey(id string) string {
+	return "sessions/by_id/" + id
+}
+
+func sessionUserPrefix(userId string) string {
+	return "sessions/by_user/" + userId + "/"
+}
+
+// sessionOwner returns the user whose sessions include the session of userToken.  Sessions in
+// which an administrator impersonates a user belong to the administrator.
+func sessionOwner(userToken *UserToken) string {
+	if userToken.ImpersonatedBy != "" {
+		return userToken.ImpersonatedBy
+	}
+	return userToken.UserId
+}
+
+// getSessionClientIP returns the address of the client making r, as for network restrictions.
+func (auth *Authenticator) getSessionClientIP(r *http.Request) string {
+	if ip := auth.NetworkRestrictions.getClientIP(r); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// createSession stores a login session for userToken and returns its handle.
+func (auth *Authenticator) createSession(r *http.Request, userToken UserToken) (string, error) {
+	handleBytes := make([]byte, 32)
+	if _, err := rand.Read(handleBytes); err != nil {
+		panic(err)
+	}
+	handle := sessionHandlePrefix + base64url.EncodeToString(handleBytes)
+	id := sessionIdFromHandle(handle)
+	session := storedSession{
+		UserToken: userToken,
+		Created:   time.Now().Unix(),
+		LastUsed:  time.Now().Unix(),
+		IPAddress: auth.getSessionClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	err := auth.Store.Put(r.Context(), sessionKey(id), session)
+	if err == nil {
+		err = auth.Store.Put(r.Context(), sessionUserPrefix(sessionOwner(&userToken))+id, struct{}{})
+	}
+	return handle, err
+}
+
+// getSession returns the stored login session with the specified id.
+func (auth *Authenticator) getSession(ctx context.Context, id string) (*storedSession, error) {
+	var session storedSession
+	if err := auth.Store.Get(ctx, sessionKey(id), &session); err != nil {
+		return nil, err
+	}
+	if session.UserToken.Expires < time.Now().Unix() {
+		return nil, fmt.Errorf("Session expired")
+	}
+	return &session, nil
+}
+
+// deleteSession deletes a stored login session and, if revoke is true, also revokes the tokens
+// derived from it.
+func (auth *Authenticator) deleteSession(ctx context.Context, id string, session *storedSession, revoke bool) error {
+	err := auth.Store.Delete(ctx, sessionKey(id))
+	if err == nil {
+		err = auth.Store.Delete(ctx, sessionUserPrefix(sessionOwner(&session.UserToken))+id)
+	}
+	if err == nil && revoke && session.UserToken.SessionId != "" {
+		err = auth.Revocations.RevokeSession(ctx, &session.UserToken)
+	}
+	return err
+}
+
+// deleteRequestSession deletes the stored login session, if any, identified by the login session
+// cookie of r.  The tokens derived from it are not revoked, since the session may be replaced by
+// one with the same session id, e.g. when a second factor is verified.
+func (auth *Authenticator) deleteRequestSession(r *http.Request) {
+	cookie, _ := r.Cookie(UserTokenCookieName)
+	if cookie == nil || !strings.HasPrefix(cookie.Value, sessionHandlePrefix) {
+		return
+	}
+	id := sessionIdFromHandle(cookie.Value)
+	session, err := auth.getSession(r.Context(), id)
+	if err != nil {
+		return
+	}
+	if err := auth.deleteSession(r.Context(), id, session, false); err != nil {
+		log.Printf("Error deleting login session of %s: %v", session.UserToken.UserId, err)
+	}
+}
+
+// decodeUserTokenCookie returns the login session identified by value, the login session cookie of
+// r, which is either a session handle or, for stateless sessions, the encoded user token.  The use
+// of a stored session is recorded, along with the origin of r.
+func (auth *Authenticator) decodeUserTokenCookie(r *http.Request, value string) (UserToken, error) {
+	if !strings.HasPrefix(value, sessionHandlePrefix) {
+		userToken, err := DecodeUserToken(auth.UserTokenKey, cookieUserTokenType, value)
+		if err != nil {
+			// Cookies set before user tokens were encrypted.  Untyped encrypted tokens are not
+			// accepted, as they cannot be distinguished from the temporary and form tokens of the
+			// same versions.
+			if legacyToken, legacyErr := DecodeLegacyUserToken(auth.UserTokenKey, value); legacyErr == nil {
+				return legacyToken, nil
+			}
+		}
+		return userToken, err
+	}
+	id := sessionIdFromHandle(value)
+	session, err := auth.getSession(r.Context(), id)
+	if err != nil {
+		return UserToken{}, err
+	}
+	now := time.Now().Unix()
+	changed := now-session.LastUsed >= int64(sessionLastUsedInterval.Seconds())
+	origin := r.Header.Get("origin")
+	if origin != "" && OriginPattern.MatchString(origin) && auth.IsOriginAllowed(origin) && !containsString(session.Origins, origin) && len(session.Origins) < maxSessionOrigins {
+		session.Origins = append(session.Origins, origin)
+		changed = true
+	}
+	if changed {
+		session.LastUsed = now
+		if err := auth.Store.Put(r.Context(), sessionKey(id), session); err != nil {
+			log.Printf("Error recording use of login session of %s: %v", session.UserToken.UserId, err)
+		}
+	}
+	return session.UserToken, nil
+}
+
+func (auth *Authenticator) listSessions(ctx context.Context, userId string) (sessions []sessionInfo, err error) {
+	prefix := sessionUserPrefix(userId)
+	keys, err := auth.Store.List(ctx, prefix)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, prefix)
+		session, getErr := auth.getSession(ctx, id)
+		if getErr != nil {
+			// Expired or deleted.
+			continue
+		}
+		sessions = append(sessions, sessionInfo{
+			Id:        id,
+			Created:   session.Created,
+			Expires:   session.UserToken.Expires,
+			LastUsed:  session.LastUsed,
+			IPAddress: session.IPAddress,
+			UserAgent: session.UserAgent,
+			Origins:   session.Origins,
+		})
+	}
+	return
+}
+
+// listRequestSessions lists the sessions of the user, marking the session of r as current.
+func (auth *Authenticator) listRequestSessions(r *http.Request, userToken *UserToken) ([]sessionInfo, error) {
+	sessions, err := auth.listSessions(r.Context(), userToken.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if cookie, _ := r.Cookie(UserTokenCookieName); cookie != nil {
+		currentId := sessionIdFromHandle(cookie.Value)
+		for i := range sessions {
+			sessions[i].Current = sessions[i].Id == currentId
+		}
+	}
+	return sessions, nil
+}
+
+func (auth *Authenticator) writeSessions(w http.ResponseWriter, r *http.Request, userToken *UserToken) {
+	sessions, err := auth.listRequestSessions(r, userToken)
+	if err != nil {
+		log.Printf("Error listing login sessions for %s: %v", userToken.UserId, err)
+		return
+	}
+	formToken := html.EscapeString(EncodeUserToken(auth.UserTokenKey, formUserTokenType, auth.makeTemporaryUserToken(*userToken, "")))
+	fmt.Fprint(w, "<p>Login sessions:</p>\n<ul>\n")
+	for _, session := range sessions {
+		details := ""
+		if session.Current {
+			details = " (this session)"
+		}
+		if len(session.Origins) > 0 {
+			details += ", used by " + strings.Join(session.Origins, ", ")
+		}
+		fmt.Fprintf(w, `<li>%s from %s, %s, last used %s%s
+<form action="/sessions/%s/revoke" method="post" style="display:inline">
+<input type="hidden" name="token" value="%s">
+<input type="submit" value="Revoke">
+</form></li>
+`, time.Unix(session.Created, 0).UTC().Format("2006-01-02 15:04"), html.EscapeString(session.IPAddress), html.EscapeString(session.UserAgent), time.Unix(session.LastUsed, 0).UTC().Format("2006-01-02 15:04"), html.EscapeString(details), html.EscapeString(session.Id), formToken)
+	}
+	fmt.Fprintf(w, `</ul>
+<form action="/sessions/revoke_all" method="post">
+<input type="hidden" name="token" value="%s">
+<input type="submit" value="Log out everywhere">
+</form>
+`, formToken)
+}
+
+func (auth *Authenticator) addSessionRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("GET").Path("/sessions").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getUserTokenFromCookie(r)
+		if userToken == nil {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		if userToken.ImpersonatedBy != "" {
+			http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+			return
+		}
+		sessions, err := auth.listRequestSessions(r, userToken)
+		if err != nil {
+			log.Printf("Error listing login sessions for %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if sessions == nil {
+			sessions = []sessionInfo{}
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	})
+
+	mux.Methods("POST").Path("/sessions/{id}/revoke").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getFormUser(w, r)
+		if userToken == nil {
+			return
+		}
+		id := gorilla_mux.Vars(r)["id"]
+		session, err := auth.getSession(r.Context(), id)
+		if err != nil || sessionOwner(&session.UserToken) != userToken.UserId {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+		if err := auth.deleteSession(r.Context(), id, session, true); err != nil {
+			log.Printf("Error revoking login session of %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Revoked login session %s of %s", id, userToken.UserId)
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+
+	// Ends all login sessions of the user, including the current one, and revokes all tokens
+	// derived from them, as for /revoke with all_sessions=true.
+	mux.Methods("POST").Path("/sessions/revoke_all").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken := auth.getFormUser(w, r)
+		if userToken == nil {
+			return
+		}
+		if err := auth.Revocations.RevokeUser(r.Context(), userToken.UserId); err != nil {
+			log.Printf("Error revoking login sessions of %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		prefix := sessionUserPrefix(userToken.UserId)
+		keys, err := auth.Store.List(r.Context(), prefix)
+		if err == nil {
+			for _, key := range keys {
+				id := strings.TrimPrefix(key, prefix)
+				if session, getErr := auth.getSession(r.Context(), id); getErr == nil {
+					if err = auth.deleteSession(r.Context(), id, session, false); err != nil {
+						break
+					}
+				}
+			}
+		}
+		if err != nil {
+			// The sessions are already revoked.
+			log.Printf("Error deleting login sessions of %s: %v", userToken.UserId, err)
+		}
+		auth.deleteRefreshToken(w, r)
+		http.SetCookie(w, &http.Cookie{
+			Name:   UserTokenCookieName,
+			MaxAge: -1,
+		})
+		auth.setLoginStatus(w, false)
+		log.Printf("Revoked all login sessions of %s", userToken.UserId)
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
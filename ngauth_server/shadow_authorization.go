@@ -0,0 +1,80 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Time allowed for the shadow authorizer, which runs after the response has been sent.
+const shadowAuthorizationTimeout = 30 * time.Second
+
+// ShadowAuthorizer evaluates a second storage authorizer alongside the enforced one, and logs the
+// decisions on which they differ, without enforcing them, e.g. to validate a migration to an
+// access control list before switching AUTHORIZATION_MODE.
+type ShadowAuthorizer struct {
+	mode       string
+	authorizer StorageAuthorizer
+}
+
+// loadShadowAuthorizer returns the authorizer selected by SHADOW_AUTHORIZATION_MODE, which takes
+// the same values, and configuration, as AUTHORIZATION_MODE.
+func loadShadowAuthorizer(client *http.Client) (*ShadowAuthorizer, error) {
+	mode, ok := os.LookupEnv("SHADOW_AUTHORIZATION_MODE")
+	if !ok {
+		return nil, nil
+	}
+	authorizer, err := makeStorageAuthorizerForMode(client, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowAuthorizer{mode: mode, authorizer: authorizer}, nil
+}
+
+// Compare evaluates the shadow authorizer and logs any difference from the enforced decision.
+func (s *ShadowAuthorizer) Compare(userToken UserToken, bucket string, prefix string, permission string, granted bool, prefixes []string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), shadowAuthorizationTimeout)
+	defer cancel()
+	shadowGranted, shadowPrefixes, shadowErr := checkStorageAuthorizer(ctx, s.authorizer, &userToken, bucket, prefix, permission)
+	if shadowErr != nil {
+		log.Printf("SHADOW: error evaluating %s authorization, user=%s, bucket=%s, prefix=%q, permission=%s: %v", s.mode, userToken.UserId, bucket, prefix, permission, shadowErr)
+		return
+	}
+	if err != nil {
+		return
+	}
+	if shadowGranted == granted && (!granted || equalStringSets(shadowPrefixes, prefixes)) {
+		return
+	}
+	log.Printf("SHADOW: %s authorization differs, user=%s, bucket=%s, prefix=%q, permission=%s: enforced granted=%v prefixes=%q, shadow granted=%v prefixes=%q", s.mode, userToken.UserId, bucket, prefix, permission, granted, prefixes, shadowGranted, shadowPrefixes)
+}
+
+// equalStringSets returns true if a and b contain the same strings, ignoring order and duplicates.
+func equalStringSets(a []string, b []string) bool {
+	for _, s := range a {
+		if !containsString(b, s) {
+			return false
+		}
+	}
+	for _, s := range b {
+		if !containsString(a, s) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Share links: a user may delegate read access to an object prefix, for a limited time, to anyone
+// holding a signed share token.  The share token is a user token of the owner restricted to the
+// bucket and prefix and signed with a separate key, so that it is only accepted by /gcs_token.
+// Access is checked as the owner whenever the share token is used, so revoking the owner's access
+// also revokes the link.
+
+const shareTokenPrefix = "ngshare_"
+
+const defaultShareLinkLifetimeSeconds = 7 * 24 * 60 * 60
+
+const maxShareLinkLifetimeSeconds = 30 * 24 * 60 * 60
+
+// ShareScope restricts a share token.
+type ShareScope struct {
+	// Object name prefix within the bucket, or "" for the whole bucket.
+	Prefix string `json:"p,omitempty"`
+}
+
+type createShareLinkRequest struct {
+	Token  string `json:"token"`
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+
+	// Lifetime of the link, in seconds.
+	ExpiresIn int64 `json:"expiresIn,omitempty"`
+}
+
+type shareLinkResponse struct {
+	// Share token, which recipients specify as the token for /gcs_token.
+	Token string `json:"token,omitempty"`
+	URL   string `json:"url,omitempty"`
+
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix,omitempty"`
+	SharedBy string `json:"sharedBy"`
+	Expires  int64  `json:"expires"`
+}
+
+// shareTokenKey derives the key used to sign share tokens from the login session key.
+func (auth *Authenticator) shareTokenKey() []byte {
+	hasher := hmac.New(sha256.New, auth.UserTokenKey)
+	hasher.Write([]byte("ngauth share link"))
+	return hasher.Sum(nil)
+}
+
+// decodeShareToken returns the restricted user token of the owner of a share link.
+func (auth *Authenticator) decodeShareToken(token string) (UserToken, error) {
+	userToken, err := DecodeUserToken(auth.shareTokenKey(), untypedUserTokenType, strings.TrimPrefix(token, shareTokenPrefix))
+	if err != nil {
+		return userToken, err
+	}
+	if userToken.Share == nil || len(userToken.Buckets) != 1 {
+		return userToken, fmt.Errorf("Malformed share token")
+	}
+	return userToken, nil
+}
+
+func (auth *Authenticator) addShareLinkRoutes(mux *gorilla_mux.Router) {
+	// Creates a share link for a bucket or object prefix that the user, identified as for
+	// /gcs_token, may read.
+	mux.Methods("POST").Path("/share_links").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin != "" {
+			w.Header().Set("vary", "origin")
+			if !OriginPattern.MatchString(origin) || !auth.IsOriginAllowed(origin) {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("access-control-allow-origin", origin)
+		}
+		var request createShareLinkRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		userToken, err := auth.resolveRequestUserToken(r, request.Token)
+		if err != nil {
+			log.Printf("Invalid authentication token: %+v", err)
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		if userToken.UserId == anonymousUserId || userToken.ImpersonatedBy != "" {
+			http.Error(w, "Not allowed", http.StatusForbidden)
+			return
+		}
+		if request.Bucket == "" || !isValidObjectPrefix(request.Prefix) {
+			http.Error(w, "Invalid bucket or prefix", http.StatusBadRequest)
+			return
+		}
+		lifetime := request.ExpiresIn
+		if lifetime == 0 {
+			lifetime = defaultShareLinkLifetimeSeconds
+		}
+		if lifetime < 0 || lifetime > maxShareLinkLifetimeSeconds {
+			http.Error(w, fmt.Sprintf("expiresIn must be at most %d", maxShareLinkLifetimeSeconds), http.StatusBadRequest)
+			return
+		}
+		if !auth.BucketFilter.IsBrokered(request.Bucket) || !userToken.AllowsBucket(request.Bucket) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		// The owner must be able to read everything shared, not only narrower prefixes.
+		tokenRequest := GcsTokenRequest{Bucket: request.Bucket, Prefix: request.Prefix}
+		granted, prefixes, _, _, err := auth.authorizeStorageAccess(r, &userToken, &tokenRequest)
+		if err != nil {
+			http.Error(w, "Failed to query bucket permissions", http.StatusInternalServerError)
+			log.Printf("Error querying permissions, user=%s, bucket=%s, err=%+v", userToken.UserId, request.Bucket, err)
+			return
+		}
+		if !granted || len(prefixes) > 0 {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		shareToken := userToken
+		shareToken.Expires = time.Now().Unix() + lifetime
+		shareToken.Buckets = []string{request.Bucket}
+		shareToken.Share = &ShareScope{Prefix: request.Prefix}
+		shareToken.Origin = ""
+		// Share links outlive the login session from which they are created.
+		shareToken.SessionId = ""
+		encoded := shareTokenPrefix + EncodeUserToken(auth.shareTokenKey(), untypedUserTokenType, shareToken)
+		log.Printf("AUDIT: %s created share link for bucket %s prefix %q expiring %d", userToken.UserId, request.Bucket, request.Prefix, shareToken.Expires)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(shareLinkResponse{
+			Token:    encoded,
+			URL:      getBaseURL(r) + "/share?token=" + url.QueryEscape(encoded),
+			Bucket:   request.Bucket,
+			Prefix:   request.Prefix,
+			SharedBy: userToken.UserId,
+			Expires:  shareToken.Expires,
+		})
+	})
+
+	// Describes a share link, for display to the recipient.
+	mux.Methods("GET").Path("/share").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("origin"); origin != "" {
+			w.Header().Set("vary", "origin")
+			if !OriginPattern.MatchString(origin) || !auth.IsOriginAllowed(origin) {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("access-control-allow-origin", origin)
+		}
+		shareToken, err := auth.decodeShareToken(r.URL.Query().Get("token"))
+		if err != nil {
+			http.Error(w, "Invalid or expired share link", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(shareLinkResponse{
+			Bucket:   shareToken.Buckets[0],
+			Prefix:   shareToken.Share.Prefix,
+			SharedBy: shareToken.UserId,
+			Expires:  shareToken.Expires,
+		})
+	})
+}
@@ -0,0 +1,280 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+// Signed URLs: as an alternative to bucket-scoped access tokens, ngauth may return V4 signed URLs
+// for specific objects, for clients that cannot easily attach an Authorization header, e.g. web
+// workers or other tools.  URLs are signed by the service account of the bucket using the IAM
+// Credentials signBlob API, so no private key is needed.
+
+const defaultSignedUrlLifetime = 15 * time.Minute
+
+const maxSignedUrlLifetime = time.Hour
+
+// Maximum number of objects in one /signed_urls request.
+const maxSignedUrlObjects = 100
+
+type signedUrlsRequest struct {
+	Token   string   `json:"token"`
+	Bucket  string   `json:"bucket"`
+	Objects []string `json:"objects"`
+
+	// Lifetime of the URLs, in seconds.
+	ExpiresIn int64 `json:"expiresIn,omitempty"`
+}
+
+type signedUrlsResponse struct {
+	// Signed URLs, in the order of the objects.
+	URLs []string `json:"urls"`
+
+	// Expiry time of the URLs, in seconds since the epoch.
+	Expires int64 `json:"expires"`
+}
+
+// getSignedUrlServiceAccount returns the email address of the service account that signs URLs
+// for objects in bucket whose names start with prefix: the service account of the dataset that
+// includes them, if any, the impersonated service account of the project of bucket, that of a
+// service account key, or SIGNED_URL_SERVICE_ACCOUNT.
+func (auth *Authenticator) getSignedUrlServiceAccount(bucket string, prefix string) string {
+	if serviceAccount := auth.Datasets.GetServiceAccount(bucket, prefix); serviceAccount != "" {
+		return serviceAccount
+	}
+	if project := auth.getBucketProject(bucket); project != nil && project.ImpersonateServiceAccount != "" {
+		return project.ImpersonateServiceAccount
+	}
+	var key struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if credentials := auth.getBucketCredentials(bucket); credentials.JSON != nil {
+		if err := json.Unmarshal(credentials.JSON, &key); err == nil && key.ClientEmail != "" {
+			return key.ClientEmail
+		}
+	}
+	return auth.SignedUrlServiceAccount
+}
+
+// signBlob signs data as serviceAccount with its Google-managed key.
+func (auth *Authenticator) signBlob(ctx context.Context, bucket string, serviceAccount string, data []byte) ([]byte, error) {
+	requestJson, _ := json.Marshal(map[string]string{"payload": base64.StdEncoding.EncodeToString(data)})
+	client := oauth2.NewClient(ctx, auth.getBucketCredentials(bucket).TokenSource)
+	resp, err := client.Post("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/"+url.PathEscape(serviceAccount)+":signBlob", "application/json", bytes.NewReader(requestJson))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Unable to sign blob: %v %v", resp.Status, string(bodyBytes))
+	}
+	var response struct {
+		SignedBlob string `json:"signedBlob"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(response.SignedBlob)
+}
+
+// escapeSignedUrlComponent percent-encodes s as required by V4 signing, leaving "/" unescaped if
+// keepSlash is true.
+func escapeSignedUrlComponent(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signObjectUrl returns a V4 signed URL for reading object, valid for lifetime from now.
+// https://cloud.google.com/storage/docs/access-control/signing-urls-manually
+func (auth *Authenticator) signObjectUrl(ctx context.Context, bucket string, object string, serviceAccount string, now time.Time, lifetime time.Duration) (string, error) {
+	const host = "storage.googleapis.com"
+	timestamp := now.UTC().Format("20060102T150405Z")
+	scope := now.UTC().Format("20060102") + "/auto/storage/goog4_request"
+	query := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    serviceAccount + "/" + scope,
+		"X-Goog-Date":          timestamp,
+		"X-Goog-Expires":       strconv.FormatInt(int64(lifetime.Seconds()), 10),
+		"X-Goog-SignedHeaders": "host",
+	}
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var queryParts []string
+	for _, name := range names {
+		queryParts = append(queryParts, escapeSignedUrlComponent(name, false)+"="+escapeSignedUrlComponent(query[name], false))
+	}
+	canonicalQuery := strings.Join(queryParts, "&")
+	path := "/" + bucket + "/" + escapeSignedUrlComponent(object, true)
+	canonicalRequest := strings.Join([]string{"GET", path, canonicalQuery, "host:" + host + "\n", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"GOOG4-RSA-SHA256", timestamp, scope, hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+	signature, err := auth.signBlob(ctx, bucket, serviceAccount, []byte(stringToSign))
+	if err != nil {
+		return "", err
+	}
+	return "https://" + host + path + "?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(signature), nil
+}
+
+// commonObjectPrefix returns the longest prefix, ending in "/", shared by the names of objects, or
+// "".
+func commonObjectPrefix(objects []string) string {
+	prefix := objects[0]
+	for _, object := range objects[1:] {
+		for !strings.HasPrefix(object, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix[:strings.LastIndexByte(prefix, '/')+1]
+}
+
+func (auth *Authenticator) addSignedUrlRoutes(mux *gorilla_mux.Router) {
+	// Returns signed URLs for reading objects of a bucket, checking access as for a /gcs_token
+	// request limited to the objects' common prefix.
+	mux.Methods("POST").Path("/signed_urls").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin != "" {
+			w.Header().Set("access-control-allow-origin", origin)
+			w.Header().Set("vary", "origin")
+		}
+		var request signedUrlsRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(request.Objects) == 0 || len(request.Objects) > maxSignedUrlObjects {
+			http.Error(w, fmt.Sprintf("Specify between 1 and %d objects", maxSignedUrlObjects), http.StatusBadRequest)
+			return
+		}
+		for _, object := range request.Objects {
+			if object == "" {
+				http.Error(w, "Invalid object name", http.StatusBadRequest)
+				return
+			}
+		}
+		lifetime := defaultSignedUrlLifetime
+		if request.ExpiresIn != 0 {
+			lifetime = time.Duration(request.ExpiresIn) * time.Second
+		}
+		if lifetime <= 0 || lifetime > maxSignedUrlLifetime {
+			http.Error(w, fmt.Sprintf("expiresIn must be at most %d", int64(maxSignedUrlLifetime.Seconds())), http.StatusBadRequest)
+			return
+		}
+		if !auth.BucketFilter.IsBrokered(request.Bucket) {
+			http.Error(w, "Bucket not served by this server", http.StatusForbidden)
+			return
+		}
+		// Signed URLs of encrypted objects also require the key in the request headers.
+		if denial := auth.checkEncryptedBucket(request.Bucket); denial != nil {
+			http.Error(w, denial.message+"; "+denial.remediation, denial.status)
+			return
+		}
+		userToken, err := auth.resolveRequestUserToken(r, request.Token)
+		if err != nil {
+			log.Printf("Invalid authentication token: %+v", err)
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		tokenRequest := GcsTokenRequest{Token: request.Token, Bucket: request.Bucket, Prefix: commonObjectPrefix(request.Objects)}
+		if !isValidObjectPrefix(tokenRequest.Prefix) {
+			http.Error(w, "Invalid prefix", http.StatusBadRequest)
+			return
+		}
+		if denial, _ := auth.checkTokenPolicies(r, origin, &userToken, &tokenRequest); denial != nil {
+			if denial.challenge != "" {
+				w.Header().Set("www-authenticate", denial.challenge)
+				w.Header().Set("access-control-expose-headers", "www-authenticate")
+			}
+			http.Error(w, denial.message, denial.status)
+			return
+		}
+		prefixes, _, tokenErr := auth.authorizeGcsToken(r, &userToken, &tokenRequest)
+		if tokenErr != nil {
+			http.Error(w, tokenErr.message, tokenErr.status)
+			return
+		}
+		for _, object := range request.Objects {
+			allowed := len(prefixes) == 0
+			for _, prefix := range prefixes {
+				allowed = allowed || strings.HasPrefix(object, prefix)
+			}
+			if !allowed {
+				http.Error(w, "Access denied", http.StatusForbidden)
+				return
+			}
+		}
+		serviceAccount := auth.getSignedUrlServiceAccount(request.Bucket, tokenRequest.Prefix)
+		if serviceAccount == "" {
+			http.Error(w, "Signed URLs not available for bucket", http.StatusNotImplemented)
+			return
+		}
+		if tokenErr := auth.consumeCredentialsQuota(r, &userToken, &tokenRequest); tokenErr != nil {
+			tokenErr.write(w)
+			return
+		}
+		now := time.Now()
+		response := signedUrlsResponse{URLs: make([]string, len(request.Objects)), Expires: now.Add(lifetime).Unix()}
+		errs := make([]error, len(request.Objects))
+		var wg sync.WaitGroup
+		for i, object := range request.Objects {
+			wg.Add(1)
+			go func(i int, object string) {
+				defer wg.Done()
+				response.URLs[i], errs[i] = auth.signObjectUrl(r.Context(), request.Bucket, object, serviceAccount, now, lifetime)
+			}(i, object)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				http.Error(w, "Failed to sign URLs", http.StatusInternalServerError)
+				log.Printf("Error signing URLs, bucket=%s, err=%+v", request.Bucket, err)
+				return
+			}
+		}
+		log.Printf("AUDIT: %s obtained %d signed URLs for bucket %s prefix %q", userToken.UserId, len(request.Objects), request.Bucket, tokenRequest.Prefix)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(&response)
+	})
+}
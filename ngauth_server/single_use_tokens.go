@@ -0,0 +1,91 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Single-use tokens: a temporary token issued by /token with single_use=true, or by any /token
+// request if SINGLE_USE_TOKENS=true, has a unique id and is accepted only by the first request
+// presenting it, so that a token captured in transit or from logs cannot be replayed.  Consumed
+// ids are recorded in the store until the token expires.
+
+type consumedToken struct {
+	UserId  string `json:"userId"`
+	Expires int64  `json:"expires"`
+}
+
+func consumedTokenKey(tokenId string) string {
+	return "consumed_tokens/" + tokenId
+}
+
+func makeTokenId() string {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		panic(err)
+	}
+	return base64url.EncodeToString(idBytes)
+}
+
+// Single-use tokens consumed by the current request, which may use the same token several times,
+// e.g. for each request of a /gcs_tokens batch.
+type consumedTokenMemo struct {
+	mutex  sync.Mutex
+	errors map[string]error
+}
+
+const consumedTokenMemoContextKey contextKey = 1
+
+// withConsumedTokenMemo returns r with a context in which each single-use token is only consumed
+// once, however many times it is resolved.
+func withConsumedTokenMemo(r *http.Request) *http.Request {
+	memo := &consumedTokenMemo{errors: make(map[string]error)}
+	return r.WithContext(context.WithValue(r.Context(), consumedTokenMemoContextKey, memo))
+}
+
+// consumeSingleUseToken records that userToken has been used, and returns an error if it is a
+// single-use token that has already been used by another request.
+func (auth *Authenticator) consumeSingleUseToken(r *http.Request, userToken *UserToken) error {
+	if userToken.TokenId == "" {
+		return nil
+	}
+	memo, _ := r.Context().Value(consumedTokenMemoContextKey).(*consumedTokenMemo)
+	if memo == nil {
+		return auth.consumeTokenId(r.Context(), userToken)
+	}
+	// Concurrent resolutions of the same token wait for the first one to complete.
+	memo.mutex.Lock()
+	defer memo.mutex.Unlock()
+	if err, ok := memo.errors[userToken.TokenId]; ok {
+		return err
+	}
+	err := auth.consumeTokenId(r.Context(), userToken)
+	memo.errors[userToken.TokenId] = err
+	return err
+}
+
+func (auth *Authenticator) consumeTokenId(ctx context.Context, userToken *UserToken) error {
+	err := auth.Store.Create(ctx, consumedTokenKey(userToken.TokenId), consumedToken{UserId: userToken.UserId, Expires: userToken.Expires})
+	if err == errStoreExists {
+		log.Printf("AUDIT: single-use token %s of %s replayed", userToken.TokenId, userToken.UserId)
+		return fmt.Errorf("Single-use token already used")
+	}
+	return err
+}
@@ -0,0 +1,479 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StorageAuthorizer determines whether a user has read access to a bucket.
+type StorageAuthorizer interface {
+	// CheckStoragePermission returns true if the qualified userId has permission, either
+	// storage.objects.get, storage.objects.list or storage.objects.create, for objects in bucket
+	// whose names start with prefix, which may be empty.
+	CheckStoragePermission(ctx context.Context, userId string, bucket string, prefix string, permission string) (bool, error)
+}
+
+// /gcs_token request modes.
+const (
+	readMode  = "read"
+	listMode  = "list"
+	writeMode = "write"
+)
+
+func isValidMode(mode string) bool {
+	return mode == "" || mode == readMode || mode == listMode || mode == writeMode
+}
+
+const (
+	storageReadPermission  = "storage.objects.get"
+	storageListPermission  = "storage.objects.list"
+	storageWritePermission = "storage.objects.create"
+)
+
+// Permissions, in the form used by credential access boundaries, of access tokens issued for
+// uploads.
+var writeTokenPermissions = []string{"inRole:roles/storage.objectCreator"}
+
+// Permissions of access tokens issued for reading without listing, with
+// READ_TOKENS_ALLOW_LISTING=false.
+var readOnlyTokenPermissions = []string{"inRole:roles/storage.legacyObjectReader"}
+
+// authorizeStorageAccess determines whether a /gcs_token request is granted and, if so, the object
+// prefixes to which the access token is limited, if any, and the permissions it carries.  The
+// source identifies the grant or authorizer that decided the request.
+func (auth *Authenticator) authorizeStorageAccess(r *http.Request, userToken *UserToken, tokenRequest *GcsTokenRequest) (granted bool, prefixes []string, permissions []string, source string, err error) {
+	ctx := r.Context()
+	bucket := tokenRequest.Bucket
+	write := tokenRequest.Mode == writeMode
+	var permission string
+	switch tokenRequest.Mode {
+	case writeMode:
+		permission = storageWritePermission
+		permissions = writeTokenPermissions
+	case listMode:
+		permission = storageListPermission
+		permissions = defaultTokenPermissions
+	default:
+		permission = storageReadPermission
+		permissions = auth.ReadTokenPermissions
+	}
+
+	// The dataset's own members, if any, replace all other grants.
+	if dataset := auth.Datasets.Get(tokenRequest.Dataset); dataset != nil && dataset.hasAccessControl() {
+		return dataset.Allows(userToken, tokenRequest.Mode), nil, permissions, "dataset", nil
+	}
+
+	if rolePermissions := auth.RoleBindings.GetPermissions(userToken, bucket); rolePermissions != nil {
+		if !write {
+			return true, nil, rolePermissions, "roles", nil
+		}
+		if allowsWrite(rolePermissions) {
+			return true, nil, permissions, "roles", nil
+		}
+	}
+
+	// The remaining grants only allow reading and listing.
+	if !write {
+		if auth.IsAnonymousBucket(bucket) {
+			return true, nil, permissions, "anonymous", nil
+		}
+		if auth.GroupBuckets.IsGranted(userToken.Groups, bucket) {
+			return true, nil, permissions, "group_buckets", nil
+		}
+		if auth.GrantsDatabase != nil {
+			source = "grants_database"
+			if granted, err = auth.GrantsDatabase.IsGranted(ctx, userToken.Principals(), bucket, tokenRequest.Prefix); granted || err != nil {
+				return
+			}
+		}
+	}
+
+	if auth.AuthorizationWebhook != nil {
+		// The webhook replaces the storage authorizer.
+		source = "authorization_webhook"
+		var decision *webhookDecision
+		if decision, err = auth.AuthorizationWebhook.Decide(ctx, r, userToken, tokenRequest); err != nil {
+			return
+		}
+		return decision.Allow, decision.Prefixes, permissions, source, nil
+	}
+	source = "authorization_mode"
+	granted, prefixes, err = checkStorageAuthorizer(ctx, auth.getStorageAuthorizer(bucket), userToken, bucket, tokenRequest.Prefix, permission)
+	if auth.ShadowAuthorizer != nil {
+		go auth.ShadowAuthorizer.Compare(*userToken, bucket, tokenRequest.Prefix, permission, granted, prefixes, err)
+	}
+	return
+}
+
+// checkStorageAuthorizer determines whether a storage authorizer grants permission on objects in
+// bucket whose names start with prefix to the user.
+func checkStorageAuthorizer(ctx context.Context, storageAuthorizer StorageAuthorizer, userToken *UserToken, bucket string, prefix string, permission string) (granted bool, prefixes []string, err error) {
+	if a, ok := storageAuthorizer.(prefixAuthorizer); ok {
+		if permission != storageWritePermission {
+			granted, prefixes = a.CheckObjectPrefixes(userToken, bucket, prefix)
+		}
+		return
+	}
+	for _, principal := range userToken.Principals() {
+		if granted, err = storageAuthorizer.CheckStoragePermission(ctx, principal, bucket, prefix, permission); granted || err != nil {
+			return
+		}
+	}
+	return
+}
+
+// isValidObjectPrefix returns false if prefix cannot be embedded in a CEL string literal in a
+// credential access boundary condition.
+func isValidObjectPrefix(prefix string) bool {
+	return !strings.ContainsAny(prefix, "'\\")
+}
+
+// resourceCoversPrefix returns true if resource, either a bucket name or "BUCKET/PREFIX", includes
+// all objects in bucket whose names start with prefix.
+func resourceCoversPrefix(resource string, bucket string, prefix string) bool {
+	parts := strings.SplitN(resource, "/", 2)
+	return parts[0] == bucket && (len(parts) == 1 || strings.HasPrefix(prefix, parts[1]))
+}
+
+// makeStorageAuthorizer returns the authorizer selected by AUTHORIZATION_MODE.
+func makeStorageAuthorizer(client *http.Client) (StorageAuthorizer, error) {
+	return makeStorageAuthorizerForMode(client, getEnvOr("AUTHORIZATION_MODE", "troubleshooter"))
+}
+
+func makeStorageAuthorizerForMode(client *http.Client, mode string) (StorageAuthorizer, error) {
+	switch mode {
+	case "troubleshooter":
+		a := &policyTroubleshooterAuthorizer{client: client, folders: &managedFolderLister{client: client}}
+		if os.Getenv("RESOLVE_GROUPS") == "true" {
+			a.groups = &GoogleGroupsChecker{client: client}
+		}
+		return a, nil
+	case "bucket_policy":
+		return makeBucketPolicyAuthorizer(client), nil
+	case "grants":
+		return loadStorageGrants()
+	case "acl":
+		return loadAccessControlList()
+	case "cave":
+		return loadCaveAuthorizer()
+	default:
+		return nil, fmt.Errorf("Unknown authorization mode: %q", mode)
+	}
+}
+
+// verifiedEmailProviders are the identity providers, in addition to Google, whose user ids are
+// verified email addresses of the Google accounts of the same name, as specified by the
+// comma-separated VERIFIED_EMAIL_PROVIDERS.
+var verifiedEmailProviders = splitList(os.Getenv("VERIFIED_EMAIL_PROVIDERS"))
+
+// getUserEmail returns the email address of the Google account of a qualified user id, or "" if
+// the user id is not a Google account.  IAM policies refer to accounts by email address, but the
+// ids of other providers, e.g. user principal names or LDAP mail attributes, are not verified
+// addresses of Google accounts, and are only used if the provider is trusted to verify them.
+func getUserEmail(userId string) string {
+	provider, email := SplitUserId(userId)
+	if !strings.Contains(email, "@") {
+		return ""
+	}
+	if provider == "google" {
+		return email
+	}
+	for _, trusted := range verifiedEmailProviders {
+		if provider == trusted {
+			return email
+		}
+	}
+	return ""
+}
+
+// Predefined roles that include the storage.objects.get permission.
+const defaultStorageReaderRoles = "roles/storage.objectViewer,roles/storage.objectUser,roles/storage.objectAdmin,roles/storage.admin,roles/storage.legacyObjectReader,roles/storage.legacyObjectOwner"
+
+// Predefined roles that include the storage.objects.list permission.
+const defaultStorageListerRoles = "roles/storage.objectViewer,roles/storage.objectUser,roles/storage.objectAdmin,roles/storage.admin,roles/storage.legacyBucketReader,roles/storage.legacyBucketWriter,roles/storage.legacyBucketOwner"
+
+// Predefined roles that include the storage.objects.create permission.
+const defaultStorageWriterRoles = "roles/storage.objectCreator,roles/storage.objectUser,roles/storage.objectAdmin,roles/storage.admin,roles/storage.legacyBucketWriter,roles/storage.legacyBucketOwner"
+
+const bucketPolicyCacheDuration = time.Minute
+
+type bucketPolicy struct {
+	Bindings []struct {
+		Role      string   `json:"role"`
+		Members   []string `json:"members"`
+		Condition *struct {
+			Expression string `json:"expression"`
+		} `json:"condition,omitempty"`
+	} `json:"bindings"`
+}
+
+// Matches conditions granting access to an object prefix, e.g.
+// resource.name.startsWith("projects/_/buckets/BUCKET/objects/PREFIX").
+var objectPrefixConditionPattern = regexp.MustCompile(`^\s*resource\.name\.startsWith\(\s*["']projects/_/buckets/([^/"']+)/objects/([^"']*)["']\s*\)\s*$`)
+
+// conditionCoversPrefix returns true if a binding condition is known to hold for all objects in
+// bucket whose names start with prefix.
+func conditionCoversPrefix(expression string, bucket string, prefix string) bool {
+	match := objectPrefixConditionPattern.FindStringSubmatch(expression)
+	return match != nil && match[1] == bucket && strings.HasPrefix(prefix, match[2])
+}
+
+type cachedBucketPolicy struct {
+	policy  *bucketPolicy
+	expires time.Time
+}
+
+// bucketPolicyAuthorizer simulates IAM evaluation of the bucket's own IAM policy, which only
+// requires the service account to have storage.buckets.getIamPolicy permission on the bucket.
+// storage.testIamPermissions cannot be used directly, since it only reports the permissions of
+// the caller.  Policies inherited from the project, folder or organization, custom roles, and
+// conditional bindings other than simple object prefix conditions are not considered.
+type bucketPolicyAuthorizer struct {
+	client *http.Client
+
+	// Roles granting each permission.
+	roles map[string]map[string]bool
+
+	// Used to expand "group:" members, which requires the service account to be allowed to view
+	// the group membership.
+	groups *GoogleGroupsChecker
+
+	// Used to find managed folders whose policies may grant access to a prefix.
+	folders *managedFolderLister
+
+	// Cache of bucket name, or "BUCKET/FOLDER" for a managed folder, to *cachedBucketPolicy.
+	policies sync.Map
+}
+
+func makeBucketPolicyAuthorizer(client *http.Client) *bucketPolicyAuthorizer {
+	a := &bucketPolicyAuthorizer{
+		client: client,
+		roles: map[string]map[string]bool{
+			storageReadPermission:  make(map[string]bool),
+			storageListPermission:  make(map[string]bool),
+			storageWritePermission: make(map[string]bool),
+		},
+		groups:  &GoogleGroupsChecker{client: client},
+		folders: &managedFolderLister{client: client},
+	}
+	for _, role := range splitList(getEnvOr("STORAGE_READER_ROLES", defaultStorageReaderRoles)) {
+		a.roles[storageReadPermission][role] = true
+	}
+	for _, role := range splitList(getEnvOr("STORAGE_LISTER_ROLES", defaultStorageListerRoles)) {
+		a.roles[storageListPermission][role] = true
+	}
+	for _, role := range splitList(getEnvOr("STORAGE_WRITER_ROLES", defaultStorageWriterRoles)) {
+		a.roles[storageWritePermission][role] = true
+	}
+	return a
+}
+
+// getPolicy returns the IAM policy of bucket or, if folder is non-empty, of the managed folder.
+func (a *bucketPolicyAuthorizer) getPolicy(ctx context.Context, bucket string, folder string) (*bucketPolicy, error) {
+	key := bucket
+	policyURL := "https://storage.googleapis.com/storage/v1/b/" + url.PathEscape(bucket)
+	if folder != "" {
+		key += "/" + folder
+		policyURL += "/managedFolders/" + url.PathEscape(folder)
+	}
+	if cached, ok := a.policies.Load(key); ok && time.Now().Before(cached.(*cachedBucketPolicy).expires) {
+		return cached.(*cachedBucketPolicy).policy, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", policyURL+"/iam?optionsRequestedPolicyVersion=3", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Error reading IAM policy of %s: %s %s", key, resp.Status, string(body))
+	}
+	policy := &bucketPolicy{}
+	if err := json.NewDecoder(resp.Body).Decode(policy); err != nil {
+		return nil, err
+	}
+	a.policies.Store(key, &cachedBucketPolicy{policy: policy, expires: time.Now().Add(bucketPolicyCacheDuration)})
+	return policy, nil
+}
+
+func (a *bucketPolicyAuthorizer) isMember(ctx context.Context, email string, member string) (bool, error) {
+	if member == "allUsers" || member == "allAuthenticatedUsers" {
+		return true, nil
+	}
+	parts := strings.SplitN(member, ":", 2)
+	if len(parts) != 2 {
+		return false, nil
+	}
+	switch parts[0] {
+	case "user", "serviceAccount":
+		return strings.EqualFold(parts[1], email), nil
+	case "domain":
+		return strings.HasSuffix(strings.ToLower(email), "@"+strings.ToLower(parts[1])), nil
+	case "group":
+		return a.groups.IsMemberOf(ctx, email, parts[1])
+	}
+	return false, nil
+}
+
+func (a *bucketPolicyAuthorizer) CheckStoragePermission(ctx context.Context, userId string, bucket string, prefix string, permission string) (bool, error) {
+	email := getUserEmail(userId)
+	if email == "" {
+		return false, nil
+	}
+	policy, err := a.getPolicy(ctx, bucket, "")
+	if err != nil {
+		return false, err
+	}
+	if granted := a.checkPolicy(ctx, policy, email, bucket, prefix, permission); granted || prefix == "" {
+		return granted, nil
+	}
+	// Managed folders containing the prefix may grant access that the bucket policy does not.
+	for _, folder := range a.folders.GetContainingFolders(ctx, bucket, prefix) {
+		policy, err := a.getPolicy(ctx, bucket, folder)
+		if err != nil {
+			// Other folders may still grant access.
+			log.Printf("%v", err)
+			continue
+		}
+		if a.checkPolicy(ctx, policy, email, bucket, prefix, permission) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkPolicy returns true if policy grants permission to email for objects in bucket whose names
+// start with prefix.
+func (a *bucketPolicyAuthorizer) checkPolicy(ctx context.Context, policy *bucketPolicy, email string, bucket string, prefix string, permission string) bool {
+	for _, binding := range policy.Bindings {
+		if !a.roles[permission][binding.Role] {
+			continue
+		}
+		if binding.Condition != nil && !conditionCoversPrefix(binding.Condition.Expression, bucket, prefix) {
+			continue
+		}
+		for _, member := range binding.Members {
+			isMember, err := a.isMember(ctx, email, member)
+			if err != nil {
+				// Other members may still grant access.
+				log.Printf("Error checking IAM member %s for bucket %s: %v", member, bucket, err)
+				continue
+			}
+			if isMember {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StorageGrants is a table, maintained by the deployment, of the users allowed to read each
+// bucket.
+//
+// The file specified by GRANTS_PATH contains a JSON object mapping bucket names, or
+// "BUCKET/PREFIX", to lists of patterns, as for the login allowlist, matched against qualified
+// user ids, e.g. "google:*@example.org".  The file is reloaded whenever it is modified.
+type StorageGrants struct {
+	path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	grants  map[string][]string
+}
+
+// reload reads the grants file if it has been modified since it was last read.
+func (g *StorageGrants) reload() error {
+	info, err := os.Stat(g.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(g.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(g.path)
+	if err != nil {
+		return err
+	}
+	var grants map[string][]string
+	if err := json.Unmarshal(data, &grants); err != nil {
+		return err
+	}
+	for bucket, patterns := range grants {
+		for i, pattern := range patterns {
+			pattern = strings.ToLower(pattern)
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Invalid pattern %q: %w", pattern, err)
+			}
+			patterns[i] = pattern
+		}
+		grants[bucket] = patterns
+	}
+	g.grants = grants
+	g.modTime = info.ModTime()
+	return nil
+}
+
+func (g *StorageGrants) CheckStoragePermission(ctx context.Context, userId string, bucket string, prefix string, permission string) (bool, error) {
+	// Grants only allow reading and listing.
+	if permission == storageWritePermission {
+		return false, nil
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if err := g.reload(); err != nil {
+		// Continue to use the previously-loaded grants.
+		log.Printf("Error reloading grants from %s: %v", g.path, err)
+	}
+	userId = strings.ToLower(userId)
+	for resource, patterns := range g.grants {
+		if !resourceCoversPrefix(resource, bucket, prefix) {
+			continue
+		}
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, userId); matched {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func loadStorageGrants() (*StorageGrants, error) {
+	path, ok := os.LookupEnv("GRANTS_PATH")
+	if !ok {
+		return nil, fmt.Errorf("GRANTS_PATH must be specified when AUTHORIZATION_MODE=grants")
+	}
+	grants := &StorageGrants{path: path}
+	if err := grants.reload(); err != nil {
+		return nil, fmt.Errorf("Error reading grants from %s: %w", path, err)
+	}
+	return grants, nil
+}
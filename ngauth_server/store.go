@@ -0,0 +1,270 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store holds server-side state, such as registered credentials, as JSON values.
+type Store interface {
+	// Get decodes the value stored under key into value.  Returns errStoreNotFound if there is no
+	// such key.
+	Get(ctx context.Context, key string, value interface{}) error
+
+	Put(ctx context.Context, key string, value interface{}) error
+
+	// Create stores value under key only if there is no such key, atomically.  Returns
+	// errStoreExists otherwise.
+	Create(ctx context.Context, key string, value interface{}) error
+
+	// Delete removes key, if present.
+	Delete(ctx context.Context, key string) error
+
+	// List returns the keys with the specified prefix, in sorted order.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+var errStoreNotFound = errors.New("Not found")
+
+var errStoreExists = errors.New("Already exists")
+
+// memoryStore is a Store for single-instance and local deployments.  State is lost on restart.
+type memoryStore struct {
+	mutex  sync.Mutex
+	values map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{values: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string, value interface{}) error {
+	s.mutex.Lock()
+	encoded, ok := s.values[key]
+	s.mutex.Unlock()
+	if !ok {
+		return errStoreNotFound
+	}
+	return json.Unmarshal(encoded, value)
+}
+
+func (s *memoryStore) Put(ctx context.Context, key string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = encoded
+	return nil
+}
+
+func (s *memoryStore) Create(ctx context.Context, key string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.values[key]; ok {
+		return errStoreExists
+	}
+	s.values[key] = encoded
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *memoryStore) List(ctx context.Context, prefix string) (keys []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+// gcsStore is a Store that keeps each value as a separate object in a GCS bucket.
+type gcsStore struct {
+	client *http.Client
+	bucket string
+	prefix string
+}
+
+func (s *gcsStore) objectURL(key string) string {
+	return "https://storage.googleapis.com/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(s.prefix+key)
+}
+
+func gcsError(resp *http.Response) error {
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("GCS request failed: %v %v", resp.Status, string(bodyBytes))
+}
+
+func (s *gcsStore) Get(ctx context.Context, key string, value interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errStoreNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcsError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+func (s *gcsStore) Put(ctx context.Context, key string, value interface{}) error {
+	return s.upload(ctx, key, value, url.Values{})
+}
+
+// Create relies on a precondition that the object does not exist.
+func (s *gcsStore) Create(ctx context.Context, key string, value interface{}) error {
+	err := s.upload(ctx, key, value, url.Values{"ifGenerationMatch": {"0"}})
+	if err == errPreconditionFailed {
+		return errStoreExists
+	}
+	return err
+}
+
+var errPreconditionFailed = errors.New("Precondition failed")
+
+func (s *gcsStore) upload(ctx context.Context, key string, value interface{}, query url.Values) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	query.Set("uploadType", "media")
+	query.Set("name", s.prefix+key)
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://storage.googleapis.com/upload/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(), bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return errPreconditionFailed
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcsError(resp)
+	}
+	return nil
+}
+
+func (s *gcsStore) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return gcsError(resp)
+	}
+	return nil
+}
+
+func (s *gcsStore) List(ctx context.Context, prefix string) (keys []string, err error) {
+	query := url.Values{}
+	query.Set("prefix", s.prefix+prefix)
+	query.Set("fields", "items/name,nextPageToken")
+	for {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, "GET", "https://storage.googleapis.com/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(), nil)
+		if err != nil {
+			return
+		}
+		var resp *http.Response
+		resp, err = s.client.Do(req)
+		if err != nil {
+			return
+		}
+		var listResponse struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = gcsError(resp)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&listResponse)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+		for _, item := range listResponse.Items {
+			keys = append(keys, strings.TrimPrefix(item.Name, s.prefix))
+		}
+		if listResponse.NextPageToken == "" {
+			return
+		}
+		query.Set("pageToken", listResponse.NextPageToken)
+	}
+}
+
+// makeStore returns the Store specified by the STATE_STORE environment variable: either
+// "gs://BUCKET/PREFIX" or "memory" (the default).
+func makeStore(client *http.Client) (Store, error) {
+	spec := getEnvOr("STATE_STORE", "memory")
+	if spec == "memory" {
+		if os.Getenv("GAE_INSTANCE") != "" || os.Getenv("K_SERVICE") != "" {
+			log.Printf("Warning: using in-memory state store, which is not shared between instances")
+		}
+		return newMemoryStore(), nil
+	}
+	if strings.HasPrefix(spec, "gs://") {
+		parts := strings.SplitN(strings.TrimPrefix(spec, "gs://"), "/", 2)
+		store := &gcsStore{client: client, bucket: parts[0]}
+		if len(parts) == 2 && parts[1] != "" {
+			store.prefix = strings.TrimSuffix(parts[1], "/") + "/"
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("Invalid STATE_STORE: %q", spec)
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// OpenStack Swift: datasets in Swift containers, common at HPC centers, may be gated by ngauth
+// logins.  ngauth holds the temp URL key of the container's account, and issues users with access
+// prefix-based temp URLs, which authorize reading all objects under a prefix without further
+// credentials until they expire.
+
+// SwiftContainer specifies a Swift container to which ngauth brokers access.
+type SwiftContainer struct {
+	// Storage URL of the account, e.g. "https://swift.example.org/v1/AUTH_0123abcd".
+	StorageUrl string `json:"storageUrl"`
+
+	// File containing the temp URL key of the account or container, i.e. the value of
+	// X-Account-Meta-Temp-URL-Key or X-Container-Meta-Temp-URL-Key.
+	TempUrlKeyPath string `json:"tempUrlKeyPath"`
+
+	// Members, as for role bindings, who may read the container.
+	Readers []string `json:"readers"`
+
+	tempUrlKey []byte
+	storageUrl *url.URL
+}
+
+// loadSwiftContainers loads the containers specified by SWIFT_CONTAINERS_PATH, a JSON object
+// mapping container names to SwiftContainer.
+func loadSwiftContainers() (map[string]*SwiftContainer, error) {
+	containersPath, ok := os.LookupEnv("SWIFT_CONTAINERS_PATH")
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(containersPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Swift containers from %s: %w", containersPath, err)
+	}
+	var containers map[string]*SwiftContainer
+	if err := json.Unmarshal(data, &containers); err != nil {
+		return nil, fmt.Errorf("Error parsing Swift containers from %s: %w", containersPath, err)
+	}
+	for name, container := range containers {
+		storageUrl, err := url.Parse(strings.TrimSuffix(container.StorageUrl, "/"))
+		if err != nil || storageUrl.Scheme != "https" || !strings.HasPrefix(storageUrl.Path, "/v1/") {
+			return nil, fmt.Errorf("Swift container %s must specify an https storageUrl of the form https://HOST/v1/ACCOUNT", name)
+		}
+		container.storageUrl = storageUrl
+		key, err := ioutil.ReadFile(container.TempUrlKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading temp URL key of Swift container %s from %s: %w", name, container.TempUrlKeyPath, err)
+		}
+		container.tempUrlKey = []byte(strings.TrimSpace(string(key)))
+	}
+	return containers, nil
+}
+
+// makeTempUrl returns the URL of the objects of container whose names start with prefix, and the
+// query parameters of a GET temp URL, which also allows HEAD, for each of them.
+func (c *SwiftContainer) makeTempUrl(container string, prefix string, expires int64) (string, url.Values) {
+	path := c.storageUrl.Path + "/" + container + "/" + prefix
+	hasher := hmac.New(sha256.New, c.tempUrlKey)
+	fmt.Fprintf(hasher, "GET\n%d\nprefix:%s", expires, path)
+	target := *c.storageUrl
+	target.Path = path
+	target.RawPath = ""
+	return target.String(), url.Values{
+		"temp_url_sig":     {hex.EncodeToString(hasher.Sum(nil))},
+		"temp_url_expires": {strconv.FormatInt(expires, 10)},
+		"temp_url_prefix":  {prefix},
+	}
+}
+
+// swiftBroker issues temp URLs for Swift containers.  The resource is the container name.
+type swiftBroker struct {
+	auth *Authenticator
+}
+
+func makeSwiftBroker(auth *Authenticator) CredentialBroker {
+	if auth.SwiftContainers == nil {
+		return nil
+	}
+	return &swiftBroker{auth: auth}
+}
+
+// authorize checks the user's access to the container of request, and returns the user token,
+// container, and lifetime of the temp URL.
+func (b *swiftBroker) authorize(r *http.Request, origin string, request *CredentialRequest) (*UserToken, *SwiftContainer, time.Duration, *credentialError) {
+	auth := b.auth
+	container := auth.SwiftContainers[request.Resource]
+	if container == nil {
+		return nil, nil, 0, &credentialError{status: http.StatusNotFound, message: "Container not served by this server"}
+	}
+	if !isValidObjectPrefix(request.Prefix) {
+		return nil, nil, 0, &credentialError{status: http.StatusBadRequest, message: "Invalid prefix"}
+	}
+	if request.Mode == writeMode {
+		return nil, nil, 0, &credentialError{status: http.StatusBadRequest, message: "Swift temp URLs are read-only"}
+	}
+	lifetime := defaultSignedUrlLifetime
+	if request.ExpiresIn != 0 {
+		lifetime = time.Duration(request.ExpiresIn) * time.Second
+	}
+	if lifetime <= 0 || lifetime > maxSignedUrlLifetime {
+		return nil, nil, 0, &credentialError{status: http.StatusBadRequest, message: "Invalid expiresIn"}
+	}
+	userToken, tokenErr := auth.authenticateCredentialRequest(r, request)
+	if tokenErr != nil {
+		return nil, nil, 0, tokenErr
+	}
+	// Policies keyed by bucket name, e.g. deny rules and embargoes, apply to the container name.
+	tokenRequest := GcsTokenRequest{Bucket: request.Resource, Prefix: request.Prefix, Mode: readMode}
+	if denial, _ := auth.checkTokenPolicies(r, origin, userToken, &tokenRequest); denial != nil {
+		return nil, nil, 0, &credentialError{status: denial.status, message: denial.message, challenge: denial.challenge}
+	}
+	if !hasMember(container.Readers, userToken) {
+		log.Printf("AUDIT: %s denied temp URL for Swift container %s prefix %q", userToken.UserId, request.Resource, request.Prefix)
+		return nil, nil, 0, &credentialError{status: http.StatusForbidden, message: "Access denied"}
+	}
+	return userToken, container, lifetime, nil
+}
+
+func (b *swiftBroker) CheckAccess(r *http.Request, origin string, request *CredentialRequest) *credentialError {
+	_, _, _, tokenErr := b.authorize(r, origin, request)
+	return tokenErr
+}
+
+func (b *swiftBroker) IssueCredential(r *http.Request, origin string, request *CredentialRequest) (interface{}, *credentialError) {
+	userToken, container, lifetime, tokenErr := b.authorize(r, origin, request)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	expires := time.Now().Add(lifetime).Unix()
+	tempUrl, query := container.makeTempUrl(request.Resource, request.Prefix, expires)
+	log.Printf("AUDIT: %s obtained temp URL for Swift container %s prefix %q", userToken.UserId, request.Resource, request.Prefix)
+	return map[string]interface{}{
+		"url":       tempUrl,
+		"query":     query.Encode(),
+		"expiresAt": expires,
+	}, nil
+}
+
+func (auth *Authenticator) addSwiftRoutes(mux *gorilla_mux.Router) {
+	// Returns a prefix-based temp URL for a container, for a request with the same token as for
+	// /gcs_token.
+	mux.Methods("POST").Path("/swift_temp_url").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowCredentialOrigin(w, r)
+		var request struct {
+			Token     string `json:"token"`
+			Container string `json:"container"`
+			Prefix    string `json:"prefix,omitempty"`
+
+			// Lifetime of the URL, in seconds.
+			ExpiresIn int64 `json:"expiresIn,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveCredentialRequest(w, r, origin, auth.CredentialBrokers["swift"], &CredentialRequest{
+			Token:     request.Token,
+			Resource:  request.Container,
+			Prefix:    request.Prefix,
+			ExpiresIn: request.ExpiresIn,
+		})
+	})
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// Token exchange for users (RFC 8693): applications that have already authenticated a user with
+// one of the configured identity providers, e.g. an institutional portal, exchange the user's
+// id_token at /exchange for an ngauth token or, if a resource is specified, directly for a GCS
+// access token, without sending the user through the ngauth login flow.  Unlike /federate, which
+// trusts workload tokens of external issuers, the same checks apply as for interactive logins.
+
+// validateExchangedIdToken finds the identity provider that accepts idToken and returns the
+// provider along with the unqualified identity.
+func (auth *Authenticator) validateExchangedIdToken(ctx context.Context, idToken string) (IdentityProvider, *Identity, error) {
+	err := fmt.Errorf("No identity provider validates id_tokens")
+	for _, provider := range auth.IdentityProviders {
+		oauth2Provider, ok := provider.(OAuth2IdentityProvider)
+		if !ok {
+			continue
+		}
+		var identity *Identity
+		if identity, err = oauth2Provider.ValidateIdToken(ctx, idToken); err == nil {
+			return provider, identity, nil
+		}
+	}
+	return nil, nil, err
+}
+
+// parseGcsResource parses a resource of the form gs://BUCKET or gs://BUCKET/PREFIX.
+func parseGcsResource(resource string) (bucket string, prefix string, ok bool) {
+	if !strings.HasPrefix(resource, "gs://") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(resource, "gs://"), "/", 2)
+	if parts[0] == "" {
+		return "", "", false
+	}
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+	return parts[0], prefix, true
+}
+
+func (auth *Authenticator) addTokenExchangeRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("POST").Path("/exchange").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		if r.PostForm.Get("grant_type") != tokenExchangeGrantType {
+			writeOAuth2Error(w, "unsupported_grant_type")
+			return
+		}
+		if tokenType := r.PostForm.Get("subject_token_type"); tokenType != idTokenTokenType && tokenType != jwtTokenType {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		if tokenType := r.PostForm.Get("requested_token_type"); tokenType != "" && tokenType != accessTokenTokenType {
+			writeOAuth2Error(w, "invalid_request")
+			return
+		}
+		audience := r.PostForm.Get("audience")
+		if !auth.isTokenAudienceAllowed(audience) {
+			writeOAuth2Error(w, "invalid_target")
+			return
+		}
+		var tokenRequest GcsTokenRequest
+		resource := r.PostForm.Get("resource")
+		if resource != "" {
+			if audience != "" && audience != gcsTokenAudience {
+				writeOAuth2Error(w, "invalid_target")
+				return
+			}
+			var ok bool
+			if tokenRequest.Bucket, tokenRequest.Prefix, ok = parseGcsResource(resource); !ok {
+				writeOAuth2Error(w, "invalid_target")
+				return
+			}
+			tokenRequest.Mode = r.PostForm.Get("scope")
+			if !isValidMode(tokenRequest.Mode) {
+				writeOAuth2Error(w, "invalid_scope")
+				return
+			}
+		}
+		provider, identity, err := auth.validateExchangedIdToken(r.Context(), r.PostForm.Get("subject_token"))
+		if err != nil {
+			log.Printf("Rejected exchanged id_token: %v", err)
+			writeOAuth2Error(w, "invalid_grant")
+			return
+		}
+		allowed, err := auth.isLoginAllowed(r.Context(), provider, identity)
+		if err != nil {
+			log.Printf("Error checking whether %s may log in: %v", identity.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			writeOAuth2Error(w, "invalid_grant")
+			return
+		}
+		identity.qualify(provider.Name())
+		if err := auth.resolveAccountLinks(r.Context(), identity); err != nil {
+			log.Printf("Error resolving linked accounts for %s: %v", identity.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		// A second factor cannot be verified without an interactive login.
+		mfaRequired, err := auth.requiresMFA(r.Context(), identity.UserId)
+		if err != nil {
+			log.Printf("Error checking second factor for %s: %v", identity.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if mfaRequired {
+			writeOAuth2Error(w, "invalid_grant")
+			return
+		}
+		lifetime := auth.TokenLifetimes.CrossOriginLifetimeSeconds("")
+		userToken := auth.makeUserToken(identity, lifetime)
+		userToken.AuthTime = getAuthTime(identity)
+		userToken.Audience = audience
+		token := auth.EncodeClientToken(userToken)
+		response := map[string]interface{}{
+			"access_token":      token,
+			"issued_token_type": accessTokenTokenType,
+			"token_type":        "Bearer",
+			"expires_in":        lifetime,
+		}
+		if resource != "" {
+			tokenRequest.Token = token
+			tokenResponse, tokenErr := auth.issueGcsToken(r, "", tokenRequest, false)
+			if tokenErr != nil {
+				if tokenErr.status == http.StatusForbidden || tokenErr.status == http.StatusNotFound {
+					writeOAuth2Error(w, "invalid_target")
+					return
+				}
+				tokenErr.writeHeaders(w)
+				http.Error(w, tokenErr.message, tokenErr.status)
+				return
+			}
+			if tokenResponse.Public {
+				// Public buckets are read without an access token.
+				writeOAuth2Error(w, "invalid_target")
+				return
+			}
+			response["access_token"] = tokenResponse.Token
+			response["expires_in"] = tokenResponse.ExpiresIn
+			response["scope"] = strings.Join(tokenResponse.Permissions, " ")
+			log.Printf("AUDIT: %s exchanged id_token for access to %s", userToken.UserId, resource)
+		} else {
+			log.Printf("Issued exchanged token to %s", userToken.UserId)
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(response)
+	})
+}
@@ -0,0 +1,257 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type tokenLifetimesConfig struct {
+	// Lifetime of login sessions, as a duration string such as "12h".
+	CookieLifetime string `json:"cookieLifetime,omitempty"`
+
+	// Lifetime of tokens sent to client origins, as a duration string such as "15m".
+	CrossOriginLifetime string `json:"crossOriginLifetime,omitempty"`
+
+	Origins []originTokenLifetimesConfig `json:"origins,omitempty"`
+
+	Domains []domainTokenLifetimesConfig `json:"domains,omitempty"`
+}
+
+type originTokenLifetimesConfig struct {
+	// Regular expression matching the origins to which the lifetimes apply.
+	Origins string `json:"origins"`
+
+	CookieLifetime      string `json:"cookieLifetime,omitempty"`
+	CrossOriginLifetime string `json:"crossOriginLifetime,omitempty"`
+}
+
+type domainTokenLifetimesConfig struct {
+	// Email domains of the users to which the lifetime applies, including their subdomains.
+	Domains []string `json:"domains"`
+
+	CookieLifetime string `json:"cookieLifetime"`
+}
+
+type domainTokenLifetimes struct {
+	domains               []string
+	cookieLifetimeSeconds int64
+}
+
+type originTokenLifetimes struct {
+	originPattern *regexp.Regexp
+
+	// Lifetimes in seconds, or 0 to use the default.
+	cookieLifetimeSeconds      int64
+	crossOriginLifetimeSeconds int64
+}
+
+// TokenLifetimes specifies shorter lifetimes than MaxUserTokenCookieLifetimeSeconds and
+// MaxUserTokenCrossOriginLifetimeSeconds for login sessions and the tokens sent to client origins,
+// optionally depending on the client origin.  The first origin entry matching the origin applies.
+//
+// The cookie lifetime also limits the age of the login sessions from which tokens are issued, so
+// that users must log in again once it elapses.  The cookie lifetime of an origin applies to login
+// sessions initiated by the origin and to tokens issued to the origin.
+//
+// The cookie lifetime may also depend on the email domain of the user, e.g. to give staff longer
+// sessions than external users.  The first domain entry matching the user replaces the default
+// cookie lifetime, but not a shorter cookie lifetime of the origin.
+type TokenLifetimes struct {
+	cookieLifetimeSeconds      int64
+	crossOriginLifetimeSeconds int64
+	origins                    []originTokenLifetimes
+	domains                    []domainTokenLifetimes
+}
+
+// parseLifetime parses a lifetime no longer than maxSeconds, returning 0 if s is empty.
+func parseLifetime(s string, maxSeconds int64) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	seconds := int64(d.Seconds())
+	if seconds <= 0 || seconds > maxSeconds {
+		return 0, fmt.Errorf("Lifetime %q must be positive and at most %ds", s, maxSeconds)
+	}
+	return seconds, nil
+}
+
+// loadTokenLifetimes returns the lifetimes specified by TOKEN_LIFETIMES_PATH,
+// USER_TOKEN_COOKIE_LIFETIME and CROSS_ORIGIN_TOKEN_LIFETIME, or nil if the default lifetimes
+// apply.  The environment variables take precedence over the defaults in the file.
+func loadTokenLifetimes() (*TokenLifetimes, error) {
+	var config tokenLifetimesConfig
+	configPath, hasConfig := os.LookupEnv("TOKEN_LIFETIMES_PATH")
+	if hasConfig {
+		data, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading token lifetimes from %s: %w", configPath, err)
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("Error parsing token lifetimes from %s: %w", configPath, err)
+		}
+	}
+	config.CookieLifetime = getEnvOr("USER_TOKEN_COOKIE_LIFETIME", config.CookieLifetime)
+	config.CrossOriginLifetime = getEnvOr("CROSS_ORIGIN_TOKEN_LIFETIME", config.CrossOriginLifetime)
+	if !hasConfig && config.CookieLifetime == "" && config.CrossOriginLifetime == "" {
+		return nil, nil
+	}
+	lifetimes := &TokenLifetimes{}
+	var err error
+	if lifetimes.cookieLifetimeSeconds, err = parseLifetime(config.CookieLifetime, MaxUserTokenCookieLifetimeSeconds); err != nil {
+		return nil, fmt.Errorf("Invalid cookie lifetime: %w", err)
+	}
+	if lifetimes.crossOriginLifetimeSeconds, err = parseLifetime(config.CrossOriginLifetime, MaxUserTokenCrossOriginLifetimeSeconds); err != nil {
+		return nil, fmt.Errorf("Invalid cross-origin token lifetime: %w", err)
+	}
+	for _, originConfig := range config.Origins {
+		var origin originTokenLifetimes
+		if origin.originPattern, err = regexp.Compile(originConfig.Origins); err != nil {
+			return nil, fmt.Errorf("Invalid origin pattern %q: %w", originConfig.Origins, err)
+		}
+		if origin.cookieLifetimeSeconds, err = parseLifetime(originConfig.CookieLifetime, MaxUserTokenCookieLifetimeSeconds); err != nil {
+			return nil, fmt.Errorf("Invalid cookie lifetime for %q: %w", originConfig.Origins, err)
+		}
+		if origin.crossOriginLifetimeSeconds, err = parseLifetime(originConfig.CrossOriginLifetime, MaxUserTokenCrossOriginLifetimeSeconds); err != nil {
+			return nil, fmt.Errorf("Invalid cross-origin token lifetime for %q: %w", originConfig.Origins, err)
+		}
+		lifetimes.origins = append(lifetimes.origins, origin)
+	}
+	for _, domainConfig := range config.Domains {
+		domain := domainTokenLifetimes{domains: domainConfig.Domains}
+		if len(domain.domains) == 0 {
+			return nil, fmt.Errorf("Domain token lifetimes must specify domains")
+		}
+		if domain.cookieLifetimeSeconds, err = parseLifetime(domainConfig.CookieLifetime, MaxUserTokenCookieLifetimeSeconds); err != nil || domain.cookieLifetimeSeconds == 0 {
+			return nil, fmt.Errorf("Invalid cookie lifetime for %v: %v", domainConfig.Domains, err)
+		}
+		lifetimes.domains = append(lifetimes.domains, domain)
+	}
+	return lifetimes, nil
+}
+
+// getEmailDomain returns the lowercase domain of a user id that is an email address, or "".
+func getEmailDomain(userId string) string {
+	_, id := SplitUserId(userId)
+	i := strings.LastIndexByte(id, '@')
+	if i == -1 {
+		return ""
+	}
+	return strings.ToLower(id[i+1:])
+}
+
+func (l *TokenLifetimes) matchDomain(userId string) *domainTokenLifetimes {
+	userDomain := getEmailDomain(userId)
+	if userDomain == "" {
+		return nil
+	}
+	for i := range l.domains {
+		for _, domain := range l.domains[i].domains {
+			domain = strings.ToLower(domain)
+			if userDomain == domain || strings.HasSuffix(userDomain, "."+domain) {
+				return &l.domains[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (l *TokenLifetimes) matchOrigin(origin string) *originTokenLifetimes {
+	if origin == "" {
+		return nil
+	}
+	for i := range l.origins {
+		if l.origins[i].originPattern.MatchString(origin) {
+			return &l.origins[i]
+		}
+	}
+	return nil
+}
+
+// sessionLifetimeSeconds returns the configured lifetime of login sessions of userId initiated by
+// origin, or 0 if none is configured.  userId may be empty if the user is not known.
+func (l *TokenLifetimes) sessionLifetimeSeconds(origin string, userId string) int64 {
+	var originLifetime int64
+	if o := l.matchOrigin(origin); o != nil {
+		originLifetime = o.cookieLifetimeSeconds
+	}
+	if d := l.matchDomain(userId); d != nil {
+		if originLifetime != 0 && originLifetime < d.cookieLifetimeSeconds {
+			return originLifetime
+		}
+		return d.cookieLifetimeSeconds
+	}
+	if originLifetime != 0 {
+		return originLifetime
+	}
+	return l.cookieLifetimeSeconds
+}
+
+// CookieLifetimeSeconds returns the lifetime of login sessions initiated by origin, or by the
+// server itself if origin is empty.
+func (l *TokenLifetimes) CookieLifetimeSeconds(origin string) int64 {
+	return l.UserCookieLifetimeSeconds(origin, "")
+}
+
+// UserCookieLifetimeSeconds returns the lifetime of login sessions of userId initiated by origin,
+// or by the server itself if origin is empty.
+func (l *TokenLifetimes) UserCookieLifetimeSeconds(origin string, userId string) int64 {
+	if l == nil {
+		return MaxUserTokenCookieLifetimeSeconds
+	}
+	if lifetime := l.sessionLifetimeSeconds(origin, userId); lifetime != 0 {
+		return lifetime
+	}
+	return MaxUserTokenCookieLifetimeSeconds
+}
+
+// CrossOriginLifetimeSeconds returns the lifetime of tokens sent to origin, or of tokens not bound
+// to an origin if origin is empty.
+func (l *TokenLifetimes) CrossOriginLifetimeSeconds(origin string) int64 {
+	if l == nil {
+		return MaxUserTokenCrossOriginLifetimeSeconds
+	}
+	if o := l.matchOrigin(origin); o != nil && o.crossOriginLifetimeSeconds != 0 {
+		return o.crossOriginLifetimeSeconds
+	}
+	if l.crossOriginLifetimeSeconds != 0 {
+		return l.crossOriginLifetimeSeconds
+	}
+	return MaxUserTokenCrossOriginLifetimeSeconds
+}
+
+// AllowsSession returns false if the login session from which userToken derives is older than the
+// configured cookie lifetime of origin and the user, e.g. because it began before the lifetime was
+// shortened.  Sessions that began before login sessions recorded their issue time are considered
+// too old.
+func (l *TokenLifetimes) AllowsSession(userToken *UserToken, origin string) bool {
+	if l == nil {
+		return true
+	}
+	lifetime := l.sessionLifetimeSeconds(origin, userToken.UserId)
+	if lifetime == 0 {
+		return true
+	}
+	return userToken.IssuedAt+lifetime >= time.Now().Unix()
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// JWT user tokens: with USER_TOKEN_FORMAT=jwt, the tokens issued to clients are RS256-signed JWTs
+// rather than opaque tokens encrypted with the login session key, and the public key is published
+// at /.well-known/jwks.json, so that other backend services can verify ngauth sessions without
+// sharing the login session key.  Login cookies and form tokens, which are only used by ngauth
+// itself, remain encrypted.
+
+// UserTokenSigner signs and verifies JWT user tokens.
+type UserTokenSigner struct {
+	key    *rsa.PrivateKey
+	keyId  string
+	issuer string
+}
+
+// Claim holding the complete user token, so that it can be recovered exactly.
+const userTokenJwtClaim = "ngauth"
+
+func loadUserTokenSigner() (*UserTokenSigner, error) {
+	format := getEnvOr("USER_TOKEN_FORMAT", "hmac")
+	switch format {
+	case "hmac":
+		return nil, nil
+	case "jwt":
+	default:
+		return nil, fmt.Errorf("Invalid USER_TOKEN_FORMAT: %q", format)
+	}
+	keyPath := getEnvOr("USER_TOKEN_SIGNING_KEY_PATH", "secrets/user_token_signing_key.pem")
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading user token signing key from %s: %w", keyPath, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in %s", keyPath)
+	}
+	var key interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing user token signing key from %s: %w", keyPath, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("User token signing key in %s is not an RSA key", keyPath)
+	}
+	issuer, ok := os.LookupEnv("USER_TOKEN_ISSUER")
+	if !ok {
+		return nil, fmt.Errorf("USER_TOKEN_ISSUER must be specified when USER_TOKEN_FORMAT=jwt")
+	}
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keyHash := sha256.Sum256(publicKeyDer)
+	return &UserTokenSigner{
+		key:    rsaKey,
+		keyId:  base64url.EncodeToString(keyHash[:16]),
+		issuer: issuer,
+	}, nil
+}
+
+// jwtAudience returns the aud claim of a JWT user token.  Tokens for ngauth itself have the issuer
+// as their audience, since they have traditionally been accepted by any service that trusts ngauth,
+// while tokens for other services have the audience for which they were requested.
+func (s *UserTokenSigner) jwtAudience(userToken *UserToken) string {
+	if userToken.Audience == "" || userToken.Audience == gcsTokenAudience {
+		return s.issuer
+	}
+	return userToken.Audience
+}
+
+// Encode returns userToken as a signed JWT.
+func (s *UserTokenSigner) Encode(userToken UserToken) string {
+	claims := map[string]interface{}{
+		"iss":             s.issuer,
+		"aud":             s.jwtAudience(&userToken),
+		"sub":             userToken.UserId,
+		"iat":             time.Now().Unix(),
+		"exp":             userToken.Expires,
+		userTokenJwtClaim: userToken,
+	}
+	if userToken.Name != "" {
+		claims["name"] = userToken.Name
+	}
+	if userToken.Picture != "" {
+		claims["picture"] = userToken.Picture
+	}
+	if len(userToken.Groups) > 0 {
+		claims["groups"] = userToken.Groups
+	}
+	if userToken.DPoPKeyThumbprint != "" {
+		claims["cnf"] = map[string]string{"jkt": userToken.DPoPKeyThumbprint}
+	}
+	if userToken.TokenId != "" {
+		claims["jti"] = userToken.TokenId
+	}
+	return s.sign(claims)
+}
+
+// sign returns a JWT with the specified claims, signed by the key.
+func (s *UserTokenSigner) sign(claims map[string]interface{}) string {
+	// Json encoding cannot fail
+	headerJson, _ := json.Marshal(jwtHeader{Alg: "RS256", Kid: s.keyId, Typ: "JWT"})
+	claimsJson, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		// Signing with a valid key cannot fail
+		panic(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Decode verifies a JWT issued by Encode and returns the user token.
+func (s *UserTokenSigner) Decode(token string) (userToken UserToken, err error) {
+	claims, err := parseAndVerifyJwtWithKey(token, func(kid string) (crypto.PublicKey, error) {
+		if kid != s.keyId {
+			return nil, fmt.Errorf("Unknown key id: %q", kid)
+		}
+		return &s.key.PublicKey, nil
+	})
+	if err != nil {
+		return
+	}
+	// Re-encoding the verified claim cannot fail
+	encodedJson, _ := json.Marshal(claims[userTokenJwtClaim])
+	if err = json.Unmarshal(encodedJson, &userToken); err != nil {
+		return
+	}
+	if err = validateJwtClaims(claims, s.issuer, s.jwtAudience(&userToken)); err != nil {
+		return
+	}
+	if userToken.UserId == "" || userToken.Expires < time.Now().Unix() {
+		err = fmt.Errorf("Token expired")
+	}
+	return
+}
+
+// publicKeySet returns the JWKS containing the verification key.
+func (s *UserTokenSigner) publicKeySet() jsonWebKeySet {
+	return jsonWebKeySet{Keys: []jsonWebKey{{
+		Kty: "RSA",
+		Kid: s.keyId,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(s.key.PublicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.PublicKey.E)).Bytes()),
+	}}}
+}
+
+// EncodeClientToken returns the token issued to clients for userToken, in the format selected by
+// USER_TOKEN_FORMAT.
+func (auth *Authenticator) EncodeClientToken(userToken UserToken) string {
+	if userToken.Audience == "" {
+		userToken.Audience = gcsTokenAudience
+	}
+	if auth.UserTokenSigner != nil {
+		return auth.UserTokenSigner.Encode(userToken)
+	}
+	return EncodeUserToken(auth.ClientTokenKey, clientUserTokenType, userToken)
+}
+
+// DecodeClientToken decodes a token issued by EncodeClientToken, and checks that it has not been
+// revoked.  Encrypted tokens are accepted in either format, so that changing the format
+// does not invalidate existing sessions.
+func (auth *Authenticator) DecodeClientToken(ctx context.Context, token string) (userToken UserToken, err error) {
+	if auth.UserTokenSigner != nil && strings.Count(token, ".") == 2 {
+		userToken, err = auth.UserTokenSigner.Decode(token)
+	} else {
+		userToken, err = DecodeUserToken(auth.ClientTokenKey, clientUserTokenType, token)
+	}
+	if err == nil && auth.Revocations.IsRevoked(ctx, &userToken) {
+		err = fmt.Errorf("Token revoked")
+	}
+	return
+}
+
+func (auth *Authenticator) addUserTokenJwksRoutes(mux *gorilla_mux.Router) {
+	mux.Methods("GET").Path("/.well-known/jwks.json").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("access-control-allow-origin", "*")
+		w.Header().Set("cache-control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(auth.UserTokenSigner.publicKeySet())
+	})
+
+	// OpenID Connect discovery document, so that services that locate the keys of an issuer by
+	// discovery, e.g. AWS IAM OIDC providers, can verify user tokens.  With OPENID_PROVIDER=true,
+	// it also describes the endpoints used by relying parties.
+	mux.Methods("GET").Path("/.well-known/openid-configuration").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("access-control-allow-origin", "*")
+		w.Header().Set("cache-control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(auth.openIDConfiguration())
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+type UserInfoResponse struct {
+	UserId        string                 `json:"userId"`
+	Name          string                 `json:"name,omitempty"`
+	Picture       string                 `json:"picture,omitempty"`
+	LinkedUserIds []string               `json:"linkedUserIds,omitempty"`
+	Groups        []string               `json:"groups,omitempty"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+}
+
+func (auth *Authenticator) addUserInfoRoutes(mux *gorilla_mux.Router) {
+	// Describes the logged-in user, identified by an ngauth token in the Authorization header, an
+	// API key or personal access token, or the login session cookie.
+	mux.Methods("GET").Path("/userinfo").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("origin")
+		if origin != "" {
+			w.Header().Set("vary", "origin")
+			if !OriginPattern.MatchString(origin) || !auth.IsOriginAllowed(origin) {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("access-control-allow-origin", origin)
+			w.Header().Set("access-control-allow-credentials", "true")
+		}
+		userToken := auth.getUserTokenFromAuthorization(r)
+		if userToken == nil && r.Header.Get("authorization") == "" {
+			userToken = auth.getUserTokenFromCookie(r)
+		}
+		if userToken == nil || userToken.UserId == anonymousUserId {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		json.NewEncoder(w).Encode(UserInfoResponse{
+			UserId:        userToken.UserId,
+			Name:          userToken.Name,
+			Picture:       userToken.Picture,
+			LinkedUserIds: userToken.LinkedUserIds,
+			Groups:        userToken.Groups,
+			Claims:        userToken.Claims,
+		})
+	})
+}
@@ -0,0 +1,681 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	gorilla_mux "github.com/gorilla/mux"
+)
+
+// WebAuthn second factor.
+//
+// Users may register security keys or passkeys from the ngauth home page.  Once a user has
+// registered a credential, each subsequent login must be completed by verifying it, which marks
+// the UserToken as MFA-verified.  Buckets listed in MFA_REQUIRED_BUCKETS are only accessible
+// with an MFA-verified token.
+//
+// Only user presence is verified; attestation statements are not requested or checked.
+
+type webAuthnMFA struct {
+	rpID   string
+	rpName string
+	origin string
+
+	requiredBuckets map[string]bool
+}
+
+// IsRequired returns true if access to bucket requires an MFA-verified token.
+func (m *webAuthnMFA) IsRequired(bucket string) bool {
+	return m.requiredBuckets[bucket]
+}
+
+type webAuthnCredential struct {
+	ID []byte `json:"id"`
+
+	// PKIX-encoded public key.
+	PublicKey []byte `json:"publicKey"`
+
+	SignCount uint32 `json:"signCount"`
+}
+
+// webAuthnSession is a pending registration or login ceremony.
+type webAuthnSession struct {
+	Challenge []byte `json:"challenge"`
+	Expires   int64  `json:"expires"`
+}
+
+const webAuthnTimeout = 5 * time.Minute
+
+// COSE algorithm identifiers.
+const (
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+)
+
+const (
+	authenticatorFlagUserPresent   = 0x01
+	authenticatorFlagAttestedCreds = 0x40
+)
+
+func webAuthnCredentialsKey(userId string) string {
+	return "webauthn/credentials/" + userId
+}
+
+func webAuthnSessionKey(userId string) string {
+	return "webauthn/sessions/" + userId
+}
+
+func (auth *Authenticator) getWebAuthnCredentials(ctx context.Context, userId string) (credentials []webAuthnCredential, err error) {
+	err = auth.Store.Get(ctx, webAuthnCredentialsKey(userId), &credentials)
+	if err == errStoreNotFound {
+		err = nil
+	}
+	return
+}
+
+// requiresMFA returns true if the user must verify a second factor to complete login.
+func (auth *Authenticator) requiresMFA(ctx context.Context, userId string) (bool, error) {
+	if auth.MFA == nil {
+		return false, nil
+	}
+	credentials, err := auth.getWebAuthnCredentials(ctx, userId)
+	return len(credentials) > 0, err
+}
+
+var base64url = base64.RawURLEncoding
+
+type webAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+func credentialDescriptors(credentials []webAuthnCredential) []webAuthnCredentialDescriptor {
+	descriptors := []webAuthnCredentialDescriptor{}
+	for _, credential := range credentials {
+		descriptors = append(descriptors, webAuthnCredentialDescriptor{Type: "public-key", ID: base64url.EncodeToString(credential.ID)})
+	}
+	return descriptors
+}
+
+// registrationOptions returns the argument to navigator.credentials.create.
+func (m *webAuthnMFA) registrationOptions(userId string, challenge []byte, credentials []webAuthnCredential) interface{} {
+	// The user handle is limited to 64 bytes.
+	userHandle := sha256.Sum256([]byte(userId))
+	return map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"rp": map[string]string{"id": m.rpID, "name": m.rpName},
+			"user": map[string]string{
+				"id":          base64url.EncodeToString(userHandle[:]),
+				"name":        userId,
+				"displayName": userId,
+			},
+			"challenge": base64url.EncodeToString(challenge),
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": coseAlgES256},
+				{"type": "public-key", "alg": coseAlgRS256},
+			},
+			"timeout":     webAuthnTimeout.Milliseconds(),
+			"attestation": "none",
+			// Prevent registering the same authenticator twice.
+			"excludeCredentials": credentialDescriptors(credentials),
+			"authenticatorSelection": map[string]string{
+				"userVerification": "discouraged",
+			},
+		},
+	}
+}
+
+// loginOptions returns the argument to navigator.credentials.get.
+func (m *webAuthnMFA) loginOptions(challenge []byte, credentials []webAuthnCredential) interface{} {
+	return map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"rpId":             m.rpID,
+			"challenge":        base64url.EncodeToString(challenge),
+			"timeout":          webAuthnTimeout.Milliseconds(),
+			"allowCredentials": credentialDescriptors(credentials),
+			"userVerification": "discouraged",
+		},
+	}
+}
+
+// webAuthnResponse is a PublicKeyCredential encoded by webAuthnScript.
+type webAuthnResponse struct {
+	RawID    string `json:"rawId"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	} `json:"response"`
+}
+
+// verifyClientData checks the client data of a ceremony response.
+func (m *webAuthnMFA) verifyClientData(clientDataJSON []byte, ceremonyType string, challenge []byte) error {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return err
+	}
+	if clientData.Type != ceremonyType {
+		return fmt.Errorf("Unexpected client data type %q", clientData.Type)
+	}
+	if clientData.Challenge != base64url.EncodeToString(challenge) {
+		return fmt.Errorf("Challenge mismatch")
+	}
+	if clientData.Origin != m.origin {
+		return fmt.Errorf("Unexpected origin %q", clientData.Origin)
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	flags     byte
+	signCount uint32
+
+	// Only present for registration.
+	credentialID        []byte
+	credentialPublicKey []byte
+}
+
+func (m *webAuthnMFA) parseAuthenticatorData(data []byte) (authData authenticatorData, err error) {
+	if len(data) < 37 {
+		err = fmt.Errorf("Authenticator data too short")
+		return
+	}
+	rpIDHash := sha256.Sum256([]byte(m.rpID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		err = fmt.Errorf("Relying party id mismatch")
+		return
+	}
+	authData.flags = data[32]
+	authData.signCount = binary.BigEndian.Uint32(data[33:37])
+	if authData.flags&authenticatorFlagUserPresent == 0 {
+		err = fmt.Errorf("User not present")
+		return
+	}
+	if authData.flags&authenticatorFlagAttestedCreds == 0 {
+		return
+	}
+	rest := data[37:]
+	// Skip the AAGUID.
+	if len(rest) < 18 {
+		err = fmt.Errorf("Attested credential data too short")
+		return
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		err = fmt.Errorf("Attested credential data too short")
+		return
+	}
+	authData.credentialID = rest[:idLength]
+	// The public key is followed by extensions, if any, so decode just the first CBOR item.
+	var publicKey cbor.RawMessage
+	decoder := cbor.NewDecoder(bytes.NewReader(rest[idLength:]))
+	if err = decoder.Decode(&publicKey); err != nil {
+		return
+	}
+	authData.credentialPublicKey = publicKey
+	return
+}
+
+// parseCOSEKey converts a COSE_Key to a PKIX-encoded public key.
+func parseCOSEKey(encoded []byte) ([]byte, error) {
+	var key map[int]interface{}
+	if err := cbor.Unmarshal(encoded, &key); err != nil {
+		return nil, err
+	}
+	alg, _ := key[3].(int64)
+	var publicKey interface{}
+	switch alg {
+	case coseAlgES256:
+		x, _ := key[-2].([]byte)
+		y, _ := key[-3].([]byte)
+		if crv, _ := key[-1].(uint64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("Invalid ES256 key")
+		}
+		ecKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !ecKey.Curve.IsOnCurve(ecKey.X, ecKey.Y) {
+			return nil, fmt.Errorf("Invalid ES256 key")
+		}
+		publicKey = ecKey
+	case coseAlgRS256:
+		n, _ := key[-1].([]byte)
+		e, _ := key[-2].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("Invalid RS256 key")
+		}
+		publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	default:
+		return nil, fmt.Errorf("Unsupported key algorithm %d", alg)
+	}
+	return x509.MarshalPKIXPublicKey(publicKey)
+}
+
+func (m *webAuthnMFA) verifyRegistration(response *webAuthnResponse, challenge []byte) (*webAuthnCredential, error) {
+	clientDataJSON, err := base64url.DecodeString(response.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+	encodedAttestation, err := base64url.DecodeString(response.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	var attestation struct {
+		AuthData []byte `cbor:"authData"`
+	}
+	if err := cbor.Unmarshal(encodedAttestation, &attestation); err != nil {
+		return nil, err
+	}
+	authData, err := m.parseAuthenticatorData(attestation.AuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.credentialID == nil {
+		return nil, fmt.Errorf("Missing attested credential data")
+	}
+	publicKey, err := parseCOSEKey(authData.credentialPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &webAuthnCredential{
+		ID:        authData.credentialID,
+		PublicKey: publicKey,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// verifyAssertion checks a login response, and updates the signature counter of the credential
+// that was used.
+func (m *webAuthnMFA) verifyAssertion(response *webAuthnResponse, challenge []byte, credentials []webAuthnCredential) error {
+	credentialID, err := base64url.DecodeString(response.RawID)
+	if err != nil {
+		return err
+	}
+	var credential *webAuthnCredential
+	for i := range credentials {
+		if bytes.Equal(credentials[i].ID, credentialID) {
+			credential = &credentials[i]
+		}
+	}
+	if credential == nil {
+		return fmt.Errorf("Unknown credential")
+	}
+	clientDataJSON, err := base64url.DecodeString(response.Response.ClientDataJSON)
+	if err != nil {
+		return err
+	}
+	if err := m.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return err
+	}
+	rawAuthData, err := base64url.DecodeString(response.Response.AuthenticatorData)
+	if err != nil {
+		return err
+	}
+	authData, err := m.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return err
+	}
+	signature, err := base64url.DecodeString(response.Response.Signature)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signedHash := sha256.Sum256(append(rawAuthData, clientDataHash[:]...))
+	publicKey, err := x509.ParsePKIXPublicKey(credential.PublicKey)
+	if err != nil {
+		return err
+	}
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, signedHash[:], signature) {
+			return fmt.Errorf("Invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, signedHash[:], signature); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unsupported public key type")
+	}
+	// Authenticators that implement a signature counter must increase it on every use; otherwise
+	// the credential may have been cloned.
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return fmt.Errorf("Signature counter did not increase")
+	}
+	credential.SignCount = authData.signCount
+	return nil
+}
+
+// startWebAuthnSession records a new challenge for the user.
+func (auth *Authenticator) startWebAuthnSession(ctx context.Context, userId string) ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	session := webAuthnSession{Challenge: challenge, Expires: time.Now().Add(webAuthnTimeout).Unix()}
+	if err := auth.Store.Put(ctx, webAuthnSessionKey(userId), session); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// takeWebAuthnSession retrieves and deletes the pending challenge for the user.
+func (auth *Authenticator) takeWebAuthnSession(ctx context.Context, userId string) ([]byte, error) {
+	key := webAuthnSessionKey(userId)
+	var session webAuthnSession
+	if err := auth.Store.Get(ctx, key, &session); err != nil {
+		return nil, err
+	}
+	if err := auth.Store.Delete(ctx, key); err != nil {
+		return nil, err
+	}
+	if session.Expires < time.Now().Unix() {
+		return nil, fmt.Errorf("WebAuthn request expired")
+	}
+	return session.Challenge, nil
+}
+
+// Converts between the JSON encoding of WebAuthn options and responses and the
+// ArrayBuffer-valued objects used by the browser API.
+const webAuthnScript = `<script>
+function decodeBase64(s) {
+  s = s.replace(/-/g, '+').replace(/_/g, '/');
+  return Uint8Array.from(atob(s), c => c.charCodeAt(0));
+}
+function encodeBase64(buffer) {
+  if (!buffer) return undefined;
+  return btoa(String.fromCharCode(...new Uint8Array(buffer)))
+      .replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+function decodeOptions(options) {
+  const publicKey = options.publicKey;
+  publicKey.challenge = decodeBase64(publicKey.challenge);
+  if (publicKey.user) publicKey.user.id = decodeBase64(publicKey.user.id);
+  for (const c of publicKey.allowCredentials || []) c.id = decodeBase64(c.id);
+  for (const c of publicKey.excludeCredentials || []) c.id = decodeBase64(c.id);
+  return options;
+}
+function encodeCredential(credential) {
+  const response = {};
+  for (const key of ['clientDataJSON', 'attestationObject', 'authenticatorData', 'signature']) {
+    response[key] = encodeBase64(credential.response[key]);
+  }
+  return JSON.stringify({
+    id: credential.id,
+    rawId: encodeBase64(credential.rawId),
+    type: credential.type,
+    response: response,
+  });
+}
+async function webAuthnCeremony(path, operation, query = '') {
+  let response = await fetch(path + '/begin', {method: 'POST', credentials: 'same-origin'});
+  if (!response.ok) throw new Error(await response.text());
+  const credential = await operation(decodeOptions(await response.json()));
+  response = await fetch(path + '/finish' + query, {method: 'POST', credentials: 'same-origin', body: encodeCredential(credential)});
+  if (!response.ok) throw new Error(await response.text());
+  return response;
+}
+</script>
+`
+
+// writeWebAuthnRegistration writes the home page section for registering credentials.
+func (auth *Authenticator) writeWebAuthnRegistration(w http.ResponseWriter, r *http.Request, userToken *UserToken) {
+	credentials, err := auth.getWebAuthnCredentials(r.Context(), userToken.UserId)
+	if err != nil {
+		log.Printf("Error reading WebAuthn credentials for %s: %v", userToken.UserId, err)
+		return
+	}
+	fmt.Fprintf(w, `<p>Registered security keys: %d</p>
+<button id="register">Register security key</button> <span id="status"></span>
+%s<script>
+document.getElementById('register').addEventListener('click', async () => {
+  const status = document.getElementById('status');
+  try {
+    await webAuthnCeremony('/webauthn/register', options => navigator.credentials.create(options));
+    location.reload();
+  } catch (e) {
+    status.textContent = e.message;
+  }
+});
+</script>
+`, len(credentials), webAuthnScript)
+}
+
+func (auth *Authenticator) addWebAuthnRoutes(mux *gorilla_mux.Router) {
+	// Returns the logged-in user and their credentials, or writes an error response.  Unless
+	// forLogin is true, a login session that has already verified a second factor is required if
+	// the user has any credentials.
+	getUser := func(w http.ResponseWriter, r *http.Request, forLogin bool) (*UserToken, []webAuthnCredential) {
+		userToken := auth.getUserTokenFromCookie(r)
+		if userToken == nil {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return nil, nil
+		}
+		credentials, err := auth.getWebAuthnCredentials(r.Context(), userToken.UserId)
+		if err != nil {
+			log.Printf("Error reading WebAuthn credentials for %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return nil, nil
+		}
+		if forLogin && len(credentials) == 0 {
+			http.Error(w, "No registered security keys", http.StatusBadRequest)
+			return nil, nil
+		}
+		if !forLogin && len(credentials) > 0 && !userToken.MFA {
+			http.Error(w, "Second factor required", http.StatusForbidden)
+			return nil, nil
+		}
+		return userToken, credentials
+	}
+
+	begin := func(forLogin bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			userToken, credentials := getUser(w, r, forLogin)
+			if userToken == nil {
+				return
+			}
+			challenge, err := auth.startWebAuthnSession(r.Context(), userToken.UserId)
+			if err != nil {
+				log.Printf("Error starting WebAuthn request for %s: %v", userToken.UserId, err)
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+			var options interface{}
+			if forLogin {
+				options = auth.MFA.loginOptions(challenge, credentials)
+			} else {
+				options = auth.MFA.registrationOptions(userToken.UserId, challenge, credentials)
+			}
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(options)
+		}
+	}
+
+	// Verifies the ceremony response and stores the updated credentials.
+	finish := func(w http.ResponseWriter, r *http.Request, forLogin bool) (*UserToken, bool) {
+		userToken, credentials := getUser(w, r, forLogin)
+		if userToken == nil {
+			return nil, false
+		}
+		var response webAuthnResponse
+		if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+			http.Error(w, "Invalid WebAuthn response", http.StatusBadRequest)
+			return nil, false
+		}
+		challenge, err := auth.takeWebAuthnSession(r.Context(), userToken.UserId)
+		if err != nil {
+			http.Error(w, "No pending WebAuthn request", http.StatusBadRequest)
+			return nil, false
+		}
+		if forLogin {
+			err = auth.MFA.verifyAssertion(&response, challenge, credentials)
+		} else {
+			var credential *webAuthnCredential
+			credential, err = auth.MFA.verifyRegistration(&response, challenge)
+			if err == nil {
+				credentials = append(credentials, *credential)
+			}
+		}
+		if err != nil {
+			log.Printf("WebAuthn verification failed for %s: %v", userToken.UserId, err)
+			http.Error(w, "Verification failed", http.StatusUnauthorized)
+			return nil, false
+		}
+		if err := auth.Store.Put(r.Context(), webAuthnCredentialsKey(userToken.UserId), credentials); err != nil {
+			log.Printf("Error storing WebAuthn credentials for %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return nil, false
+		}
+		// The user has just demonstrated possession of a credential.
+		userToken.MFA = true
+		userToken.AuthTime = time.Now().Unix()
+		if err := auth.setUserTokenCookie(w, r, *userToken); err != nil {
+			log.Printf("Error setting login session of %s: %v", userToken.UserId, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return nil, false
+		}
+		return userToken, true
+	}
+
+	mux.Methods("POST").Path("/webauthn/register/begin").HandlerFunc(begin(false))
+
+	mux.Methods("POST").Path("/webauthn/register/finish").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := finish(w, r, false); ok {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	mux.Methods("POST").Path("/webauthn/login/begin").HandlerFunc(begin(true))
+
+	mux.Methods("POST").Path("/webauthn/login/finish").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Client origin to which /mfa sends the token.
+		origin := r.URL.Query().Get("origin")
+		if origin != "" && !auth.IsOriginAllowed(origin) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		userToken, ok := finish(w, r, true)
+		if !ok {
+			return
+		}
+		if !auth.OriginPolicies.AllowsOrigin(userToken, origin) {
+			http.Error(w, "Origin not allowed for user", http.StatusForbidden)
+			return
+		}
+		tempUserToken := auth.makeTemporaryUserToken(*userToken, origin)
+		tempUserToken.Origin = origin
+		tempUserToken.Audience = gcsTokenAudience
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"token": auth.EncodeClientToken(tempUserToken),
+		})
+	})
+
+	mux.Methods("GET").Path("/mfa").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.URL.Query().Get("origin")
+		if !auth.IsOriginAllowed(origin) {
+			origin = ""
+		}
+		if userToken := auth.getUserTokenFromCookie(r); userToken != nil && !auth.OriginPolicies.AllowsOrigin(userToken, origin) {
+			origin = ""
+		}
+		returnPath := r.URL.Query().Get("return")
+		if !isLocalPath(returnPath) {
+			returnPath = "/"
+		}
+		jsonOrigin, err := json.Marshal(origin)
+		if err != nil {
+			panic(err)
+		}
+		jsonReturnPath, err := json.Marshal(returnPath)
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Add("x-frame-options", "deny")
+		w.Header().Add("content-type", "text/html")
+		fmt.Fprintf(w, `<html><head><title>Verify security key</title></head><body>
+<p>Verify your security key to complete login.</p>
+<button id="verify">Verify</button> <span id="status"></span>
+%s<script>
+const origin = %s;
+const returnPath = %s;
+async function verify() {
+  const status = document.getElementById('status');
+  try {
+    const response = await webAuthnCeremony('/webauthn/login', options => navigator.credentials.get(options),
+                                            origin ? '?origin=' + encodeURIComponent(origin) : '');
+    const token = await response.json();
+    if (origin) {
+      window.opener.postMessage(token, origin);
+      window.close();
+    } else {
+      location.href = returnPath;
+    }
+  } catch (e) {
+    status.textContent = e.message;
+  }
+}
+document.getElementById('verify').addEventListener('click', verify);
+verify();
+</script>
+</body></html>`, webAuthnScript, jsonOrigin, jsonReturnPath)
+	})
+}
+
+// makeWebAuthnMFA returns the WebAuthn configuration, or nil if WEBAUTHN_RP_ID is not set.
+func makeWebAuthnMFA() (*webAuthnMFA, error) {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		return nil, nil
+	}
+	m := &webAuthnMFA{
+		rpID:            rpID,
+		rpName:          getEnvOr("WEBAUTHN_RP_DISPLAY_NAME", "ngauth"),
+		origin:          getEnvOr("WEBAUTHN_RP_ORIGIN", "https://"+rpID),
+		requiredBuckets: make(map[string]bool),
+	}
+	if buckets := os.Getenv("MFA_REQUIRED_BUCKETS"); buckets != "" {
+		for _, bucket := range strings.Split(buckets, ",") {
+			m.requiredBuckets[strings.TrimSpace(bucket)] = true
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 Google Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	testWebAuthnRPID   = "ngauth.example.org"
+	testWebAuthnOrigin = "https://ngauth.example.org"
+)
+
+var testWebAuthnCredentialID = []byte("test-credential")
+
+func makeTestWebAuthnMFA() *webAuthnMFA {
+	return &webAuthnMFA{rpID: testWebAuthnRPID, rpName: "ngauth", origin: testWebAuthnOrigin}
+}
+
+func generateTestWebAuthnKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testAuthenticatorData holds the fields of authenticator data that the tests vary.
+type testAuthenticatorData struct {
+	rpID      string
+	flags     byte
+	signCount uint32
+
+	// COSE_Key of the attested credential, or nil if there is no attested credential data.
+	publicKey []byte
+}
+
+func (d testAuthenticatorData) encode() []byte {
+	rpIDHash := sha256.Sum256([]byte(d.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, d.flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:37], d.signCount)
+	if d.publicKey != nil {
+		// AAGUID, credential id length and credential id.
+		data = append(data, make([]byte, 16)...)
+		data = append(data, 0, byte(len(testWebAuthnCredentialID)))
+		data = append(data, testWebAuthnCredentialID...)
+		data = append(data, d.publicKey...)
+	}
+	return data
+}
+
+func encodeTestCOSEKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	coordinate := func(v []byte) []byte {
+		return append(make([]byte, 32-len(v)), v...)
+	}
+	encoded, err := cbor.Marshal(map[int]interface{}{
+		1:  2,
+		3:  coseAlgES256,
+		-1: 1,
+		-2: coordinate(key.X.Bytes()),
+		-3: coordinate(key.Y.Bytes()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func encodeTestClientData(ceremonyType string, challenge []byte, origin string) []byte {
+	// Json encoding cannot fail
+	encoded, _ := json.Marshal(map[string]string{
+		"type":      ceremonyType,
+		"challenge": base64url.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	return encoded
+}
+
+func TestWebAuthnVerifyRegistration(t *testing.T) {
+	m := makeTestWebAuthnMFA()
+	key := generateTestWebAuthnKey(t)
+	challenge := []byte("registration challenge")
+	validAuthData := testAuthenticatorData{
+		rpID:      testWebAuthnRPID,
+		flags:     authenticatorFlagUserPresent | authenticatorFlagAttestedCreds,
+		publicKey: encodeTestCOSEKey(t, key),
+	}
+
+	tests := []struct {
+		name         string
+		ceremonyType string
+		challenge    []byte
+		origin       string
+		modify       func(*testAuthenticatorData)
+
+		// Expected error, or "" if the response is valid.
+		err string
+	}{
+		{name: "valid"},
+		{name: "wrong rpIdHash", modify: func(d *testAuthenticatorData) { d.rpID = "evil.example.org" }, err: "Relying party id mismatch"},
+		{name: "user not present", modify: func(d *testAuthenticatorData) { d.flags &^= authenticatorFlagUserPresent }, err: "User not present"},
+		{name: "no attested credential", modify: func(d *testAuthenticatorData) { d.flags &^= authenticatorFlagAttestedCreds }, err: "Missing attested credential data"},
+		{name: "wrong challenge", challenge: []byte("other challenge"), err: "Challenge mismatch"},
+		{name: "wrong origin", origin: "https://evil.example.org", err: "Unexpected origin"},
+		{name: "login response", ceremonyType: "webauthn.get", err: "Unexpected client data type"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authData := validAuthData
+			if test.modify != nil {
+				test.modify(&authData)
+			}
+			ceremonyType, responseChallenge, origin := "webauthn.create", challenge, testWebAuthnOrigin
+			if test.ceremonyType != "" {
+				ceremonyType = test.ceremonyType
+			}
+			if test.challenge != nil {
+				responseChallenge = test.challenge
+			}
+			if test.origin != "" {
+				origin = test.origin
+			}
+			attestationObject, err := cbor.Marshal(map[string]interface{}{
+				"fmt":      "none",
+				"attStmt":  map[string]interface{}{},
+				"authData": authData.encode(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var response webAuthnResponse
+			response.RawID = base64url.EncodeToString(testWebAuthnCredentialID)
+			response.Response.ClientDataJSON = base64url.EncodeToString(encodeTestClientData(ceremonyType, responseChallenge, origin))
+			response.Response.AttestationObject = base64url.EncodeToString(attestationObject)
+			credential, err := m.verifyRegistration(&response, challenge)
+			if test.err != "" {
+				if err == nil {
+					t.Fatalf("Expected error %q, got credential", test.err)
+				}
+				if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error %q, got %q", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(credential.ID) != string(testWebAuthnCredentialID) {
+				t.Errorf("Got credential id %q, expected %q", credential.ID, testWebAuthnCredentialID)
+			}
+			expectedPublicKey, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			if string(credential.PublicKey) != string(expectedPublicKey) {
+				t.Errorf("Public key does not match the registered key")
+			}
+		})
+	}
+}
+
+func TestWebAuthnVerifyAssertion(t *testing.T) {
+	m := makeTestWebAuthnMFA()
+	key := generateTestWebAuthnKey(t)
+	otherKey := generateTestWebAuthnKey(t)
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := []byte("login challenge")
+
+	tests := []struct {
+		name string
+
+		// Signature counter of the stored credential and of the response.
+		storedSignCount uint32
+		signCount       uint32
+
+		rpID         string
+		ceremonyType string
+		challenge    []byte
+		credentialID []byte
+		signingKey   *ecdsa.PrivateKey
+
+		// Modifies the authenticator data after it is signed.
+		tamper func(authData []byte)
+
+		// Expected error, or "" if the response is valid.
+		err string
+	}{
+		{name: "valid", storedSignCount: 4, signCount: 5},
+		{name: "valid without signature counter"},
+		{name: "sign counter not increased", storedSignCount: 5, signCount: 5, err: "Signature counter did not increase"},
+		{name: "sign counter decreased", storedSignCount: 5, signCount: 3, err: "Signature counter did not increase"},
+		{name: "sign counter reset to zero", storedSignCount: 5, signCount: 0, err: "Signature counter did not increase"},
+		{name: "wrong rpIdHash", storedSignCount: 4, signCount: 5, rpID: "evil.example.org", err: "Relying party id mismatch"},
+		{name: "signed by another key", storedSignCount: 4, signCount: 5, signingKey: otherKey, err: "Invalid signature"},
+		{
+			name:            "authenticator data modified after signing",
+			storedSignCount: 4,
+			signCount:       5,
+			tamper:          func(authData []byte) { binary.BigEndian.PutUint32(authData[33:37], 100) },
+			err:             "Invalid signature",
+		},
+		{name: "wrong challenge", challenge: []byte("other challenge"), err: "Challenge mismatch"},
+		{name: "registration response", ceremonyType: "webauthn.create", err: "Unexpected client data type"},
+		{name: "unknown credential", credentialID: []byte("other-credential"), err: "Unknown credential"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rpID, ceremonyType, responseChallenge, credentialID, signingKey := testWebAuthnRPID, "webauthn.get", challenge, testWebAuthnCredentialID, key
+			if test.rpID != "" {
+				rpID = test.rpID
+			}
+			if test.ceremonyType != "" {
+				ceremonyType = test.ceremonyType
+			}
+			if test.challenge != nil {
+				responseChallenge = test.challenge
+			}
+			if test.credentialID != nil {
+				credentialID = test.credentialID
+			}
+			if test.signingKey != nil {
+				signingKey = test.signingKey
+			}
+			authData := testAuthenticatorData{rpID: rpID, flags: authenticatorFlagUserPresent, signCount: test.signCount}.encode()
+			clientDataJSON := encodeTestClientData(ceremonyType, responseChallenge, testWebAuthnOrigin)
+			clientDataHash := sha256.Sum256(clientDataJSON)
+			signedHash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+			signature, err := ecdsa.SignASN1(rand.Reader, signingKey, signedHash[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.tamper != nil {
+				test.tamper(authData)
+			}
+			var response webAuthnResponse
+			response.RawID = base64url.EncodeToString(credentialID)
+			response.Response.ClientDataJSON = base64url.EncodeToString(clientDataJSON)
+			response.Response.AuthenticatorData = base64url.EncodeToString(authData)
+			response.Response.Signature = base64url.EncodeToString(signature)
+			credentials := []webAuthnCredential{{ID: testWebAuthnCredentialID, PublicKey: publicKey, SignCount: test.storedSignCount}}
+			err = m.verifyAssertion(&response, challenge, credentials)
+			if test.err != "" {
+				if err == nil {
+					t.Fatalf("Expected error %q", test.err)
+				}
+				if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error %q, got %q", test.err, err)
+				}
+				if credentials[0].SignCount != test.storedSignCount {
+					t.Errorf("Signature counter updated to %d by rejected response", credentials[0].SignCount)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if credentials[0].SignCount != test.signCount {
+				t.Errorf("Got signature counter %d, expected %d", credentials[0].SignCount, test.signCount)
+			}
+		})
+	}
+}
@@ -14,11 +14,11 @@
  * limitations under the License.
  */
 
-import {CredentialsProvider, makeCredentialsGetter} from 'neuroglancer/credentials_provider';
-import {fetchWithCredentials} from 'neuroglancer/credentials_provider/http_request';
+import {CredentialsProvider, CredentialsWithGeneration, makeCredentialsGetter} from 'neuroglancer/credentials_provider';
 import {OAuth2Credentials} from 'neuroglancer/credentials_provider/oauth2';
 import {StatusMessage} from 'neuroglancer/status';
-import {HttpError, responseJson} from 'neuroglancer/util/http_request';
+import {CancellationToken} from 'neuroglancer/util/cancellation';
+import {HttpError} from 'neuroglancer/util/http_request';
 import {verifyObject, verifyObjectProperty, verifyString} from 'neuroglancer/util/json';
 
 function makeOriginError(serverUrl: string): Error {
@@ -29,9 +29,82 @@ function makeOriginError(serverUrl: string): Error {
 
 export interface Credentials {
   token: string;
+  /**
+   * Whether the token is bound to the DPoP key of this page, and must be sent with a proof of
+   * possession of the key.
+   */
+  dpop?: boolean;
 }
 
-async function waitForLogin(serverUrl: string): Promise<Credentials> {
+function base64UrlEncode(data: ArrayBuffer|Uint8Array|string): string {
+  const bytes = typeof data === 'string' ? new TextEncoder().encode(data) : new Uint8Array(data);
+  let s = '';
+  for (let i = 0; i < bytes.length; ++i) {
+    s += String.fromCharCode(bytes[i]);
+  }
+  return btoa(s).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+let dpopKeyPair: Promise<CryptoKeyPair|undefined>|undefined;
+
+/**
+ * Returns the key pair to which ngauth servers bind the tokens issued to this page, as specified by
+ * RFC 9449, or `undefined` if Web Crypto is unavailable.  The private key is not extractable, so a
+ * token leaked from the page cannot be used elsewhere.
+ */
+function getDpopKeyPair() {
+  if (dpopKeyPair === undefined) {
+    dpopKeyPair = (async () => {
+      try {
+        return await crypto.subtle.generateKey(
+            {name: 'ECDSA', namedCurve: 'P-256'}, /*extractable=*/ false, ['sign']);
+      } catch (e) {
+        return undefined;
+      }
+    })();
+  }
+  return dpopKeyPair;
+}
+
+/**
+ * Returns a DPoP proof for a request, bound to `token` if specified.
+ */
+async function makeDpopProof(method: string, url: string, token?: string) {
+  const keyPair = await getDpopKeyPair();
+  if (keyPair === undefined) return undefined;
+  const {kty, crv, x, y} = await crypto.subtle.exportKey('jwk', keyPair.publicKey);
+  const header = {typ: 'dpop+jwt', alg: 'ES256', jwk: {kty, crv, x, y}};
+  const payload: {[key: string]: string|number} = {
+    jti: base64UrlEncode(crypto.getRandomValues(new Uint8Array(16))),
+    htm: method,
+    htu: url,
+    iat: Math.floor(Date.now() / 1000),
+  };
+  if (token !== undefined) {
+    payload['ath'] =
+        base64UrlEncode(await crypto.subtle.digest('SHA-256', new TextEncoder().encode(token)));
+  }
+  const signingInput =
+      `${base64UrlEncode(JSON.stringify(header))}.${base64UrlEncode(JSON.stringify(payload))}`;
+  const signature = await crypto.subtle.sign(
+      {name: 'ECDSA', hash: 'SHA-256'}, keyPair.privateKey, new TextEncoder().encode(signingInput));
+  return `${signingInput}.${base64UrlEncode(signature)}`;
+}
+
+/**
+ * Sends a request for a GCS access token, with a DPoP proof if the token is bound to a key.
+ */
+async function postWithToken(url: string, credentials: Credentials, body: any) {
+  const headers: {[key: string]: string} = {};
+  if (credentials.dpop) {
+    const proof = await makeDpopProof('POST', url, credentials.token);
+    if (proof !== undefined) headers['DPoP'] = proof;
+  }
+  return await fetch(
+      url, {method: 'POST', headers, body: JSON.stringify({...body, token: credentials.token})});
+}
+
+async function waitForLogin(serverUrl: string, freshLogin = false): Promise<Credentials> {
   let status = new StatusMessage(/*delay=*/ false);
   function writeLoginStatus(message: string, buttonMessage: string) {
     status.element.textContent = message + ' ';
@@ -39,7 +112,9 @@ async function waitForLogin(serverUrl: string): Promise<Credentials> {
     button.textContent = buttonMessage;
     status.element.appendChild(button);
     button.addEventListener('click', () => {
-      window.open(`${serverUrl}/login?origin=${encodeURIComponent(self.origin)}`);
+      window.open(
+          `${serverUrl}/login?origin=${encodeURIComponent(self.origin)}` +
+          (freshLogin ? '&prompt=login' : ''));
       writeLoginStatus(`Waiting for login to ngauth server ${serverUrl}...`, 'Retry');
     });
   }
@@ -68,7 +143,10 @@ async function waitForLogin(serverUrl: string): Promise<Credentials> {
     }
     window.addEventListener('message', messageHandler, false);
   });
-  writeLoginStatus(`ngauth server ${serverUrl} login required.`, 'Login');
+  writeLoginStatus(
+      freshLogin ? `ngauth server ${serverUrl} requires you to log in again.` :
+                   `ngauth server ${serverUrl} login required.`,
+      'Login');
   try {
     return {token: await messagePromise};
   } finally {
@@ -77,14 +155,38 @@ async function waitForLogin(serverUrl: string): Promise<Credentials> {
 }
 
 export class NgauthCredentialsProvider extends CredentialsProvider<Credentials> {
+  /**
+   * Set when a bucket requires a more recent login than that of the existing session.
+   */
+  freshLoginRequired = false;
+  /**
+   * Set to `false` if the server does not accept DPoP proofs.
+   */
+  private dpopSupported = true;
   constructor(public serverUrl: string) {
     super();
   }
   get = makeCredentialsGetter(async () => {
-    let response = await fetch(`${this.serverUrl}/token`, {method: 'POST', credentials: 'include'});
+    if (this.freshLoginRequired) {
+      this.freshLoginRequired = false;
+      return await waitForLogin(this.serverUrl, /*freshLogin=*/ true);
+    }
+    const url = `${this.serverUrl}/token`;
+    const proof = this.dpopSupported ? await makeDpopProof('POST', url) : undefined;
+    let response: Response;
+    try {
+      response = await fetch(
+          url,
+          {method: 'POST', credentials: 'include', headers: proof ? {'DPoP': proof} : undefined});
+    } catch (e) {
+      if (proof === undefined) throw e;
+      // Servers that do not support DPoP reject the CORS preflight request.
+      this.dpopSupported = false;
+      response = await fetch(url, {method: 'POST', credentials: 'include'});
+    }
     switch (response.status) {
       case 200:
-        return {token: await response.text()};
+        return {token: await response.text(), dpop: proof !== undefined && this.dpopSupported};
       case 401:
         return await waitForLogin(this.serverUrl);
       case 403:
@@ -95,26 +197,82 @@ export class NgauthCredentialsProvider extends CredentialsProvider<Credentials>
   });
 }
 
+/**
+ * Access tokens are renewed when they expire within this many milliseconds.
+ */
+const accessTokenRefreshMarginMs = 60 * 1000;
+
 export class NgauthGcsCredentialsProvider extends CredentialsProvider<OAuth2Credentials> {
+  private isPublic: boolean|undefined;
+  private credentials: CredentialsWithGeneration<OAuth2Credentials>|undefined;
+  /**
+   * Time, in milliseconds since the epoch, at which the current access token expires.
+   */
+  private expiresAt = Infinity;
   constructor(
       public ngauthCredentialsProvider: CredentialsProvider<Credentials>, public serverUrl: string,
       public bucket: string) {
     super();
   }
-  get = makeCredentialsGetter(async () => {
-    const response = await fetchWithCredentials(
-        this.ngauthCredentialsProvider, `${this.serverUrl}/gcs_token`, {method: 'POST'},
-        responseJson,
-        (credentials, init) => {
-          return {...init, body: JSON.stringify({token: credentials.token, bucket: this.bucket})};
-        },
-        error => {
-          const {status} = error;
-          if (status === 401) {
-            return 'refresh';
-          }
-          throw error;
-        });
-    return {tokenType: 'Bearer', accessToken: response['token']};
+  get = async (
+      invalidCredentials?: CredentialsWithGeneration<OAuth2Credentials>,
+      cancellationToken?: CancellationToken) => {
+    // Renew the access token before it expires, rather than waiting for a request to fail.
+    if (invalidCredentials === undefined && this.credentials !== undefined &&
+        Date.now() >= this.expiresAt - accessTokenRefreshMarginMs) {
+      invalidCredentials = this.credentials;
+    }
+    const credentials = await this.getCredentials(invalidCredentials, cancellationToken);
+    this.credentials = credentials;
+    return credentials;
+  };
+  private getCredentials = makeCredentialsGetter(async () => {
+    if (this.isPublic === undefined) {
+      // World-readable buckets are read without credentials, and without logging in.
+      const response = await fetch(
+          `${this.serverUrl}/gcs_token`,
+          {method: 'POST', body: JSON.stringify({bucket: this.bucket})});
+      this.isPublic = response.ok && (await response.json())['public'] === true;
+    }
+    if (this.isPublic) {
+      return {tokenType: 'Bearer', accessToken: ''};
+    }
+    if (this.credentials !== undefined) {
+      // Renewing an access token: the server may skip repeating the permission check.  Fall back
+      // to /gcs_token if it does not support this or the grant is no longer valid.
+      try {
+        const {credentials} = await this.ngauthCredentialsProvider.get();
+        const response = await postWithToken(
+            `${this.serverUrl}/gcs_token/refresh`, credentials, {bucket: this.bucket});
+        if (response.ok) {
+          return this.handleTokenResponse(await response.json());
+        }
+      } catch (e) {
+      }
+    }
+    let credentials: CredentialsWithGeneration<Credentials>|undefined;
+    while (true) {
+      credentials = await this.ngauthCredentialsProvider.get(credentials);
+      const response = await postWithToken(
+          `${this.serverUrl}/gcs_token`, credentials.credentials, {bucket: this.bucket});
+      if (response.ok) {
+        return this.handleTokenResponse(await response.json());
+      }
+      if (response.status === 401) {
+        const challenge = response.headers.get('www-authenticate');
+        if (challenge?.includes('insufficient_user_authentication') &&
+            this.ngauthCredentialsProvider instanceof NgauthCredentialsProvider) {
+          this.ngauthCredentialsProvider.freshLoginRequired = true;
+        }
+        continue;
+      }
+      throw HttpError.fromResponse(response);
+    }
   });
+
+  private handleTokenResponse(response: any): OAuth2Credentials {
+    const expiresIn = response['expiresIn'];
+    this.expiresAt = typeof expiresIn === 'number' ? Date.now() + expiresIn * 1000 : Infinity;
+    return {tokenType: 'Bearer', accessToken: response['token']};
+  }
 }